@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
 	"debug/elf"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nikandfor/cli"
 	"github.com/nikandfor/errors"
@@ -12,7 +20,14 @@ import (
 	"github.com/nikandfor/tlog/compress"
 	"github.com/nikandfor/tlog/convert"
 	"github.com/nikandfor/tlog/ext/tlflag"
+	"github.com/nikandfor/tlog/filter"
+	"github.com/nikandfor/tlog/index"
 	"github.com/nikandfor/tlog/rotated"
+	"github.com/nikandfor/tlog/tldb"
+	"github.com/nikandfor/tlog/tlnet"
+	"github.com/nikandfor/tlog/tlweb"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 type (
@@ -25,6 +40,23 @@ type (
 		n string
 		f *os.File
 	}
+
+	// mergeWriter merges events from several streams into one.
+	// Events are encoded again with full locations,
+	// labels header is written each time the source changes.
+	mergeWriter struct {
+		mu sync.Mutex
+
+		w    io.Writer
+		e    tlog.Encoder
+		b    []byte
+		last *tlog.Reader
+	}
+
+	tableWriter struct {
+		*convert.Table
+		io.Closer
+	}
 )
 
 func main() {
@@ -43,6 +75,54 @@ func main() {
 			Args:   cli.Args{},
 			Flags: []*cli.Flag{
 				cli.NewFlag("output,out,o", "-", "output file (empty is stderr, - is stdout)"),
+				cli.NewFlag("follow,f", false, "wait for new data and rotated files (name@.tlog)"),
+				cli.NewFlag("format", "", "output format (file extension: log, json, logfmt, csv, tsv, ...)"),
+				cli.NewFlag("fields", "", "csv/tsv columns (comma separated, discovered from the first events if empty)"),
+				cli.NewFlag("split", false, "csv/tsv table per span name (out.<name>.csv)"),
+			},
+		}, {
+			Name:        "query,q",
+			Description: "filter events: tlog query 'level>=warn && m~timeout' file.tlog ...",
+			Action:      query,
+			Args:        cli.Args{},
+			Flags: []*cli.Flag{
+				cli.NewFlag("output,out,o", "-", "output file (empty is stderr, - is stdout)"),
+				cli.NewFlag("follow,f", false, "wait for new data and rotated files (name@.tlog)"),
+				cli.NewFlag("format", "", "output format (file extension: log, json, logfmt, ...)"),
+			},
+		}, {
+			Name:        "trace",
+			Description: "span tree waterfall: tlog trace <span id or prefix> file.tlog ...",
+			Action:      trace,
+			Args:        cli.Args{},
+			Flags: []*cli.Flag{
+				cli.NewFlag("output,out,o", "-", "output file (empty is stderr, - is stdout)"),
+				cli.NewFlag("json", false, "write the tree as json"),
+				cli.NewFlag("width,w", convert.DefaultWaterfallWidth, "waterfall width"),
+			},
+		}, {
+			Name:        "stats",
+			Description: "aggregate events: tlog stats --spans --where m=http_request --by path --agg count,p99(e) file.tlog ...",
+			Action:      stats,
+			Args:        cli.Args{},
+			Flags: []*cli.Flag{
+				cli.NewFlag("output,out,o", "-", "output file (empty is stderr, - is stdout)"),
+				cli.NewFlag("where,w", "", "filter expression"),
+				cli.NewFlag("by,g", "", "group by keys (comma separated: m,level,L.service,path)"),
+				cli.NewFlag("bucket,b", time.Duration(0), "time bucket (1m, 1h)"),
+				cli.NewFlag("agg,a", "count", "aggregates: count, count(<filter>), ratio(<filter>), sum, min, max, avg, pNN (p99(e))"),
+				cli.NewFlag("spans", false, "aggregate finished spans joined with their start events"),
+				cli.NewFlag("json", false, "write json lines"),
+			},
+		}, {
+			Name:        "serve",
+			Description: "local web ui: tlog serve file.tlog 'rotated@.tlog' ... or tlog serve --db events.db",
+			Action:      serve,
+			Args:        cli.Args{},
+			Flags: []*cli.Flag{
+				cli.NewFlag("listen,l", "localhost:8080", "listen address"),
+				cli.NewFlag("db", "", "tldb database to read instead of files"),
+				cli.NewFlag("limit", tlweb.DefaultLimit, "max events and metric values returned"),
 			},
 		}, {
 			Name:        "tlz",
@@ -62,6 +142,39 @@ func main() {
 				Action: tlz,
 				Args:   cli.Args{},
 			}},
+		}, {
+			Name:        "index,idx",
+			Description: "sidecar index for time and span lookups",
+			Commands: []*cli.Command{{
+				Name:   "build,b",
+				Action: indexBuild,
+				Args:   cli.Args{},
+				Flags: []*cli.Flag{
+					cli.NewFlag("bucket", index.DefaultBucket, "time bucket"),
+					cli.NewFlag("block,b", int(index.DefaultBlockSize), "max block size"),
+				},
+			}, {
+				Name:   "search,find,s",
+				Action: indexSearch,
+				Args:   cli.Args{},
+				Flags: []*cli.Flag{
+					cli.NewFlag("output,out,o", "-", "output file (empty is stderr, - is stdout)"),
+					cli.NewFlag("since", "", "events since time (RFC3339)"),
+					cli.NewFlag("until", "", "events until time (RFC3339)"),
+					cli.NewFlag("span", "", "span id"),
+					cli.NewFlag("message,msg,m", "", "message text"),
+				},
+			}},
+		}, {
+			Name:        "collect",
+			Description: "collect events from tlnet writers",
+			Action:      collect,
+			Flags: []*cli.Flag{
+				cli.NewFlag("listen,l", "localhost:7070", "listen address (host:port or unix:/path), :7070 to accept connections on all interfaces"),
+				cli.NewFlag("output,out,o", "-", "merged output file (empty is stderr, - is stdout) or directory with --per-client"),
+				cli.NewFlag("per-client", false, "file per client (<out>/<hostname>_<execname>_<pid>.tlog)"),
+				cli.NewFlag("http", "", "also accept batches POSTed over http on this address"),
+			},
 		}, {
 			Name:        "core",
 			Description: "core dump memory dumper",
@@ -90,8 +203,22 @@ func before(c *cli.Command) error {
 	return nil
 }
 
-func conv(c *cli.Command) error {
-	w, err := tlflag.OpenWriter(c.String("out"))
+func conv(c *cli.Command) (err error) {
+	out := c.String("out")
+
+	if f := c.String("format"); f != "" {
+		out = strings.TrimSuffix(out, filepath.Ext(out)) + "." + f
+	}
+
+	var w io.WriteCloser
+
+	switch ext := filepath.Ext(out); {
+	case (ext == ".csv" || ext == ".tsv") && (c.String("fields") != "" || c.Bool("split")):
+		w, err = openTable(out, c.String("fields"), c.Bool("split"))
+	default:
+		w, err = tlflag.OpenWriter(out)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -115,9 +242,208 @@ func conv(c *cli.Command) error {
 
 	//	tlog.Printf("writer: %T %[1]v", w)
 
-	for _, a := range c.Args {
+	return copyFiles(w, c.Args, c.Bool("follow"))
+}
+
+func query(c *cli.Command) (err error) {
+	if c.Args.Len() == 0 {
+		return errors.New("filter expression expected")
+	}
+
+	f, err := filter.Parse(c.Args.First())
+	if err != nil {
+		return err
+	}
+
+	out := c.String("out")
+
+	if f := c.String("format"); f != "" {
+		out = strings.TrimSuffix(out, filepath.Ext(out)) + "." + f
+	}
+
+	w, err := tlflag.OpenWriter(out)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		e := w.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	return copyFiles(filter.NewWriter(w, f), c.Args[1:], c.Bool("follow"))
+}
+
+func trace(c *cli.Command) (err error) {
+	if c.Args.Len() < 2 {
+		return errors.New("span id and files expected")
+	}
+
+	out, err := createFile(c.String("out"))
+	if err != nil {
+		return err
+	}
+
+	defer closeFile(out, &err)
+
+	w := convert.NewWaterfallWriter(out, c.Args.First())
+	w.JSON = c.Bool("json")
+	w.Width = c.Int("width")
+	w.Colorize = terminal.IsTerminal(int(out.Fd()))
+
+	err = copyFiles(w, c.Args[1:], false)
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func stats(c *cli.Command) (err error) {
+	if c.Args.Len() == 0 {
+		return errors.New("files expected")
+	}
+
+	out, err := createFile(c.String("out"))
+	if err != nil {
+		return err
+	}
+
+	defer closeFile(out, &err)
+
+	w := convert.NewStatsWriter(out)
+	w.Bucket = c.Duration("bucket")
+	w.Spans = c.Bool("spans")
+	w.JSON = c.Bool("json")
+
+	w.Where, err = filter.Parse(c.String("where"))
+	if err != nil {
+		return errors.Wrap(err, "where")
+	}
+
+	if by := c.String("by"); by != "" {
+		w.GroupBy = strings.Split(by, ",")
+	}
+
+	w.Aggs, err = convert.ParseAggs(c.String("agg"))
+	if err != nil {
+		return errors.Wrap(err, "agg")
+	}
+
+	err = copyFiles(w, c.Args, false)
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+func serve(c *cli.Command) (err error) {
+	s := &tlweb.Server{
+		Files: c.Args,
+		Limit: c.Int("limit"),
+	}
+
+	if name := c.String("db"); name != "" {
+		s.DB, err = tldb.Open(name, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+		if err != nil {
+			return errors.Wrap(err, "open db")
+		}
+
+		defer func() {
+			e := s.DB.Close()
+			if err == nil {
+				err = e
+			}
+		}()
+	} else if len(s.Files) == 0 {
+		return errors.New("files or --db expected")
+	}
+
+	l, err := net.Listen("tcp", c.String("listen"))
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+
+	s.Addr = l.Addr().String()
+
+	hs := &http.Server{Handler: s}
+
+	tlog.Printw("serving", "url", "http://"+l.Addr().String()+"/")
+
+	errc := make(chan error, 1)
+
+	go func() {
+		errc <- hs.Serve(l)
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+
+	select {
+	case err = <-errc:
+	case <-sigc:
+	}
+
+	_ = hs.Close() // tail streams never end by themselves
+
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
+	return err
+}
+
+// isRotatedPattern reports whether a is rotated files set name (dir/name@.tlog) rather than a file.
+func isRotatedPattern(a string) bool {
+	if !strings.ContainsRune(filepath.Base(a), rotated.SubstChar) {
+		return false
+	}
+
+	_, err := os.Stat(a)
+
+	return os.IsNotExist(err)
+}
+
+// createFile creates file or returns stdout for "-" and stderr for "".
+func createFile(name string) (*os.File, error) {
+	switch name {
+	case "":
+		return os.Stderr, nil
+	case "-":
+		return os.Stdout, nil
+	}
+
+	return os.Create(name)
+}
+
+func closeFile(f *os.File, errp *error) {
+	if f == os.Stdout || f == os.Stderr {
+		return
+	}
+
+	e := f.Close()
+	if *errp == nil {
+		*errp = e
+	}
+}
+
+func copyFiles(w io.Writer, args []string, follow bool) (err error) {
+	if follow {
+		return followFiles(w, args)
+	}
+
+	for _, a := range args {
 		err = func() (err error) {
-			r, err := tlflag.OpenReader(a)
+			var r io.ReadCloser
+			if isRotatedPattern(a) {
+				r = rotated.NewFollower(a)
+			} else {
+				r, err = tlflag.OpenReader(a)
+			}
 			if err != nil {
 				return errors.Wrap(err, a)
 			}
@@ -147,6 +473,363 @@ func conv(c *cli.Command) error {
 	return nil
 }
 
+func openTable(out, fields string, split bool) (w io.WriteCloser, err error) {
+	ext := filepath.Ext(out)
+	base := strings.TrimSuffix(out, ext)
+
+	var f io.Closer
+
+	tw := convert.NewCSVWriter(nil)
+	if ext == ".tsv" {
+		tw.Comma = '\t'
+	}
+
+	if fields != "" {
+		tw.Fields = strings.Split(fields, ",")
+	}
+
+	switch {
+	case split && (base == "" || base == "-"):
+		return nil, errors.New("split tables need output file name")
+	case split:
+		tw.Open = func(name string) (io.Writer, error) {
+			name = strings.Map(func(r rune) rune {
+				if r == '/' || r == os.PathSeparator || r <= ' ' {
+					return '_'
+				}
+
+				return r
+			}, name)
+
+			return os.Create(base + "." + name + ext)
+		}
+	case base == "":
+		tw.Writer = os.Stderr
+	case base == "-":
+		tw.Writer = os.Stdout
+	default:
+		file, err := os.Create(out)
+		if err != nil {
+			return nil, err
+		}
+
+		tw.Writer, f = file, file
+	}
+
+	return tableWriter{Table: tw, Closer: f}, nil
+}
+
+func (w tableWriter) Close() error {
+	err := w.Table.Close()
+
+	if w.Closer != nil {
+		if e := w.Closer.Close(); err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func followFiles(w io.Writer, args []string) (err error) {
+	if len(args) == 0 {
+		return errors.New("file name expected")
+	}
+
+	m := &mergeWriter{w: w}
+
+	fs := make([]*rotated.Follower, len(args))
+	errc := make(chan error, len(args))
+
+	for i, a := range args {
+		fs[i] = rotated.NewFollower(a)
+		fs[i].Follow = true
+
+		go func(f *rotated.Follower, a string) {
+			err := m.copy(f)
+			if err != nil {
+				err = errors.Wrap(err, "%v", a)
+			}
+
+			errc <- err
+		}(fs[i], a)
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+
+	select {
+	case err = <-errc:
+	case <-sigc:
+	}
+
+	for _, f := range fs {
+		_ = f.Close()
+	}
+
+	if errors.Is(err, rotated.ErrClosed) {
+		err = nil
+	}
+
+	return err
+}
+
+func collect(c *cli.Command) (err error) {
+	network, addr := "tcp", c.String("listen")
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return errors.Wrap(err, "listen")
+	}
+
+	out := c.String("out")
+
+	col := &tlnet.Collector{}
+
+	if c.Bool("per-client") {
+		col.Open = func(name string) (io.Writer, error) {
+			return tlflag.OpenWriter(filepath.Join(out, name+".tlog"))
+		}
+	} else {
+		w, err := tlflag.OpenWriter(out)
+		if err != nil {
+			return errors.Wrap(err, "open output")
+		}
+
+		defer func() {
+			e := w.Close()
+			if err == nil {
+				err = e
+			}
+		}()
+
+		col.Open = func(string) (io.Writer, error) { return struct{ io.Writer }{w}, nil } // don't close on client disconnect
+		col.Name = func(tlog.Labels, net.Addr) string { return "" }
+	}
+
+	tlog.Printw("listening", "addr", l.Addr())
+
+	errc := make(chan error, 2)
+
+	go func() {
+		errc <- col.Serve(l)
+	}()
+
+	var hs *http.Server
+
+	if a := c.String("http"); a != "" {
+		hl, err := net.Listen("tcp", a)
+		if err != nil {
+			_ = l.Close()
+
+			return errors.Wrap(err, "listen http")
+		}
+
+		hs = &http.Server{Handler: &tlnet.HTTPHandler{Collector: col}}
+
+		tlog.Printw("listening http", "addr", hl.Addr())
+
+		go func() {
+			errc <- hs.Serve(hl)
+		}()
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	defer signal.Stop(sigc)
+
+	select {
+	case err = <-errc:
+	case <-sigc:
+	}
+
+	_ = l.Close()
+
+	if hs != nil {
+		_ = hs.Shutdown(context.Background()) // wait for active batches
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+
+	if e := col.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+func indexBuild(c *cli.Command) (err error) {
+	for _, a := range c.Args {
+		x := &index.Index{
+			File:       a,
+			Compressed: filepath.Ext(a) == ".ez",
+			Bucket:     c.Duration("bucket"),
+			BlockSize:  int64(c.Int("block")),
+		}
+
+		err = func() error {
+			f, err := os.Open(a)
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+
+			return x.Build(f)
+		}()
+		if err != nil {
+			return errors.Wrap(err, "%v", a)
+		}
+
+		err = x.SaveFile(index.FileName(a))
+		if err != nil {
+			return errors.Wrap(err, "%v: save", a)
+		}
+
+		tlog.V("index").Printw("index built", "file", a, "blocks", len(x.Blocks))
+	}
+
+	return nil
+}
+
+func indexSearch(c *cli.Command) (err error) {
+	if c.Args.Len() != 1 {
+		return errors.New("one arg expected")
+	}
+
+	var q index.Query
+
+	if v := c.String("since"); v != "" {
+		q.Since, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return errors.Wrap(err, "since")
+		}
+	}
+
+	if v := c.String("until"); v != "" {
+		q.Until, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return errors.Wrap(err, "until")
+		}
+	}
+
+	if v := c.String("span"); v != "" {
+		q.Span, err = tlog.IDFromString(v)
+		if err != nil {
+			return errors.Wrap(err, "span")
+		}
+	}
+
+	q.Message = c.String("message")
+
+	a := c.Args.First()
+
+	x, err := index.LoadFile(index.FileName(a))
+	if err != nil {
+		return errors.Wrap(err, "load index (build it with: tlog index build %v)", a)
+	}
+
+	f, err := os.Open(a)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	w, err := tlflag.OpenWriter(c.String("out"))
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		e := w.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	bs := x.Find(q)
+
+	tlog.V("index").Printw("blocks found", "blocks", len(bs), "total", len(x.Blocks))
+
+	r := x.NewReader(f, bs)
+
+	// blocks are parts of the stream, so events are encoded again
+	// with their labels and full locations
+	var e tlog.Encoder
+	var b []byte
+	var ls tlog.Labels
+	first := true
+
+	for r.Next() {
+		ev := r.Event()
+
+		if ev.IsHeader() || !matchQuery(ev, &q) {
+			continue
+		}
+
+		b = b[:0]
+
+		if first || !sameLabels(ev.Labels, ls) {
+			b = e.AppendLabelsHeader(b, ev.Labels)
+			ls = ev.Labels.Copy()
+			first = false
+		}
+
+		b, err = e.AppendEvent(b, ev, nil)
+		if err != nil {
+			return errors.Wrap(err, "encode")
+		}
+
+		_, err = w.Write(b)
+		if err != nil {
+			return errors.Wrap(err, "write")
+		}
+	}
+
+	return r.Err()
+}
+
+func sameLabels(a, b tlog.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchQuery(ev *tlog.Event, q *index.Query) bool {
+	if !q.Since.IsZero() && ev.Time.Time().Before(q.Since) {
+		return false
+	}
+
+	if !q.Until.IsZero() && !ev.Time.Time().Before(q.Until) {
+		return false
+	}
+
+	if q.Span != (tlog.ID{}) && ev.Span != q.Span && ev.Parent != q.Span {
+		return false
+	}
+
+	if q.Message != "" && string(ev.Message) != q.Message {
+		return false
+	}
+
+	return true
+}
+
 func tlz(c *cli.Command) (err error) {
 	var rs []io.Reader
 	for _, a := range c.Args {
@@ -222,6 +905,51 @@ func coredump(c *cli.Command) (err error) {
 	return nil
 }
 
+func (w *mergeWriter) copy(rd io.Reader) (err error) {
+	r := tlog.NewReader(rd)
+
+	for r.Next() {
+		err = w.write(r, r.Event())
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.Err()
+}
+
+func (w *mergeWriter) write(r *tlog.Reader, ev *tlog.Event) (err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+again:
+	b := w.b[:0]
+
+	if w.last != r && !ev.IsHeader() && (w.last != nil || len(r.Labels()) != 0) {
+		b = w.e.AppendLabelsHeader(b, r.Labels())
+	}
+
+	w.last = r
+
+	b, err = w.e.AppendEvent(b, ev, nil)
+	if err != nil {
+		return errors.Wrap(err, "encode")
+	}
+
+	w.b = b[:0]
+
+	_, err = w.w.Write(b)
+
+	var rot tlog.RotatedError
+	if errors.As(err, &rot) && rot.IsRotated() {
+		w.last = nil
+
+		goto again
+	}
+
+	return err
+}
+
 func (f *filereader) Read(p []byte) (n int, err error) {
 	if f.f == nil {
 		f.f, err = os.Open(f.n)
@@ -125,6 +125,39 @@ func TestCopy(t *testing.T) {
 	tl.Printw("compression", "ratio", float64(18+17)/float64(len(buf)))
 }
 
+func TestDecoderOnReset(t *testing.T) {
+	var buf low.Buf
+
+	w := NewEncoder(&buf, 1<<16)
+
+	_, err := w.Write([]byte("first_message_first_message"))
+	require.NoError(t, err)
+
+	raw := len(buf)
+
+	w.Reset(&buf)
+
+	_, err = w.Write([]byte("second_message"))
+	require.NoError(t, err)
+
+	var resets [][2]int64
+
+	r := NewDecoderBytes(buf)
+	r.OnReset = func(raw, out int64) {
+		resets = append(resets, [2]int64{raw, out})
+	}
+
+	data, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "first_message_first_messagesecond_message", string(data))
+
+	assert.Equal(t, [][2]int64{{0, 0}, {int64(raw), 27}}, resets)
+
+	data, err = ioutil.ReadAll(NewDecoderBytes(buf[raw:]))
+	require.NoError(t, err)
+	assert.Equal(t, "second_message", string(data))
+}
+
 func TestDumpFile(t *testing.T) {
 	const MaxEvents = 800
 
@@ -22,6 +22,13 @@ type (
 		i, end int
 		ref    int64
 
+		out int64 // decoded bytes
+
+		// OnReset is called when the stream reset is met.
+		// raw is the encoded stream offset decoding can be started from,
+		// out is the decoded stream offset it corresponds to.
+		OnReset func(raw, out int64)
+
 		err error
 	}
 
@@ -64,12 +71,20 @@ func (r *Decoder) ResetBytes(b []byte) {
 	r.i = 0
 	r.end = len(b)
 	r.ref = 0
+	r.out = 0
 
 	r.state = 0
 	r.err = nil
 }
 
-func (r *Decoder) Read(p []byte) (i int, err error) {
+func (r *Decoder) Read(p []byte) (n int, err error) {
+	n, err = r.read(p)
+	r.out += int64(n)
+
+	return
+}
+
+func (r *Decoder) read(p []byte) (i int, err error) {
 	if r.err != nil {
 		return 0, r.err
 	}
@@ -79,6 +94,8 @@ more:
 	case 0:
 		//	tl.Printw("stream pos", "ref+i", r.ref+r.i, "prefix", tlog.FormatNext("%.10s"), r.b[r.i:])
 
+		st := r.ref + int64(r.i)
+
 		tag, l := r.tag()
 		if r.err != nil {
 			return int(i), r.err
@@ -126,6 +143,10 @@ more:
 
 				r.state = 0
 
+				if r.OnReset != nil {
+					r.OnReset(st, r.out+int64(i))
+				}
+
 			//	tl.Printw("tag", "name", "meta", "tag", tlog.Hex(tag), "sub", tlog.Hex(l), "sub_name", "block_size", "block_size", len(r.block))
 			default:
 				return int(i), r.newErr("unsupported meta tag: %x", l)
@@ -113,6 +113,9 @@ func (w *Encoder) reset() {
 	}
 }
 
+// Written returns the number of compressed bytes written to the underlying writer.
+func (w *Encoder) Written() int64 { return w.written }
+
 func (w *Encoder) Write(p []byte) (done int, err error) {
 	w.b = w.b[:0]
 
@@ -4,10 +4,8 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/debug"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/nikandfor/errors"
@@ -64,8 +62,29 @@ type (
 			Debug []byte
 		}
 
+		// SpanIndent is the indentation step for nested spans in Lspans mode.
+		SpanIndent int
+
+		// MaxSpans limits the number of tracked open spans.
+		// The earliest started span is forgotten when the limit is reached,
+		// so spans that never finish don't pile up.
+		MaxSpans int
+
+		spans   map[ID]consoleSpan
+		spanSeq int64
+		m, v    low.Buf
+
+		// Format is the line template. If nil it's built from flags on the first Write.
+		Format *ConsoleFormat
+
 		pad map[string]int
 	}
+
+	consoleSpan struct {
+		name  string
+		depth int
+		seq   int64 // start order
+	}
 )
 
 const ( // console writer flags
@@ -80,6 +99,7 @@ const ( // console writer flags
 	Lfuncname // Func
 	LUTC
 	Lloglevel // log level
+	Lspans    // track spans, indent nested events and render span start/finish/value events
 
 	LstdFlags = Ldate | Ltime
 	LdetFlags = Ldate | Ltime | Lmicroseconds | Lshortfile | Lloglevel
@@ -117,6 +137,8 @@ func NewConsoleWriter(w io.Writer, f int) *ConsoleWriter {
 		MessageWidth: 30,
 		IDWidth:      8,
 		MaxValPad:    24,
+		SpanIndent:   2,
+		MaxSpans:     1000,
 
 		TimeFormat:     "2006-01-02_15:04:05.000",
 		DurationFormat: "%v",
@@ -172,13 +194,17 @@ func (w *ConsoleWriter) Write(p []byte) (_ int, err error) {
 		fmt.Fprintf(w.Writer, "%s", s)
 	}()
 
+	if w.Format == nil {
+		w.Format, err = ParseConsoleFormat(w.FlagsFormat())
+		if err != nil {
+			return 0, errors.Wrap(err, "format")
+		}
+	}
+
 	w.d.ResetBytes(p)
 	w.addpad = 0
 
-	var ts Timestamp
-	var pc loc.PC
-	var lv LogLevel
-	var m []byte
+	var ev consoleEvent
 	b := w.b
 
 again:
@@ -196,6 +222,9 @@ again:
 		return 0, errors.New("expected map")
 	}
 
+	has := &w.Format.has
+	spans := w.f&Lspans != 0
+
 	var k []byte
 	var sub int
 	for el := 0; els == -1 || el < els; el++ {
@@ -214,6 +243,20 @@ again:
 		st := i
 
 		tag, sub, i = w.d.Tag(i)
+
+		if spans && (string(k) == "err" || string(k) == "error") && tag != Special {
+			ev.failed = true
+		}
+
+		if spans && ev.tp == 'v' && len(w.v) == 0 {
+			// value name and value go right after the event type
+			w.v = append(w.v, k...)
+			w.v = append(w.v, w.KVSeparator...)
+			w.v, i = w.convertValue(w.v, st)
+
+			continue
+		}
+
 		if tag != Semantic {
 			b, i = w.appendPair(b, k, st)
 			continue
@@ -222,13 +265,28 @@ again:
 		ks := low.UnsafeBytesToString(k)
 		switch {
 		case ks == KeyTime && sub == WireTime:
-			ts, i = w.d.Time(st)
+			ev.ts, i = w.d.Time(st)
 		case ks == KeyLocation && sub == WireLocation:
-			pc, i = w.d.Location(st)
+			ev.pc, i = w.d.Location(st)
 		case ks == KeyMessage && sub == WireMessage:
-			m, i = w.d.String(i)
-		case ks == KeyLogLevel && sub == WireLogLevel && w.f&Lloglevel != 0:
-			lv, i = w.d.LogLevel(st)
+			ev.m, i = w.d.String(i)
+		case ks == KeyLogLevel && sub == WireLogLevel && has[fieldLevel]:
+			ev.lv, i = w.d.LogLevel(st)
+		case ks == KeySpan && sub == WireID && (has[fieldSpan] || spans):
+			ev.span, i = w.d.ID(st)
+		case ks == KeyParent && sub == WireID && (has[fieldParent] || spans):
+			ev.par, i = w.d.ID(st)
+		case ks == KeyEventType && sub == WireEventType && spans:
+			var tp []byte
+			tp, i = w.d.String(i)
+
+			if len(tp) == 1 {
+				ev.tp = tp[0]
+			} else {
+				b = w.appendKV(b, k, tp)
+			}
+		case ks == KeyElapsed && sub == WireDuration && spans:
+			ev.el, i = w.d.Int(i)
 		default:
 			b, i = w.appendPair(b, k, st)
 		}
@@ -238,303 +296,123 @@ again:
 		return
 	}
 
-	h := w.h
-	h = w.appendHeader(w.h, ts, lv, pc, m, len(b))
+	if spans {
+		w.spanEvent(&ev)
+	}
 
-	h = append(h, b...)
+	h := low.Buf(w.appendFormat(w.h, &ev, b))
 
 	h.NewLine()
 
 	w.b = b[:0]
 	w.h = h[:0]
+	w.m = w.m[:0]
+	w.v = w.v[:0]
 
 	_, err = w.Writer.Write(h)
 
 	return len(p), err
 }
 
-func (w *ConsoleWriter) appendHeader(b []byte, ts Timestamp, lv LogLevel, pc loc.PC, m []byte, blen int) []byte {
-	var fname, file string
-	line := -1
-
-	if w.f&(Ldate|Ltime|Lmilliseconds|Lmicroseconds) != 0 {
-		var t time.Time
-		if ts != 0 {
-			t = time.Unix(0, int64(ts))
-		}
-
-		if w.f&LUTC != 0 {
-			t = t.UTC()
-		}
-
-		var Y, M, D, h, m, s int
-		if w.f&(Ldate|Ltime) != 0 {
-			Y, M, D, h, m, s = low.SplitTime(t)
-		}
-
-		if w.Colorize && len(w.TimeColor) != 0 {
-			b = append(b, w.TimeColor...)
-		}
-
-		if w.f&Ldate != 0 {
-			i := len(b)
-			b = append(b, "0000-00-00"...)
-
-			for j := 0; j < 4; j++ {
-				b[i+3-j] = byte(Y%10) + '0'
-				Y /= 10
-			}
-
-			b[i+6] = byte(M%10) + '0'
-			M /= 10
-			b[i+5] = byte(M) + '0'
-
-			b[i+9] = byte(D%10) + '0'
-			D /= 10
-			b[i+8] = byte(D) + '0'
-		}
-		if w.f&Ltime != 0 {
-			if len(b) != 0 {
-				b = append(b, '_')
-			}
-
-			i := len(b)
-			b = append(b, "00:00:00"...)
-
-			b[i+1] = byte(h%10) + '0'
-			h /= 10
-			b[i+0] = byte(h) + '0'
-
-			b[i+4] = byte(m%10) + '0'
-			m /= 10
-			b[i+3] = byte(m) + '0'
-
-			b[i+7] = byte(s%10) + '0'
-			s /= 10
-			b[i+6] = byte(s) + '0'
-		}
-		if w.f&(Lmilliseconds|Lmicroseconds) != 0 {
-			if len(b) != 0 {
-				b = append(b, '.')
-			}
-
-			ns := t.Nanosecond() / 1e3
-			if w.f&Lmilliseconds != 0 {
-				ns /= 1000
-
-				i := len(b)
-				b = append(b, "000"...)
-
-				b[i+2] = byte(ns%10) + '0'
-				ns /= 10
-				b[i+1] = byte(ns%10) + '0'
-				ns /= 10
-				b[i+0] = byte(ns%10) + '0'
-			} else {
-				i := len(b)
-				b = append(b, "000000"...)
-
-				b[i+5] = byte(ns%10) + '0'
-				ns /= 10
-				b[i+4] = byte(ns%10) + '0'
-				ns /= 10
-				b[i+3] = byte(ns%10) + '0'
-				ns /= 10
-				b[i+2] = byte(ns%10) + '0'
-				ns /= 10
-				b[i+1] = byte(ns%10) + '0'
-				ns /= 10
-				b[i+0] = byte(ns%10) + '0'
-			}
-		}
-
-		if w.Colorize && len(w.TimeColor) != 0 {
-			b = append(b, ResetColor...)
-		}
-
-		b = append(b, ' ', ' ')
+// spanEvent tracks open spans and builds the indented message for the event.
+func (w *ConsoleWriter) spanEvent(ev *consoleEvent) {
+	if w.spans == nil {
+		w.spans = make(map[ID]consoleSpan)
 	}
 
-	if w.f&Lloglevel != 0 {
-		var col []byte
-		switch {
-		case !w.Colorize:
-			// break
-		case lv == Info:
-			col = w.LevelColor.Info
-		case lv == Warn:
-			col = w.LevelColor.Warn
-		case lv == Error:
-			col = w.LevelColor.Error
-		case lv >= Fatal:
-			col = w.LevelColor.Fatal
-		default:
-			col = w.LevelColor.Debug
-		}
+	sp, ok := w.spans[ev.span]
+	depth := sp.depth
 
-		if col != nil {
-			b = append(b, col...)
+	switch ev.tp {
+	case 's':
+		if p, ok := w.spans[ev.par]; ok && ev.par != (ID{}) {
+			depth = p.depth + 1
+		} else {
+			depth = 0
 		}
 
-		i := len(b)
-		b = append(b, low.Spaces[:w.LevelWidth]...)
-
-		switch lv {
-		case Info:
-			copy(b[i:], "INFO")
-		case Warn:
-			copy(b[i:], "WARN")
-		case Error:
-			copy(b[i:], "ERROR")
-		case Fatal:
-			copy(b[i:], "FATAL")
-		default:
-			b = low.AppendPrintf(b[:i], "%*x", w.LevelWidth, lv)
+		if w.MaxSpans > 0 && len(w.spans) >= w.MaxSpans {
+			w.evictSpan()
 		}
 
-		end := len(b)
-
-		if col != nil {
-			b = append(b, ResetColor...)
-		}
-
-		if pad := i + w.LevelWidth + 2 - end; pad > 0 {
-			b = append(b, low.Spaces[:pad]...)
+		w.spanSeq++
+		w.spans[ev.span] = consoleSpan{name: string(ev.m), depth: depth, seq: w.spanSeq}
+	case 'f':
+		delete(w.spans, ev.span)
+	default:
+		if ok {
+			depth++
 		}
 	}
 
-	if w.f&(Llongfile|Lshortfile) != 0 {
-		fname, file, line = pc.NameFileLine()
-
-		if w.Colorize && len(w.FileColor) != 0 {
-			b = append(b, w.FileColor...)
-		}
-
-		if w.f&Lshortfile != 0 {
-			file = filepath.Base(file)
-
-			n := 1
-			for q := line; q != 0; q /= 10 {
-				n++
-			}
-
-			i := len(b)
+	m := low.AppendSpaces(w.m[:0], depth*w.SpanIndent)
 
-			b = append(b, low.Spaces[:w.Shortfile]...)
-			b = append(b[:i], file...)
+	switch ev.tp {
+	case 's':
+		m = append(m, "> "...)
+		m = append(m, ev.m...)
+	case 'f':
+		m = append(m, "< "...)
 
-			e := len(b)
-			b = b[:i+w.Shortfile]
-
-			if len(file)+n > w.Shortfile {
-				i = i + w.Shortfile - n
-			} else {
-				i = e
-			}
-
-			b[i] = ':'
-			for q, j := line, n-1; j >= 1; j-- {
-				b[i+j] = byte(q%10) + '0'
-				q /= 10
-			}
+		if ok {
+			m = append(m, sp.name...)
 		} else {
-			b = append(b, file...)
-			i := len(b)
-			b = append(b, ":           "...)
-
-			n := 1
-			for q := line; q != 0; q /= 10 {
-				n++
-			}
-
-			for q, j := line, n-1; j >= 1; j-- {
-				b[i+j] = byte(q%10) + '0'
-				q /= 10
-			}
+			st := len(m)
+			m = append(m, "________"...)
+			ev.span.FormatTo(m[st:], 'v')
 		}
 
-		if w.Colorize && len(w.FileColor) != 0 {
-			b = append(b, ResetColor...)
+		if ev.el != 0 {
+			m = append(m, " ("...)
+			m = low.AppendPrintf(m, w.DurationFormat, time.Duration(ev.el))
+			m = append(m, ')')
 		}
 
-		b = append(b, ' ', ' ')
-	}
-
-	if w.f&(Ltypefunc|Lfuncname) != 0 {
-		if line == -1 {
-			fname, _, _ = pc.NameFileLine()
-		}
-		fname = filepath.Base(fname)
-
-		if w.Colorize && len(w.FuncColor) != 0 {
-			b = append(b, w.FuncColor...)
-		}
-
-		if w.f&Lfuncname != 0 {
-			p := strings.Index(fname, ").")
-			if p == -1 {
-				p = strings.IndexByte(fname, '.')
-				fname = fname[p+1:]
-			} else {
-				fname = fname[p+2:]
-			}
-
-			if l := len(fname); l <= w.Funcname {
-				i := len(b)
-				b = append(b, low.Spaces[:w.Funcname]...)
-				b = append(b[:i], fname...)
-				b = b[:i+w.Funcname]
-			} else {
-				b = append(b, fname[:w.Funcname]...)
-				j := 1
-				for {
-					q := fname[l-j]
-					if q < '0' || '9' < q {
-						break
-					}
-					b[len(b)-j] = q
-					j++
-				}
-			}
+		if ev.failed {
+			m = append(m, " error"...)
 		} else {
-			b = append(b, fname...)
+			m = append(m, " ok"...)
 		}
-
-		if w.Colorize && len(w.FuncColor) != 0 {
-			b = append(b, ResetColor...)
-		}
-
-		b = append(b, ' ', ' ')
+	case 'v':
+		m = append(m, w.v...)
+	default:
+		m = append(m, ev.m...)
 	}
 
-	if len(m) != 0 {
-		if w.Colorize && len(w.MessageColor) != 0 {
-			b = append(b, w.MessageColor...)
-		}
+	w.m = m
+	ev.m = m
+}
 
-		b = append(b, m...)
+// evictSpan forgets the earliest started span.
+func (w *ConsoleWriter) evictSpan() {
+	var id ID
+	var seq int64
 
-		if w.Colorize && len(w.MessageColor) != 0 {
-			b = append(b, ResetColor...)
+	for sid, s := range w.spans {
+		if seq == 0 || s.seq < seq {
+			id, seq = sid, s.seq
 		}
 	}
 
-	if len(m) >= w.MessageWidth && blen != 0 {
-		b = append(b, ' ', ' ')
-	}
+	delete(w.spans, id)
+}
 
-	if (w.PadEmptyMessage || len(m) != 0) && len(m) < w.MessageWidth && blen != 0 {
-		b = append(b, low.Spaces[:w.MessageWidth-len(m)]...)
+func (w *ConsoleWriter) appendKV(b, k, v []byte) []byte {
+	if len(b) != 0 {
+		b = append(b, w.PairSeparator...)
 	}
 
-	return b
+	b = append(b, k...)
+	b = append(b, w.KVSeparator...)
+
+	return append(b, v...)
 }
 
 func (w *ConsoleWriter) appendPair(b []byte, k []byte, st int) (_ []byte, i int) {
 	i = st
 
 	if w.addpad != 0 {
-		b = append(b, low.Spaces[:w.addpad]...)
+		b = low.AppendSpaces(b, w.addpad)
 		w.addpad = 0
 	}
 
@@ -0,0 +1,542 @@
+package tlog
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// ConsoleFormat is a parsed ConsoleWriter line template.
+	//
+	// Template is a text with fields in braces: {name[:spec][|color]}.
+	// Use {{ and }} for literal braces.
+	//
+	// Fields:
+	//	time      event time, spec is a time layout (ConsoleWriter.TimeFormat by default)
+	//	level     log level (INFO, WARN, ERROR, FATAL or hex number)
+	//	span      span id, width is the number of hex digits (ConsoleWriter.IDWidth by default)
+	//	parent    parent span id
+	//	loc       file base name and line
+	//	longloc   full file path and line
+	//	func      function name without package and type
+	//	typefunc  package qualified function name
+	//	msg       message
+	//	kvs       the rest of key-value pairs
+	//
+	// Spec for all fields but time is [<|>][width][.max]:
+	// < aligns left (default), > aligns right, width is the min width, max truncates the value.
+	// loc keeps the line number and func keeps the closure number when truncated.
+	// Trailing padding is only written if something follows it.
+	//
+	// Color is a list of SGR codes separated by ';' (31;1) or "none".
+	// Default colors are taken from ConsoleWriter.
+	ConsoleFormat struct {
+		items []formatItem
+		has   [fieldKVs + 1]bool
+	}
+
+	formatItem struct {
+		field int
+		text  string // literal or time layout
+
+		width, max int
+		right      bool
+
+		color   []byte
+		nocolor bool
+	}
+
+	consoleEvent struct {
+		ts Timestamp
+		lv LogLevel
+		pc loc.PC
+		m  []byte
+
+		span, par ID
+
+		tp byte // event type
+		el int64
+
+		failed bool // err key in span finish
+	}
+)
+
+// format fields
+const (
+	fieldLiteral = iota
+	fieldTime
+	fieldLevel
+	fieldSpan
+	fieldParent
+	fieldLoc
+	fieldLongLoc
+	fieldFunc
+	fieldTypeFunc
+	fieldMsg
+	fieldKVs
+)
+
+var formatFields = map[string]int{
+	"time":     fieldTime,
+	"level":    fieldLevel,
+	"span":     fieldSpan,
+	"parent":   fieldParent,
+	"loc":      fieldLoc,
+	"longloc":  fieldLongLoc,
+	"func":     fieldFunc,
+	"typefunc": fieldTypeFunc,
+	"msg":      fieldMsg,
+	"kvs":      fieldKVs,
+}
+
+// ParseConsoleFormat parses line template. See ConsoleFormat for syntax.
+func ParseConsoleFormat(f string) (_ *ConsoleFormat, err error) {
+	var cf ConsoleFormat
+	var lit []byte
+
+	for i := 0; i < len(f); {
+		switch {
+		case strings.HasPrefix(f[i:], "{{"), strings.HasPrefix(f[i:], "}}"):
+			lit = append(lit, f[i])
+			i += 2
+
+			continue
+		case f[i] == '}':
+			return nil, errors.New("unexpected } at pos %d", i)
+		case f[i] != '{':
+			lit = append(lit, f[i])
+			i++
+
+			continue
+		}
+
+		end := strings.IndexByte(f[i:], '}')
+		if end == -1 {
+			return nil, errors.New("unclosed { at pos %d", i)
+		}
+
+		if len(lit) != 0 {
+			cf.items = append(cf.items, formatItem{text: string(lit)})
+			lit = lit[:0]
+		}
+
+		it, err := parseFormatItem(f[i+1 : i+end])
+		if err != nil {
+			return nil, errors.Wrap(err, "pos %d", i)
+		}
+
+		cf.items = append(cf.items, it)
+		cf.has[it.field] = true
+
+		i += end + 1
+	}
+
+	if len(lit) != 0 {
+		cf.items = append(cf.items, formatItem{text: string(lit)})
+	}
+
+	return &cf, nil
+}
+
+func parseFormatItem(s string) (it formatItem, err error) {
+	if p := strings.IndexByte(s, '|'); p != -1 {
+		c := s[p+1:]
+		s = s[:p]
+
+		if c == "none" {
+			it.nocolor = true
+		} else {
+			var codes []int
+
+			for _, q := range strings.Split(c, ";") {
+				v, err := strconv.Atoi(q)
+				if err != nil {
+					return it, errors.New("bad color: %q", c)
+				}
+
+				codes = append(codes, v)
+			}
+
+			it.color = Color(codes...)
+		}
+	}
+
+	name := s
+	spec := ""
+
+	if p := strings.IndexByte(s, ':'); p != -1 {
+		name, spec = s[:p], s[p+1:]
+	}
+
+	var ok bool
+	it.field, ok = formatFields[name]
+	if !ok {
+		return it, errors.New("unknown field: %q", name)
+	}
+
+	if it.field == fieldTime {
+		it.text = spec
+
+		return it, nil
+	}
+
+	if spec == "" {
+		return it, nil
+	}
+
+	switch spec[0] {
+	case '>':
+		it.right = true
+		spec = spec[1:]
+	case '<':
+		spec = spec[1:]
+	}
+
+	w, m := spec, ""
+	if p := strings.IndexByte(spec, '.'); p != -1 {
+		w, m = spec[:p], spec[p+1:]
+	}
+
+	if w != "" {
+		it.width, err = strconv.Atoi(w)
+		if err != nil {
+			return it, errors.New("bad width: %q", w)
+		}
+	}
+
+	if m != "" {
+		it.max, err = strconv.Atoi(m)
+		if err != nil {
+			return it, errors.New("bad max width: %q", m)
+		}
+	}
+
+	return it, nil
+}
+
+// SetFormat sets line template. See ConsoleFormat for syntax.
+func (w *ConsoleWriter) SetFormat(f string) error {
+	cf, err := ParseConsoleFormat(f)
+	if err != nil {
+		return err
+	}
+
+	w.Format = cf
+
+	return nil
+}
+
+// FlagsFormat returns the template equivalent to the writer flags and widths.
+func (w *ConsoleWriter) FlagsFormat() string {
+	var b []byte
+
+	if w.f&(Ldate|Ltime|Lmilliseconds|Lmicroseconds) != 0 {
+		var l []byte
+
+		if w.f&Ldate != 0 {
+			l = append(l, "2006-01-02"...)
+		}
+
+		if w.f&Ltime != 0 {
+			if len(l) != 0 {
+				l = append(l, '_')
+			}
+
+			l = append(l, "15:04:05"...)
+		}
+
+		switch {
+		case w.f&Lmilliseconds != 0:
+			l = append(l, ".000"...)
+		case w.f&Lmicroseconds != 0:
+			l = append(l, ".000000"...)
+		}
+
+		b = low.AppendPrintf(b, "{time:%s}  ", l)
+	}
+
+	if w.f&Lloglevel != 0 {
+		b = low.AppendPrintf(b, "{level:%d.%[1]d}  ", w.LevelWidth)
+	}
+
+	switch {
+	case w.f&Lshortfile != 0:
+		b = low.AppendPrintf(b, "{loc:%d.%[1]d}  ", w.Shortfile)
+	case w.f&Llongfile != 0:
+		b = append(b, "{longloc}  "...)
+	}
+
+	switch {
+	case w.f&Lfuncname != 0:
+		b = low.AppendPrintf(b, "{func:%d.%[1]d}  ", w.Funcname)
+	case w.f&Ltypefunc != 0:
+		b = append(b, "{typefunc}  "...)
+	}
+
+	b = low.AppendPrintf(b, "{msg:%d}{kvs}", w.MessageWidth)
+
+	return string(b)
+}
+
+// appendFormat executes w.Format. kvs are already formatted pairs.
+func (w *ConsoleWriter) appendFormat(b []byte, ev *consoleEvent, kvs []byte) []byte {
+	pad := 0 // postponed padding
+
+	for i := range w.Format.items {
+		it := &w.Format.items[i]
+
+		if it.field == fieldLiteral {
+			text := strings.TrimRight(it.text, " ")
+
+			if text != "" {
+				b = low.AppendSpaces(b, pad)
+				b = append(b, text...)
+				pad = 0
+			}
+
+			pad += len(it.text) - len(text)
+
+			continue
+		}
+
+		st := len(b)
+		b = low.AppendSpaces(b, pad)
+
+		if it.field == fieldKVs {
+			if len(kvs) == 0 {
+				b = b[:st]
+				continue
+			}
+
+			if pad == 0 && len(b) != 0 && b[len(b)-1] != ' ' {
+				b = append(b, w.PairSeparator...)
+			}
+
+			b = append(b, kvs...)
+			pad = 0
+
+			continue
+		}
+
+		col := w.fieldColor(it, ev)
+		if col != nil {
+			b = append(b, col...)
+		}
+
+		vst := len(b)
+
+		b = w.appendField(b, it, ev)
+
+		if it.max != 0 && len(b)-vst > it.max {
+			b = truncateField(b, vst, it)
+		}
+
+		vw := len(b) - vst
+
+		if vw == 0 {
+			b = b[:st]
+		} else {
+			if it.right && vw < it.width {
+				n := it.width - vw
+
+				b = low.AppendSpaces(b, n)
+				copy(b[vst+n:], b[vst:vst+vw])
+
+				for j := vst; j < vst+n; j++ {
+					b[j] = ' '
+				}
+
+				vw = it.width
+			}
+
+			pad = 0
+
+			if col != nil {
+				b = append(b, ResetColor...)
+			}
+		}
+
+		if vw < it.width && (it.field != fieldMsg || vw != 0 || w.PadEmptyMessage) {
+			pad += it.width - vw
+		}
+	}
+
+	return b
+}
+
+func (w *ConsoleWriter) appendField(b []byte, it *formatItem, ev *consoleEvent) []byte {
+	switch it.field {
+	case fieldTime:
+		if ev.ts == 0 {
+			return b
+		}
+
+		t := time.Unix(0, int64(ev.ts))
+		if w.f&LUTC != 0 {
+			t = t.UTC()
+		}
+
+		l := it.text
+		if l == "" {
+			l = w.TimeFormat
+		}
+
+		return t.AppendFormat(b, l)
+	case fieldLevel:
+		switch ev.lv {
+		case Info:
+			return append(b, "INFO"...)
+		case Warn:
+			return append(b, "WARN"...)
+		case Error:
+			return append(b, "ERROR"...)
+		case Fatal:
+			return append(b, "FATAL"...)
+		default:
+			return strconv.AppendInt(b, int64(ev.lv), 16)
+		}
+	case fieldSpan, fieldParent:
+		id := ev.span
+		if it.field == fieldParent {
+			id = ev.par
+		}
+
+		if id == (ID{}) {
+			return b
+		}
+
+		n := it.width
+		if n == 0 {
+			n = w.IDWidth
+		}
+
+		if n > 2*len(id) {
+			n = 2 * len(id)
+		}
+
+		st := len(b)
+		b = append(b, low.Spaces[:n]...)
+		id.FormatTo(b[st:], 'v')
+
+		return b
+	case fieldLoc, fieldLongLoc:
+		if ev.pc == 0 {
+			return b
+		}
+
+		_, file, line := ev.pc.NameFileLine()
+
+		if it.field == fieldLoc {
+			file = filepath.Base(file)
+		}
+
+		b = append(b, file...)
+		b = append(b, ':')
+
+		return strconv.AppendInt(b, int64(line), 10)
+	case fieldFunc, fieldTypeFunc:
+		if ev.pc == 0 {
+			return b
+		}
+
+		fname, _, _ := ev.pc.NameFileLine()
+		fname = filepath.Base(fname)
+
+		if it.field == fieldFunc {
+			fname = shortFuncName(fname)
+		}
+
+		return append(b, fname...)
+	case fieldMsg:
+		return append(b, ev.m...)
+	}
+
+	return b
+}
+
+func (w *ConsoleWriter) fieldColor(it *formatItem, ev *consoleEvent) []byte {
+	if !w.Colorize || it.nocolor {
+		return nil
+	}
+
+	if it.color != nil {
+		return it.color
+	}
+
+	var c []byte
+
+	switch it.field {
+	case fieldTime:
+		c = w.TimeColor
+	case fieldLevel:
+		switch {
+		case ev.lv == Info:
+			c = w.LevelColor.Info
+		case ev.lv == Warn:
+			c = w.LevelColor.Warn
+		case ev.lv == Error:
+			c = w.LevelColor.Error
+		case ev.lv >= Fatal:
+			c = w.LevelColor.Fatal
+		default:
+			c = w.LevelColor.Debug
+		}
+	case fieldLoc, fieldLongLoc:
+		c = w.FileColor
+	case fieldFunc, fieldTypeFunc:
+		c = w.FuncColor
+	case fieldMsg:
+		c = w.MessageColor
+	}
+
+	if len(c) == 0 {
+		return nil
+	}
+
+	return c
+}
+
+// truncateField cuts the field value started at st to it.max
+// keeping the meaningful suffix: line number for loc and closure number for func.
+func truncateField(b []byte, st int, it *formatItem) []byte {
+	v := b[st:]
+	keep := 0
+
+	switch it.field {
+	case fieldLoc, fieldLongLoc:
+		for keep < len(v) && v[len(v)-1-keep] != ':' {
+			keep++
+		}
+
+		keep++
+	case fieldFunc, fieldTypeFunc:
+		for keep < len(v) && v[len(v)-1-keep] >= '0' && v[len(v)-1-keep] <= '9' {
+			keep++
+		}
+	}
+
+	if keep > it.max {
+		keep = it.max
+	}
+
+	copy(v[it.max-keep:], v[len(v)-keep:])
+
+	return b[:st+it.max]
+}
+
+func shortFuncName(fname string) string {
+	p := strings.Index(fname, ").")
+	if p != -1 {
+		return fname[p+2:]
+	}
+
+	p = strings.IndexByte(fname, '.')
+
+	return fname[p+1:]
+}
@@ -0,0 +1,227 @@
+package tlog
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog/low"
+)
+
+func TestConsoleFlagsCompat(t *testing.T) {
+	tm := time.Date(2020, time.December, 25, 22, 8, 13, 123456789, time.UTC)
+	TestSetTime(func() time.Time { return tm }, tm.UnixNano)
+	defer TestSetTime(time.Now, low.UnixNano)
+
+	// output of the flags driven ConsoleWriter before templates were introduced
+	for _, tc := range []struct {
+		ff  int
+		exp string
+	}{
+		{0x0, "message                       a=1  str=\"string value\"\nformatted 2\nlong message which is longer than thirty chars  b=2\n                              a=1\nlevel                         a=1  i=1\nerror                         i=2\n"},
+		{0x3, "2020-12-25_22:08:13  message                       a=1  str=\"string value\"\n2020-12-25_22:08:13  formatted 2\n2020-12-25_22:08:13  long message which is longer than thirty chars  b=2\n2020-12-25_22:08:13                                a=1\n2020-12-25_22:08:13  level                         a=1  i=1\n2020-12-25_22:08:13  error                         i=2\n"},
+		{0x433, "2020-12-25_22:08:13.123456  INF  console_test.go:35  message                       a=1  str=\"string value\"\n2020-12-25_22:08:13.123456  INF  console_test.go:36  formatted 2\n2020-12-25_22:08:13.123456  INF  console_test.go:37  long message which is longer than thirty chars  b=2\n2020-12-25_22:08:13.123456  INF  console_test.go:38                                a=1\n2020-12-25_22:08:13.123456  WAR  console_test.go:39  level                         a=1\n2020-12-25_22:08:13.123456  ERR  console_test.go:40  error\n"},
+		{0x10a, "22:08:13.123  TestConsoleFlags  message                       a=1  str=\"string value\"\n22:08:13.123  TestConsoleFlags  formatted 2\n22:08:13.123  TestConsoleFlags  long message which is longer than thirty chars  b=2\n22:08:13.123  TestConsoleFlags                                a=1\n22:08:13.123  TestConsoleFlags  level                         a=1  i=1\n22:08:13.123  TestConsoleFlags  error                         i=2\n"},
+		{0x4a0, "INF  console_test.go:35  tlog.TestConsoleFlagsCompat  message                       a=1  str=\"string value\"\nINF  console_test.go:36  tlog.TestConsoleFlagsCompat  formatted 2\nINF  console_test.go:37  tlog.TestConsoleFlagsCompat  long message which is longer than thirty chars  b=2\nINF  console_test.go:38  tlog.TestConsoleFlagsCompat                                a=1\nWAR  console_test.go:39  tlog.TestConsoleFlagsCompat  level                         a=1\nERR  console_test.go:40  tlog.TestConsoleFlagsCompat  error\n"},
+	} {
+		var buf low.Buf
+
+		w := NewConsoleWriter(&buf, tc.ff|LUTC)
+		l := New(w)
+
+		l.Printw("message", "a", 1, "str", "string value")
+		l.Printf("formatted %d", 2)
+		l.Printw("long message which is longer than thirty chars", "b", 2)
+		l.Printw("", "a", 1)
+		l.Printw("level", "a", 1, KeyLogLevel, Warn)
+		l.Printw("error", KeyLogLevel, Error)
+
+		assert.Equal(t, tc.exp, string(buf), "flags %x: %s", tc.ff, w.FlagsFormat())
+	}
+}
+
+func TestConsoleFormat(t *testing.T) {
+	tm := time.Date(2020, time.December, 25, 22, 8, 13, 123456789, time.UTC)
+	TestSetTime(func() time.Time { return tm }, tm.UnixNano)
+	defer TestSetTime(time.Now, low.UnixNano)
+
+	var buf low.Buf
+
+	w := NewConsoleWriter(&buf, LUTC)
+
+	err := w.SetFormat("[{time:15:04:05.000}] {level:>5} {span:6} {loc:12.12} {func:6.6} {{{msg:10.10}}} {kvs}")
+	require.NoError(t, err)
+
+	l := New(w)
+	l.NewID = func() ID { return ID{0xab, 0xcd, 0xef, 0x12} }
+
+	tr := l.Start("span_name")
+	tr.Printw("message which is long", "a", 1, KeyLogLevel, Warn)
+	tr.Finish()
+
+	l.Printw("m")
+
+	assert.Equal(t, `[22:08:13.123]  INFO abcdef console_t:61 TestCo {span_name } T=s
+[22:08:13.123]  WARN abcdef console_t:62 TestCo {message wh} a=1
+[]  INFO abcdef                     {          } T=f
+[22:08:13.123]  INFO        console_t:65 TestCo {m         }
+`, string(buf))
+
+	for _, f := range []string{"{unknown}", "{msg", "msg}", "{msg:x}", "{msg:1.x}", "{time|red}"} {
+		_, err = ParseConsoleFormat(f)
+		assert.Error(t, err, "%q", f)
+	}
+}
+
+func TestConsoleFormatColor(t *testing.T) {
+	var buf low.Buf
+
+	w := NewConsoleWriter(&buf, 0)
+	w.Colorize = true
+
+	err := w.SetFormat("{level:4.4} {msg|33} {kvs}")
+	require.NoError(t, err)
+
+	l := New(w)
+	l.NoTime = true
+	l.NoCaller = true
+
+	l.Printw("msg", KeyLogLevel, Error)
+
+	assert.Equal(t, "\x1b[31;1mERRO\x1b[0m \x1b[33mmsg\x1b[0m\n", string(buf))
+}
+
+func TestConsoleFormatWide(t *testing.T) {
+	var buf low.Buf
+
+	w := NewConsoleWriter(&buf, 0)
+
+	err := w.SetFormat("{msg:200}|{level:>300}|{kvs}")
+	require.NoError(t, err)
+
+	l := New(w)
+	l.NoTime = true
+	l.NoCaller = true
+
+	l.Printw("msg", "a", 1)
+
+	assert.Equal(t, "msg"+string(low.AppendSpaces(nil, 197))+"|"+string(low.AppendSpaces(nil, 296))+"INFO|  a=1\n", string(buf))
+}
+
+func BenchmarkConsoleFormat(b *testing.B) {
+	b.ReportAllocs()
+
+	w := NewConsoleWriter(ioutil.Discard, LdetFlags|Lfuncname)
+	_ = w.SetFormat("{time:15:04:05.000} {level:3} {span:8} {loc:20} {msg:30} {kvs}")
+
+	l := New(w)
+
+	for i := 0; i < b.N; i++ {
+		l.Printw("message", "a", i+1000, "b", "str")
+	}
+}
+
+func BenchmarkConsoleWrite(b *testing.B) {
+	b.ReportAllocs()
+
+	var buf low.Buf
+
+	l := New(&buf)
+	l.Printw("message", "a", 1000, "b", "str")
+
+	w := NewConsoleWriter(ioutil.Discard, LdetFlags|Lfuncname)
+	_ = w.SetFormat("{time:15:04:05.000} {level:3} {span:8} {loc:20} {msg:30} {kvs}")
+
+	for i := 0; i < b.N; i++ {
+		_, _ = w.Write(buf)
+	}
+}
+
+func TestConsoleSpans(t *testing.T) {
+	tm := time.Date(2020, time.December, 25, 22, 8, 13, 0, time.UTC)
+	TestSetTime(func() time.Time { return tm }, tm.UnixNano)
+	defer TestSetTime(time.Now, low.UnixNano)
+
+	var buf low.Buf
+
+	w := NewConsoleWriter(&buf, Lspans)
+	w.MessageWidth = 20
+
+	l := New(w)
+	l.NoCaller = true
+
+	var id byte
+	l.NewID = func() ID {
+		id++
+		return ID{id}
+	}
+
+	tr := l.Start("request")
+	tr.Printw("parsing", "size", 10)
+
+	ch := tr.Spawn("db_query", "table", "users")
+	ch.Printw("query done")
+	ch.Observe("rows", 3)
+
+	tm = tm.Add(1500 * time.Millisecond)
+
+	ch.Finish("err", "timeout")
+
+	tr.Printw("response sent")
+	tr.Finish("status", 200)
+
+	l.Printw("outside")
+
+	assert.Equal(t, `> request
+  parsing           size=10
+  > db_query        table=users
+    query done
+    rows=3
+  < db_query (1.5s) error  err=timeout
+  response sent
+< request (1.5s) ok status=200
+outside
+`, string(buf))
+}
+
+func TestConsoleSpansDeep(t *testing.T) {
+	var buf low.Buf
+
+	w := NewConsoleWriter(&buf, Lspans)
+
+	l := New(w)
+	l.NoCaller = true
+	l.NoTime = true
+
+	sp := l.Start("root")
+
+	for i := 0; i < 100; i++ {
+		sp = sp.Spawn("child")
+	}
+
+	buf = buf[:0]
+
+	sp.Printw("deep")
+
+	assert.Equal(t, string(low.AppendSpaces(nil, 202))+"deep\n", string(buf))
+}
+
+func TestConsoleSpansLimit(t *testing.T) {
+	var buf low.Buf
+
+	w := NewConsoleWriter(&buf, Lspans)
+	w.MaxSpans = 3
+
+	l := New(w)
+	l.NoCaller = true
+	l.NoTime = true
+
+	for i := 0; i < 10; i++ {
+		_ = l.Start("unfinished")
+	}
+
+	assert.Len(t, w.spans, 3)
+}
@@ -14,67 +14,58 @@ type (
 	}
 )
 
+// Copy copies top-level values from r to w one by one.
+// Events, semantic headers and other values are copied as is.
+//
+// Framed events are verified and unwrapped.
+// Damaged frames are skipped up to the next sync marker.
+// If that happened tlog.CorruptedError is returned after the whole stream is copied.
+//
+// If w returns tlog.RotatedError the value is written again,
+// the next event is preceded by the current labels
+// and events are written with full locations from then on, as tlog.Encoder does.
 func Copy(w io.Writer, r io.Reader) (err error) {
-	var d tlog.Decoder
-
-	b := make([]byte, 16*1024)
-
-	i := 0
-
-file:
-	for { // loop over the file
-		n, err := r.Read(b[i:])
-		if errors.Is(err, io.EOF) {
-			if n == 0 {
-				if i == 0 {
-					return nil
-				} else {
-					return io.ErrUnexpectedEOF
-				}
-			}
-		} else if err != nil {
-			return errors.Wrap(err, "read")
-		}
-
-		//	tlog.Printf("read from %4x another %4x bytes [% .6x]", i, n, b[i:])
-
-		n += i
-		i = 0
+	rd := tlog.NewReader(r)
 
-		d.ResetBytes(b[:n])
+	var e tlog.Encoder
+	var b []byte
+	var rotated, header bool
 
-		for i < n { // loop over the buffer
-			end := d.Skip(i)
+	for rd.NextRaw() {
+	again:
+		p := rd.Raw()
 
-			//	tlog.Printf("skip from %4x to end %4x  of %4x  err %v", i, end, n, d.Err())
+		if rotated && rd.IsEvent() {
+			ev := rd.Event()
+			b = b[:0]
 
-			err = d.Err()
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				if i == 0 {
-					q := make([]byte, len(b)*2)
-					copy(q, b)
-					b = q
-
-					i = n
-				} else {
-					i = copy(b, b[i:n])
-				}
-
-				continue file
+			if ls := rd.Labels(); header && !ev.IsHeader() && len(ls) != 0 {
+				b = e.AppendLabelsHeader(b, ls)
 			}
 
-			if err != nil {
-				return errors.Wrap(err, "parse")
-			}
+			header = false
 
-			_, err = w.Write(b[i:end])
+			b, err = e.AppendEvent(b, ev, nil)
 			if err != nil {
-				return errors.Wrap(err, "write")
+				return errors.Wrap(err, "encode")
 			}
 
-			i = end
+			p = b
 		}
 
-		i = 0
+		_, err = w.Write(p)
+
+		var rot tlog.RotatedError
+		if errors.As(err, &rot) && rot.IsRotated() {
+			rotated, header = true, true
+
+			goto again
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "write")
+		}
 	}
+
+	return rd.Err()
 }
@@ -0,0 +1,177 @@
+package convert
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	rotatingWriter struct {
+		files []low.Buf
+		at    map[int]bool
+		n     int
+	}
+
+	testRotatedError struct{}
+)
+
+func TestCopyRotated(t *testing.T) {
+	var stream low.Buf
+
+	l := tlog.New(&stream)
+	l.SetLabels(tlog.Labels{"a=b"})
+
+	for i := 0; i < 5; i++ {
+		l.Printw("message", "i", i)
+	}
+
+	w := &rotatingWriter{files: []low.Buf{nil}, at: map[int]bool{1: true, 4: true}}
+
+	err := Copy(w, bytes.NewReader(stream))
+	require.NoError(t, err)
+
+	require.Len(t, w.files, 3)
+
+	var total int
+
+	for i, f := range w.files {
+		r := tlog.NewReader(bytes.NewReader(f))
+
+		for r.Next() {
+			ev := r.Event()
+
+			if ev.IsHeader() {
+				continue
+			}
+
+			_, file, _ := ev.LocationInfo()
+
+			assert.Equal(t, tlog.Labels{"a=b"}, ev.Labels, "file %d", i)
+			assert.Equal(t, "convert_test.go", filepath.Base(file), "file %d", i)
+
+			total++
+		}
+
+		assert.NoError(t, r.Err())
+	}
+
+	assert.Equal(t, 5, total)
+}
+
+func TestCopyFramed(t *testing.T) {
+	var stream low.Buf
+	var offs []int
+
+	l := tlog.New(&stream)
+	l.Framed = true
+	l.NoTime = true
+	l.NoCaller = true
+
+	l.SetLabels(tlog.Labels{"a=b"})
+
+	for i := 0; i < 5; i++ {
+		offs = append(offs, len(stream))
+
+		l.Printw("message", "i", i)
+	}
+
+	offs = append(offs, len(stream))
+
+	t.Logf("framed dump\n%s", tlog.Dump(stream))
+
+	var plain low.Buf
+	err := Copy(&plain, bytes.NewReader(stream))
+	require.NoError(t, err)
+
+	t.Logf("dump\n%s", tlog.Dump(plain))
+
+	// flip a bit in the payload of the second message
+	damaged := append([]byte{}, stream...)
+	damaged[offs[1]+tlog.FrameHeaderSize+2] ^= 0x10
+
+	// tear the fourth message
+	damaged = append(damaged[:offs[3]+7], damaged[offs[4]:]...)
+
+	var res low.Buf
+	err = Copy(&res, iotest.HalfReader(bytes.NewReader(damaged)))
+
+	var cerr tlog.CorruptedError
+	if assert.True(t, errors.As(err, &cerr), "error: %v", err) && assert.Len(t, cerr, 2) {
+		assert.Equal(t, int64(offs[1]), cerr[0].Start)
+		assert.Equal(t, int64(offs[2]), cerr[0].End)
+		assert.True(t, errors.Is(cerr[0].Err, tlog.ErrFrameChecksum), "%v", cerr[0].Err)
+
+		assert.Equal(t, int64(offs[3]), cerr[1].Start)
+		assert.Equal(t, int64(offs[3]+7), cerr[1].End)
+	}
+
+	var exp low.Buf
+	l = tlog.New(&exp)
+	l.NoTime = true
+	l.NoCaller = true
+
+	l.SetLabels(tlog.Labels{"a=b"})
+	l.Printw("message", "i", 0)
+	l.Printw("message", "i", 2)
+	l.Printw("message", "i", 4)
+
+	assert.Equal(t, tlog.Dump(exp), tlog.Dump(res))
+}
+
+func TestCopyPlain(t *testing.T) {
+	var stream low.Buf
+
+	l := tlog.New(&stream)
+	l.NoTime = true
+	l.NoCaller = true
+
+	var e tlog.Encoder
+
+	for i := 0; i < 3; i++ {
+		l.Printw("message", "i", i)
+
+		switch i {
+		case 0:
+			stream = append(stream, tlog.Semantic|tlog.WireHeader)
+			stream = e.AppendString(stream, tlog.String, "header")
+		case 1:
+			stream = e.AppendInt(stream, 5)
+			stream = e.AppendString(stream, tlog.String, "not an event")
+		}
+	}
+
+	var res low.Buf
+	err := Copy(&res, iotest.OneByteReader(bytes.NewReader(stream)))
+	assert.NoError(t, err)
+	assert.Equal(t, stream, res)
+
+	err = Copy(&res, bytes.NewReader(stream[:len(stream)-1]))
+	assert.Error(t, err)
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.n++
+
+	if w.at[w.n] {
+		w.files = append(w.files, nil)
+
+		return 0, testRotatedError{}
+	}
+
+	w.files[len(w.files)-1] = append(w.files[len(w.files)-1], p...)
+
+	return len(p), nil
+}
+
+func (testRotatedError) Error() string { return "rotated" }
+
+func (testRotatedError) IsRotated() bool { return true }
@@ -0,0 +1,206 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// Jaeger collects spans and writes them in Jaeger UI JSON format on Close.
+	//
+	// Span messages become logs and span kvs become tags.
+	// Each distinct labels set becomes a process, service name is taken from labels (see ServiceLabel).
+	// Trace id is the root span id.
+	Jaeger struct {
+		io.Writer
+
+		spanTree
+	}
+
+	jaegerFile struct {
+		Data []jaegerTrace `json:"data"`
+	}
+
+	jaegerTrace struct {
+		TraceID   string                   `json:"traceID"`
+		Spans     []jaegerSpan             `json:"spans"`
+		Processes map[string]jaegerProcess `json:"processes"`
+	}
+
+	jaegerSpan struct {
+		TraceID       string      `json:"traceID"`
+		SpanID        string      `json:"spanID"`
+		OperationName string      `json:"operationName"`
+		References    []jaegerRef `json:"references"`
+		StartTime     int64       `json:"startTime"`
+		Duration      int64       `json:"duration"`
+		Tags          []jaegerKV  `json:"tags"`
+		Logs          []jaegerLog `json:"logs"`
+		ProcessID     string      `json:"processID"`
+	}
+
+	jaegerRef struct {
+		RefType string `json:"refType"`
+		TraceID string `json:"traceID"`
+		SpanID  string `json:"spanID"`
+	}
+
+	jaegerKV struct {
+		Key   string      `json:"key"`
+		Type  string      `json:"type"`
+		Value interface{} `json:"value"`
+	}
+
+	jaegerLog struct {
+		Timestamp int64      `json:"timestamp"`
+		Fields    []jaegerKV `json:"fields"`
+	}
+
+	jaegerProcess struct {
+		ServiceName string     `json:"serviceName"`
+		Tags        []jaegerKV `json:"tags"`
+	}
+)
+
+func NewJaegerWriter(w io.Writer) *Jaeger {
+	return &Jaeger{
+		Writer:   w,
+		spanTree: newSpanTree(),
+	}
+}
+
+func (w *Jaeger) Write(p []byte) (int, error) {
+	return w.write(p)
+}
+
+// Close writes collected spans grouped by trace. It doesn't close the underlying writer.
+func (w *Jaeger) Close() error {
+	w.finish()
+
+	var f jaegerFile
+
+	traces := map[tlog.ID]int{}
+	procs := map[tlog.ID]map[string]string{} // trace -> labels -> process id
+
+	for _, s := range w.spans {
+		ti, ok := traces[s.Trace]
+		if !ok {
+			ti = len(f.Data)
+			traces[s.Trace] = ti
+
+			f.Data = append(f.Data, jaegerTrace{
+				TraceID:   hexID(s.Trace, len(s.Trace)),
+				Processes: map[string]jaegerProcess{},
+			})
+
+			procs[s.Trace] = map[string]string{}
+		}
+
+		tr := &f.Data[ti]
+
+		lk := strings.Join(s.Labels, ",")
+
+		pid, ok := procs[s.Trace][lk]
+		if !ok {
+			pid = "p" + strconv.Itoa(len(tr.Processes)+1)
+			procs[s.Trace][lk] = pid
+
+			tr.Processes[pid] = jaegerProcess{
+				ServiceName: s.Service,
+				Tags:        jaegerLabels(s.Labels),
+			}
+		}
+
+		js := jaegerSpan{
+			TraceID:       tr.TraceID,
+			SpanID:        hexID(s.ID, 8),
+			OperationName: s.Name,
+			References:    []jaegerRef{},
+			StartTime:     micros(int64(s.Start)),
+			Duration:      micros(int64(s.Duration)),
+			Tags:          jaegerKVs(s.Tags),
+			Logs:          []jaegerLog{},
+			ProcessID:     pid,
+		}
+
+		if s.Parent != (tlog.ID{}) {
+			js.References = append(js.References, jaegerRef{
+				RefType: "CHILD_OF",
+				TraceID: tr.TraceID,
+				SpanID:  hexID(s.Parent, 8),
+			})
+		}
+
+		hasErr := false
+
+		for _, kv := range js.Tags {
+			hasErr = hasErr || kv.Key == "error"
+		}
+
+		for _, l := range s.Logs {
+			fs := []jaegerKV{{Key: "event", Type: "string", Value: l.Message}}
+
+			if l.Level != tlog.Info {
+				fs = append(fs, jaegerKV{Key: "level", Type: "string", Value: logfmtLevel(l.Level)})
+			}
+
+			if l.Level >= tlog.Error && !hasErr {
+				js.Tags = append(js.Tags, jaegerKV{Key: "error", Type: "bool", Value: true})
+				hasErr = true
+			}
+
+			js.Logs = append(js.Logs, jaegerLog{
+				Timestamp: micros(int64(l.Time)),
+				Fields:    append(fs, jaegerKVs(l.KVs)...),
+			})
+		}
+
+		tr.Spans = append(tr.Spans, js)
+	}
+
+	if f.Data == nil {
+		f.Data = []jaegerTrace{}
+	}
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+
+	data = append(data, '\n')
+
+	_, err = w.Writer.Write(data)
+
+	return err
+}
+
+func jaegerKVs(kvs []spanKV) []jaegerKV {
+	r := make([]jaegerKV, len(kvs))
+
+	for i, kv := range kvs {
+		r[i] = jaegerKV{Key: kv.Key, Type: kv.Type, Value: kv.Value}
+	}
+
+	return r
+}
+
+func jaegerLabels(ls tlog.Labels) []jaegerKV {
+	r := make([]jaegerKV, 0, len(ls))
+
+	for _, l := range ls {
+		k, v := l, ""
+		if p := strings.IndexByte(l, '='); p != -1 {
+			k, v = l[:p], l[p+1:]
+		}
+
+		r = append(r, jaegerKV{Key: k, Type: "string", Value: v})
+	}
+
+	return r
+}
@@ -2,20 +2,160 @@ package convert
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"io"
+	"math"
+	"math/big"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
 
 	"github.com/nikandfor/tlog"
 	"github.com/nikandfor/tlog/low"
 )
 
 type (
+	// JSON writes events as JSON lines.
+	//
+	// With zero JSONOptions events are written as is: with short keys,
+	// timestamps as nanoseconds and locations as encoded.
 	JSON struct {
 		io.Writer
 
+		JSONOptions
+
 		d tlog.Decoder
 
+		b   low.Buf
+		a   []byte
+		key []byte
+	}
+
+	// JSONOptions maps tlog events to JSON schema.
+	JSONOptions struct {
+		// Rename maps event keys to output keys.
+		Rename map[string]string
+
+		// TimeFormat is time layout or JSONTimeMillis or JSONTimeNanos.
+		// Empty means as is (nanoseconds).
+		TimeFormat string
+		TimeZone   *time.Location
+
+		// Location is split into file, line and function fields if LocationFile is set.
+		LocationFile string
+		LocationLine string
+		LocationFunc string
+
+		// LabelsObject writes labels as an object {"key": "value"} instead of an array.
+		LabelsObject bool
+
+		// LevelText writes log level as a name instead of a number.
+		LevelText bool
+
+		// SeverityNumber is the key to add OpenTelemetry severity number with.
+		SeverityNumber string
+
+		// HexIDs writes IDs as hex strings instead of base64 bytes.
+		HexIDs bool
+
+		// Flatten flattens nested objects into dotted keys.
+		Flatten bool
+
+		// Attributes is the key to put not renamed keys under.
+		Attributes string
+	}
+
+	// JSONReader reads JSON lines and produces tlog events.
+	//
+	// Object keys are renamed according to Keys (input key -> event key).
+	// Predefined tlog keys are parsed into their semantic types
+	// (time, span ids, message, elapsed, labels, event type and log level).
+	// Other values are encoded as is, object keys order is preserved.
+	// Numbers are kept as int64, uint64 or float64 whichever is exact, or as a string otherwise.
+	JSONReader struct {
+		Keys map[string]string
+
+		d *json.Decoder
+		e tlog.Encoder
+
 		b low.Buf
+		i int
+		v low.Buf
+	}
+)
+
+// DefaultJSONKeys maps common JSON log keys to tlog keys.
+var DefaultJSONKeys = map[string]string{
+	"time":       tlog.KeyTime,
+	"ts":         tlog.KeyTime,
+	"timestamp":  tlog.KeyTime,
+	"@timestamp": tlog.KeyTime,
+	"span":       tlog.KeySpan,
+	"span_id":    tlog.KeySpan,
+	"parent":     tlog.KeyParent,
+	"parent_id":  tlog.KeyParent,
+	"msg":        tlog.KeyMessage,
+	"message":    tlog.KeyMessage,
+	"elapsed":    tlog.KeyElapsed,
+	"labels":     tlog.KeyLabels,
+	"type":       tlog.KeyEventType,
+	"level":      tlog.KeyLogLevel,
+	"lvl":        tlog.KeyLogLevel,
+	"severity":   tlog.KeyLogLevel,
+}
+
+// Time formats.
+const (
+	JSONTimeMillis = "ms"
+	JSONTimeNanos  = "ns"
+)
+
+// Presets.
+var (
+	// ECS is Elastic Common Schema.
+	ECS = JSONOptions{
+		Rename: map[string]string{
+			tlog.KeyTime:      "@timestamp",
+			tlog.KeySpan:      "span.id",
+			tlog.KeyParent:    "parent.id",
+			tlog.KeyMessage:   "message",
+			tlog.KeyElapsed:   "event.duration",
+			tlog.KeyLabels:    "labels",
+			tlog.KeyEventType: "tlog.type", // event.kind has fixed set of values
+			tlog.KeyLogLevel:  "log.level",
+		},
+		TimeFormat:   time.RFC3339Nano,
+		TimeZone:     time.UTC,
+		LocationFile: "log.origin.file.name",
+		LocationLine: "log.origin.file.line",
+		LocationFunc: "log.origin.function",
+		LabelsObject: true,
+		LevelText:    true,
+		HexIDs:       true,
+	}
+
+	// OTel is OpenTelemetry log data model.
+	OTel = JSONOptions{
+		Rename: map[string]string{
+			tlog.KeyTime:     "Timestamp",
+			tlog.KeySpan:     "SpanId",
+			tlog.KeyMessage:  "Body",
+			tlog.KeyLabels:   "Resource",
+			tlog.KeyLogLevel: "SeverityText",
+		},
+		TimeFormat:     JSONTimeNanos,
+		LocationFile:   "code.filepath",
+		LocationLine:   "code.lineno",
+		LocationFunc:   "code.function",
+		LabelsObject:   true,
+		LevelText:      true,
+		SeverityNumber: "SeverityNumber",
+		HexIDs:         true,
+		Flatten:        true,
+		Attributes:     "Attributes",
 	}
 )
 
@@ -32,7 +172,17 @@ func (w *JSON) Write(p []byte) (n int, err error) {
 	i := 0
 
 	for i < len(p) {
-		b, i = w.appendValue(b, i)
+		tag, els, st := w.d.Tag(i)
+
+		if tag == tlog.Map {
+			b, i = w.appendEvent(b, els, st)
+		} else {
+			b, i = w.appendValue(b, i)
+		}
+
+		if err = w.d.Err(); err != nil {
+			return 0, err
+		}
 
 		b = append(b, '\n')
 	}
@@ -125,7 +275,11 @@ func (w *JSON) appendValue(b []byte, st int) (_ []byte, i int) {
 
 		b = append(b, '}')
 	case tlog.Semantic:
-		b, i = w.appendValue(b, i)
+		var ok bool
+		b, i, ok = w.appendSemantic(b, st, sub, i)
+		if !ok {
+			b, i = w.appendValue(b, i)
+		}
 	case tlog.Special:
 		switch sub {
 		case tlog.False:
@@ -145,3 +299,498 @@ func (w *JSON) appendValue(b []byte, st int) (_ []byte, i int) {
 
 	return b, i
 }
+
+// appendEvent appends top-level map of els pairs starting at st.
+func (w *JSON) appendEvent(b []byte, els, i int) (_ []byte, _ int) {
+	b = append(b, '{')
+	obj := len(b)
+
+	w.a = w.a[:0]
+
+	for el := 0; els == -1 || el < els; el++ {
+		if els == -1 && w.d.Break(&i) {
+			break
+		}
+
+		var k []byte
+		k, i = w.d.String(i)
+
+		ks := low.UnsafeBytesToString(k)
+
+		rk, top := w.Rename[ks]
+		if !top {
+			rk = ks
+		}
+
+		dst, base := &b, obj
+		if !top && w.Attributes != "" {
+			dst, base = &w.a, 0
+		}
+
+		tag, sub, vst := w.d.Tag(i)
+
+		switch {
+		case tag == tlog.Semantic && sub == tlog.WireLocation && ks == tlog.KeyLocation && w.LocationFile != "":
+			var pc loc.PC
+			pc, i = w.d.Location(i)
+
+			name, file, line := pc.NameFileLine()
+
+			if w.Attributes != "" {
+				dst, base = &w.a, 0
+			}
+
+			*dst = appendJSONKey(*dst, base, w.LocationFile)
+			*dst = strconv.AppendQuote(*dst, file)
+
+			if w.LocationLine != "" {
+				*dst = appendJSONKey(*dst, base, w.LocationLine)
+				*dst = strconv.AppendInt(*dst, int64(line), 10)
+			}
+
+			if w.LocationFunc != "" {
+				*dst = appendJSONKey(*dst, base, w.LocationFunc)
+				*dst = strconv.AppendQuote(*dst, name)
+			}
+
+			continue
+		case tag == tlog.Semantic && sub == tlog.WireLogLevel && w.SeverityNumber != "":
+			var lv tlog.LogLevel
+			lv, _ = w.d.LogLevel(i)
+
+			b = appendJSONKey(b, obj, w.SeverityNumber)
+			b = strconv.AppendInt(b, int64(otelSeverity(lv)), 10)
+		case tag == tlog.Map && w.Flatten && !top:
+			w.key = append(w.key[:0], rk...)
+
+			*dst, i = w.appendFlat(*dst, base, sub, vst)
+
+			continue
+		}
+
+		*dst = appendJSONKey(*dst, base, rk)
+		*dst, i = w.appendValue(*dst, i)
+	}
+
+	if len(w.a) != 0 {
+		b = appendJSONKey(b, obj, w.Attributes)
+		b = append(b, '{')
+		b = append(b, w.a...)
+		b = append(b, '}')
+	}
+
+	b = append(b, '}')
+
+	return b, i
+}
+
+// appendFlat appends map of els pairs at st as pairs with w.key dotted prefix.
+func (w *JSON) appendFlat(b []byte, base, els, i int) (_ []byte, _ int) {
+	kl := len(w.key)
+
+	for el := 0; els == -1 || el < els; el++ {
+		if els == -1 && w.d.Break(&i) {
+			break
+		}
+
+		var k []byte
+		k, i = w.d.String(i)
+
+		w.key = append(w.key[:kl], '.')
+		w.key = append(w.key, k...)
+
+		tag, sub, vst := w.d.Tag(i)
+		if tag == tlog.Map {
+			b, i = w.appendFlat(b, base, sub, vst)
+			continue
+		}
+
+		b = appendJSONKey(b, base, low.UnsafeBytesToString(w.key))
+		b, i = w.appendValue(b, i)
+	}
+
+	w.key = w.key[:kl]
+
+	return b, i
+}
+
+// appendSemantic appends semantic value formatted according to options.
+// It returns ok == false if the value should be written as is.
+func (w *JSON) appendSemantic(b []byte, st, sub, i int) (_ []byte, _ int, ok bool) {
+	switch {
+	case sub == tlog.WireTime && w.TimeFormat != "":
+		var ts tlog.Timestamp
+		ts, i = w.d.Time(st)
+
+		switch w.TimeFormat {
+		case JSONTimeMillis:
+			return strconv.AppendInt(b, int64(ts)/1e6, 10), i, true
+		case JSONTimeNanos:
+			return strconv.AppendInt(b, int64(ts), 10), i, true
+		}
+
+		t := time.Unix(0, int64(ts))
+		if w.TimeZone != nil {
+			t = t.In(w.TimeZone)
+		}
+
+		b = append(b, '"')
+		b = t.AppendFormat(b, w.TimeFormat)
+		b = append(b, '"')
+
+		return b, i, true
+	case sub == tlog.WireID && w.HexIDs:
+		var id tlog.ID
+		id, i = w.d.ID(st)
+
+		b = append(b, '"')
+		s := len(b)
+		b = append(b, "00000000000000000000000000000000"...)
+		id.FormatTo(b[s:], 'x')
+		b = append(b, '"')
+
+		return b, i, true
+	case sub == tlog.WireLogLevel && w.LevelText:
+		var lv tlog.LogLevel
+		lv, i = w.d.LogLevel(st)
+
+		return strconv.AppendQuote(b, logfmtLevel(lv)), i, true
+	case sub == tlog.WireLabels && w.LabelsObject:
+		var ls tlog.Labels
+		ls, i = w.d.Labels(st)
+
+		b = append(b, '{')
+
+		for j, l := range ls {
+			if j != 0 {
+				b = append(b, ',')
+			}
+
+			k, v := l, ""
+			if p := strings.IndexByte(l, '='); p != -1 {
+				k, v = l[:p], l[p+1:]
+			}
+
+			b = strconv.AppendQuote(b, k)
+			b = append(b, ':')
+			b = strconv.AppendQuote(b, v)
+		}
+
+		b = append(b, '}')
+
+		return b, i, true
+	}
+
+	return b, i, false
+}
+
+func appendJSONKey(b []byte, base int, k string) []byte {
+	if len(b) != base {
+		b = append(b, ',')
+	}
+
+	b = strconv.AppendQuote(b, k)
+
+	return append(b, ':')
+}
+
+// otelSeverity converts log level to OpenTelemetry severity number.
+func otelSeverity(lv tlog.LogLevel) int {
+	switch {
+	case lv < tlog.Info:
+		return 5
+	case lv > tlog.Fatal:
+		return 24
+	default:
+		return 9 + 4*int(lv)
+	}
+}
+
+// NewJSONReader creates JSONReader with DefaultJSONKeys.
+func NewJSONReader(r io.Reader) *JSONReader {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+
+	return &JSONReader{
+		d:    d,
+		Keys: DefaultJSONKeys,
+	}
+}
+
+func (r *JSONReader) Read(p []byte) (n int, err error) {
+	if r.i == len(r.b) {
+		r.b = r.b[:0]
+		r.i = 0
+
+		err = r.readEvent()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.b[r.i:])
+	r.i += n
+
+	return n, nil
+}
+
+// readEvent reads one JSON object and encodes it as a tlog event into r.b.
+func (r *JSONReader) readEvent() (err error) {
+	tk, err := r.d.Token()
+	if err != nil {
+		return err
+	}
+
+	if tk != json.Delim('{') {
+		return errors.New("expected object, got %v", tk)
+	}
+
+	r.v = r.v[:0]
+	els := 0
+
+	for r.d.More() {
+		tk, err = r.d.Token()
+		if err != nil {
+			return errors.Wrap(err, "key")
+		}
+
+		k := tk.(string)
+
+		if tk, ok := r.Keys[k]; ok {
+			k = tk
+		}
+
+		r.v = r.e.AppendString(r.v, tlog.String, k)
+
+		if isSemanticKey(k) {
+			var v interface{}
+
+			err = r.d.Decode(&v)
+			if err != nil {
+				return errors.Wrap(err, "value: %v", k)
+			}
+
+			r.v = r.e.AppendValue(r.v, jsonSemantic(k, v))
+		} else {
+			r.v, err = r.appendValue(r.v)
+			if err != nil {
+				return errors.Wrap(err, "value: %v", k)
+			}
+		}
+
+		els++
+	}
+
+	_, err = r.d.Token() // }
+	if err != nil {
+		return err
+	}
+
+	r.b = r.e.AppendTag(r.b, tlog.Map, els)
+	r.b = append(r.b, r.v...)
+
+	return nil
+}
+
+func (r *JSONReader) appendValue(b []byte) (_ []byte, err error) {
+	tk, err := r.d.Token()
+	if err != nil {
+		return b, err
+	}
+
+	switch tk := tk.(type) {
+	case json.Delim:
+		switch tk {
+		case '{':
+			b = append(b, tlog.Map|tlog.LenBreak)
+
+			for r.d.More() {
+				k, err := r.d.Token()
+				if err != nil {
+					return b, err
+				}
+
+				b = r.e.AppendString(b, tlog.String, k.(string))
+
+				b, err = r.appendValue(b)
+				if err != nil {
+					return b, err
+				}
+			}
+		case '[':
+			b = append(b, tlog.Array|tlog.LenBreak)
+
+			for r.d.More() {
+				b, err = r.appendValue(b)
+				if err != nil {
+					return b, err
+				}
+			}
+		default:
+			return b, errors.New("unexpected %v", tk)
+		}
+
+		_, err = r.d.Token() // closing delim
+		if err != nil {
+			return b, err
+		}
+
+		b = append(b, tlog.Special|tlog.Break)
+	case json.Number:
+		b = r.e.AppendValue(b, jsonNumber(tk))
+	default:
+		b = r.e.AppendValue(b, tk)
+	}
+
+	return b, nil
+}
+
+func isSemanticKey(k string) bool {
+	switch k {
+	case tlog.KeyTime, tlog.KeySpan, tlog.KeyParent, tlog.KeyMessage, tlog.KeyElapsed,
+		tlog.KeyLabels, tlog.KeyEventType, tlog.KeyLogLevel:
+		return true
+	}
+
+	return false
+}
+
+// jsonSemantic converts decoded value of predefined key to its tlog type.
+// If the value doesn't fit the type it's returned as is.
+func jsonSemantic(k string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		switch k {
+		case tlog.KeyTime:
+			if ts, ok := jsonTimestamp(v); ok {
+				return ts
+			}
+		case tlog.KeyElapsed:
+			if x, err := v.Int64(); err == nil {
+				return time.Duration(x)
+			}
+
+			if f, err := v.Float64(); err == nil {
+				return time.Duration(f * float64(time.Second))
+			}
+		case tlog.KeyLogLevel:
+			if x, err := v.Int64(); err == nil {
+				return tlog.LogLevel(x)
+			}
+		}
+
+		return jsonNumber(v)
+	case string:
+		switch k {
+		case tlog.KeyTime:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t
+			}
+		case tlog.KeySpan, tlog.KeyParent:
+			if id, err := tlog.IDFromString(v); err == nil {
+				return id
+			}
+
+			if p, err := base64.StdEncoding.DecodeString(v); err == nil && len(p) == len(tlog.ID{}) {
+				var id tlog.ID
+				copy(id[:], p)
+
+				return id
+			}
+		case tlog.KeyMessage:
+			return tlog.Message(v)
+		case tlog.KeyElapsed:
+			if d, err := time.ParseDuration(v); err == nil {
+				return d
+			}
+		case tlog.KeyLabels:
+			return tlog.Labels(strings.Split(v, ","))
+		case tlog.KeyEventType:
+			return tlog.EventType(v)
+		case tlog.KeyLogLevel:
+			if lv, ok := parseLogfmtLevel(v); ok {
+				return lv
+			}
+		}
+	case []interface{}:
+		if k != tlog.KeyLabels {
+			break
+		}
+
+		ls := make(tlog.Labels, 0, len(v))
+
+		for _, l := range v {
+			s, ok := l.(string)
+			if !ok {
+				return v
+			}
+
+			ls = append(ls, s)
+		}
+
+		return ls
+	}
+
+	return v
+}
+
+// jsonTimestamp guesses timestamp units by its magnitude: s, ms, µs or ns.
+func jsonTimestamp(v json.Number) (tlog.Timestamp, bool) {
+	f, err := v.Float64()
+	if err != nil {
+		return 0, false
+	}
+
+	if x, err := v.Int64(); err == nil && (x >= 1e17 || x <= -1e17) {
+		return tlog.Timestamp(x), true
+	}
+
+	switch a := math.Abs(f); {
+	case a < 1e11:
+		f *= 1e9
+	case a < 1e14:
+		f *= 1e6
+	case a < 1e17:
+		f *= 1e3
+	}
+
+	return tlog.Timestamp(f), true
+}
+
+// jsonNumber converts number to int64, uint64 or float64 whichever keeps it exactly.
+// Numbers which don't fit are kept as strings.
+func jsonNumber(v json.Number) interface{} {
+	s := string(v)
+
+	if x, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return x
+	}
+
+	if x, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return x
+	}
+
+	if !strings.ContainsAny(s, ".eE") {
+		return s
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return s
+	}
+
+	// keep the text if float64 would lose precision
+	var x, y big.Rat
+
+	if _, ok := x.SetString(s); !ok {
+		return s
+	}
+
+	y.SetString(strconv.FormatFloat(f, 'g', -1, 64))
+
+	if x.Cmp(&y) != 0 {
+		return s
+	}
+
+	return f
+}
@@ -1,14 +1,17 @@
 package convert
 
 import (
+	"encoding/json"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/nikandfor/loc"
 	"github.com/nikandfor/tlog"
 	"github.com/nikandfor/tlog/low"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestJSON(t *testing.T) {
@@ -53,3 +56,182 @@ func TestJSON(t *testing.T) {
 		assert.True(t, false, "expected\n%s\ngot\n%s", "", ls[i])
 	}
 }
+
+func TestJSONReader(t *testing.T) {
+	const in = `{"ts":1608934093.5,"level":"warn","msg":"message","span_id":"0102030405060708090a0b0c0d0e0f10","obj":{"z":1,"a":[1,"b",null]},"big":18446744073709551615,"huge":123456789012345678901234567890,"f":0.1,"one":1.0,"exp":1e3,"pi":3.14159265358979323846,"long":0.10000000000000000001}
+{"t":1608934093000000000,"i":1,"m":"second","L":["a=b","c"],"e":1500000000}
+`
+
+	rd := tlog.NewReader(NewJSONReader(strings.NewReader(in)))
+
+	require.True(t, rd.Next())
+	ev := rd.Event()
+
+	assert.Equal(t, tlog.Timestamp(1608934093500000000), ev.Time)
+	assert.Equal(t, tlog.Warn, ev.Level)
+	assert.Equal(t, "message", string(ev.Message))
+	assert.Equal(t, tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, ev.Span)
+
+	for _, c := range []struct {
+		k string
+		v interface{}
+	}{
+		{"big", uint64(18446744073709551615)},
+		{"huge", "123456789012345678901234567890"},
+		{"f", 0.1},
+		{"one", 1.0},
+		{"exp", 1000.0},
+		{"pi", "3.14159265358979323846"},
+		{"long", "0.10000000000000000001"},
+	} {
+		v, ok := ev.Get(c.k)
+		if assert.True(t, ok, "key %v", c.k) {
+			assert.Equal(t, c.v, v, "key %v", c.k)
+		}
+	}
+
+	var b low.Buf
+	j := NewJSONWriter(&b)
+
+	_, err := j.Write(ev.Raw())
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"obj":{"z":1,"a":[1,"b",null]}`)
+
+	require.True(t, rd.Next())
+	ev = rd.Event()
+
+	assert.Equal(t, tlog.Timestamp(1608934093000000000), ev.Time)
+	assert.Equal(t, tlog.Warn, ev.Level)
+	assert.Equal(t, "second", string(ev.Message))
+	assert.Equal(t, tlog.Labels{"a=b", "c"}, ev.Labels)
+	assert.Equal(t, 1500*time.Millisecond, ev.Elapsed)
+
+	assert.False(t, rd.Next())
+	assert.NoError(t, rd.Err())
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	var b low.Buf
+
+	e := tlog.Encoder{Writer: NewJSONWriter(&b)}
+
+	err := e.Encode(nil, []interface{}{
+		tlog.KeyTime, tlog.Timestamp(1608934093123456789),
+		tlog.KeySpan, tlog.ID{1, 2, 3},
+		tlog.KeyMessage, tlog.Message("msg"),
+		tlog.KeyLogLevel, tlog.Error,
+		"int", 5,
+		"neg", -5,
+		"str", "val",
+	})
+	require.NoError(t, err)
+
+	first := string(b)
+
+	var out low.Buf
+
+	err = Copy(NewJSONWriter(&out), NewJSONReader(strings.NewReader(first)))
+	require.NoError(t, err)
+
+	assert.Equal(t, first, string(out))
+}
+
+func TestJSONPresets(t *testing.T) {
+	tm := time.Date(2020, time.December, 25, 22, 8, 13, 123456789, time.UTC)
+	pc := loc.Caller(0)
+
+	kvs := []interface{}{
+		tlog.KeyTime, tm,
+		tlog.KeySpan, tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		tlog.KeyLocation, pc,
+		tlog.KeyLabels, tlog.Labels{"a=b", "c"},
+		tlog.KeyLogLevel, tlog.Warn,
+		tlog.KeyEventType, tlog.EventType("v"),
+		tlog.KeyMessage, tlog.Message("message"),
+		"user", map[string]interface{}{"id": 5},
+	}
+
+	name, file, line := pc.NameFileLine()
+
+	for _, c := range []struct {
+		name string
+		opts JSONOptions
+		exp  map[string]interface{}
+	}{
+		{"ecs", ECS, map[string]interface{}{
+			"@timestamp":           "2020-12-25T22:08:13.123456789Z",
+			"span.id":              "0102030405060708090a0b0c0d0e0f10",
+			"log.origin.file.name": file,
+			"log.origin.file.line": float64(line),
+			"log.origin.function":  name,
+			"labels":               map[string]interface{}{"a": "b", "c": ""},
+			"log.level":            "warn",
+			"tlog.type":            "v",
+			"message":              "message",
+			"user":                 map[string]interface{}{"id": float64(5)},
+		}},
+		{"otel", OTel, map[string]interface{}{
+			"Timestamp":      float64(tm.UnixNano()),
+			"SpanId":         "0102030405060708090a0b0c0d0e0f10",
+			"Resource":       map[string]interface{}{"a": "b", "c": ""},
+			"SeverityNumber": float64(13),
+			"SeverityText":   "warn",
+			"Body":           "message",
+			"Attributes": map[string]interface{}{
+				"T":             "v",
+				"code.filepath": file,
+				"code.lineno":   float64(line),
+				"code.function": name,
+				"user.id":       float64(5),
+			},
+		}},
+	} {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			var b low.Buf
+
+			w := NewJSONWriter(&b)
+			w.JSONOptions = c.opts
+
+			e := tlog.Encoder{Writer: w}
+
+			err := e.Encode(nil, kvs)
+			require.NoError(t, err)
+
+			var res map[string]interface{}
+
+			err = json.Unmarshal(b, &res)
+			require.NoError(t, err, "%s", b)
+
+			assert.Equal(t, c.exp, res)
+		})
+	}
+}
+
+func TestJSONTimeFormat(t *testing.T) {
+	ts := tlog.Timestamp(1608934093123456789)
+
+	for _, c := range []struct {
+		f   string
+		exp string
+	}{
+		{"", `{"t":1608934093123456789}`},
+		{JSONTimeNanos, `{"t":1608934093123456789}`},
+		{JSONTimeMillis, `{"t":1608934093123}`},
+		{time.RFC3339Nano, `{"t":"2020-12-25T22:08:13.123456789Z"}`},
+	} {
+		var b low.Buf
+
+		w := NewJSONWriter(&b)
+		w.TimeFormat = c.f
+		w.TimeZone = time.UTC
+
+		e := tlog.Encoder{Writer: w}
+
+		err := e.Encode(nil, []interface{}{tlog.KeyTime, ts})
+		require.NoError(t, err)
+
+		assert.Equal(t, c.exp+"\n", string(b), "format %q", c.f)
+	}
+}
@@ -0,0 +1,602 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Logfmt writes events as logfmt lines: key=value pairs separated by space.
+	//
+	// Predefined keys are renamed according to Rename.
+	// Nested maps are flattened with dotted keys (a.b=c), arrays get indexes as keys (a.0=b).
+	// Labels are joined with comma.
+	Logfmt struct {
+		io.Writer
+
+		TimeFormat string
+		TimeZone   *time.Location
+
+		// Rename maps event keys to output keys.
+		Rename map[string]string
+
+		d tlog.Decoder
+
+		b   low.Buf
+		key []byte
+	}
+
+	// LogfmtReader parses logfmt lines and produces tlog events.
+	//
+	// Keys are renamed back to predefined tlog keys according to Rename
+	// (output key -> tlog key) and their values are parsed into typed values.
+	// Other values are parsed as int, float, bool or string.
+	// Empty value is nil, key without value is true.
+	LogfmtReader struct {
+		r *bufio.Reader
+
+		TimeFormat string
+
+		// Rename maps input keys to event keys.
+		Rename map[string]string
+
+		e   tlog.Encoder
+		b   low.Buf
+		i   int
+		kvs []interface{}
+	}
+)
+
+// DefaultLogfmtKeys are the common logfmt names for predefined keys.
+var DefaultLogfmtKeys = map[string]string{
+	tlog.KeyTime:      "time",
+	tlog.KeySpan:      "span",
+	tlog.KeyParent:    "parent",
+	tlog.KeyMessage:   "msg",
+	tlog.KeyElapsed:   "elapsed",
+	tlog.KeyLocation:  "caller",
+	tlog.KeyLabels:    "labels",
+	tlog.KeyEventType: "type",
+	tlog.KeyLogLevel:  "level",
+}
+
+func NewLogfmtWriter(w io.Writer) *Logfmt {
+	return &Logfmt{
+		Writer:     w,
+		TimeFormat: time.RFC3339Nano,
+		TimeZone:   time.UTC,
+		Rename:     DefaultLogfmtKeys,
+	}
+}
+
+// NewLogfmtReader creates logfmt reader with keys reversed from DefaultLogfmtKeys.
+func NewLogfmtReader(r io.Reader) *LogfmtReader {
+	rn := make(map[string]string, len(DefaultLogfmtKeys))
+
+	for k, v := range DefaultLogfmtKeys {
+		rn[v] = k
+	}
+
+	lr := &LogfmtReader{
+		r:          bufio.NewReader(r),
+		TimeFormat: time.RFC3339Nano,
+		Rename:     rn,
+	}
+
+	lr.e.Writer = &lr.b
+
+	return lr
+}
+
+func (w *Logfmt) Write(p []byte) (n int, err error) {
+	w.d.ResetBytes(p)
+
+	b := w.b[:0]
+	i := 0
+
+	for i < len(p) {
+		tag, els, st := w.d.Tag(i)
+		if err = w.d.Err(); err != nil {
+			return 0, err
+		}
+
+		if tag == tlog.Semantic && els == tlog.WireHeader {
+			i = w.d.Skip(i)
+			continue
+		}
+
+		if tag != tlog.Map {
+			return 0, errors.New("expected map, got %x", tag)
+		}
+
+		i = st
+		lst := len(b)
+
+		for el := 0; els == -1 || el < els; el++ {
+			if els == -1 && w.d.Break(&i) {
+				break
+			}
+
+			var k []byte
+			k, i = w.d.String(i)
+
+			if r, ok := w.Rename[low.UnsafeBytesToString(k)]; ok {
+				w.key = append(w.key[:0], r...)
+			} else {
+				w.key = appendLogfmtKey(w.key[:0], k)
+			}
+
+			b, i = w.appendPair(b, lst, i)
+		}
+
+		if err = w.d.Err(); err != nil {
+			return 0, err
+		}
+
+		b = append(b, '\n')
+	}
+
+	w.b = b[:0]
+
+	_, err = w.Writer.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// appendPair appends value at st with w.key, flattening maps and arrays.
+func (w *Logfmt) appendPair(b []byte, lst, st int) (_ []byte, i int) {
+	tag, sub, i := w.d.Tag(st)
+	if w.d.Err() != nil {
+		return b, i
+	}
+
+	switch {
+	case tag == tlog.Map:
+		kl := len(w.key)
+
+		for el := 0; sub == -1 || el < sub; el++ {
+			if sub == -1 && w.d.Break(&i) {
+				break
+			}
+
+			var k []byte
+			k, i = w.d.String(i)
+
+			w.key = append(w.key[:kl], '.')
+			w.key = appendLogfmtKey(w.key, k)
+
+			b, i = w.appendPair(b, lst, i)
+		}
+
+		w.key = w.key[:kl]
+
+		return b, i
+	case tag == tlog.Array:
+		kl := len(w.key)
+
+		for el := 0; sub == -1 || el < sub; el++ {
+			if sub == -1 && w.d.Break(&i) {
+				break
+			}
+
+			w.key = append(w.key[:kl], '.')
+			w.key = strconv.AppendInt(w.key, int64(el), 10)
+
+			b, i = w.appendPair(b, lst, i)
+		}
+
+		w.key = w.key[:kl]
+
+		return b, i
+	case tag == tlog.Semantic && !logfmtScalar(sub):
+		return w.appendPair(b, lst, i)
+	}
+
+	if len(b) != lst {
+		b = append(b, ' ')
+	}
+
+	b = append(b, w.key...)
+	b = append(b, '=')
+
+	return w.appendValue(b, st)
+}
+
+func (w *Logfmt) appendValue(b []byte, st int) (_ []byte, i int) {
+	tag, sub, i := w.d.Tag(st)
+
+	switch tag {
+	case tlog.Int:
+		var v int64
+		v, i = w.d.Int(st)
+
+		b = strconv.AppendUint(b, uint64(v), 10)
+	case tlog.Neg:
+		var v int64
+		v, i = w.d.Int(st)
+
+		b = strconv.AppendInt(b, v, 10)
+	case tlog.Bytes:
+		var s []byte
+		s, i = w.d.String(st)
+
+		b = append(b, base64.StdEncoding.EncodeToString(s)...)
+	case tlog.String:
+		var s []byte
+		s, i = w.d.String(st)
+
+		b = appendLogfmtString(b, s)
+	case tlog.Special:
+		switch sub {
+		case tlog.False:
+			b = append(b, "false"...)
+		case tlog.True:
+			b = append(b, "true"...)
+		case tlog.Null, tlog.Undefined:
+		case tlog.Float64, tlog.Float32, tlog.Float16, tlog.FloatInt8:
+			var f float64
+			f, i = w.d.Float(st)
+
+			b = strconv.AppendFloat(b, f, 'f', -1, 64)
+		}
+	case tlog.Semantic:
+		b, i = w.appendSemantic(b, st, sub, i)
+	default:
+		i = w.d.Skip(st)
+	}
+
+	return b, i
+}
+
+func (w *Logfmt) appendSemantic(b []byte, st, sub, i int) (_ []byte, _ int) {
+	switch sub {
+	case tlog.WireTime:
+		var ts tlog.Timestamp
+		ts, i = w.d.Time(st)
+
+		t := time.Unix(0, int64(ts))
+		if w.TimeZone != nil {
+			t = t.In(w.TimeZone)
+		}
+
+		return t.AppendFormat(b, w.TimeFormat), i
+	case tlog.WireDuration:
+		var v int64
+		v, i = w.d.Int(i)
+
+		return append(b, time.Duration(v).String()...), i
+	case tlog.WireID:
+		var id tlog.ID
+		id, i = w.d.ID(st)
+
+		s := len(b)
+		b = append(b, "00000000000000000000000000000000"...)
+		id.FormatTo(b[s:], 'x')
+
+		return b, i
+	case tlog.WireLocation:
+		var pc loc.PC
+		pc, i = w.d.Location(st)
+
+		_, file, line := pc.NameFileLine()
+
+		s := len(b)
+		b = append(b, file...)
+		b = append(b, ':')
+		b = strconv.AppendInt(b, int64(line), 10)
+
+		return quoteLogfmtTail(b, s), i
+	case tlog.WireLabels:
+		var ls tlog.Labels
+		ls, i = w.d.Labels(st)
+
+		s := len(b)
+
+		for j, l := range ls {
+			if j != 0 {
+				b = append(b, ',')
+			}
+
+			b = append(b, l...)
+		}
+
+		return quoteLogfmtTail(b, s), i
+	case tlog.WireLogLevel:
+		var lv tlog.LogLevel
+		lv, i = w.d.LogLevel(st)
+
+		return append(b, logfmtLevel(lv)...), i
+	case tlog.WireHex:
+		tag, _, _ := w.d.Tag(i)
+
+		if tag == tlog.Int || tag == tlog.Neg {
+			var v int64
+			v, i = w.d.Int(i)
+
+			if v < 0 {
+				b = append(b, '-')
+				v = -v
+			}
+
+			b = append(b, "0x"...)
+
+			return strconv.AppendUint(b, uint64(v), 16), i
+		}
+
+		return w.appendValue(b, i)
+	default:
+		return w.appendValue(b, i)
+	}
+}
+
+func logfmtScalar(sub int) bool {
+	switch sub {
+	case tlog.WireTime, tlog.WireDuration, tlog.WireID, tlog.WireLocation,
+		tlog.WireLabels, tlog.WireLogLevel, tlog.WireHex, tlog.WireMessage, tlog.WireError:
+		return true
+	}
+
+	return false
+}
+
+func logfmtLevel(lv tlog.LogLevel) string {
+	switch {
+	case lv == tlog.Info:
+		return "info"
+	case lv == tlog.Warn:
+		return "warn"
+	case lv == tlog.Error:
+		return "error"
+	case lv == tlog.Fatal:
+		return "fatal"
+	case lv < tlog.Info:
+		return "debug"
+	default:
+		return strconv.Itoa(int(lv))
+	}
+}
+
+func appendLogfmtKey(b, k []byte) []byte {
+	for _, c := range k {
+		if c <= ' ' || c == '=' || c == '"' || c >= 0x7f {
+			c = '_'
+		}
+
+		b = append(b, c)
+	}
+
+	return b
+}
+
+func appendLogfmtString(b, s []byte) []byte {
+	if !logfmtNeedQuote(s) && !logfmtAmbiguous(s) {
+		return append(b, s...)
+	}
+
+	return strconv.AppendQuote(b, low.UnsafeBytesToString(s))
+}
+
+// quoteLogfmtTail quotes b[st:] if needed.
+func quoteLogfmtTail(b []byte, st int) []byte {
+	if !logfmtNeedQuote(b[st:]) {
+		return b
+	}
+
+	v := string(b[st:])
+
+	return strconv.AppendQuote(b[:st], v)
+}
+
+func logfmtNeedQuote(s []byte) bool {
+	if len(s) == 0 {
+		return true
+	}
+
+	for _, c := range s {
+		if c <= ' ' || c == '=' || c == '"' || c == '\\' || c >= 0x7f {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logfmtAmbiguous reports whether the string would be read back as a number or bool.
+func logfmtAmbiguous(s []byte) bool {
+	switch ss := low.UnsafeBytesToString(s); ss {
+	case "true", "false":
+		return true
+	default:
+		_, err := strconv.ParseFloat(ss, 64)
+		return err == nil
+	}
+}
+
+func (r *LogfmtReader) Read(p []byte) (n int, err error) {
+	for r.i == len(r.b) {
+		r.b = r.b[:0]
+		r.i = 0
+
+		var line []byte
+		line, err = r.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return 0, err
+		}
+
+		e := r.parseLine(line)
+		if e != nil {
+			return 0, e
+		}
+
+		if len(r.kvs) == 0 {
+			continue
+		}
+
+		e = r.e.Encode(nil, r.kvs)
+		if e != nil {
+			return 0, errors.Wrap(e, "encode")
+		}
+	}
+
+	n = copy(p, r.b[r.i:])
+	r.i += n
+
+	return n, nil
+}
+
+func (r *LogfmtReader) parseLine(line []byte) (err error) {
+	r.kvs = r.kvs[:0]
+
+	for i := 0; i < len(line); {
+		for i < len(line) && line[i] <= ' ' {
+			i++
+		}
+
+		if i == len(line) {
+			break
+		}
+
+		st := i
+		for i < len(line) && line[i] > ' ' && line[i] != '=' {
+			i++
+		}
+
+		k := string(line[st:i])
+
+		if i == len(line) || line[i] != '=' {
+			r.kvs = append(r.kvs, k, true)
+			continue
+		}
+
+		i++ // =
+
+		var v string
+		var quoted bool
+
+		if i < len(line) && line[i] == '"' {
+			st = i
+
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+
+			if i >= len(line) {
+				return errors.New("unterminated quoted value: %q", k)
+			}
+
+			i++
+
+			v, err = strconv.Unquote(string(line[st:i]))
+			if err != nil {
+				return errors.Wrap(err, "key %q", k)
+			}
+
+			quoted = true
+		} else {
+			st = i
+			for i < len(line) && line[i] > ' ' {
+				i++
+			}
+
+			v = string(line[st:i])
+		}
+
+		if rk, ok := r.Rename[k]; ok {
+			k = rk
+		}
+
+		r.kvs = append(r.kvs, k, r.value(k, v, quoted))
+	}
+
+	return nil
+}
+
+func (r *LogfmtReader) value(k, v string, quoted bool) interface{} {
+	switch k {
+	case tlog.KeyTime:
+		if t, err := time.Parse(r.TimeFormat, v); err == nil {
+			return t
+		}
+	case tlog.KeySpan, tlog.KeyParent:
+		if id, err := tlog.IDFromString(v); err == nil {
+			return id
+		}
+	case tlog.KeyMessage:
+		return tlog.Message(v)
+	case tlog.KeyElapsed:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	case tlog.KeyLabels:
+		if v == "" {
+			return tlog.Labels(nil)
+		}
+
+		return tlog.Labels(strings.Split(v, ","))
+	case tlog.KeyEventType:
+		return tlog.EventType(v)
+	case tlog.KeyLogLevel:
+		if lv, ok := parseLogfmtLevel(v); ok {
+			return lv
+		}
+	}
+
+	if quoted {
+		return v
+	}
+
+	switch v {
+	case "":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+
+	if x, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return x
+	}
+
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return f
+	}
+
+	return v
+}
+
+func parseLogfmtLevel(v string) (tlog.LogLevel, bool) {
+	switch strings.ToLower(v) {
+	case "debug", "dbg", "trace":
+		return tlog.Debug, true
+	case "info", "inf":
+		return tlog.Info, true
+	case "warn", "warning", "wrn":
+		return tlog.Warn, true
+	case "error", "err":
+		return tlog.Error, true
+	case "fatal", "ftl":
+		return tlog.Fatal, true
+	}
+
+	x, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, false
+	}
+
+	return tlog.LogLevel(x), true
+}
@@ -0,0 +1,95 @@
+package convert
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+func TestLogfmt(t *testing.T) {
+	tm := time.Date(2020, time.December, 25, 22, 8, 13, 123456000, time.UTC)
+	id := tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	var b low.Buf
+
+	e := tlog.Encoder{Writer: NewLogfmtWriter(&b), Labels: tlog.Labels{"a=b", "c"}}
+
+	err := e.Encode(nil, []interface{}{
+		tlog.KeyTime, tm,
+		tlog.KeySpan, id,
+		tlog.KeyLogLevel, tlog.Warn,
+		tlog.KeyMessage, tlog.Message("some message"),
+		"str", "arg",
+		"num_str", "123",
+		"empty", "",
+		"int", 5,
+		"neg", -3,
+		"float", 1.5,
+		"bool", true,
+		"nested", map[string]interface{}{"a": 1},
+		"arr", []int{1, 2},
+		"dur", time.Second,
+	})
+	require.NoError(t, err)
+
+	exp := `labels="a=b,c"
+time=2020-12-25T22:08:13.123456Z span=0102030405060708090a0b0c0d0e0f10 level=warn msg="some message" str=arg num_str="123" empty="" int=5 neg=-3 float=1.5 bool=true nested.a=1 arr.0=1 arr.1=2 dur=1s
+`
+
+	assert.Equal(t, exp, string(b))
+
+	r := NewLogfmtReader(strings.NewReader(exp))
+	rd := tlog.NewReader(r)
+
+	require.True(t, rd.Next(), "labels event")
+
+	require.True(t, rd.Next(), "event")
+	ev := rd.Event()
+
+	assert.Equal(t, tlog.Timestamp(tm.UnixNano()), ev.Time)
+	assert.Equal(t, id, ev.Span)
+	assert.Equal(t, tlog.Warn, ev.Level)
+	assert.Equal(t, "some message", string(ev.Message))
+	assert.Equal(t, tlog.Labels{"a=b", "c"}, ev.Labels)
+
+	for _, c := range []struct {
+		k string
+		v interface{}
+	}{
+		{"str", "arg"},
+		{"num_str", "123"},
+		{"empty", ""},
+		{"int", int64(5)},
+		{"neg", int64(-3)},
+		{"float", 1.5},
+		{"bool", true},
+		{"nested.a", int64(1)},
+	} {
+		v, ok := ev.Get(c.k)
+		if assert.True(t, ok, "key %v", c.k) {
+			assert.EqualValues(t, c.v, v, "key %v", c.k)
+		}
+	}
+
+	assert.False(t, rd.Next())
+	assert.NoError(t, rd.Err())
+
+	// round trip
+
+	var out bytes.Buffer
+
+	r = NewLogfmtReader(strings.NewReader(exp))
+	w := NewLogfmtWriter(&out)
+
+	err = Copy(w, r)
+	require.NoError(t, err)
+
+	assert.Equal(t, exp, out.String())
+}
@@ -0,0 +1,500 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// OTLP collects events and writes them in OpenTelemetry Protocol JSON
+	// (the file exporter format) on Close.
+	//
+	// Messages become log records, spans become spans and Observe values become metric data points.
+	// Metrics registered as counters are written as monotonic sums, the others as gauges.
+	// Labels become resource attributes, ServiceLabel is also written as service.name.
+	//
+	// Up to three lines are written: logs, traces and metrics requests.
+	OTLP struct {
+		io.Writer
+
+		Scope string
+
+		spanTree
+
+		res  []*otlpResource
+		resm map[string]*otlpResource
+
+		metrics map[string]tlog.EventType
+		help    map[string]string
+	}
+
+	otlpResource struct {
+		ls   tlog.Labels
+		logs []otlpLog
+		mets []*otlpMetric
+		metm map[string]*otlpMetric
+	}
+
+	otlpLog struct {
+		span tlog.ID
+		rec  OTLPLogRecord
+	}
+
+	otlpMetric struct {
+		m   OTLPMetric
+		pts []OTLPDataPoint
+	}
+
+	OTLPLogsData struct {
+		ResourceLogs []OTLPResourceLogs `json:"resourceLogs"`
+	}
+
+	OTLPResourceLogs struct {
+		Resource  OTLPResourceAttrs `json:"resource"`
+		ScopeLogs []OTLPScopeLogs   `json:"scopeLogs"`
+	}
+
+	OTLPScopeLogs struct {
+		Scope      OTLPScope       `json:"scope"`
+		LogRecords []OTLPLogRecord `json:"logRecords"`
+	}
+
+	OTLPLogRecord struct {
+		TimeUnixNano   string         `json:"timeUnixNano,omitempty"`
+		SeverityNumber int            `json:"severityNumber,omitempty"`
+		SeverityText   string         `json:"severityText,omitempty"`
+		Body           OTLPAnyValue   `json:"body"`
+		Attributes     []OTLPKeyValue `json:"attributes,omitempty"`
+		TraceID        string         `json:"traceId,omitempty"`
+		SpanID         string         `json:"spanId,omitempty"`
+	}
+
+	OTLPTracesData struct {
+		ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+	}
+
+	OTLPResourceSpans struct {
+		Resource   OTLPResourceAttrs `json:"resource"`
+		ScopeSpans []OTLPScopeSpans  `json:"scopeSpans"`
+	}
+
+	OTLPScopeSpans struct {
+		Scope OTLPScope  `json:"scope"`
+		Spans []OTLPSpan `json:"spans"`
+	}
+
+	OTLPSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano,omitempty"`
+		Attributes        []OTLPKeyValue `json:"attributes,omitempty"`
+		Status            OTLPStatus     `json:"status"`
+	}
+
+	OTLPStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+
+	OTLPMetricsData struct {
+		ResourceMetrics []OTLPResourceMetrics `json:"resourceMetrics"`
+	}
+
+	OTLPResourceMetrics struct {
+		Resource     OTLPResourceAttrs  `json:"resource"`
+		ScopeMetrics []OTLPScopeMetrics `json:"scopeMetrics"`
+	}
+
+	OTLPScopeMetrics struct {
+		Scope   OTLPScope    `json:"scope"`
+		Metrics []OTLPMetric `json:"metrics"`
+	}
+
+	OTLPMetric struct {
+		Name        string     `json:"name"`
+		Description string     `json:"description,omitempty"`
+		Gauge       *OTLPGauge `json:"gauge,omitempty"`
+		Sum         *OTLPSum   `json:"sum,omitempty"`
+	}
+
+	OTLPGauge struct {
+		DataPoints []OTLPDataPoint `json:"dataPoints"`
+	}
+
+	OTLPSum struct {
+		DataPoints             []OTLPDataPoint `json:"dataPoints"`
+		AggregationTemporality int             `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	}
+
+	OTLPDataPoint struct {
+		Attributes        []OTLPKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano,omitempty"`
+		AsInt             *string        `json:"asInt,omitempty"`
+		AsDouble          *float64       `json:"asDouble,omitempty"`
+	}
+
+	OTLPResourceAttrs struct {
+		Attributes []OTLPKeyValue `json:"attributes,omitempty"`
+	}
+
+	OTLPScope struct {
+		Name string `json:"name,omitempty"`
+	}
+
+	OTLPKeyValue struct {
+		Key   string       `json:"key"`
+		Value OTLPAnyValue `json:"value"`
+	}
+
+	OTLPAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// OTLP constants.
+const (
+	OTLPSpanKindInternal = 1
+
+	OTLPStatusError = 2
+
+	OTLPTemporalityDelta      = 1
+	OTLPTemporalityCumulative = 2
+)
+
+func NewOTLPWriter(w io.Writer) *OTLP {
+	return &OTLP{
+		Writer:   w,
+		Scope:    "tlog",
+		spanTree: newSpanTree(),
+		resm:     map[string]*otlpResource{},
+		metrics:  map[string]tlog.EventType{},
+		help:     map[string]string{},
+	}
+}
+
+func (w *OTLP) Write(p []byte) (n int, err error) {
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		w.spanTree.add(&w.ev)
+		w.add(&w.ev)
+	}
+
+	return len(p), nil
+}
+
+func (w *OTLP) add(ev *tlog.Event) {
+	switch ev.Type {
+	case "m":
+		name := string(ev.Message)
+
+		for i := 0; i < ev.Len(); i++ {
+			v, _ := ev.Value(i).(string)
+
+			switch string(ev.Key(i)) {
+			case "type":
+				w.metrics[name] = tlog.EventType(v)
+			case "help":
+				w.help[name] = v
+			}
+		}
+	case "v":
+		w.addValue(ev)
+	case "":
+		if len(ev.Message) == 0 {
+			return
+		}
+
+		r := w.resource()
+
+		rec := OTLPLogRecord{
+			TimeUnixNano:   otlpTime(ev.Time),
+			SeverityNumber: otelSeverity(ev.Level),
+			SeverityText:   strings.ToUpper(logfmtLevel(ev.Level)),
+			Body:           otlpString(string(ev.Message)),
+			Attributes:     otlpKVs(w.kvs(nil, ev)),
+		}
+
+		r.logs = append(r.logs, otlpLog{span: ev.Span, rec: rec})
+	}
+}
+
+func (w *OTLP) addValue(ev *tlog.Event) {
+	kvs := w.kvs(nil, ev)
+	if len(kvs) == 0 {
+		return
+	}
+
+	v := kvs[0]
+
+	var pt OTLPDataPoint
+
+	switch x := v.Value.(type) {
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		pt.AsInt = &s
+	case uint64: // over MaxInt64
+		f := float64(x)
+		pt.AsDouble = &f
+	case float64:
+		pt.AsDouble = &x
+	default:
+		return
+	}
+
+	pt.TimeUnixNano = otlpTime(ev.Time)
+	pt.Attributes = otlpKVs(kvs[1:])
+
+	r := w.resource()
+
+	m, ok := r.metm[v.Key]
+	if !ok {
+		m = &otlpMetric{m: OTLPMetric{
+			Name:        v.Key,
+			Description: w.help[v.Key],
+		}}
+
+		r.mets = append(r.mets, m)
+		r.metm[v.Key] = m
+	}
+
+	m.pts = append(m.pts, pt)
+}
+
+// deltaPoints sets each point start time to the previous point time of the same series.
+func deltaPoints(pts []OTLPDataPoint) []OTLPDataPoint {
+	last := map[string]string{}
+
+	for i := range pts {
+		k, _ := json.Marshal(pts[i].Attributes)
+
+		pts[i].StartTimeUnixNano = last[string(k)]
+		last[string(k)] = pts[i].TimeUnixNano
+	}
+
+	return pts
+}
+
+func (w *OTLP) resource() *otlpResource {
+	k := strings.Join(w.ls, ",")
+
+	r, ok := w.resm[k]
+	if !ok {
+		r = &otlpResource{
+			ls:   w.ls,
+			metm: map[string]*otlpMetric{},
+		}
+
+		w.res = append(w.res, r)
+		w.resm[k] = r
+	}
+
+	return r
+}
+
+// Close writes collected data. It doesn't close the underlying writer.
+func (w *OTLP) Close() (err error) {
+	w.finish()
+
+	scope := OTLPScope{Name: w.Scope}
+
+	var logs OTLPLogsData
+	var metrics OTLPMetricsData
+
+	for _, r := range w.res {
+		res := w.resourceAttrs(r.ls)
+
+		if len(r.logs) != 0 {
+			recs := make([]OTLPLogRecord, len(r.logs))
+
+			for i, l := range r.logs {
+				recs[i] = l.rec
+
+				if s, ok := w.byID[l.span]; ok {
+					recs[i].TraceID = hexID(s.Trace, len(s.Trace))
+					recs[i].SpanID = hexID(s.ID, 8)
+				}
+			}
+
+			logs.ResourceLogs = append(logs.ResourceLogs, OTLPResourceLogs{
+				Resource:  res,
+				ScopeLogs: []OTLPScopeLogs{{Scope: scope, LogRecords: recs}},
+			})
+		}
+
+		if len(r.mets) != 0 {
+			ms := make([]OTLPMetric, len(r.mets))
+
+			for i, m := range r.mets {
+				ms[i] = m.m
+
+				if w.metrics[m.m.Name] == tlog.MetricCounter {
+					// tlog counter values are increments
+					ms[i].Sum = &OTLPSum{
+						DataPoints:             deltaPoints(m.pts),
+						AggregationTemporality: OTLPTemporalityDelta,
+						IsMonotonic:            true,
+					}
+				} else {
+					ms[i].Gauge = &OTLPGauge{DataPoints: m.pts}
+				}
+			}
+
+			metrics.ResourceMetrics = append(metrics.ResourceMetrics, OTLPResourceMetrics{
+				Resource:     res,
+				ScopeMetrics: []OTLPScopeMetrics{{Scope: scope, Metrics: ms}},
+			})
+		}
+	}
+
+	traces := w.traces(scope)
+
+	for _, d := range []struct {
+		ok bool
+		v  interface{}
+	}{
+		{len(logs.ResourceLogs) != 0, logs},
+		{len(traces.ResourceSpans) != 0, traces},
+		{len(metrics.ResourceMetrics) != 0, metrics},
+	} {
+		if !d.ok {
+			continue
+		}
+
+		data, err := json.Marshal(d.v)
+		if err != nil {
+			return errors.Wrap(err, "marshal")
+		}
+
+		data = append(data, '\n')
+
+		_, err = w.Writer.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *OTLP) traces(scope OTLPScope) (d OTLPTracesData) {
+	idx := map[string]int{}
+
+	for _, s := range w.spans {
+		k := strings.Join(s.Labels, ",")
+
+		i, ok := idx[k]
+		if !ok {
+			i = len(d.ResourceSpans)
+			idx[k] = i
+
+			d.ResourceSpans = append(d.ResourceSpans, OTLPResourceSpans{
+				Resource:   w.resourceAttrs(s.Labels),
+				ScopeSpans: []OTLPScopeSpans{{Scope: scope}},
+			})
+		}
+
+		sp := OTLPSpan{
+			TraceID:           hexID(s.Trace, len(s.Trace)),
+			SpanID:            hexID(s.ID, 8),
+			Name:              s.Name,
+			Kind:              OTLPSpanKindInternal,
+			StartTimeUnixNano: otlpTime(s.Start),
+			Attributes:        otlpKVs(s.Tags),
+		}
+
+		if s.Parent != (tlog.ID{}) {
+			sp.ParentSpanID = hexID(s.Parent, 8)
+		}
+
+		if s.Finished {
+			sp.EndTimeUnixNano = otlpTime(s.Start + tlog.Timestamp(s.Duration))
+		}
+
+		for _, l := range s.Logs {
+			if l.Level >= tlog.Error {
+				sp.Status = OTLPStatus{Code: OTLPStatusError, Message: l.Message}
+			}
+		}
+
+		ss := &d.ResourceSpans[i].ScopeSpans[0]
+		ss.Spans = append(ss.Spans, sp)
+	}
+
+	return d
+}
+
+func (w *OTLP) resourceAttrs(ls tlog.Labels) (r OTLPResourceAttrs) {
+	if v, ok := ls.Lookup(w.ServiceLabel); ok && v != "" {
+		r.Attributes = append(r.Attributes, OTLPKeyValue{Key: "service.name", Value: otlpString(v)})
+	}
+
+	for _, l := range ls {
+		k, v := l, ""
+		if p := strings.IndexByte(l, '='); p != -1 {
+			k, v = l[:p], l[p+1:]
+		}
+
+		r.Attributes = append(r.Attributes, OTLPKeyValue{Key: k, Value: otlpString(v)})
+	}
+
+	return r
+}
+
+func otlpKVs(kvs []spanKV) []OTLPKeyValue {
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	r := make([]OTLPKeyValue, len(kvs))
+
+	for i, kv := range kvs {
+		r[i].Key = kv.Key
+
+		switch v := kv.Value.(type) {
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			r[i].Value.IntValue = &s
+		case float64:
+			r[i].Value.DoubleValue = &v
+		case bool:
+			r[i].Value.BoolValue = &v
+		default:
+			r[i].Value = otlpString(kv.Text)
+		}
+	}
+
+	return r
+}
+
+func otlpString(s string) OTLPAnyValue {
+	return OTLPAnyValue{StringValue: &s}
+}
+
+func otlpTime(ts tlog.Timestamp) string {
+	if ts == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(int64(ts), 10)
+}
@@ -0,0 +1,210 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestOTLP(t *testing.T) {
+	var b low.Buf
+
+	w := NewOTLPWriter(&b)
+
+	writeTwoServices(t, w)
+
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"service=back"}}
+
+	for _, kvs := range [][]interface{}{
+		{tlog.KeyEventType, tlog.EventType("m"), tlog.KeyMessage, "requests", "type", tlog.MetricCounter, "help", "number of requests"},
+		{tlog.KeyTime, tlog.Timestamp(1e9 + 20e3), tlog.KeyEventType, tlog.EventType("v"), "requests", 1, "path", "/api"},
+		{tlog.KeyTime, tlog.Timestamp(1e9 + 30e3), tlog.KeyEventType, tlog.EventType("v"), "requests", 2, "path", "/api"},
+		{tlog.KeyTime, tlog.Timestamp(1e9 + 30e3), tlog.KeyEventType, tlog.EventType("v"), "load", 0.25},
+		{tlog.KeyTime, tlog.Timestamp(1e9 + 40e3), tlog.KeyMessage, tlog.Message("no span"), "took", time.Millisecond},
+	} {
+		err := e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	const fixture = "testdata/otlp.jsonl"
+
+	if *update {
+		err = ioutil.WriteFile(fixture, b, 0644)
+		require.NoError(t, err)
+	}
+
+	exp, err := ioutil.ReadFile(fixture)
+	require.NoError(t, err)
+
+	assert.Equal(t, string(exp), string(b))
+
+	// round trip the fixture through the types
+
+	lines := bytes.Split(bytes.TrimSpace(exp), []byte("\n"))
+	require.Len(t, lines, 3)
+
+	for i, v := range []interface{}{&OTLPLogsData{}, &OTLPTracesData{}, &OTLPMetricsData{}} {
+		dec := json.NewDecoder(bytes.NewReader(lines[i]))
+		dec.DisallowUnknownFields()
+
+		err = dec.Decode(v)
+		require.NoError(t, err, "line %d", i)
+
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+
+		assert.Equal(t, string(lines[i]), string(data), "line %d", i)
+	}
+}
+
+func TestOTLPCounterDelta(t *testing.T) {
+	var b low.Buf
+
+	w := NewOTLPWriter(&b)
+
+	e := tlog.Encoder{Writer: w}
+
+	for _, kvs := range [][]interface{}{
+		{tlog.KeyEventType, tlog.EventType("m"), tlog.KeyMessage, "requests", "type", tlog.MetricCounter},
+		{tlog.KeyTime, tlog.Timestamp(1000), tlog.KeyEventType, tlog.EventType("v"), "requests", 1, "path", "/a"},
+		{tlog.KeyTime, tlog.Timestamp(2000), tlog.KeyEventType, tlog.EventType("v"), "requests", 3, "path", "/b"},
+		{tlog.KeyTime, tlog.Timestamp(3000), tlog.KeyEventType, tlog.EventType("v"), "requests", 2, "path", "/a"},
+	} {
+		err := e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	var d OTLPMetricsData
+
+	err = json.Unmarshal(b, &d)
+	require.NoError(t, err)
+
+	require.Len(t, d.ResourceMetrics, 1)
+	require.Len(t, d.ResourceMetrics[0].ScopeMetrics, 1)
+	require.Len(t, d.ResourceMetrics[0].ScopeMetrics[0].Metrics, 1)
+
+	sum := d.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Sum
+	require.NotNil(t, sum)
+
+	assert.Equal(t, OTLPTemporalityDelta, sum.AggregationTemporality)
+	assert.True(t, sum.IsMonotonic)
+
+	type pt struct {
+		Start, Time, Value string
+	}
+
+	var pts []pt
+
+	for _, p := range sum.DataPoints {
+		pts = append(pts, pt{Start: p.StartTimeUnixNano, Time: p.TimeUnixNano, Value: *p.AsInt})
+	}
+
+	assert.Equal(t, []pt{
+		{Time: "1000", Value: "1"},
+		{Time: "2000", Value: "3"},
+		{Start: "1000", Time: "3000", Value: "2"},
+	}, pts)
+}
+
+func TestOTLPSpans(t *testing.T) {
+	a, b, c := tlog.ID{0xa1}, tlog.ID{0xb2}, tlog.ID{0xc3}
+
+	ts := func(us int) tlog.Timestamp { return tlog.Timestamp(1e9 + us*1000) }
+
+	trace := "a1000000000000000000000000000000"
+
+	for _, tc := range []struct {
+		name string
+		evs  [][]interface{}
+		exp  []OTLPSpan
+	}{{
+		name: "nested",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("mid")},
+			{tlog.KeySpan, c, tlog.KeyTime, ts(20), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, b, tlog.KeyMessage, tlog.Message("leaf")},
+			{tlog.KeySpan, c, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 5 * time.Microsecond},
+			{tlog.KeySpan, b, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * time.Microsecond},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 40 * time.Microsecond},
+		},
+		exp: []OTLPSpan{
+			{SpanID: "a100000000000000", Name: "root", StartTimeUnixNano: "1000000000", EndTimeUnixNano: "1000040000"},
+			{SpanID: "b200000000000000", ParentSpanID: "a100000000000000", Name: "mid", StartTimeUnixNano: "1000010000", EndTimeUnixNano: "1000030000"},
+			{SpanID: "c300000000000000", ParentSpanID: "b200000000000000", Name: "leaf", StartTimeUnixNano: "1000020000", EndTimeUnixNano: "1000025000"},
+		},
+	}, {
+		name: "error",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("query")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(5), tlog.KeyLogLevel, tlog.Warn, tlog.KeyMessage, tlog.Message("slow")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(8), tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("failed")},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 10 * time.Microsecond},
+		},
+		exp: []OTLPSpan{{
+			SpanID: "a100000000000000", Name: "query", StartTimeUnixNano: "1000000000", EndTimeUnixNano: "1000010000",
+			Status: OTLPStatus{Code: OTLPStatusError, Message: "failed"},
+		}},
+	}, {
+		name: "unfinished",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("worker")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(30), tlog.KeyMessage, tlog.Message("still working")},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * time.Microsecond},
+		},
+		exp: []OTLPSpan{
+			{SpanID: "a100000000000000", Name: "root", StartTimeUnixNano: "1000000000", EndTimeUnixNano: "1000020000"},
+			{SpanID: "b200000000000000", ParentSpanID: "a100000000000000", Name: "worker", StartTimeUnixNano: "1000010000"},
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf low.Buf
+
+			w := NewOTLPWriter(&buf)
+			e := tlog.Encoder{Writer: w}
+
+			for _, kvs := range tc.evs {
+				err := e.Encode(nil, kvs)
+				require.NoError(t, err)
+			}
+
+			err := w.Close()
+			require.NoError(t, err)
+
+			var d OTLPTracesData
+
+			// span messages come first as logs
+			for _, l := range bytes.Split(bytes.TrimSpace(buf), []byte("\n")) {
+				err = json.Unmarshal(l, &d)
+				require.NoError(t, err, "%s", l)
+			}
+
+			require.Len(t, d.ResourceSpans, 1, "%s", buf)
+			require.Len(t, d.ResourceSpans[0].ScopeSpans, 1)
+
+			for i := range tc.exp {
+				tc.exp[i].TraceID = trace
+				tc.exp[i].Kind = OTLPSpanKindInternal
+			}
+
+			assert.Equal(t, tc.exp, d.ResourceSpans[0].ScopeSpans[0].Spans)
+		})
+	}
+}
@@ -0,0 +1,726 @@
+package convert
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Proto writes events in protobuf encoding described in tlog.proto.
+	// Each Event message is prefixed by its length as varint.
+	Proto struct {
+		io.Writer
+
+		d tlog.Decoder
+
+		b low.Buf
+	}
+
+	// ProtoReader reads length-delimited protobuf events written by Proto
+	// and produces tlog events.
+	//
+	// Events longer than MaxMessage are treated as corrupted input.
+	ProtoReader struct {
+		MaxMessage int
+
+		r *bufio.Reader
+
+		e tlog.Encoder
+
+		msg []byte
+		b   low.Buf
+		i   int
+	}
+)
+
+// DefaultProtoMaxMessage is the default ProtoReader.MaxMessage.
+var DefaultProtoMaxMessage = 4 << 20
+
+// protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoLen     = 2
+	protoFixed32 = 5
+)
+
+// Value fields.
+const (
+	protoUint = 1 + iota
+	protoInt
+	protoFloat
+	protoString
+	protoBytes
+	protoBool
+	protoNull
+	protoArray
+	protoMap
+
+	protoID
+	protoTime
+	protoDuration
+	protoLocation
+	protoLabels
+	protoLogLevel
+	protoHex
+	protoMessage
+	protoError
+	protoEventType
+
+	protoSemantic
+)
+
+func NewProtoWriter(w io.Writer) *Proto {
+	return &Proto{
+		Writer: w,
+	}
+}
+
+func (w *Proto) Write(p []byte) (n int, err error) {
+	w.d.ResetBytes(p)
+
+	b := w.b[:0]
+	i := 0
+
+	for i < len(p) {
+		tag, els, st := w.d.Tag(i)
+		if err = w.d.Err(); err != nil {
+			return 0, err
+		}
+
+		if tag == tlog.Semantic && els == tlog.WireHeader {
+			i = w.d.Skip(i)
+			continue
+		}
+
+		if tag != tlog.Map {
+			return 0, errors.New("expected map, got %x", tag)
+		}
+
+		s := len(b)
+
+		b, i = w.appendPairs(b, els, st)
+		if err = w.d.Err(); err != nil {
+			return 0, err
+		}
+
+		b = protoInsertLen(b, s)
+	}
+
+	w.b = b[:0]
+
+	_, err = w.Writer.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// appendPairs appends els pairs as repeated Pair field 1.
+func (w *Proto) appendPairs(b []byte, els, i int) (_ []byte, _ int) {
+	for el := 0; els == -1 || el < els; el++ {
+		if els == -1 && w.d.Break(&i) {
+			break
+		}
+
+		b = protoAppendTag(b, 1, protoLen)
+		ps := len(b)
+
+		var k []byte
+		k, i = w.d.String(i)
+
+		b = protoAppendBytes(b, 1, k)
+
+		b = protoAppendTag(b, 2, protoLen)
+		vs := len(b)
+
+		b, i = w.appendValue(b, i)
+
+		b = protoInsertLen(b, vs)
+		b = protoInsertLen(b, ps)
+	}
+
+	return b, i
+}
+
+// appendValue appends Value message content.
+func (w *Proto) appendValue(b []byte, st int) (_ []byte, i int) {
+	tag, sub, i := w.d.Tag(st)
+	if w.d.Err() != nil {
+		return b, i
+	}
+
+	switch tag {
+	case tlog.Int:
+		var v int64
+		v, i = w.d.Int(st)
+
+		b = protoAppendVarint(b, protoUint, uint64(v))
+	case tlog.Neg:
+		var v int64
+		v, i = w.d.Int(st)
+
+		b = protoAppendVarint(b, protoInt, protoZigzag(v))
+	case tlog.String, tlog.Bytes:
+		var s []byte
+		s, i = w.d.String(st)
+
+		f := protoString
+		if tag == tlog.Bytes {
+			f = protoBytes
+		}
+
+		b = protoAppendBytes(b, f, s)
+	case tlog.Array:
+		b = protoAppendTag(b, protoArray, protoLen)
+		as := len(b)
+
+		for el := 0; sub == -1 || el < sub; el++ {
+			if sub == -1 && w.d.Break(&i) {
+				break
+			}
+
+			b = protoAppendTag(b, 1, protoLen)
+			vs := len(b)
+
+			b, i = w.appendValue(b, i)
+
+			b = protoInsertLen(b, vs)
+		}
+
+		b = protoInsertLen(b, as)
+	case tlog.Map:
+		b = protoAppendTag(b, protoMap, protoLen)
+		ms := len(b)
+
+		b, i = w.appendPairs(b, sub, i)
+
+		b = protoInsertLen(b, ms)
+	case tlog.Special:
+		switch sub {
+		case tlog.False, tlog.True:
+			v := uint64(0)
+			if sub == tlog.True {
+				v = 1
+			}
+
+			b = protoAppendVarint(b, protoBool, v)
+		case tlog.Null, tlog.Undefined:
+			b = protoAppendTag(b, protoNull, protoLen)
+			b = append(b, 0)
+		case tlog.Float64, tlog.Float32, tlog.Float16, tlog.FloatInt8:
+			var f float64
+			f, i = w.d.Float(st)
+
+			b = protoAppendTag(b, protoFloat, protoFixed64)
+			b = protoAppendFixed64(b, math.Float64bits(f))
+		default:
+			i = w.d.Skip(st)
+		}
+	case tlog.Semantic:
+		b, i = w.appendSemantic(b, st, sub, i)
+	}
+
+	return b, i
+}
+
+func (w *Proto) appendSemantic(b []byte, st, sub, i int) (_ []byte, _ int) {
+	switch sub {
+	case tlog.WireID:
+		var id tlog.ID
+		id, i = w.d.ID(st)
+
+		return protoAppendBytes(b, protoID, id[:]), i
+	case tlog.WireTime:
+		var ts tlog.Timestamp
+		ts, i = w.d.Time(st)
+
+		b = protoAppendTag(b, protoTime, protoFixed64)
+
+		return protoAppendFixed64(b, uint64(ts)), i
+	case tlog.WireDuration:
+		var v int64
+		v, i = w.d.Int(i)
+
+		return protoAppendVarint(b, protoDuration, protoZigzag(v)), i
+	case tlog.WireLocation:
+		var pc loc.PC
+		pc, i = w.d.Location(st)
+
+		name, file, line := pc.NameFileLine()
+
+		b = protoAppendTag(b, protoLocation, protoLen)
+		ls := len(b)
+
+		b = protoAppendVarint(b, 1, uint64(pc))
+		b = protoAppendBytes(b, 2, []byte(name))
+		b = protoAppendBytes(b, 3, []byte(file))
+		b = protoAppendVarint(b, 4, uint64(line))
+
+		return protoInsertLen(b, ls), i
+	case tlog.WireLabels:
+		var lbs tlog.Labels
+		lbs, i = w.d.Labels(st)
+
+		b = protoAppendTag(b, protoLabels, protoLen)
+		ls := len(b)
+
+		for _, l := range lbs {
+			b = protoAppendBytes(b, 1, []byte(l))
+		}
+
+		return protoInsertLen(b, ls), i
+	case tlog.WireLogLevel:
+		var lv tlog.LogLevel
+		lv, i = w.d.LogLevel(st)
+
+		return protoAppendVarint(b, protoLogLevel, protoZigzag(int64(lv))), i
+	case tlog.WireMessage, tlog.WireError, tlog.WireEventType:
+		var s []byte
+		s, i = w.d.String(i)
+
+		f := protoMessage
+		switch sub {
+		case tlog.WireError:
+			f = protoError
+		case tlog.WireEventType:
+			f = protoEventType
+		}
+
+		return protoAppendBytes(b, f, s), i
+	case tlog.WireHex:
+		b = protoAppendTag(b, protoHex, protoLen)
+		vs := len(b)
+
+		b, i = w.appendValue(b, i)
+
+		return protoInsertLen(b, vs), i
+	default:
+		b = protoAppendTag(b, protoSemantic, protoLen)
+		ss := len(b)
+
+		b = protoAppendVarint(b, 1, uint64(sub))
+
+		b = protoAppendTag(b, 2, protoLen)
+		vs := len(b)
+
+		b, i = w.appendValue(b, i)
+
+		b = protoInsertLen(b, vs)
+
+		return protoInsertLen(b, ss), i
+	}
+}
+
+func NewProtoReader(r io.Reader) *ProtoReader {
+	return &ProtoReader{
+		MaxMessage: DefaultProtoMaxMessage,
+		r:          bufio.NewReader(r),
+	}
+}
+
+func (r *ProtoReader) Read(p []byte) (n int, err error) {
+	if r.i == len(r.b) {
+		r.b = r.b[:0]
+		r.i = 0
+
+		err = r.readEvent()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n = copy(p, r.b[r.i:])
+	r.i += n
+
+	return n, nil
+}
+
+func (r *ProtoReader) readEvent() (err error) {
+	l, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		}
+
+		return errors.Wrap(err, "read length")
+	}
+
+	if r.MaxMessage != 0 && l > uint64(r.MaxMessage) {
+		return errors.New("event too big: %d bytes", l)
+	}
+
+	if uint64(cap(r.msg)) < l {
+		r.msg = make([]byte, l)
+	}
+
+	r.msg = r.msg[:l]
+
+	_, err = io.ReadFull(r.r, r.msg)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return errors.Wrap(err, "read event")
+	}
+
+	r.b, err = r.appendPairs(r.b, r.msg)
+
+	return err
+}
+
+// appendPairs appends map of repeated Pair field 1 found in msg.
+func (r *ProtoReader) appendPairs(b, msg []byte) (_ []byte, err error) {
+	n, err := protoCount(msg, 1)
+	if err != nil {
+		return b, err
+	}
+
+	b = r.e.AppendTag(b, tlog.Map, n)
+
+	for i := 0; i < len(msg); {
+		f, _, _, pair, next, err := protoField(msg, i)
+		if err != nil {
+			return b, err
+		}
+
+		i = next
+
+		if f != 1 {
+			continue
+		}
+
+		var k, v []byte
+
+		for j := 0; j < len(pair); {
+			f, _, _, data, next, err := protoField(pair, j)
+			if err != nil {
+				return b, err
+			}
+
+			j = next
+
+			switch f {
+			case 1:
+				k = data
+			case 2:
+				v = data
+			}
+		}
+
+		b = r.e.AppendString(b, tlog.String, low.UnsafeBytesToString(k))
+
+		b, err = r.appendValue(b, v)
+		if err != nil {
+			return b, err
+		}
+	}
+
+	return b, nil
+}
+
+// appendValue converts Value message to tlog wire.
+func (r *ProtoReader) appendValue(b, msg []byte) (_ []byte, err error) {
+	if len(msg) == 0 {
+		return append(b, tlog.Special|tlog.Null), nil
+	}
+
+	f, _, x, data, _, err := protoField(msg, 0)
+	if err != nil {
+		return b, err
+	}
+
+	switch f {
+	case protoUint:
+		return r.e.AppendUint(b, tlog.Int, x), nil
+	case protoInt:
+		return r.e.AppendInt(b, protoUnzigzag(x)), nil
+	case protoFloat:
+		return r.e.AppendFloat(b, math.Float64frombits(x)), nil
+	case protoString:
+		return r.e.AppendString(b, tlog.String, low.UnsafeBytesToString(data)), nil
+	case protoBytes:
+		return r.e.AppendString(b, tlog.Bytes, low.UnsafeBytesToString(data)), nil
+	case protoBool:
+		if x != 0 {
+			return append(b, tlog.Special|tlog.True), nil
+		}
+
+		return append(b, tlog.Special|tlog.False), nil
+	case protoNull:
+		return append(b, tlog.Special|tlog.Null), nil
+	case protoArray:
+		n, err := protoCount(data, 1)
+		if err != nil {
+			return b, err
+		}
+
+		b = r.e.AppendTag(b, tlog.Array, n)
+
+		for i := 0; i < len(data); {
+			f, _, _, v, next, err := protoField(data, i)
+			if err != nil {
+				return b, err
+			}
+
+			i = next
+
+			if f != 1 {
+				continue
+			}
+
+			b, err = r.appendValue(b, v)
+			if err != nil {
+				return b, err
+			}
+		}
+
+		return b, nil
+	case protoMap:
+		return r.appendPairs(b, data)
+	case protoID:
+		var id tlog.ID
+		copy(id[:], data)
+
+		return r.e.AppendID(b, id), nil
+	case protoTime:
+		return r.e.AppendValue(b, tlog.Timestamp(x)), nil
+	case protoDuration:
+		return r.e.AppendValue(b, time.Duration(protoUnzigzag(x))), nil
+	case protoLocation:
+		return r.appendLocation(b, data)
+	case protoLabels:
+		var ls tlog.Labels
+
+		for i := 0; i < len(data); {
+			f, _, _, l, next, err := protoField(data, i)
+			if err != nil {
+				return b, err
+			}
+
+			i = next
+
+			if f == 1 {
+				ls = append(ls, string(l))
+			}
+		}
+
+		return r.e.AppendLabels(b, ls), nil
+	case protoLogLevel:
+		return r.e.AppendValue(b, tlog.LogLevel(protoUnzigzag(x))), nil
+	case protoHex:
+		b = append(b, tlog.Semantic|tlog.WireHex)
+
+		return r.appendValue(b, data)
+	case protoMessage, protoError, protoEventType:
+		sub := tlog.WireMessage
+		switch f {
+		case protoError:
+			sub = tlog.WireError
+		case protoEventType:
+			sub = tlog.WireEventType
+		}
+
+		b = r.e.AppendTag(b, tlog.Semantic, sub)
+
+		return r.e.AppendString(b, tlog.String, low.UnsafeBytesToString(data)), nil
+	case protoSemantic:
+		var code uint64
+		var v []byte
+
+		for i := 0; i < len(data); {
+			f, _, x, d, next, err := protoField(data, i)
+			if err != nil {
+				return b, err
+			}
+
+			i = next
+
+			switch f {
+			case 1:
+				code = x
+			case 2:
+				v = d
+			}
+		}
+
+		b = r.e.AppendTag(b, tlog.Semantic, int(code))
+
+		return r.appendValue(b, v)
+	default:
+		return b, errors.New("proto: unsupported value field %d", f)
+	}
+}
+
+// appendLocation writes full location so the stream is self-contained.
+func (r *ProtoReader) appendLocation(b, msg []byte) (_ []byte, err error) {
+	var pc uint64
+	var name, file []byte
+	var line uint64
+
+	for i := 0; i < len(msg); {
+		f, _, x, data, next, err := protoField(msg, i)
+		if err != nil {
+			return b, err
+		}
+
+		i = next
+
+		switch f {
+		case 1:
+			pc = x
+		case 2:
+			name = data
+		case 3:
+			file = data
+		case 4:
+			line = x
+		}
+	}
+
+	b = append(b, tlog.Semantic|tlog.WireLocation)
+	b = r.e.AppendTag(b, tlog.Map, 4)
+
+	b = r.e.AppendString(b, tlog.String, "p")
+	b = r.e.AppendUint(b, tlog.Int, pc)
+
+	b = r.e.AppendString(b, tlog.String, "n")
+	b = r.e.AppendString(b, tlog.String, low.UnsafeBytesToString(name))
+
+	b = r.e.AppendString(b, tlog.String, "f")
+	b = r.e.AppendString(b, tlog.String, low.UnsafeBytesToString(file))
+
+	b = r.e.AppendString(b, tlog.String, "l")
+	b = r.e.AppendInt(b, int64(line))
+
+	return b, nil
+}
+
+// protoField parses field at i.
+// x is the value for varint and fixed fields, data is the content for length-delimited.
+func protoField(p []byte, i int) (f, wt int, x uint64, data []byte, next int, err error) {
+	t, n := binary.Uvarint(p[i:])
+	if n <= 0 {
+		return 0, 0, 0, nil, i, errors.New("proto: bad field tag at %d", i)
+	}
+
+	i += n
+	f, wt = int(t>>3), int(t&7)
+
+	switch wt {
+	case protoVarint:
+		x, n = binary.Uvarint(p[i:])
+		if n <= 0 {
+			return 0, 0, 0, nil, i, errors.New("proto: bad varint at %d", i)
+		}
+
+		i += n
+	case protoFixed64:
+		if i+8 > len(p) {
+			return 0, 0, 0, nil, i, io.ErrUnexpectedEOF
+		}
+
+		x = binary.LittleEndian.Uint64(p[i:])
+		i += 8
+	case protoFixed32:
+		if i+4 > len(p) {
+			return 0, 0, 0, nil, i, io.ErrUnexpectedEOF
+		}
+
+		x = uint64(binary.LittleEndian.Uint32(p[i:]))
+		i += 4
+	case protoLen:
+		x, n = binary.Uvarint(p[i:])
+		if n <= 0 || uint64(len(p)-i-n) < x {
+			return 0, 0, 0, nil, i, errors.New("proto: bad length at %d", i)
+		}
+
+		i += n
+		data = p[i : i+int(x)]
+		i += int(x)
+	default:
+		return 0, 0, 0, nil, i, errors.New("proto: unsupported wire type %d", wt)
+	}
+
+	return f, wt, x, data, i, nil
+}
+
+// protoCount counts occurrences of field f in message p.
+func protoCount(p []byte, f int) (n int, err error) {
+	for i := 0; i < len(p); {
+		ff, _, _, _, next, err := protoField(p, i)
+		if err != nil {
+			return 0, err
+		}
+
+		if ff == f {
+			n++
+		}
+
+		i = next
+	}
+
+	return n, nil
+}
+
+func protoAppendTag(b []byte, f, wt int) []byte {
+	return protoAppendUvarint(b, uint64(f)<<3|uint64(wt))
+}
+
+func protoAppendVarint(b []byte, f int, v uint64) []byte {
+	b = protoAppendTag(b, f, protoVarint)
+
+	return protoAppendUvarint(b, v)
+}
+
+func protoAppendBytes(b []byte, f int, s []byte) []byte {
+	b = protoAppendTag(b, f, protoLen)
+	b = protoAppendUvarint(b, uint64(len(s)))
+
+	return append(b, s...)
+}
+
+func protoAppendFixed64(b []byte, v uint64) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24), byte(v>>32), byte(v>>40), byte(v>>48), byte(v>>56))
+}
+
+func protoAppendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(b, byte(v))
+}
+
+// protoInsertLen inserts length of b[st:] before it.
+func protoInsertLen(b []byte, st int) []byte {
+	n := len(b) - st
+
+	var buf [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(buf[:], uint64(n))
+
+	b = append(b, buf[:l]...)
+	copy(b[st+l:], b[st:st+n])
+	copy(b[st:], buf[:l])
+
+	return b
+}
+
+func protoZigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func protoUnzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
@@ -0,0 +1,110 @@
+package convert
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+func TestProtoWire(t *testing.T) {
+	var b low.Buf
+
+	e := tlog.Encoder{Writer: NewProtoWriter(&b)}
+
+	err := e.Encode(nil, []interface{}{"a", 1})
+	require.NoError(t, err)
+
+	// len, Event.pairs{key: "a", value: {uint: 1}}
+	assert.Equal(t, []byte{0x09, 0x0a, 0x07, 0x0a, 0x01, 'a', 0x12, 0x02, 0x08, 0x01}, []byte(b))
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	var raw, pb bytes.Buffer
+
+	e := tlog.Encoder{Writer: &raw, Labels: tlog.Labels{"a=b", "c"}}
+
+	for _, kvs := range [][]interface{}{
+		{
+			tlog.KeyTime, tlog.Timestamp(1608934093123456789),
+			tlog.KeySpan, tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+			tlog.KeyLocation, loc.Caller(0),
+			tlog.KeyEventType, tlog.EventType("s"),
+			tlog.KeyLogLevel, tlog.Debug,
+			tlog.KeyMessage, tlog.Message("message"),
+		},
+		{
+			"int", 5,
+			"neg", -5,
+			"float", 1.5,
+			"str", "string",
+			"bytes", []byte("bytes"),
+			"true", true,
+			"false", false,
+			"nil", nil,
+			"arr", []interface{}{1, "a", []int{2}},
+			"map", map[string]interface{}{"k": "v"},
+			"dur", time.Second,
+			"hex", tlog.Hex(255),
+			"err", errors.New("some error"),
+			tlog.KeyLogLevel, tlog.Error,
+		},
+	} {
+		err := e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+
+	src := append([]byte{}, raw.Bytes()...)
+
+	err := Copy(NewProtoWriter(&pb), tlog.NewReader(&raw))
+	require.NoError(t, err)
+
+	var exp, got low.Buf
+
+	_, err = NewJSONWriter(&exp).Write(src)
+	require.NoError(t, err)
+
+	err = Copy(NewJSONWriter(&got), NewProtoReader(&pb))
+	require.NoError(t, err)
+
+	assert.Equal(t, string(exp), string(got))
+}
+
+func TestProtoReaderCorrupted(t *testing.T) {
+	var pb low.Buf
+
+	e := tlog.Encoder{Writer: NewProtoWriter(&pb)}
+
+	err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("message"), "arr", []interface{}{1, "a"}, "map", map[string]interface{}{"k": 1.5}})
+	require.NoError(t, err)
+
+	for _, in := range [][]byte{
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, // 2^64-1 length
+		{0x80, 0x80, 0x80, 0x80, 0x10},                               // 4GiB
+		{0x09, 0x0a, 0x07},                                           // truncated
+		{0x03, 0xff, 0xff, 0xff},                                     // garbage
+		{0x04, 0x0a, 0x7f, 0x0a, 0x01},                               // pair length out of message
+	} {
+		err = Copy(NewJSONWriter(ioutil.Discard), NewProtoReader(bytes.NewReader(in)))
+		assert.Error(t, err, "%x", in)
+	}
+
+	for i := 1; i < len(pb); i++ {
+		err = Copy(NewJSONWriter(ioutil.Discard), NewProtoReader(bytes.NewReader(pb[:i])))
+		assert.Error(t, err, "truncated at %d", i)
+	}
+
+	r := NewProtoReader(bytes.NewReader(pb))
+	r.MaxMessage = 10
+
+	err = Copy(NewJSONWriter(ioutil.Discard), r)
+	assert.Error(t, err)
+}
@@ -0,0 +1,280 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// spanTree collects spans from "s" and "f" events and messages logged inside them.
+	// It's a base for trace exporters which need the whole span at once.
+	spanTree struct {
+		// ServiceLabel is the label used as service name.
+		// If there is no such label all labels are joined.
+		ServiceLabel string
+
+		spans []*span
+		byID  map[tlog.ID]*span
+		ls    tlog.Labels
+
+		ev tlog.Event
+		j  JSON
+	}
+
+	span struct {
+		ID     tlog.ID
+		Parent tlog.ID
+		Trace  tlog.ID
+
+		Name     string
+		Start    tlog.Timestamp
+		Duration time.Duration
+		Finished bool
+
+		Service string
+		Labels  tlog.Labels
+
+		Tags []spanKV
+		Logs []spanLog
+	}
+
+	spanKV struct {
+		Key   string
+		Type  string // string, bool, int64, float64
+		Value interface{}
+		Text  string
+	}
+
+	spanLog struct {
+		Time    tlog.Timestamp
+		Message string
+		Level   tlog.LogLevel
+		KVs     []spanKV
+	}
+)
+
+const DefaultServiceLabel = "service"
+
+func newSpanTree() spanTree {
+	return spanTree{
+		ServiceLabel: DefaultServiceLabel,
+		byID:         make(map[tlog.ID]*span),
+		j: JSON{
+			JSONOptions: JSONOptions{
+				TimeFormat:   time.RFC3339Nano,
+				TimeZone:     time.UTC,
+				LabelsObject: true,
+				LevelText:    true,
+				HexIDs:       true,
+			},
+		},
+	}
+}
+
+func (t *spanTree) write(p []byte) (n int, err error) {
+	for i := 0; i < len(p); {
+		n, err = t.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		t.add(&t.ev)
+	}
+
+	return len(p), nil
+}
+
+func (t *spanTree) add(ev *tlog.Event) {
+	if ev.Labels != nil {
+		t.ls = ev.Labels
+	}
+
+	switch ev.Type {
+	case "s":
+		s := &span{
+			ID:      ev.Span,
+			Parent:  ev.Parent,
+			Name:    string(ev.Message),
+			Start:   ev.Time,
+			Service: t.service(t.ls),
+			Labels:  t.ls,
+			Tags:    t.kvs(nil, ev),
+		}
+
+		t.spans = append(t.spans, s)
+		t.byID[s.ID] = s
+	case "f":
+		s, ok := t.byID[ev.Span]
+		if !ok {
+			return
+		}
+
+		s.Duration = ev.Elapsed
+		s.Finished = true
+		s.Tags = t.kvs(s.Tags, ev)
+	case "":
+		s, ok := t.byID[ev.Span]
+		if !ok || len(ev.Message) == 0 {
+			return
+		}
+
+		s.Logs = append(s.Logs, spanLog{
+			Time:    ev.Time,
+			Message: string(ev.Message),
+			Level:   ev.Level,
+			KVs:     t.kvs(nil, ev),
+		})
+	}
+}
+
+// finish assigns trace ids and sorts spans by start time.
+//
+// Trace id is the root span id or its parent id if the parent is not known.
+// Spans looped by parent ids are given the least id in the loop.
+func (t *spanTree) finish() {
+	var path []*span
+	seen := map[tlog.ID]int{}
+
+	for _, s := range t.spans {
+		path = append(path[:0], s)
+
+		for id := range seen {
+			delete(seen, id)
+		}
+
+		seen[s.ID] = 0
+
+		r := s
+		loop := -1
+
+		for {
+			p, ok := t.byID[r.Parent]
+			if !ok {
+				break
+			}
+
+			if i, ok := seen[p.ID]; ok {
+				loop = i
+				break
+			}
+
+			seen[p.ID] = len(path)
+			path = append(path, p)
+
+			r = p
+		}
+
+		switch {
+		case loop != -1:
+			s.Trace = path[loop].ID
+
+			for _, p := range path[loop:] {
+				if bytes.Compare(p.ID[:], s.Trace[:]) < 0 {
+					s.Trace = p.ID
+				}
+			}
+		case r.Parent != (tlog.ID{}):
+			s.Trace = r.Parent
+		default:
+			s.Trace = r.ID
+		}
+	}
+
+	sort.SliceStable(t.spans, func(i, j int) bool {
+		return t.spans[i].Start < t.spans[j].Start
+	})
+}
+
+func (t *spanTree) service(ls tlog.Labels) string {
+	if v, ok := ls.Lookup(t.ServiceLabel); ok && v != "" {
+		return v
+	}
+
+	if len(ls) == 0 {
+		return "unknown"
+	}
+
+	return strings.Join(ls, ",")
+}
+
+// kvs appends not predefined event pairs.
+func (t *spanTree) kvs(kvs []spanKV, ev *tlog.Event) []spanKV {
+	for i := 0; i < ev.Len(); i++ {
+		k := ev.Key(i)
+		if traceSkipKey(k) {
+			continue
+		}
+
+		kvs = append(kvs, t.value(string(k), ev.RawValue(i)))
+	}
+
+	return kvs
+}
+
+func (t *spanTree) value(k string, raw []byte) (kv spanKV) {
+	kv.Key = k
+
+	d := &t.j.d
+	d.ResetBytes(raw)
+
+	tag, sub, _ := d.Tag(0)
+
+	switch {
+	case tag == tlog.Int || tag == tlog.Neg:
+		x, _ := d.Int(0)
+		kv.Type, kv.Value, kv.Text = "int64", x, strconv.FormatInt(x, 10)
+
+		return
+	case tag == tlog.String:
+		s, _ := d.String(0)
+		kv.Type, kv.Value, kv.Text = "string", string(s), string(s)
+
+		return
+	case tag == tlog.Special && (sub == tlog.True || sub == tlog.False):
+		kv.Type, kv.Value, kv.Text = "bool", sub == tlog.True, strconv.FormatBool(sub == tlog.True)
+
+		return
+	case tag == tlog.Special && sub >= tlog.FloatInt8 && sub <= tlog.Float64:
+		f, _ := d.Float(0)
+		kv.Type, kv.Value, kv.Text = "float64", f, strconv.FormatFloat(f, 'f', -1, 64)
+
+		return
+	case tag == tlog.Semantic && sub == tlog.WireDuration:
+		_, _, i := d.Tag(0)
+		x, _ := d.Int(i)
+		s := time.Duration(x).String()
+		kv.Type, kv.Value, kv.Text = "string", s, s
+
+		return
+	}
+
+	var b low.Buf
+	b, _ = t.j.appendValue(b, 0)
+
+	s := string(b)
+	if q, err := strconv.Unquote(s); err == nil {
+		s = q
+	}
+
+	kv.Type, kv.Value, kv.Text = "string", s, s
+
+	return
+}
+
+// hexID formats first n bytes of id.
+func hexID(id tlog.ID, n int) string {
+	return hex.EncodeToString(id[:n])
+}
+
+func micros(ts int64) int64 {
+	return ts / 1e3
+}
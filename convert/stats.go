@@ -0,0 +1,677 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/filter"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Stats aggregates events and writes the result as a table or json lines on Close.
+	//
+	// Events matching Where are grouped by time Bucket and GroupBy keys
+	// (keys are the same as in filter expressions: m, level, L.<name>, loc, kv names, ...).
+	//
+	// If Spans is set only finished spans are aggregated: the finish event is joined
+	// with the span start event, so the record has start message, time and kvs,
+	// finish kvs and elapsed time.
+	// Up to MaxSpans started spans are waiting for their finish, the earliest is dropped
+	// when the limit is reached, so spans which never finish don't pile up.
+	// Finish of a dropped span is aggregated alone.
+	//
+	// Values are kept in memory to compute exact quantiles.
+	Stats struct {
+		io.Writer
+
+		Where   *filter.Filter
+		GroupBy []string
+		Bucket  time.Duration
+		Aggs    []Agg
+
+		Spans    bool
+		MaxSpans int
+		JSON     bool
+
+		groups map[string]*statsGroup
+		starts map[tlog.ID]*tlog.Event
+		order  []tlog.ID // starts in order, finished spans are removed lazily
+
+		ev tlog.Event
+		ls tlog.Labels
+		e  tlog.Encoder
+		b  low.Buf
+		k  []byte
+	}
+
+	// Agg is an aggregate function.
+	//
+	// Func is one of count, sum, min, max, avg or pNN (percentile: p50, p99, p99.9).
+	// Key is the value key, it's empty for count.
+	// Where is set for conditional count(<filter>) and ratio(<filter>) (matching events share).
+	Agg struct {
+		Name  string
+		Func  string
+		Key   string
+		Q     float64
+		Where *filter.Filter
+	}
+
+	statsGroup struct {
+		bucket time.Time
+		keys   []string
+		aggs   []statsAgg
+	}
+
+	statsAgg struct {
+		n    int
+		hit  int
+		sum  float64
+		min  float64
+		max  float64
+		vals []float64
+		dur  bool
+		num  bool
+	}
+)
+
+// NewStatsWriter creates Stats writer. Default aggregate is count.
+func NewStatsWriter(w io.Writer) *Stats {
+	return &Stats{
+		Writer:   w,
+		MaxSpans: 100000,
+	}
+}
+
+// ParseAggs parses comma separated aggregates: count,p99(e),avg(bytes),ratio(level>=error).
+func ParseAggs(s string) (aggs []Agg, err error) {
+	for _, a := range splitAggs(s) {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		x, err := ParseAgg(a)
+		if err != nil {
+			return nil, err
+		}
+
+		aggs = append(aggs, x)
+	}
+
+	return aggs, nil
+}
+
+// ParseAgg parses aggregate: count, count(<filter>), ratio(<filter>), sum(key), min(key), max(key), avg(key), pNN(key).
+func ParseAgg(s string) (a Agg, err error) {
+	a.Name = s
+	a.Func = s
+
+	if p := strings.IndexByte(s, '('); p != -1 {
+		if !strings.HasSuffix(s, ")") {
+			return a, errors.New("bad aggregate: %v", s)
+		}
+
+		a.Func, a.Key = s[:p], s[p+1:len(s)-1]
+	}
+
+	switch {
+	case a.Func == "count" && a.Key == "":
+		return a, nil
+	case a.Func == "count" || a.Func == "ratio":
+		a.Where, err = filter.Parse(a.Key)
+		if err != nil {
+			return a, errors.Wrap(err, "%v", s)
+		}
+
+		a.Key = ""
+
+		return a, nil
+	case a.Func == "sum", a.Func == "min", a.Func == "max", a.Func == "avg":
+	case strings.HasPrefix(a.Func, "p"):
+		a.Q, err = strconv.ParseFloat(a.Func[1:], 64)
+		if err != nil || a.Q < 0 || a.Q > 100 {
+			return a, errors.New("bad percentile: %v", s)
+		}
+
+		a.Q /= 100
+	default:
+		return a, errors.New("unsupported aggregate: %v", s)
+	}
+
+	if a.Key == "" {
+		return a, errors.New("%v: key expected", s)
+	}
+
+	return a, nil
+}
+
+func (w *Stats) Write(p []byte) (n int, err error) {
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		if w.ev.Labels != nil {
+			w.ls = w.ev.Labels
+		} else {
+			w.ev.Labels = w.ls
+		}
+
+		err = w.add(&w.ev)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *Stats) add(ev *tlog.Event) (err error) {
+	if ev.IsHeader() {
+		return nil // labels header
+	}
+
+	if w.Spans {
+		switch ev.Type {
+		case "s":
+			w.start(ev)
+
+			return nil
+		case "f":
+			ev, err = w.join(ev)
+			if err != nil {
+				return errors.Wrap(err, "join span")
+			}
+		default:
+			return nil
+		}
+	}
+
+	if !w.Where.Match(ev) {
+		return nil
+	}
+
+	g := w.group(ev)
+
+	aggs := w.aggs()
+
+	for i, a := range aggs {
+		x := &g.aggs[i]
+
+		switch {
+		case a.Where != nil:
+			x.n++
+
+			if a.Where.Match(ev) {
+				x.hit++
+			}
+
+			continue
+		case a.Key == "":
+			x.n++
+
+			continue
+		}
+
+		v, ok := filter.Lookup(ev, a.Key)
+		if !ok {
+			continue
+		}
+
+		f, dur, ok := number(v)
+		if !ok {
+			continue
+		}
+
+		if x.n == 0 || f < x.min {
+			x.min = f
+		}
+
+		if x.n == 0 || f > x.max {
+			x.max = f
+		}
+
+		x.n++
+		x.sum += f
+		x.dur = dur
+		x.num = true
+
+		if strings.HasPrefix(a.Func, "p") {
+			x.vals = append(x.vals, f)
+		}
+	}
+
+	return nil
+}
+
+func (w *Stats) start(ev *tlog.Event) {
+	if w.starts == nil {
+		w.starts = make(map[tlog.ID]*tlog.Event)
+	}
+
+	if w.MaxSpans > 0 && len(w.starts) >= w.MaxSpans {
+		w.evictSpan()
+	}
+
+	w.starts[ev.Span] = ev.Clone()
+	w.order = append(w.order, ev.Span)
+
+	if len(w.order) > 2*len(w.starts)+64 {
+		q := w.order[:0]
+
+		for _, id := range w.order {
+			if _, ok := w.starts[id]; ok {
+				q = append(q, id)
+			}
+		}
+
+		w.order = q
+	}
+}
+
+// evictSpan drops the earliest started span.
+func (w *Stats) evictSpan() {
+	for len(w.order) != 0 {
+		id := w.order[0]
+		w.order = w.order[1:]
+
+		if _, ok := w.starts[id]; ok {
+			delete(w.starts, id)
+			return
+		}
+	}
+}
+
+// join makes an event from span start and finish events.
+func (w *Stats) join(fin *tlog.Event) (*tlog.Event, error) {
+	st := w.starts[fin.Span]
+	delete(w.starts, fin.Span)
+
+	if st == nil {
+		return fin, nil
+	}
+
+	b := w.b[:0]
+
+	b = w.e.AppendTag(b, tlog.Map, 5+st.Len()+fin.Len())
+
+	for _, kv := range []struct {
+		k string
+		v interface{}
+	}{
+		{tlog.KeyTime, st.Time},
+		{tlog.KeySpan, st.Span},
+		{tlog.KeyEventType, tlog.EventType("f")},
+		{tlog.KeyMessage, tlog.Message(st.Message)},
+		{tlog.KeyElapsed, fin.Elapsed},
+	} {
+		b = w.e.AppendString(b, tlog.String, kv.k)
+		b = w.e.AppendValue(b, kv.v)
+	}
+
+	for _, ev := range []*tlog.Event{st, fin} {
+		for i := 0; i < ev.Len(); i++ {
+			b = w.e.AppendString(b, tlog.String, string(ev.Key(i)))
+			b = append(b, ev.RawValue(i)...)
+		}
+	}
+
+	w.b = b
+
+	var ev tlog.Event
+
+	_, err := ev.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	ev.Parent = st.Parent
+	ev.Level = st.Level
+	ev.Location = st.Location
+	ev.Labels = st.Labels
+
+	return &ev, nil
+}
+
+func (w *Stats) aggs() []Agg {
+	if len(w.Aggs) == 0 {
+		return []Agg{{Name: "count", Func: "count"}}
+	}
+
+	return w.Aggs
+}
+
+func (w *Stats) group(ev *tlog.Event) *statsGroup {
+	var bucket time.Time
+
+	if w.Bucket != 0 && ev.Time != 0 {
+		bucket = ev.Time.Time().Truncate(w.Bucket)
+	}
+
+	k := w.k[:0]
+	k = strconv.AppendInt(k, bucket.UnixNano(), 10)
+
+	keys := make([]string, len(w.GroupBy))
+
+	for i, key := range w.GroupBy {
+		if v, ok := filter.Lookup(ev, key); ok {
+			keys[i] = filter.Format(v)
+		}
+
+		k = append(k, 0)
+		k = append(k, keys[i]...)
+	}
+
+	w.k = k
+
+	g, ok := w.groups[string(k)]
+	if ok {
+		return g
+	}
+
+	if w.groups == nil {
+		w.groups = make(map[string]*statsGroup)
+	}
+
+	g = &statsGroup{
+		bucket: bucket,
+		keys:   keys,
+		aggs:   make([]statsAgg, len(w.aggs())),
+	}
+
+	w.groups[string(k)] = g
+
+	return g
+}
+
+// Close writes the result. It doesn't close the underlying writer.
+func (w *Stats) Close() (err error) {
+	gs := make([]*statsGroup, 0, len(w.groups))
+
+	for _, g := range w.groups {
+		gs = append(gs, g)
+	}
+
+	sort.Slice(gs, func(i, j int) bool {
+		if !gs[i].bucket.Equal(gs[j].bucket) {
+			return gs[i].bucket.Before(gs[j].bucket)
+		}
+
+		for k := range gs[i].keys {
+			if gs[i].keys[k] != gs[j].keys[k] {
+				return gs[i].keys[k] < gs[j].keys[k]
+			}
+		}
+
+		return false
+	})
+
+	var b []byte
+
+	if w.JSON {
+		b, err = w.appendJSON(b, gs)
+	} else {
+		b = w.appendTable(b, gs)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Writer.Write(b)
+
+	return err
+}
+
+func (w *Stats) columns() (cols []string) {
+	if w.Bucket != 0 {
+		cols = append(cols, "time")
+	}
+
+	cols = append(cols, w.GroupBy...)
+
+	for _, a := range w.aggs() {
+		cols = append(cols, a.Name)
+	}
+
+	return cols
+}
+
+func (w *Stats) appendTable(b []byte, gs []*statsGroup) []byte {
+	rows := [][]string{w.columns()}
+
+	for _, g := range gs {
+		var row []string
+
+		if w.Bucket != 0 {
+			if g.bucket.IsZero() {
+				row = append(row, "-")
+			} else {
+				row = append(row, g.bucket.UTC().Format(time.RFC3339))
+			}
+		}
+
+		row = append(row, g.keys...)
+
+		for i, a := range w.aggs() {
+			v := g.aggs[i].value(a)
+
+			switch v := v.(type) {
+			case nil:
+				row = append(row, "-")
+			case time.Duration:
+				row = append(row, roundDuration(v).String())
+			case float64:
+				row = append(row, strconv.FormatFloat(v, 'f', -1, 64))
+			default:
+				row = append(row, filter.Format(v))
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	width := make([]int, len(rows[0]))
+
+	for _, row := range rows {
+		for i, c := range row {
+			if l := utf8.RuneCountInString(c); l > width[i] {
+				width[i] = l
+			}
+		}
+	}
+
+	aggs := len(w.aggs())
+
+	for _, row := range rows {
+		for i, c := range row {
+			if i != 0 {
+				b = append(b, "  "...)
+			}
+
+			if i >= len(row)-aggs {
+				b = appendPad(b, c, width[i]) // numbers are right aligned
+				continue
+			}
+
+			b = append(b, c...)
+
+			if i != len(row)-1 {
+				for j := utf8.RuneCountInString(c); j < width[i]; j++ {
+					b = append(b, ' ')
+				}
+			}
+		}
+
+		b = append(b, '\n')
+	}
+
+	return b
+}
+
+func (w *Stats) appendJSON(b []byte, gs []*statsGroup) (_ []byte, err error) {
+	cols := w.columns()
+
+	for _, g := range gs {
+		row := make(map[string]interface{}, len(cols))
+		c := 0
+
+		if w.Bucket != 0 {
+			if !g.bucket.IsZero() {
+				row[cols[c]] = g.bucket.UTC().Format(time.RFC3339Nano)
+			}
+
+			c++
+		}
+
+		for _, k := range g.keys {
+			row[cols[c]] = k
+			c++
+		}
+
+		for i, a := range w.aggs() {
+			v := g.aggs[i].value(a)
+
+			if d, ok := v.(time.Duration); ok {
+				v = int64(d)
+			}
+
+			row[cols[c]] = v
+			c++
+		}
+
+		data, err := json.Marshal(row)
+		if err != nil {
+			return b, errors.Wrap(err, "marshal")
+		}
+
+		b = append(b, data...)
+		b = append(b, '\n')
+	}
+
+	return b, nil
+}
+
+// value returns aggregate result: int for counts, float64 or time.Duration for values, nil if there were no values.
+func (x *statsAgg) value(a Agg) interface{} {
+	switch {
+	case a.Where != nil && a.Func == "ratio":
+		if x.n == 0 {
+			return nil
+		}
+
+		return float64(x.hit) / float64(x.n)
+	case a.Where != nil:
+		return x.hit
+	case a.Key == "":
+		return x.n
+	case !x.num:
+		return nil
+	}
+
+	var v float64
+
+	switch a.Func {
+	case "sum":
+		v = x.sum
+	case "min":
+		v = x.min
+	case "max":
+		v = x.max
+	case "avg":
+		v = x.sum / float64(x.n)
+	default:
+		sort.Float64s(x.vals)
+
+		v = quantile(x.vals, a.Q)
+	}
+
+	if x.dur {
+		return time.Duration(math.Round(v))
+	}
+
+	return v
+}
+
+// quantile is the nearest-rank quantile of sorted values.
+func quantile(vals []float64, q float64) float64 {
+	if len(vals) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(q*float64(len(vals)))) - 1
+
+	switch {
+	case i < 0:
+		i = 0
+	case i >= len(vals):
+		i = len(vals) - 1
+	}
+
+	return vals[i]
+}
+
+func number(v interface{}) (f float64, dur, ok bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), false, true
+	case uint64:
+		return float64(x), false, true
+	case float64:
+		return x, false, true
+	case tlog.Hex:
+		return float64(x), false, true
+	case time.Duration:
+		return float64(x), true, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		if err == nil {
+			return f, false, true
+		}
+
+		d, err := time.ParseDuration(x)
+		if err == nil {
+			return float64(d), true, true
+		}
+	}
+
+	return 0, false, false
+}
+
+// splitAggs splits by commas outside of parentheses and quotes.
+func splitAggs(s string) (r []string) {
+	depth, q, st := 0, false, 0
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case q && c == '\\':
+			i++
+		case c == '"':
+			q = !q
+		case q:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			r = append(r, s[st:i])
+			st = i + 1
+		}
+	}
+
+	return append(r, s[st:])
+}
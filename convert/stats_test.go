@@ -0,0 +1,176 @@
+package convert
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/filter"
+	"github.com/nikandfor/tlog/low"
+)
+
+func writeRequests(t *testing.T, w *Stats) {
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"service=api"}}
+
+	ts := func(s int) tlog.Timestamp { return tlog.Timestamp(time.Date(2020, 12, 25, 10, 0, s, 0, time.UTC).UnixNano()) }
+
+	for i := 0; i < 10; i++ {
+		id := tlog.ID{byte(i + 1)}
+
+		path := "/a"
+		if i%2 == 1 {
+			path = "/b"
+		}
+
+		kvs := [][]interface{}{
+			{tlog.KeySpan, id, tlog.KeyTime, ts(i * 10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("http_request"), "path", path},
+			{tlog.KeySpan, id, tlog.KeyTime, ts(i*10 + 1), tlog.KeyMessage, tlog.Message("handled")},
+		}
+
+		if i%5 == 0 {
+			kvs = append(kvs, []interface{}{tlog.KeySpan, id, tlog.KeyTime, ts(i*10 + 2), tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("failed")})
+		}
+
+		kvs = append(kvs, []interface{}{tlog.KeySpan, id, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, time.Duration(i+1) * time.Millisecond, "status", 200})
+
+		for _, kv := range kvs {
+			err := e.Encode(nil, kv)
+			require.NoError(t, err)
+		}
+	}
+}
+
+func TestStatsCount(t *testing.T) {
+	var b low.Buf
+
+	w := NewStatsWriter(&b)
+	w.GroupBy = []string{"m"}
+	w.Where = filter.MustParse("!T")
+
+	writeRequests(t, w)
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, `m        count
+failed       2
+handled     10
+`, string(b))
+}
+
+func TestStatsSpans(t *testing.T) {
+	var b low.Buf
+
+	aggs, err := ParseAggs("count,p50(e),p99(e),max(e),avg(status)")
+	require.NoError(t, err)
+
+	w := NewStatsWriter(&b)
+	w.Spans = true
+	w.Where = filter.MustParse("m=http_request")
+	w.GroupBy = []string{"path", "L.service"}
+	w.Aggs = aggs
+
+	writeRequests(t, w)
+
+	err = w.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, `path  L.service  count  p50(e)  p99(e)  max(e)  avg(status)
+/a    api            5     5ms     9ms     9ms          200
+/b    api            5     6ms    10ms    10ms          200
+`, string(b))
+}
+
+func TestStatsMaxSpans(t *testing.T) {
+	var b low.Buf
+
+	w := NewStatsWriter(&b)
+	w.Spans = true
+	w.MaxSpans = 2
+	w.Where = filter.MustParse("m=req")
+	w.GroupBy = []string{"m"}
+
+	e := tlog.Encoder{Writer: w}
+
+	// spans which never finish
+	for i := 0; i < 100; i++ {
+		err := e.Encode(nil, []interface{}{tlog.KeySpan, tlog.ID{0xff, byte(i)}, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("lost")})
+		require.NoError(t, err)
+
+		assert.LessOrEqual(t, len(w.starts), 2)
+		assert.LessOrEqual(t, len(w.order), 2*2+64)
+	}
+
+	for _, id := range []byte{1, 2, 3} {
+		err := e.Encode(nil, []interface{}{tlog.KeySpan, tlog.ID{id}, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("req")})
+		require.NoError(t, err)
+	}
+
+	// the first start is dropped
+	for _, id := range []byte{1, 2, 3} {
+		err := e.Encode(nil, []interface{}{tlog.KeySpan, tlog.ID{id}, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, time.Millisecond})
+		require.NoError(t, err)
+	}
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, `m    count
+req      2
+`, string(b))
+}
+
+func TestStatsBucketJSON(t *testing.T) {
+	var b low.Buf
+
+	aggs, err := ParseAggs("count,count(level>=error),ratio(level>=error)")
+	require.NoError(t, err)
+
+	w := NewStatsWriter(&b)
+	w.Where = filter.MustParse("m")
+	w.Bucket = time.Minute
+	w.Aggs = aggs
+	w.JSON = true
+
+	writeRequests(t, w)
+
+	err = w.Close()
+	require.NoError(t, err)
+
+	var rows []map[string]interface{}
+
+	for _, l := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var r map[string]interface{}
+
+		err = json.Unmarshal([]byte(l), &r)
+		require.NoError(t, err, "%s", l)
+
+		rows = append(rows, r)
+	}
+
+	assert.Equal(t, []map[string]interface{}{
+		{"time": "2020-12-25T10:00:00Z", "count": 14.0, "count(level>=error)": 2.0, "ratio(level>=error)": 2.0 / 14},
+		{"time": "2020-12-25T10:01:00Z", "count": 8.0, "count(level>=error)": 0.0, "ratio(level>=error)": 0.0},
+	}, rows)
+}
+
+func TestParseAggs(t *testing.T) {
+	aggs, err := ParseAggs(`count, p99.9(e), ratio(m~"a,b" || (level>=warn))`)
+	require.NoError(t, err)
+
+	if assert.Len(t, aggs, 3) {
+		assert.Equal(t, "p99.9(e)", aggs[1].Name)
+		assert.InDelta(t, 0.999, aggs[1].Q, 1e-9)
+		assert.NotNil(t, aggs[2].Where)
+	}
+
+	for _, s := range []string{"sum", "median(e)", "p101(e)", "count(a=", "avg(e"} {
+		_, err = ParseAggs(s)
+		assert.Error(t, err, "agg: %v", s)
+	}
+}
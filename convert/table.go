@@ -0,0 +1,518 @@
+package convert
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Table writes events as CSV (or TSV) rows.
+	//
+	// Columns are Fields if set. Otherwise the first Discover events are kept
+	// and columns are discovered from them in the order of appearance.
+	// After that rows are streamed and keys not seen in the first events are dropped.
+	// Nested maps are flattened into dotted columns (a.b), arrays are written as JSON.
+	// Semantic values are formatted: time with TimeFormat, ids in hex, levels by name,
+	// locations as file:line and labels comma separated.
+	//
+	// If Open is set events are split into tables by TableName and each table
+	// is written to its own writer with its own columns.
+	Table struct {
+		io.Writer
+
+		Comma rune
+
+		// Fields are column names. Predefined keys may be referred by their long names (see DefaultLogfmtKeys).
+		Fields []string
+
+		// Discover is the number of events columns are discovered from if Fields are not set.
+		// Default is DefaultTableDiscover. Negative value means all events are kept until Close.
+		Discover int
+
+		NoHeader bool
+
+		TimeFormat string
+		TimeZone   *time.Location
+
+		// TableName returns the table name for the event. Default is DefaultTableName.
+		TableName func(ev *tlog.Event, span string) string
+
+		// Open opens writer for the table. It's closed on Close if it's io.Closer.
+		Open func(name string) (io.Writer, error)
+
+		tables map[string]*table
+		order  []string
+
+		spans map[tlog.ID]string
+
+		ev  tlog.Event
+		d   tlog.Decoder
+		raw []byte
+		j   JSON
+		b   low.Buf
+
+		key  []byte
+		row  map[string]string
+		keys []string
+	}
+
+	table struct {
+		w    io.Writer
+		csv  *csv.Writer
+		cols []string
+		colm map[string]int // event key -> column
+		rows []map[string]string
+		head bool
+		done bool // columns are known
+	}
+)
+
+// DefaultTableDiscover is the default Table.Discover.
+var DefaultTableDiscover = 100
+
+// NewCSVWriter creates CSV Table writer with discovered columns.
+func NewCSVWriter(w io.Writer) *Table {
+	return &Table{
+		Writer:     w,
+		Comma:      ',',
+		TimeFormat: time.RFC3339Nano,
+		TimeZone:   time.UTC,
+	}
+}
+
+// NewTSVWriter creates tab separated Table writer with discovered columns.
+func NewTSVWriter(w io.Writer) *Table {
+	t := NewCSVWriter(w)
+	t.Comma = '\t'
+
+	return t
+}
+
+// DefaultTableName puts span events (start, finish and messages inside the span) into the table named after the span.
+// Other events go to "messages" table.
+func DefaultTableName(ev *tlog.Event, span string) string {
+	if span != "" {
+		return span
+	}
+
+	return "messages"
+}
+
+func (w *Table) Write(p []byte) (n int, err error) {
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		err = w.add(&w.ev)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close writes pending rows and closes table writers opened by Open.
+// It doesn't close the underlying Writer.
+func (w *Table) Close() (err error) {
+	for _, name := range w.order {
+		t := w.tables[name]
+
+		if e := w.flushRows(t); err == nil {
+			err = e
+		}
+
+		if w.Open == nil {
+			continue
+		}
+
+		if c, ok := t.w.(io.Closer); ok {
+			if e := c.Close(); err == nil {
+				err = e
+			}
+		}
+	}
+
+	return err
+}
+
+func (w *Table) add(ev *tlog.Event) (err error) {
+	if w.row == nil {
+		w.row = map[string]string{}
+		w.tables = map[string]*table{}
+		w.spans = map[tlog.ID]string{}
+	}
+
+	if ev.IsHeader() {
+		return nil // labels header
+	}
+
+	var span string
+
+	if ev.Span != (tlog.ID{}) {
+		if ev.Type == "s" {
+			w.spans[ev.Span] = string(ev.Message)
+		}
+
+		span = w.spans[ev.Span]
+
+		if ev.Type == "f" {
+			delete(w.spans, ev.Span)
+		}
+	}
+
+	name := ""
+	if w.Open != nil {
+		tn := w.TableName
+		if tn == nil {
+			tn = DefaultTableName
+		}
+
+		name = tn(ev, span)
+	}
+
+	t, err := w.table(name)
+	if err != nil {
+		return errors.Wrap(err, "table %v", name)
+	}
+
+	row := w.row
+	for k := range row {
+		delete(row, k)
+	}
+
+	w.keys = w.keys[:0]
+
+	err = w.fill(row, ev)
+	if err != nil {
+		return err
+	}
+
+	if t.done {
+		return w.writeRow(t, row)
+	}
+
+	for _, k := range w.keys {
+		if _, ok := t.colm[k]; !ok {
+			t.colm[k] = len(t.cols)
+			t.cols = append(t.cols, k)
+		}
+	}
+
+	cp := make(map[string]string, len(row))
+	for k, v := range row {
+		cp[k] = v
+	}
+
+	t.rows = append(t.rows, cp)
+
+	n := w.Discover
+	if n == 0 {
+		n = DefaultTableDiscover
+	}
+
+	if n < 0 || len(t.rows) < n {
+		return nil
+	}
+
+	return w.flushRows(t)
+}
+
+// flushRows writes kept rows and fixes the columns.
+func (w *Table) flushRows(t *table) (err error) {
+	t.done = true
+
+	for _, r := range t.rows {
+		if e := w.writeRow(t, r); err == nil {
+			err = e
+		}
+	}
+
+	t.rows = nil
+
+	if t.csv != nil {
+		t.csv.Flush()
+
+		if e := t.csv.Error(); err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (w *Table) table(name string) (t *table, err error) {
+	t, ok := w.tables[name]
+	if ok {
+		return t, nil
+	}
+
+	t = &table{
+		w:    w.Writer,
+		colm: map[string]int{},
+	}
+
+	if w.Open != nil {
+		t.w, err = w.Open(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, f := range w.Fields {
+		t.colm[tableKey(f)] = i
+	}
+
+	t.cols = w.Fields
+	t.done = len(w.Fields) != 0
+
+	w.tables[name] = t
+	w.order = append(w.order, name)
+
+	return t, nil
+}
+
+func (w *Table) writeRow(t *table, row map[string]string) error {
+	if t.csv == nil {
+		t.csv = csv.NewWriter(t.w)
+
+		if w.Comma != 0 {
+			t.csv.Comma = w.Comma
+		}
+	}
+
+	if !t.head && !w.NoHeader {
+		t.head = true
+
+		head := t.cols
+
+		if len(w.Fields) == 0 {
+			head = make([]string, len(t.cols))
+
+			for i, k := range t.cols {
+				head[i] = k
+
+				if n, ok := DefaultLogfmtKeys[k]; ok {
+					head[i] = n
+				}
+			}
+		}
+
+		err := t.csv.Write(head)
+		if err != nil {
+			return err
+		}
+	}
+
+	rec := make([]string, len(t.cols))
+
+	for k, v := range row {
+		if i, ok := t.colm[k]; ok {
+			rec[i] = v
+		}
+	}
+
+	err := t.csv.Write(rec)
+	if err != nil {
+		return err
+	}
+
+	if len(t.rows) != 0 {
+		return nil // flushed by flushRows
+	}
+
+	t.csv.Flush()
+
+	return t.csv.Error()
+}
+
+// fill formats event pairs into row, nested maps are flattened.
+func (w *Table) fill(row map[string]string, ev *tlog.Event) (err error) {
+	w.raw = ev.Raw()
+	w.d.ResetBytes(w.raw)
+
+	tag, els, i := w.d.Tag(0)
+	if tag != tlog.Map {
+		return errors.New("expected map, got %x", tag)
+	}
+
+	for el := 0; els == -1 || el < els; el++ {
+		if els == -1 && w.d.Break(&i) {
+			break
+		}
+
+		var k []byte
+		k, i = w.d.String(i)
+
+		w.key = append(w.key[:0], k...)
+
+		i = w.fillValue(row, i)
+	}
+
+	return w.d.Err()
+}
+
+func (w *Table) fillValue(row map[string]string, st int) (i int) {
+	tag, sub, i := w.d.Tag(st)
+
+	if tag == tlog.Map {
+		kl := len(w.key)
+
+		for el := 0; sub == -1 || el < sub; el++ {
+			if sub == -1 && w.d.Break(&i) {
+				break
+			}
+
+			var k []byte
+			k, i = w.d.String(i)
+
+			w.key = append(w.key[:kl], '.')
+			w.key = append(w.key, k...)
+
+			i = w.fillValue(row, i)
+		}
+
+		w.key = w.key[:kl]
+
+		return i
+	}
+
+	w.b, i = w.appendValue(w.b[:0], st)
+
+	k := string(w.key)
+
+	if _, ok := row[k]; !ok {
+		w.keys = append(w.keys, k)
+	}
+
+	row[k] = string(w.b)
+
+	return i
+}
+
+func (w *Table) appendValue(b []byte, st int) (_ []byte, i int) {
+	tag, sub, i := w.d.Tag(st)
+
+	switch tag {
+	case tlog.Int:
+		var v int64
+		v, i = w.d.Int(st)
+
+		return strconv.AppendUint(b, uint64(v), 10), i
+	case tlog.Neg:
+		var v int64
+		v, i = w.d.Int(st)
+
+		return strconv.AppendInt(b, v, 10), i
+	case tlog.String:
+		var s []byte
+		s, i = w.d.String(st)
+
+		return append(b, s...), i
+	case tlog.Bytes:
+		var s []byte
+		s, i = w.d.String(st)
+
+		return append(b, base64.StdEncoding.EncodeToString(s)...), i
+	case tlog.Special:
+		switch sub {
+		case tlog.False:
+			return append(b, "false"...), i
+		case tlog.True:
+			return append(b, "true"...), i
+		case tlog.Null, tlog.Undefined:
+			return b, i
+		case tlog.Float64, tlog.Float32, tlog.Float16, tlog.FloatInt8:
+			var f float64
+			f, i = w.d.Float(st)
+
+			return strconv.AppendFloat(b, f, 'f', -1, 64), i
+		}
+	case tlog.Semantic:
+		return w.appendSemantic(b, st, sub, i)
+	}
+
+	// arrays and the rest as json
+
+	w.j.d.ResetBytes(w.raw[st:])
+
+	b, i = w.j.appendValue(b, 0)
+
+	return b, st + i
+}
+
+func (w *Table) appendSemantic(b []byte, st, sub, i int) (_ []byte, _ int) {
+	switch sub {
+	case tlog.WireTime:
+		var ts tlog.Timestamp
+		ts, i = w.d.Time(st)
+
+		t := time.Unix(0, int64(ts))
+		if w.TimeZone != nil {
+			t = t.In(w.TimeZone)
+		}
+
+		return t.AppendFormat(b, w.TimeFormat), i
+	case tlog.WireDuration:
+		var v int64
+		v, i = w.d.Int(i)
+
+		return append(b, time.Duration(v).String()...), i
+	case tlog.WireID:
+		var id tlog.ID
+		id, i = w.d.ID(st)
+
+		s := len(b)
+		b = append(b, "00000000000000000000000000000000"...)
+		id.FormatTo(b[s:], 'x')
+
+		return b, i
+	case tlog.WireLocation:
+		var pc loc.PC
+		pc, i = w.d.Location(st)
+
+		_, file, line := pc.NameFileLine()
+
+		b = append(b, file...)
+		b = append(b, ':')
+
+		return strconv.AppendInt(b, int64(line), 10), i
+	case tlog.WireLabels:
+		var ls tlog.Labels
+		ls, i = w.d.Labels(st)
+
+		return append(b, strings.Join(ls, ",")...), i
+	case tlog.WireLogLevel:
+		var lv tlog.LogLevel
+		lv, i = w.d.LogLevel(st)
+
+		return append(b, logfmtLevel(lv)...), i
+	default:
+		return w.appendValue(b, i)
+	}
+}
+
+// tableKey converts column name to event key.
+func tableKey(f string) string {
+	for k, v := range DefaultLogfmtKeys {
+		if v == f {
+			return k
+		}
+	}
+
+	return f
+}
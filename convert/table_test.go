@@ -0,0 +1,112 @@
+package convert
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+func writeTableEvents(t *testing.T, w io.Writer) {
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"a=b"}}
+
+	ts := tlog.Timestamp(time.Date(2020, time.December, 25, 22, 8, 13, 0, time.UTC).UnixNano())
+	id := tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+	for _, kvs := range [][]interface{}{
+		{tlog.KeyTime, ts, tlog.KeyLogLevel, tlog.Warn, tlog.KeyMessage, tlog.Message("message"), "client_ip", "1.2.3.4"},
+		{tlog.KeyTime, ts, tlog.KeySpan, id, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("http_request"), "req", map[string]interface{}{"path": "/a, b"}},
+		{tlog.KeySpan, id, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, time.Second, "status_code", 200, "tags", []string{"x", "y"}},
+	} {
+		err := e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+}
+
+func TestTableFields(t *testing.T) {
+	var b low.Buf
+
+	w := NewCSVWriter(&b)
+	w.Fields = []string{"time", "level", "m", "client_ip", "status_code", "req.path"}
+
+	writeTableEvents(t, w)
+
+	// rows are written without waiting for Close
+
+	assert.Equal(t, `time,level,m,client_ip,status_code,req.path
+2020-12-25T22:08:13Z,warn,message,1.2.3.4,,
+2020-12-25T22:08:13Z,,http_request,,,"/a, b"
+,,,,200,
+`, string(b))
+
+	err := w.Close()
+	require.NoError(t, err)
+}
+
+func TestTableDiscover(t *testing.T) {
+	var b low.Buf
+
+	w := NewTSVWriter(&b)
+
+	writeTableEvents(t, w)
+
+	assert.Empty(t, b)
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, "time\tlevel\tmsg\tclient_ip\tspan\ttype\treq.path\telapsed\tstatus_code\ttags\n"+
+		"2020-12-25T22:08:13Z\twarn\tmessage\t1.2.3.4\t\t\t\t\t\t\n"+
+		"2020-12-25T22:08:13Z\t\thttp_request\t\t0102030405060708090a0b0c0d0e0f10\ts\t/a, b\t\t\t\n"+
+		"\t\t\t\t0102030405060708090a0b0c0d0e0f10\tf\t\t1s\t200\t\"[\"\"x\"\",\"\"y\"\"]\"\n", string(b))
+}
+
+func TestTableDiscoverStream(t *testing.T) {
+	var b low.Buf
+
+	w := NewTSVWriter(&b)
+	w.Discover = 2
+
+	writeTableEvents(t, w)
+
+	// columns are taken from the first two events, the rest is streamed
+
+	assert.Equal(t, "time\tlevel\tmsg\tclient_ip\tspan\ttype\treq.path\n"+
+		"2020-12-25T22:08:13Z\twarn\tmessage\t1.2.3.4\t\t\t\n"+
+		"2020-12-25T22:08:13Z\t\thttp_request\t\t0102030405060708090a0b0c0d0e0f10\ts\t/a, b\n"+
+		"\t\t\t\t0102030405060708090a0b0c0d0e0f10\tf\t\n", string(b))
+
+	err := w.Close()
+	require.NoError(t, err)
+}
+
+func TestTableSplit(t *testing.T) {
+	bufs := map[string]*bytes.Buffer{}
+
+	w := NewCSVWriter(nil)
+	w.Fields = []string{"t", "m", "client_ip", "elapsed", "status_code"}
+	w.Open = func(name string) (io.Writer, error) {
+		bufs[name] = &bytes.Buffer{}
+
+		return bufs[name], nil
+	}
+
+	writeTableEvents(t, w)
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	if assert.Contains(t, bufs, "messages") {
+		assert.Equal(t, "t,m,client_ip,elapsed,status_code\n2020-12-25T22:08:13Z,message,1.2.3.4,,\n", bufs["messages"].String())
+	}
+
+	if assert.Contains(t, bufs, "http_request") {
+		assert.Equal(t, "t,m,client_ip,elapsed,status_code\n2020-12-25T22:08:13Z,http_request,,,\n,,,1s,200\n", bufs["http_request"].String())
+	}
+}
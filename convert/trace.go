@@ -0,0 +1,312 @@
+package convert
+
+import (
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Trace writes events in Chrome trace event format (JSON array)
+	// which can be opened in about:tracing or Perfetto.
+	//
+	// Spans become complete events written when the span is finished.
+	// Messages become instant events and Observe values become counters.
+	//
+	// Spans are placed into lanes (tids): a child continues on its parent lane
+	// if the parent has no other open children there, otherwise it takes the first free lane.
+	// So that concurrent spans don't overlap.
+	// Spans not finished by Close are written as begin events.
+	Trace struct {
+		io.Writer
+
+		Pid int
+
+		spans map[tlog.ID]*traceSpan
+		lanes [][]tlog.ID // open spans stack
+
+		j JSON
+
+		ev tlog.Event
+		b  low.Buf
+		n  int
+	}
+
+	traceSpan struct {
+		name  string
+		start tlog.Timestamp
+		lane  int
+		args  []byte
+	}
+)
+
+func NewTraceWriter(w io.Writer) *Trace {
+	return &Trace{
+		Writer: w,
+		Pid:    1,
+		spans:  make(map[tlog.ID]*traceSpan),
+	}
+}
+
+func (w *Trace) Write(p []byte) (n int, err error) {
+	b := w.b[:0]
+
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		b = w.appendEvent(b, &w.ev)
+	}
+
+	w.b = b[:0]
+
+	if len(b) == 0 {
+		return len(p), nil
+	}
+
+	_, err = w.Writer.Write(b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close writes unfinished spans and closes the array.
+// It doesn't close the underlying writer.
+func (w *Trace) Close() (err error) {
+	ids := make([]tlog.ID, 0, len(w.spans))
+	for id := range w.spans {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return w.spans[ids[i]].start < w.spans[ids[j]].start
+	})
+
+	b := w.b[:0]
+
+	for _, id := range ids {
+		s := w.spans[id]
+
+		b = w.appendHead(b, s.name, "B", s.start, s.lane)
+		b = appendTraceArgs(b, s.args)
+		b = append(b, '}')
+
+		delete(w.spans, id)
+	}
+
+	if w.n == 0 {
+		b = append(b, '[')
+	}
+
+	b = append(b, "]\n"...)
+
+	w.b = b[:0]
+
+	_, err = w.Writer.Write(b)
+
+	return err
+}
+
+func (w *Trace) appendEvent(b []byte, ev *tlog.Event) []byte {
+	switch ev.Type {
+	case "s":
+		s := &traceSpan{
+			name:  string(ev.Message),
+			start: ev.Time,
+			lane:  w.lane(ev.Parent),
+			args:  w.appendArgs(nil, ev),
+		}
+
+		w.spans[ev.Span] = s
+		w.lanes[s.lane] = append(w.lanes[s.lane], ev.Span)
+	case "f":
+		s, ok := w.spans[ev.Span]
+		if !ok {
+			return b
+		}
+
+		delete(w.spans, ev.Span)
+		w.release(s.lane, ev.Span)
+
+		b = w.appendHead(b, s.name, "X", s.start, s.lane)
+
+		b = append(b, `,"dur":`...)
+		b = appendMicros(b, int64(ev.Elapsed))
+
+		args := w.appendArgs(s.args, ev)
+
+		b = appendTraceArgs(b, args)
+		b = append(b, '}')
+	case "v":
+		for i := 0; i < ev.Len(); i++ {
+			k := ev.Key(i)
+			if traceSkipKey(k) {
+				continue
+			}
+
+			var num []byte
+
+			switch v := ev.Value(i).(type) {
+			case int64:
+				num = strconv.AppendInt(nil, v, 10)
+			case uint64:
+				num = strconv.AppendUint(nil, v, 10)
+			case float64:
+				num = strconv.AppendFloat(nil, v, 'f', -1, 64)
+			default:
+				continue
+			}
+
+			b = w.appendHead(b, string(k), "C", ev.Time, w.spanLane(ev.Span))
+
+			b = append(b, `,"args":{`...)
+			b = strconv.AppendQuote(b, low.UnsafeBytesToString(k))
+			b = append(b, ':')
+			b = append(b, num...)
+			b = append(b, "}}"...)
+		}
+	case "":
+		if len(ev.Message) == 0 {
+			return b
+		}
+
+		b = w.appendHead(b, string(ev.Message), "i", ev.Time, w.spanLane(ev.Span))
+
+		if _, ok := w.spans[ev.Span]; ok {
+			b = append(b, `,"s":"t"`...)
+		} else {
+			b = append(b, `,"s":"p"`...)
+		}
+
+		b = appendTraceArgs(b, w.appendArgs(nil, ev))
+		b = append(b, '}')
+	}
+
+	return b
+}
+
+func (w *Trace) appendHead(b []byte, name, ph string, ts tlog.Timestamp, lane int) []byte {
+	if w.n == 0 {
+		b = append(b, "[\n"...)
+	} else {
+		b = append(b, ",\n"...)
+	}
+
+	w.n++
+
+	b = append(b, `{"name":`...)
+	b = strconv.AppendQuote(b, name)
+	b = append(b, `,"ph":"`...)
+	b = append(b, ph...)
+	b = append(b, `","ts":`...)
+	b = appendMicros(b, int64(ts))
+	b = append(b, `,"pid":`...)
+	b = strconv.AppendInt(b, int64(w.Pid), 10)
+	b = append(b, `,"tid":`...)
+	b = strconv.AppendInt(b, int64(lane), 10)
+
+	return b
+}
+
+// appendArgs appends not predefined event pairs as JSON object members.
+func (w *Trace) appendArgs(b []byte, ev *tlog.Event) []byte {
+	for i := 0; i < ev.Len(); i++ {
+		k := ev.Key(i)
+		if traceSkipKey(k) {
+			continue
+		}
+
+		b = appendJSONKey(b, 0, low.UnsafeBytesToString(k))
+
+		w.j.d.ResetBytes(ev.RawValue(i))
+		b, _ = w.j.appendValue(b, 0)
+	}
+
+	return b
+}
+
+// lane picks the lane for a new span with parent par.
+func (w *Trace) lane(par tlog.ID) int {
+	if s, ok := w.spans[par]; ok {
+		l := w.lanes[s.lane]
+
+		if l[len(l)-1] == par {
+			return s.lane
+		}
+	}
+
+	for i, l := range w.lanes {
+		if len(l) == 0 {
+			return i
+		}
+	}
+
+	w.lanes = append(w.lanes, nil)
+
+	return len(w.lanes) - 1
+}
+
+func (w *Trace) release(lane int, id tlog.ID) {
+	l := w.lanes[lane]
+
+	for i := len(l) - 1; i >= 0; i-- {
+		if l[i] == id {
+			w.lanes[lane] = append(l[:i], l[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w *Trace) spanLane(id tlog.ID) int {
+	if s, ok := w.spans[id]; ok {
+		return s.lane
+	}
+
+	return 0
+}
+
+func appendTraceArgs(b, args []byte) []byte {
+	if len(args) == 0 {
+		return b
+	}
+
+	b = append(b, `,"args":{`...)
+	b = append(b, args...)
+
+	return append(b, '}')
+}
+
+// appendMicros appends nanoseconds as microseconds with fraction.
+func appendMicros(b []byte, ns int64) []byte {
+	if ns < 0 {
+		b = append(b, '-')
+		ns = -ns
+	}
+
+	b = strconv.AppendInt(b, ns/1000, 10)
+
+	if f := ns % 1000; f != 0 {
+		b = append(b, '.', byte('0'+f/100), byte('0'+f/10%10), byte('0'+f%10))
+	}
+
+	return b
+}
+
+func traceSkipKey(k []byte) bool {
+	switch string(k) {
+	case tlog.KeyTime, tlog.KeySpan, tlog.KeyParent, tlog.KeyMessage, tlog.KeyElapsed,
+		tlog.KeyLocation, tlog.KeyLabels, tlog.KeyEventType, tlog.KeyLogLevel:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,57 @@
+package convert
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+func TestTrace(t *testing.T) {
+	var b low.Buf
+
+	w := NewTraceWriter(&b)
+	e := tlog.Encoder{Writer: w}
+
+	root, a, c, d := tlog.ID{1}, tlog.ID{2}, tlog.ID{3}, tlog.ID{4}
+	ts := func(us int) tlog.Timestamp { return tlog.Timestamp(1e9 + us*1000) }
+
+	for _, kvs := range [][]interface{}{
+		{tlog.KeySpan, root, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root"), "arg", 1},
+		{tlog.KeySpan, a, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, root, tlog.KeyMessage, tlog.Message("a")},
+		{tlog.KeySpan, c, tlog.KeyTime, ts(20), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, root, tlog.KeyMessage, tlog.Message("c")},
+		{tlog.KeySpan, a, tlog.KeyTime, ts(30), tlog.KeyMessage, tlog.Message("msg in a")},
+		{tlog.KeySpan, c, tlog.KeyTime, ts(35), tlog.KeyEventType, tlog.EventType("v"), "load", 0.5},
+		{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 30 * time.Microsecond},
+		{tlog.KeySpan, d, tlog.KeyTime, ts(45), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("d")},
+		{tlog.KeySpan, c, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 30 * time.Microsecond, "res", "ok"},
+		{tlog.KeySpan, root, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 60*time.Microsecond + 500},
+	} {
+		err := e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	var evs []map[string]interface{}
+
+	err = json.Unmarshal(b, &evs)
+	require.NoError(t, err, "%s", b)
+
+	exp := []map[string]interface{}{
+		{"name": "msg in a", "ph": "i", "ts": 1e6 + 30., "pid": 1., "tid": 0., "s": "t"},
+		{"name": "load", "ph": "C", "ts": 1e6 + 35., "pid": 1., "tid": 1., "args": map[string]interface{}{"load": 0.5}},
+		{"name": "a", "ph": "X", "ts": 1e6 + 10., "dur": 30., "pid": 1., "tid": 0.},
+		{"name": "c", "ph": "X", "ts": 1e6 + 20., "dur": 30., "pid": 1., "tid": 1., "args": map[string]interface{}{"res": "ok"}},
+		{"name": "root", "ph": "X", "ts": 1e6 + 0., "dur": 60.5, "pid": 1., "tid": 0., "args": map[string]interface{}{"arg": 1.}},
+		{"name": "d", "ph": "B", "ts": 1e6 + 45., "pid": 1., "tid": 2.},
+	}
+
+	assert.Equal(t, exp, evs)
+}
@@ -0,0 +1,517 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Waterfall collects spans and renders span trees on Close.
+	//
+	// If Span is set (full id or its prefix, like short ids printed by ConsoleWriter)
+	// the tree contains the span, its ancestors and all of its descendants.
+	// Otherwise all the traces are rendered.
+	//
+	// Each span line shows its start offset from the trace start, duration and a bar.
+	// Critical path (the chain of children finishing last) is drawn with '#', other spans with '='.
+	// Span messages are printed inline below the span.
+	//
+	// If JSON is set trees are written as WaterfallTrace objects, one per line.
+	Waterfall struct {
+		io.Writer
+
+		Span string
+
+		JSON     bool
+		Width    int
+		Colorize bool
+
+		spanTree
+
+		children map[tlog.ID][]*span
+	}
+
+	WaterfallTrace struct {
+		TraceID  string         `json:"trace_id"`
+		Start    time.Time      `json:"start"`
+		Duration time.Duration  `json:"duration_ns"`
+		Spans    int            `json:"spans"`
+		Root     *WaterfallSpan `json:"root"`
+	}
+
+	WaterfallSpan struct {
+		SpanID   string        `json:"span_id"`
+		ParentID string        `json:"parent_id,omitempty"`
+		Name     string        `json:"name"`
+		Service  string        `json:"service,omitempty"`
+		Labels   tlog.Labels   `json:"labels,omitempty"`
+		Offset   time.Duration `json:"offset_ns"`
+		Duration time.Duration `json:"duration_ns"`
+		Finished bool          `json:"finished"`
+		Critical bool          `json:"critical,omitempty"`
+		Selected bool          `json:"selected,omitempty"`
+
+		Tags map[string]interface{} `json:"tags,omitempty"`
+		Logs []WaterfallLog         `json:"logs,omitempty"`
+
+		Children []*WaterfallSpan `json:"children,omitempty"`
+
+		tags []spanKV
+	}
+
+	WaterfallLog struct {
+		Offset  time.Duration          `json:"offset_ns"`
+		Level   string                 `json:"level,omitempty"`
+		Message string                 `json:"message"`
+		KVs     map[string]interface{} `json:"kvs,omitempty"`
+
+		kvs []spanKV
+	}
+)
+
+var DefaultWaterfallWidth = 40
+
+var (
+	waterfallCritical = tlog.Color(31, 1)
+	waterfallSelected = tlog.Color(1)
+)
+
+func NewWaterfallWriter(w io.Writer, span string) *Waterfall {
+	return &Waterfall{
+		Writer:   w,
+		Span:     span,
+		Width:    DefaultWaterfallWidth,
+		spanTree: newSpanTree(),
+	}
+}
+
+func (w *Waterfall) Write(p []byte) (int, error) {
+	return w.write(p)
+}
+
+// Close renders collected spans. It doesn't close the underlying writer.
+func (w *Waterfall) Close() (err error) {
+	trs, err := w.Traces()
+	if err != nil {
+		return err
+	}
+
+	var b low.Buf
+
+	for _, tr := range trs {
+		if w.JSON {
+			data, err := json.Marshal(tr)
+			if err != nil {
+				return errors.Wrap(err, "marshal")
+			}
+
+			b = append(b, data...)
+			b = append(b, '\n')
+
+			continue
+		}
+
+		if len(b) != 0 {
+			b = append(b, '\n')
+		}
+
+		b = w.appendTrace(b, tr)
+	}
+
+	_, err = w.Writer.Write(b)
+
+	return err
+}
+
+// Traces builds span trees from collected events.
+func (w *Waterfall) Traces() (trs []*WaterfallTrace, err error) {
+	w.finish()
+
+	w.children = make(map[tlog.ID][]*span)
+
+	for _, s := range w.spans {
+		if _, ok := w.byID[s.Parent]; ok && s.Parent != s.ID {
+			w.children[s.Parent] = append(w.children[s.Parent], s)
+		}
+	}
+
+	if w.Span == "" {
+		for _, s := range w.spans {
+			if _, ok := w.byID[s.Parent]; ok && s.Parent != s.ID {
+				continue
+			}
+
+			trs = append(trs, w.trace([]*span{s}))
+		}
+
+		return trs, nil
+	}
+
+	pref := strings.ToLower(w.Span)
+
+	var sel []*span
+
+	for _, s := range w.spans {
+		if strings.HasPrefix(s.ID.FullString(), pref) {
+			sel = append(sel, s)
+		}
+	}
+
+	switch {
+	case len(sel) == 0:
+		return nil, errors.New("span not found: %v", w.Span)
+	case len(sel) > 1:
+		return nil, errors.New("ambiguous span id %v: %d spans match", w.Span, len(sel))
+	}
+
+	path := []*span{sel[0]}
+
+	for {
+		p, ok := w.byID[path[0].Parent]
+		if !ok || contains(path, p) {
+			break
+		}
+
+		path = append([]*span{p}, path...)
+	}
+
+	return []*WaterfallTrace{w.trace(path)}, nil
+}
+
+// trace builds the tree from path[0] with only path spans on the way to the last one
+// which is included with all of its descendants.
+func (w *Waterfall) trace(path []*span) *WaterfallTrace {
+	root := path[0]
+
+	tr := &WaterfallTrace{
+		TraceID: root.Trace.FullString(),
+		Start:   root.Start.Time().UTC(),
+	}
+
+	visited := map[tlog.ID]bool{}
+
+	tr.Root = w.node(root, root.Start, path, visited, &tr.Spans)
+	tr.Duration = end(tr.Root)
+
+	markCritical(tr.Root)
+
+	return tr
+}
+
+func (w *Waterfall) node(s *span, start tlog.Timestamp, path []*span, visited map[tlog.ID]bool, count *int) *WaterfallSpan {
+	visited[s.ID] = true
+	*count++
+
+	n := &WaterfallSpan{
+		SpanID:   s.ID.FullString(),
+		Name:     s.Name,
+		Service:  s.Service,
+		Labels:   s.Labels,
+		Offset:   time.Duration(s.Start - start),
+		Duration: s.Duration,
+		Finished: s.Finished,
+		Selected: w.Span != "" && len(path) == 1 && path[0] == s,
+		Tags:     kvsMap(s.Tags),
+		tags:     s.Tags,
+	}
+
+	if len(s.Labels) == 0 {
+		n.Service = "" // not "unknown"
+	}
+
+	if s.Parent != (tlog.ID{}) {
+		n.ParentID = s.Parent.FullString()
+	}
+
+	for _, l := range s.Logs {
+		wl := WaterfallLog{
+			Message: l.Message,
+			KVs:     kvsMap(l.KVs),
+			kvs:     l.KVs,
+		}
+
+		if l.Time != 0 {
+			wl.Offset = time.Duration(l.Time - start)
+		}
+
+		if l.Level != tlog.Info {
+			wl.Level = logfmtLevel(l.Level)
+		}
+
+		n.Logs = append(n.Logs, wl)
+	}
+
+	children := w.children[s.ID]
+
+	if len(path) > 1 {
+		children = path[1:2]
+		path = path[1:]
+	} else {
+		path = nil
+	}
+
+	for _, c := range children {
+		if visited[c.ID] {
+			continue
+		}
+
+		n.Children = append(n.Children, w.node(c, start, path, visited, count))
+	}
+
+	if !n.Finished {
+		n.Duration = end(n) - n.Offset
+	}
+
+	return n
+}
+
+// end is the span end offset. Unfinished spans end with their last child or message.
+func end(n *WaterfallSpan) (e time.Duration) {
+	e = n.Offset + n.Duration
+
+	if n.Finished {
+		return e
+	}
+
+	for _, l := range n.Logs {
+		if l.Offset > e {
+			e = l.Offset
+		}
+	}
+
+	for _, c := range n.Children {
+		if ce := end(c); ce > e {
+			e = ce
+		}
+	}
+
+	return e
+}
+
+// markCritical marks the chain of children finishing last.
+func markCritical(n *WaterfallSpan) {
+	for n != nil {
+		n.Critical = true
+
+		var next *WaterfallSpan
+
+		for _, c := range n.Children {
+			if next == nil || end(c) > end(next) {
+				next = c
+			}
+		}
+
+		n = next
+	}
+}
+
+func (w *Waterfall) appendTrace(b []byte, tr *WaterfallTrace) []byte {
+	b = append(b, "trace "...)
+	b = append(b, tr.TraceID...)
+	b = append(b, "  start "...)
+	b = tr.Start.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, "  duration "...)
+	b = append(b, roundDuration(tr.Duration).String()...)
+	b = append(b, "  spans "...)
+	b = strconv.AppendInt(b, int64(tr.Spans), 10)
+	b = append(b, '\n')
+
+	return w.appendSpan(b, tr.Root, tr.Duration, 0)
+}
+
+func (w *Waterfall) appendSpan(b []byte, n *WaterfallSpan, total time.Duration, depth int) []byte {
+	width := w.Width
+	if width <= 0 {
+		width = DefaultWaterfallWidth
+	}
+
+	from, to := scale(n.Offset, total, width), scale(n.Offset+n.Duration, total, width)
+	if to == from && to < width {
+		to++
+	}
+
+	c := byte('=')
+	if n.Critical {
+		c = '#'
+	}
+
+	b = appendPad(b, roundDuration(n.Offset).String(), 10)
+	b = append(b, ' ')
+	b = appendPad(b, roundDuration(n.Duration).String(), 10)
+	b = append(b, " |"...)
+
+	if w.Colorize && n.Critical {
+		b = append(b, waterfallCritical...)
+	}
+
+	for i := 0; i < width; i++ {
+		switch {
+		case i >= from && i < to:
+			b = append(b, c)
+		default:
+			b = append(b, ' ')
+		}
+	}
+
+	if w.Colorize && n.Critical {
+		b = append(b, tlog.ResetColor...)
+	}
+
+	b = append(b, "| "...)
+
+	for i := 0; i < depth; i++ {
+		b = append(b, "  "...)
+	}
+
+	if n.Selected {
+		b = append(b, "> "...)
+	}
+
+	if w.Colorize && n.Selected {
+		b = append(b, waterfallSelected...)
+	}
+
+	b = append(b, n.Name...)
+
+	if w.Colorize && n.Selected {
+		b = append(b, tlog.ResetColor...)
+	}
+
+	b = append(b, "  "...)
+	b = append(b, n.SpanID[:8]...)
+
+	if n.Service != "" {
+		b = append(b, "  ["...)
+		b = append(b, n.Service...)
+		b = append(b, ']')
+	}
+
+	if !n.Finished {
+		b = append(b, "  (unfinished)"...)
+	}
+
+	b = appendKVs(b, n.tags)
+	b = append(b, '\n')
+
+	for _, l := range n.Logs {
+		at := scale(l.Offset, total, width)
+		if at >= width {
+			at = width - 1
+		}
+
+		b = appendPad(b, roundDuration(l.Offset).String(), 10)
+		b = append(b, "            |"...)
+
+		for i := 0; i < width; i++ {
+			if i == at {
+				b = append(b, '.')
+			} else {
+				b = append(b, ' ')
+			}
+		}
+
+		b = append(b, "| "...)
+
+		for i := 0; i <= depth; i++ {
+			b = append(b, "  "...)
+		}
+
+		b = append(b, "- "...)
+
+		if l.Level != "" {
+			b = append(b, strings.ToUpper(l.Level)...)
+			b = append(b, ' ')
+		}
+
+		b = append(b, l.Message...)
+		b = appendKVs(b, l.kvs)
+		b = append(b, '\n')
+	}
+
+	for _, c := range n.Children {
+		b = w.appendSpan(b, c, total, depth+1)
+	}
+
+	return b
+}
+
+func scale(d, total time.Duration, width int) int {
+	if total <= 0 {
+		return 0
+	}
+
+	x := int(int64(d) * int64(width) / int64(total))
+
+	switch {
+	case x < 0:
+		return 0
+	case x > width:
+		return width
+	}
+
+	return x
+}
+
+// roundDuration leaves about four significant digits.
+func roundDuration(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond)
+	}
+
+	return d
+}
+
+func appendPad(b []byte, s string, w int) []byte {
+	for i := utf8.RuneCountInString(s); i < w; i++ {
+		b = append(b, ' ')
+	}
+
+	return append(b, s...)
+}
+
+func appendKVs(b []byte, kvs []spanKV) []byte {
+	for _, kv := range kvs {
+		b = append(b, "  "...)
+		b = append(b, kv.Key...)
+		b = append(b, '=')
+		b = append(b, kv.Text...)
+	}
+
+	return b
+}
+
+func kvsMap(kvs []spanKV) map[string]interface{} {
+	if len(kvs) == 0 {
+		return nil
+	}
+
+	m := make(map[string]interface{}, len(kvs))
+
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+
+	return m
+}
+
+func contains(ss []*span, s *span) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
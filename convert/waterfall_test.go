@@ -0,0 +1,208 @@
+package convert
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+func TestWaterfall(t *testing.T) {
+	var b low.Buf
+
+	w := NewWaterfallWriter(&b, "")
+	w.Width = 10
+
+	writeTwoServices(t, w)
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	exp := `trace 0102030405060708090a0b0c0d0e0f10  start 1970-01-01T00:00:01Z  duration 50µs  spans 2
+        0s       50µs |##########| request  01020304  [front]  path=/api  status=500
+      10µs       20µs |  ####    |   query  11121314  [back]
+      15µs            |   .      |     - ERROR failed  rows=3
+`
+
+	assert.Equal(t, exp, string(b))
+}
+
+func TestWaterfallSelect(t *testing.T) {
+	root := tlog.ID{0xaa, 1}
+	fast := tlog.ID{0xbb, 1}
+	slow := tlog.ID{0xbb, 2}
+	leaf := tlog.ID{0xcc, 1}
+
+	ts := func(ms int) tlog.Timestamp { return tlog.Timestamp(1e9 + ms*1e6) }
+
+	write := func(w *Waterfall) {
+		e := tlog.Encoder{Writer: w}
+
+		for _, kvs := range [][]interface{}{
+			{tlog.KeySpan, root, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, fast, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, root, tlog.KeyMessage, tlog.Message("fast")},
+			{tlog.KeySpan, slow, tlog.KeyTime, ts(20), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, root, tlog.KeyMessage, tlog.Message("slow")},
+			{tlog.KeySpan, leaf, tlog.KeyTime, ts(30), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, slow, tlog.KeyMessage, tlog.Message("leaf")},
+			{tlog.KeySpan, leaf, tlog.KeyTime, ts(60), tlog.KeyMessage, tlog.Message("still working")},
+			{tlog.KeySpan, fast, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 5 * time.Millisecond},
+			{tlog.KeySpan, slow, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 60 * time.Millisecond},
+			{tlog.KeySpan, root, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 100 * time.Millisecond},
+		} {
+			err := e.Encode(nil, kvs)
+			require.NoError(t, err)
+		}
+	}
+
+	var b low.Buf
+
+	w := NewWaterfallWriter(&b, "bb")
+	write(w)
+
+	err := w.Close()
+	assert.Error(t, err, "ambiguous")
+
+	w = NewWaterfallWriter(&b, "bb02")
+	w.JSON = true
+	write(w)
+
+	err = w.Close()
+	require.NoError(t, err)
+
+	var tr WaterfallTrace
+
+	err = json.Unmarshal(b, &tr)
+	require.NoError(t, err, "%s", b)
+
+	assert.Equal(t, root.FullString(), tr.TraceID)
+	assert.Equal(t, 100*time.Millisecond, tr.Duration)
+	assert.Equal(t, 3, tr.Spans)
+
+	r := tr.Root
+	assert.Equal(t, "root", r.Name)
+	assert.True(t, r.Critical)
+	assert.False(t, r.Selected)
+	require.Len(t, r.Children, 1) // only the path to the selected span
+
+	s := r.Children[0]
+	assert.Equal(t, "slow", s.Name)
+	assert.Equal(t, 20*time.Millisecond, s.Offset)
+	assert.Equal(t, 60*time.Millisecond, s.Duration)
+	assert.True(t, s.Critical)
+	assert.True(t, s.Selected)
+	require.Len(t, s.Children, 1)
+
+	l := s.Children[0]
+	assert.Equal(t, "leaf", l.Name)
+	assert.False(t, l.Finished)
+	assert.Equal(t, 30*time.Millisecond, l.Duration) // till the last message
+	assert.True(t, l.Critical)
+	assert.Equal(t, []WaterfallLog{{Offset: 60 * time.Millisecond, Message: "still working"}}, l.Logs)
+}
+
+func TestWaterfallSpans(t *testing.T) {
+	a, b, c := tlog.ID{0xa1}, tlog.ID{0xb2}, tlog.ID{0xc3}
+
+	ts := func(us int) tlog.Timestamp { return tlog.Timestamp(1e9 + us*1000) }
+
+	us := time.Microsecond
+
+	for _, tc := range []struct {
+		name  string
+		evs   [][]interface{}
+		dur   time.Duration
+		spans int
+		exp   *WaterfallSpan
+	}{{
+		name: "nested",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("mid")},
+			{tlog.KeySpan, c, tlog.KeyTime, ts(20), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, b, tlog.KeyMessage, tlog.Message("leaf")},
+			{tlog.KeySpan, c, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 5 * us},
+			{tlog.KeySpan, b, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * us},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 40 * us},
+		},
+		dur:   40 * us,
+		spans: 3,
+		exp: &WaterfallSpan{
+			SpanID: a.FullString(), Name: "root", Duration: 40 * us, Finished: true, Critical: true,
+			Children: []*WaterfallSpan{{
+				SpanID: b.FullString(), ParentID: a.FullString(), Name: "mid", Offset: 10 * us, Duration: 20 * us, Finished: true, Critical: true,
+				Children: []*WaterfallSpan{{
+					SpanID: c.FullString(), ParentID: b.FullString(), Name: "leaf", Offset: 20 * us, Duration: 5 * us, Finished: true, Critical: true,
+				}},
+			}},
+		},
+	}, {
+		name: "error",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("query")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(5), tlog.KeyLogLevel, tlog.Warn, tlog.KeyMessage, tlog.Message("slow")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(8), tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("failed"), "code", 7},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 10 * us},
+		},
+		dur:   10 * us,
+		spans: 1,
+		exp: &WaterfallSpan{
+			SpanID: a.FullString(), Name: "query", Duration: 10 * us, Finished: true, Critical: true,
+			Logs: []WaterfallLog{
+				{Offset: 5 * us, Level: "warn", Message: "slow"},
+				{Offset: 8 * us, Level: "error", Message: "failed", KVs: map[string]interface{}{"code": 7.}},
+			},
+		},
+	}, {
+		name: "unfinished",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("worker")},
+			{tlog.KeySpan, c, tlog.KeyTime, ts(15), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, b, tlog.KeyMessage, tlog.Message("step")},
+			{tlog.KeySpan, c, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 25 * us},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(30), tlog.KeyMessage, tlog.Message("still working")},
+		},
+		dur:   40 * us, // the root ends with its last descendant
+		spans: 3,
+		exp: &WaterfallSpan{
+			SpanID: a.FullString(), Name: "root", Duration: 40 * us, Critical: true,
+			Children: []*WaterfallSpan{{
+				SpanID: b.FullString(), ParentID: a.FullString(), Name: "worker", Offset: 10 * us, Duration: 30 * us, Critical: true,
+				Logs: []WaterfallLog{{Offset: 30 * us, Message: "still working"}},
+				Children: []*WaterfallSpan{{
+					SpanID: c.FullString(), ParentID: b.FullString(), Name: "step", Offset: 15 * us, Duration: 25 * us, Finished: true, Critical: true,
+				}},
+			}},
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf low.Buf
+
+			w := NewWaterfallWriter(&buf, "")
+			w.JSON = true
+
+			e := tlog.Encoder{Writer: w}
+
+			for _, kvs := range tc.evs {
+				err := e.Encode(nil, kvs)
+				require.NoError(t, err)
+			}
+
+			err := w.Close()
+			require.NoError(t, err)
+
+			var tr WaterfallTrace
+
+			err = json.Unmarshal(buf, &tr)
+			require.NoError(t, err, "%s", buf)
+
+			assert.Equal(t, a.FullString(), tr.TraceID)
+			assert.Equal(t, time.Unix(1, 0).UTC(), tr.Start)
+			assert.Equal(t, tc.dur, tr.Duration)
+			assert.Equal(t, tc.spans, tr.Spans)
+			assert.Equal(t, tc.exp, tr.Root)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// Zipkin collects spans and writes them as Zipkin v2 JSON on Close.
+	//
+	// Span messages become annotations and span kvs become tags.
+	// Service name is taken from labels (see ServiceLabel).
+	// Trace id is the root span id.
+	Zipkin struct {
+		io.Writer
+
+		spanTree
+	}
+
+	zipkinSpan struct {
+		TraceID       string             `json:"traceId"`
+		ID            string             `json:"id"`
+		ParentID      string             `json:"parentId,omitempty"`
+		Name          string             `json:"name,omitempty"`
+		Timestamp     int64              `json:"timestamp,omitempty"`
+		Duration      int64              `json:"duration,omitempty"`
+		LocalEndpoint zipkinEndpoint     `json:"localEndpoint"`
+		Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+		Tags          map[string]string  `json:"tags,omitempty"`
+	}
+
+	zipkinEndpoint struct {
+		ServiceName string `json:"serviceName"`
+	}
+
+	zipkinAnnotation struct {
+		Timestamp int64  `json:"timestamp"`
+		Value     string `json:"value"`
+	}
+)
+
+func NewZipkinWriter(w io.Writer) *Zipkin {
+	return &Zipkin{
+		Writer:   w,
+		spanTree: newSpanTree(),
+	}
+}
+
+func (w *Zipkin) Write(p []byte) (int, error) {
+	return w.write(p)
+}
+
+// Close writes collected spans. It doesn't close the underlying writer.
+func (w *Zipkin) Close() error {
+	w.finish()
+
+	zs := make([]zipkinSpan, 0, len(w.spans))
+
+	for _, s := range w.spans {
+		z := zipkinSpan{
+			TraceID:       hexID(s.Trace, len(s.Trace)),
+			ID:            hexID(s.ID, 8),
+			Name:          s.Name,
+			Timestamp:     micros(int64(s.Start)),
+			Duration:      micros(int64(s.Duration)),
+			LocalEndpoint: zipkinEndpoint{ServiceName: s.Service},
+		}
+
+		if s.Parent != (tlog.ID{}) {
+			z.ParentID = hexID(s.Parent, 8)
+		}
+
+		if len(s.Tags) != 0 {
+			z.Tags = make(map[string]string, len(s.Tags))
+		}
+
+		for _, kv := range s.Tags {
+			z.Tags[kv.Key] = kv.Text
+		}
+
+		for _, l := range s.Logs {
+			v := l.Message
+
+			if len(l.KVs) != 0 {
+				var b strings.Builder
+
+				b.WriteString(v)
+
+				for _, kv := range l.KVs {
+					b.WriteString(" ")
+					b.WriteString(kv.Key)
+					b.WriteString("=")
+					b.WriteString(kv.Text)
+				}
+
+				v = b.String()
+			}
+
+			z.Annotations = append(z.Annotations, zipkinAnnotation{
+				Timestamp: micros(int64(l.Time)),
+				Value:     v,
+			})
+
+			if l.Level >= tlog.Error {
+				if z.Tags == nil {
+					z.Tags = make(map[string]string)
+				}
+
+				z.Tags["error"] = l.Message
+			}
+		}
+
+		zs = append(zs, z)
+	}
+
+	data, err := json.Marshal(zs)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+
+	data = append(data, '\n')
+
+	_, err = w.Writer.Write(data)
+
+	return err
+}
@@ -0,0 +1,391 @@
+package convert
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+func writeTwoServices(t *testing.T, w io.Writer) {
+	front := tlog.Encoder{Writer: w, Labels: tlog.Labels{"service=front", "host=a"}}
+	back := tlog.Encoder{Writer: w, Labels: tlog.Labels{"service=back"}}
+
+	root := tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	child := tlog.ID{0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18}
+
+	ts := func(us int) tlog.Timestamp { return tlog.Timestamp(1e9 + us*1000) }
+
+	for _, c := range []struct {
+		e   *tlog.Encoder
+		kvs []interface{}
+	}{
+		{&front, []interface{}{tlog.KeySpan, root, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("request"), "path", "/api"}},
+		{&back, []interface{}{tlog.KeySpan, child, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, root, tlog.KeyMessage, tlog.Message("query")}},
+		{&back, []interface{}{tlog.KeySpan, child, tlog.KeyTime, ts(15), tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("failed"), "rows", 3}},
+		{&back, []interface{}{tlog.KeySpan, child, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * time.Microsecond}},
+		{&front, []interface{}{tlog.KeySpan, root, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 50 * time.Microsecond, "status", 500}},
+	} {
+		err := c.e.Encode(nil, c.kvs)
+		require.NoError(t, err)
+	}
+}
+
+func TestZipkin(t *testing.T) {
+	var b low.Buf
+
+	w := NewZipkinWriter(&b)
+
+	writeTwoServices(t, w)
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	var res []map[string]interface{}
+
+	err = json.Unmarshal(b, &res)
+	require.NoError(t, err, "%s", b)
+
+	trace := "0102030405060708090a0b0c0d0e0f10"
+
+	exp := []map[string]interface{}{{
+		"traceId":       trace,
+		"id":            "0102030405060708",
+		"name":          "request",
+		"timestamp":     1e6,
+		"duration":      50.,
+		"localEndpoint": map[string]interface{}{"serviceName": "front"},
+		"tags":          map[string]interface{}{"path": "/api", "status": "500"},
+	}, {
+		"traceId":       trace,
+		"id":            "1112131415161718",
+		"parentId":      "0102030405060708",
+		"name":          "query",
+		"timestamp":     1e6 + 10,
+		"duration":      20.,
+		"localEndpoint": map[string]interface{}{"serviceName": "back"},
+		"annotations": []interface{}{
+			map[string]interface{}{"timestamp": 1e6 + 15, "value": "failed rows=3"},
+		},
+		"tags": map[string]interface{}{"error": "failed"},
+	}}
+
+	assert.Equal(t, exp, res)
+}
+
+func TestJaeger(t *testing.T) {
+	var b low.Buf
+
+	w := NewJaegerWriter(&b)
+
+	writeTwoServices(t, w)
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	var res jaegerFile
+
+	err = json.Unmarshal(b, &res)
+	require.NoError(t, err, "%s", b)
+
+	require.Len(t, res.Data, 1)
+
+	tr := res.Data[0]
+
+	assert.Equal(t, "0102030405060708090a0b0c0d0e0f10", tr.TraceID)
+	assert.Equal(t, map[string]jaegerProcess{
+		"p1": {ServiceName: "front", Tags: []jaegerKV{{"service", "string", "front"}, {"host", "string", "a"}}},
+		"p2": {ServiceName: "back", Tags: []jaegerKV{{"service", "string", "back"}}},
+	}, tr.Processes)
+
+	require.Len(t, tr.Spans, 2)
+
+	assert.Equal(t, jaegerSpan{
+		TraceID:       tr.TraceID,
+		SpanID:        "0102030405060708",
+		OperationName: "request",
+		References:    []jaegerRef{},
+		StartTime:     1e6,
+		Duration:      50,
+		Tags:          []jaegerKV{{"path", "string", "/api"}, {"status", "int64", 500.}},
+		Logs:          []jaegerLog{},
+		ProcessID:     "p1",
+	}, tr.Spans[0])
+
+	assert.Equal(t, jaegerSpan{
+		TraceID:       tr.TraceID,
+		SpanID:        "1112131415161718",
+		OperationName: "query",
+		References:    []jaegerRef{{"CHILD_OF", tr.TraceID, "0102030405060708"}},
+		StartTime:     1e6 + 10,
+		Duration:      20,
+		Tags:          []jaegerKV{{"error", "bool", true}},
+		Logs: []jaegerLog{{
+			Timestamp: 1e6 + 15,
+			Fields: []jaegerKV{
+				{"event", "string", "failed"},
+				{"level", "string", "error"},
+				{"rows", "int64", 3.},
+			},
+		}},
+		ProcessID: "p2",
+	}, tr.Spans[1])
+}
+
+func TestJaegerErrorTagOnce(t *testing.T) {
+	var b low.Buf
+
+	w := NewJaegerWriter(&b)
+	e := tlog.Encoder{Writer: w}
+
+	id := tlog.ID{1}
+
+	for _, kvs := range [][]interface{}{
+		{tlog.KeySpan, id, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("query")},
+		{tlog.KeySpan, id, tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("failed")},
+		{tlog.KeySpan, id, tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("rollback failed")},
+		{tlog.KeySpan, id, tlog.KeyEventType, tlog.EventType("f")},
+	} {
+		err := e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+
+	err := w.Close()
+	require.NoError(t, err)
+
+	var res jaegerFile
+
+	err = json.Unmarshal(b, &res)
+	require.NoError(t, err, "%s", b)
+
+	require.Len(t, res.Data, 1)
+	require.Len(t, res.Data[0].Spans, 1)
+
+	s := res.Data[0].Spans[0]
+
+	assert.Equal(t, []jaegerKV{{"error", "bool", true}}, s.Tags)
+	assert.Len(t, s.Logs, 2)
+}
+
+func TestSpanTreeLoop(t *testing.T) {
+	tree := newSpanTree()
+
+	a, b, c := tlog.ID{1}, tlog.ID{2}, tlog.ID{3}
+
+	e := tlog.Encoder{Writer: writerFunc(tree.write)}
+
+	// a -> c -> b -> c: the loop doesn't pass through a
+	for _, s := range [][2]tlog.ID{{a, c}, {b, c}, {c, b}} {
+		err := e.Encode(nil, []interface{}{tlog.KeySpan, s[0], tlog.KeyParent, s[1], tlog.KeyEventType, tlog.EventType("s")})
+		require.NoError(t, err)
+	}
+
+	tree.finish()
+
+	for _, s := range tree.spans {
+		assert.Equal(t, b, s.Trace, "span %v", s.ID)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestZipkinSpans(t *testing.T) {
+	a, b, c := tlog.ID{0xa1}, tlog.ID{0xb2}, tlog.ID{0xc3}
+
+	ts := func(us int) tlog.Timestamp { return tlog.Timestamp(1e9 + us*1000) }
+
+	trace := "a1000000000000000000000000000000"
+
+	for _, tc := range []struct {
+		name string
+		evs  [][]interface{}
+		exp  []zipkinSpan
+	}{{
+		name: "nested",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("mid")},
+			{tlog.KeySpan, c, tlog.KeyTime, ts(20), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, b, tlog.KeyMessage, tlog.Message("leaf")},
+			{tlog.KeySpan, c, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 5 * time.Microsecond},
+			{tlog.KeySpan, b, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * time.Microsecond},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 40 * time.Microsecond},
+		},
+		exp: []zipkinSpan{
+			{TraceID: trace, ID: "a100000000000000", Name: "root", Timestamp: 1e6, Duration: 40},
+			{TraceID: trace, ID: "b200000000000000", ParentID: "a100000000000000", Name: "mid", Timestamp: 1e6 + 10, Duration: 20},
+			{TraceID: trace, ID: "c300000000000000", ParentID: "b200000000000000", Name: "leaf", Timestamp: 1e6 + 20, Duration: 5},
+		},
+	}, {
+		name: "error",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("query")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(5), tlog.KeyLogLevel, tlog.Warn, tlog.KeyMessage, tlog.Message("slow")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(8), tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("failed"), "code", 7},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 10 * time.Microsecond},
+		},
+		exp: []zipkinSpan{{
+			TraceID: trace, ID: "a100000000000000", Name: "query", Timestamp: 1e6, Duration: 10,
+			Annotations: []zipkinAnnotation{
+				{Timestamp: 1e6 + 5, Value: "slow"},
+				{Timestamp: 1e6 + 8, Value: "failed code=7"},
+			},
+			Tags: map[string]string{"error": "failed"},
+		}},
+	}, {
+		name: "unfinished",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("worker")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(30), tlog.KeyMessage, tlog.Message("still working")},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * time.Microsecond},
+		},
+		exp: []zipkinSpan{
+			{TraceID: trace, ID: "a100000000000000", Name: "root", Timestamp: 1e6, Duration: 20},
+			{
+				TraceID: trace, ID: "b200000000000000", ParentID: "a100000000000000", Name: "worker", Timestamp: 1e6 + 10,
+				Annotations: []zipkinAnnotation{{Timestamp: 1e6 + 30, Value: "still working"}},
+			},
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf low.Buf
+
+			w := NewZipkinWriter(&buf)
+			e := tlog.Encoder{Writer: w}
+
+			for _, kvs := range tc.evs {
+				err := e.Encode(nil, kvs)
+				require.NoError(t, err)
+			}
+
+			err := w.Close()
+			require.NoError(t, err)
+
+			var res []zipkinSpan
+
+			err = json.Unmarshal(buf, &res)
+			require.NoError(t, err, "%s", buf)
+
+			for i := range tc.exp {
+				tc.exp[i].LocalEndpoint.ServiceName = "unknown"
+			}
+
+			assert.Equal(t, tc.exp, res)
+		})
+	}
+}
+
+func TestJaegerSpans(t *testing.T) {
+	a, b, c := tlog.ID{0xa1}, tlog.ID{0xb2}, tlog.ID{0xc3}
+
+	ts := func(us int) tlog.Timestamp { return tlog.Timestamp(1e9 + us*1000) }
+
+	trace := "a1000000000000000000000000000000"
+
+	child := func(id string) []jaegerRef {
+		return []jaegerRef{{RefType: "CHILD_OF", TraceID: trace, SpanID: id}}
+	}
+
+	for _, tc := range []struct {
+		name string
+		evs  [][]interface{}
+		exp  []jaegerSpan
+	}{{
+		name: "nested",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("mid")},
+			{tlog.KeySpan, c, tlog.KeyTime, ts(20), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, b, tlog.KeyMessage, tlog.Message("leaf")},
+			{tlog.KeySpan, c, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 5 * time.Microsecond},
+			{tlog.KeySpan, b, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * time.Microsecond},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 40 * time.Microsecond},
+		},
+		exp: []jaegerSpan{
+			{SpanID: "a100000000000000", OperationName: "root", References: []jaegerRef{}, StartTime: 1e6, Duration: 40},
+			{SpanID: "b200000000000000", OperationName: "mid", References: child("a100000000000000"), StartTime: 1e6 + 10, Duration: 20},
+			{SpanID: "c300000000000000", OperationName: "leaf", References: child("b200000000000000"), StartTime: 1e6 + 20, Duration: 5},
+		},
+	}, {
+		name: "error",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("query")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(5), tlog.KeyLogLevel, tlog.Warn, tlog.KeyMessage, tlog.Message("slow")},
+			{tlog.KeySpan, a, tlog.KeyTime, ts(8), tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("failed"), "code", 7},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 10 * time.Microsecond},
+		},
+		exp: []jaegerSpan{{
+			SpanID: "a100000000000000", OperationName: "query", References: []jaegerRef{}, StartTime: 1e6, Duration: 10,
+			Tags: []jaegerKV{{"error", "bool", true}},
+			Logs: []jaegerLog{{
+				Timestamp: 1e6 + 5,
+				Fields:    []jaegerKV{{"event", "string", "slow"}, {"level", "string", "warn"}},
+			}, {
+				Timestamp: 1e6 + 8,
+				Fields:    []jaegerKV{{"event", "string", "failed"}, {"level", "string", "error"}, {"code", "int64", 7.}},
+			}},
+		}},
+	}, {
+		name: "unfinished",
+		evs: [][]interface{}{
+			{tlog.KeySpan, a, tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("root")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(10), tlog.KeyEventType, tlog.EventType("s"), tlog.KeyParent, a, tlog.KeyMessage, tlog.Message("worker")},
+			{tlog.KeySpan, b, tlog.KeyTime, ts(30), tlog.KeyMessage, tlog.Message("still working")},
+			{tlog.KeySpan, a, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 20 * time.Microsecond},
+		},
+		exp: []jaegerSpan{
+			{SpanID: "a100000000000000", OperationName: "root", References: []jaegerRef{}, StartTime: 1e6, Duration: 20},
+			{
+				SpanID: "b200000000000000", OperationName: "worker", References: child("a100000000000000"), StartTime: 1e6 + 10,
+				Logs: []jaegerLog{{Timestamp: 1e6 + 30, Fields: []jaegerKV{{"event", "string", "still working"}}}},
+			},
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf low.Buf
+
+			w := NewJaegerWriter(&buf)
+			e := tlog.Encoder{Writer: w}
+
+			for _, kvs := range tc.evs {
+				err := e.Encode(nil, kvs)
+				require.NoError(t, err)
+			}
+
+			err := w.Close()
+			require.NoError(t, err)
+
+			var res jaegerFile
+
+			err = json.Unmarshal(buf, &res)
+			require.NoError(t, err, "%s", buf)
+
+			require.Len(t, res.Data, 1)
+			assert.Equal(t, trace, res.Data[0].TraceID)
+
+			for i := range tc.exp {
+				s := &tc.exp[i]
+
+				s.TraceID = trace
+				s.ProcessID = "p1"
+
+				if s.Tags == nil {
+					s.Tags = []jaegerKV{}
+				}
+
+				if s.Logs == nil {
+					s.Logs = []jaegerLog{}
+				}
+			}
+
+			assert.Equal(t, tc.exp, res.Data[0].Spans)
+		})
+	}
+}
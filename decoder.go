@@ -1,8 +1,10 @@
 package tlog
 
 import (
+	"fmt"
 	"io"
 	"math"
+	"time"
 
 	"github.com/nikandfor/errors"
 	"github.com/nikandfor/loc"
@@ -96,6 +98,154 @@ func (d *Decoder) Skip(st int) (i int) {
 	return
 }
 
+// Value decodes value at st into Go value.
+//
+// Semantic types are preserved:
+// time is time.Time, duration is time.Duration, message is Message,
+// and so on for ID, Labels, loc.PC, EventType, LogLevel and Hex.
+// Errors are decoded as error, maps as map[string]interface{},
+// arrays as []interface{}, integers as int64 (uint64 if it doesn't fit) and floats as float64.
+func (d *Decoder) Value(st int) (v interface{}, i int) {
+	tag, sub, i := d.Tag(st)
+	if d.err != nil {
+		return
+	}
+
+	switch tag {
+	case Int, Neg:
+		var x int64
+		x, i = d.Int(st)
+
+		if tag == Int && x < 0 {
+			v = uint64(x) // over MaxInt64
+		} else {
+			v = x
+		}
+	case Bytes:
+		var s []byte
+		s, i = d.String(st)
+
+		v = append([]byte{}, s...)
+	case String:
+		var s []byte
+		s, i = d.String(st)
+
+		v = string(s)
+	case Array:
+		arr := []interface{}{}
+		if sub > 0 && sub <= len(d.b)-i { // LenBreak is -1
+			arr = make([]interface{}, 0, sub)
+		}
+
+		for el := 0; sub == -1 || el < sub; el++ {
+			if sub == -1 && d.Break(&i) {
+				break
+			}
+
+			v, i = d.Value(i)
+			if d.err != nil {
+				return nil, i
+			}
+
+			arr = append(arr, v)
+		}
+
+		v = arr
+	case Map:
+		m := make(map[string]interface{})
+
+		var k interface{}
+		for el := 0; sub == -1 || el < sub; el++ {
+			if sub == -1 && d.Break(&i) {
+				break
+			}
+
+			k, i = d.Value(i)
+			if d.err != nil {
+				return nil, i
+			}
+
+			v, i = d.Value(i)
+			if d.err != nil {
+				return nil, i
+			}
+
+			if s, ok := k.(string); ok {
+				m[s] = v
+			} else {
+				m[fmt.Sprint(k)] = v
+			}
+		}
+
+		v = m
+	case Semantic:
+		v, i = d.semanticValue(st, sub, i)
+	case Special:
+		switch sub {
+		case False:
+			v = false
+		case True:
+			v = true
+		case Null, Undefined:
+		case FloatInt8, Float16, Float32, Float64:
+			v, i = d.Float(st)
+		default:
+			d.newErr(st, "unsupported special")
+		}
+	}
+
+	if d.err != nil {
+		return nil, i
+	}
+
+	return v, i
+}
+
+func (d *Decoder) semanticValue(st, sub, i int) (v interface{}, _ int) {
+	switch sub {
+	case WireTime:
+		var ts Timestamp
+		ts, i = d.Time(st)
+
+		return ts.Time(), i
+	case WireDuration:
+		var x int64
+		x, i = d.Int(i)
+
+		return time.Duration(x), i
+	case WireMessage, WireEventType, WireError:
+		var s []byte
+		s, i = d.String(i)
+
+		switch sub {
+		case WireMessage:
+			return Message(s), i
+		case WireEventType:
+			return EventType(s), i
+		default:
+			return errors.NewNoLoc("%s", s), i
+		}
+	case WireID:
+		return d.ID(st)
+	case WireLabels:
+		return d.Labels(st)
+	case WireLocation:
+		return d.Location(st)
+	case WireLogLevel:
+		return d.LogLevel(st)
+	case WireHex:
+		v, i = d.Value(i)
+
+		if x, ok := v.(int64); ok {
+			return Hex(x), i
+		}
+
+		return v, i
+	default:
+		return d.Value(i)
+	}
+}
+
 func (d *Decoder) ID(st int) (id ID, i int) {
 	tag, sub, i := d.Tag(st)
 	if d.err != nil {
@@ -114,6 +264,16 @@ func (d *Decoder) ID(st int) (id ID, i int) {
 }
 
 func (d *Decoder) Location(st int) (pc loc.PC, i int) {
+	pc, l, full, i := d.location(st)
+	if full {
+		pc.SetCache(l.name, l.file, l.line)
+	}
+
+	return pc, i
+}
+
+// location decodes location without touching the global loc cache.
+func (d *Decoder) location(st int) (pc loc.PC, l locInfo, full bool, i int) {
 	tag, sub, i := d.Tag(st)
 	if d.err != nil {
 		return
@@ -135,7 +295,7 @@ func (d *Decoder) Location(st int) (pc loc.PC, i int) {
 	if tag == Int {
 		v, i = d.Int(st)
 
-		return loc.PC(v), i
+		return loc.PC(v), l, false, i
 	}
 
 	if tag != Map {
@@ -143,9 +303,6 @@ func (d *Decoder) Location(st int) (pc loc.PC, i int) {
 		return
 	}
 
-	var name, file string
-	var line int
-
 	var k []byte
 	for el := 0; sub == -1 || el < sub; el++ {
 		if sub == -1 && d.Break(&i) {
@@ -158,6 +315,7 @@ func (d *Decoder) Location(st int) (pc loc.PC, i int) {
 		}
 		if len(k) == 0 {
 			d.newErr(st, "location map: empty key")
+			return
 		}
 
 		switch k[0] {
@@ -166,21 +324,19 @@ func (d *Decoder) Location(st int) (pc loc.PC, i int) {
 			pc = loc.PC(v)
 		case 'n':
 			k, i = d.String(i)
-			name = string(k)
+			l.name = string(k)
 		case 'f':
 			k, i = d.String(i)
-			file = string(k)
+			l.file = string(k)
 		case 'l':
 			v, i = d.Int(i)
-			line = int(v)
+			l.line = int(v)
 		default:
 			i = d.Skip(i)
 		}
 	}
 
-	pc.SetCache(name, file, line)
-
-	return
+	return pc, l, d.err == nil, i
 }
 
 func (d *Decoder) Labels(st int) (ls Labels, i int) {
@@ -209,7 +365,8 @@ func (d *Decoder) Labels(st int) (ls Labels, i int) {
 			break
 		}
 
-		s, i := d.String(i)
+		var s []byte
+		s, i = d.String(i)
 		if d.err != nil {
 			return nil, i
 		}
@@ -243,7 +400,7 @@ func (d *Decoder) LogLevel(st int) (lv LogLevel, i int) {
 	}
 
 	if tag != Semantic || sub != WireLogLevel {
-		d.newErr(st, "expected time")
+		d.newErr(st, "expected log level")
 		return
 	}
 
@@ -523,7 +680,12 @@ func (w *Dumper) Write(p []byte) (int, error) {
 	w.b = w.b[:0]
 
 	i := 0
-	for i < len(p) {
+	for i < len(p) && w.d.err == nil {
+		if w.d.IsFrame(i) {
+			i = w.dumpFrame(i)
+			continue
+		}
+
 		i = w.dump(i, 0)
 	}
 
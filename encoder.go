@@ -20,6 +20,10 @@ type (
 		Labels Labels
 		ls     map[loc.PC]struct{}
 
+		// Framed wraps each event into a frame with sync marker, length and checksum.
+		// Decoder can skip damaged frames and resynchronize on the next one.
+		Framed bool
+
 		newLabels Labels
 
 		b []byte
@@ -102,6 +106,7 @@ const (
 	WireLogLevel
 
 	WireHex
+	WireFrame
 )
 
 func (e *Encoder) resetRotated() {
@@ -129,6 +134,10 @@ func (e *Encoder) Encode(hdr []interface{}, kvs ...[]interface{}) (err error) {
 again:
 	e.b = e.b[:0]
 
+	if e.Framed {
+		e.b = append(e.b, frameStub...)
+	}
+
 	if e.pos == 0 {
 		e.b = e.appendHeader(e.b)
 	}
@@ -145,6 +154,10 @@ again:
 		}
 	}
 
+	if e.Framed {
+		e.b = finishFrame(e.b, 0)
+	}
+
 	n, err := e.Write(e.b)
 	e.pos += int64(n)
 
@@ -178,12 +191,7 @@ func (e *Encoder) appendHeader(b []byte) []byte {
 		return b
 	}
 
-	b = e.AppendTag(b, Map, 1)
-
-	b = e.AppendString(b, String, KeyLabels)
-	b = e.AppendLabels(b, e.Labels)
-
-	return b
+	return e.AppendLabelsHeader(b, e.Labels)
 }
 
 func (e *Encoder) calcMapLen(kvs []interface{}) (l int) {
@@ -419,13 +427,21 @@ func (e *Encoder) AppendLoc(b []byte, pc loc.PC, cache bool) []byte {
 		return e.AppendUint(b, Int, uint64(pc))
 	}
 
+	name, file, line := pc.NameFileLine()
+
+	b = e.appendLocFull(b, pc, name, file, line)
+
+	e.ls[pc] = struct{}{}
+
+	return b
+}
+
+func (e *Encoder) appendLocFull(b []byte, pc loc.PC, name, file string, line int) []byte {
 	b = append(b, Map|4)
 
 	b = e.AppendString(b, String, "p")
 	b = e.AppendUint(b, Int, uint64(pc))
 
-	name, file, line := pc.NameFileLine()
-
 	b = e.AppendString(b, String, "n")
 	b = e.AppendString(b, String, name)
 
@@ -435,11 +451,82 @@ func (e *Encoder) AppendLoc(b []byte, pc loc.PC, cache bool) []byte {
 	b = e.AppendString(b, String, "l")
 	b = e.AppendInt(b, int64(line))
 
-	e.ls[pc] = struct{}{}
-
 	return b
 }
 
+// AppendEvent appends a copy of the parsed event with location written in full,
+// so it doesn't depend on the stream it was read from.
+// Labels ls are added if not nil and the event has no labels of its own.
+func (e *Encoder) AppendEvent(b []byte, ev *Event, ls Labels) (_ []byte, err error) {
+	var d Decoder
+	d.ResetBytes(ev.raw)
+
+	tag, els, i := d.Tag(0)
+	if tag != Map {
+		return b, errors.New("expected map, got %x", tag)
+	}
+
+	addLabels := ls != nil && !ev.hasLabels
+
+	st := len(b)
+
+	if addLabels && els != -1 {
+		b = e.AppendTag(b, Map, els+1)
+	} else {
+		b = append(b, ev.raw[:i]...)
+	}
+
+	for el := 0; els == -1 || el < els; el++ {
+		if els == -1 && d.Break(&i) {
+			break
+		}
+
+		kst := i
+
+		var k []byte
+		k, i = d.String(i)
+
+		vst := i
+
+		tag, sub, _ := d.Tag(i)
+		i = d.Skip(i)
+
+		if string(k) != KeyLocation || tag != Semantic || sub != WireLocation || ev.Location == 0 {
+			b = append(b, ev.raw[kst:i]...)
+			continue
+		}
+
+		name, file, line := ev.LocationInfo()
+
+		b = append(b, ev.raw[kst:vst]...)
+		b = append(b, Semantic|WireLocation)
+		b = e.appendLocFull(b, ev.Location, name, file, line)
+	}
+
+	if err = d.Err(); err != nil {
+		return b[:st], err
+	}
+
+	if addLabels {
+		b = e.AppendString(b, String, KeyLabels)
+		b = e.AppendLabels(b, ls)
+	}
+
+	if els == -1 {
+		b = append(b, Special|Break)
+	}
+
+	return b, nil
+}
+
+// AppendLabelsHeader appends the event setting stream labels to ls.
+func (e *Encoder) AppendLabelsHeader(b []byte, ls Labels) []byte {
+	b = e.AppendTag(b, Map, 1)
+	b = e.AppendString(b, String, KeyLabels)
+
+	return e.AppendLabels(b, ls)
+}
+
 func (e *Encoder) AppendLabels(b []byte, ls Labels) []byte {
 	b = append(b, Semantic|WireLabels)
 	b = e.AppendTag(b, Array, len(ls))
@@ -0,0 +1,295 @@
+package tlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Event is a parsed view of one encoded event.
+	//
+	// Well-known fields are decoded into struct fields.
+	// The rest key-value pairs are available in the original order by index or by key.
+	//
+	// Event refers to the buffer it was parsed from (Message, Key and RawValue results included).
+	// Use Clone to keep it after the buffer is reused.
+	Event struct {
+		Time     Timestamp
+		Span     ID
+		Parent   ID
+		Type     EventType
+		Level    LogLevel
+		Message  []byte
+		Location loc.PC
+		Elapsed  time.Duration
+
+		// Labels are event labels if it has them or current labels in the stream otherwise.
+		Labels Labels
+
+		raw []byte
+		kvs []int // key start, value start, value end
+
+		hasLabels bool
+		locFull   bool // location is defined by the event
+		locKnown  bool // loc is set
+		loc       locInfo
+	}
+)
+
+// Parse parses the first event in p and returns its end.
+//
+// Semantic header is skipped.
+func (ev *Event) Parse(p []byte) (i int, err error) {
+	var d Decoder
+	d.ResetBytes(p)
+
+	return ev.parse(&d, 0)
+}
+
+func (ev *Event) parse(d *Decoder, st int) (i int, err error) {
+	ev.reset()
+
+again:
+	tag, els, i := d.Tag(st)
+	if err = d.Err(); err != nil {
+		return
+	}
+
+	if tag == Semantic && els == WireHeader {
+		st = d.Skip(st)
+		if err = d.Err(); err != nil {
+			return
+		}
+
+		goto again
+	}
+
+	if tag != Map {
+		return st, errors.New("expected map, got %x", tag)
+	}
+
+	var k []byte
+	var sub int
+	for el := 0; els == -1 || el < els; el++ {
+		if els == -1 && d.Break(&i) {
+			break
+		}
+
+		kst := i
+
+		k, i = d.String(i)
+		if err = d.Err(); err != nil {
+			return
+		}
+
+		vst := i
+
+		tag, sub, i = d.Tag(i)
+		if err = d.Err(); err != nil {
+			return
+		}
+
+		ks := low.UnsafeBytesToString(k)
+
+		switch {
+		case ks == KeyTime && tag == Semantic && sub == WireTime:
+			ev.Time, i = d.Time(vst)
+		case ks == KeySpan && tag == Semantic && sub == WireID:
+			ev.Span, i = d.ID(vst)
+		case ks == KeyParent && tag == Semantic && sub == WireID:
+			ev.Parent, i = d.ID(vst)
+		case ks == KeyMessage && (tag == Semantic && sub == WireMessage || tag == String):
+			if tag == Semantic {
+				ev.Message, i = d.String(i)
+			} else {
+				ev.Message, i = d.String(vst)
+			}
+		case ks == KeyLocation && tag == Semantic && sub == WireLocation:
+			ev.Location, ev.loc, ev.locFull, i = d.location(vst)
+			ev.locKnown = ev.locFull
+
+			if ev.locFull {
+				ev.Location.SetCache(ev.loc.name, ev.loc.file, ev.loc.line)
+			}
+		case ks == KeyElapsed && tag == Semantic && sub == WireDuration:
+			var v int64
+			v, i = d.Int(i)
+
+			ev.Elapsed = time.Duration(v)
+		case ks == KeyEventType && tag == Semantic && sub == WireEventType:
+			var s []byte
+			s, i = d.String(i)
+
+			ev.Type = eventType(s)
+		case ks == KeyLogLevel && tag == Semantic && sub == WireLogLevel:
+			ev.Level, i = d.LogLevel(vst)
+		case ks == KeyLabels && tag == Semantic && sub == WireLabels:
+			ev.Labels, i = d.Labels(vst)
+			ev.hasLabels = true
+		default:
+			i = d.Skip(vst)
+
+			ev.kvs = append(ev.kvs, kst-st, vst-st, i-st)
+		}
+
+		if err = d.Err(); err != nil {
+			return
+		}
+	}
+
+	ev.raw = d.b[st:i]
+
+	return i, nil
+}
+
+func (ev *Event) reset() {
+	*ev = Event{
+		kvs: ev.kvs[:0],
+	}
+}
+
+// LocationInfo returns Location function name, file and line.
+// They are taken from the stream the event was read from if known
+// so that events from different processes don't mix up in the global loc cache.
+func (ev *Event) LocationInfo() (name, file string, line int) {
+	if ev.locKnown {
+		return ev.loc.name, ev.loc.file, ev.loc.line
+	}
+
+	return ev.Location.NameFileLine()
+}
+
+// LocationDefined reports whether the event has its location written in full
+// rather than referring to the one defined earlier in the stream.
+func (ev *Event) LocationDefined() bool { return ev.locFull }
+
+// IsHeader reports whether the event only sets stream labels.
+func (ev *Event) IsHeader() bool {
+	return ev.hasLabels && ev.Len() == 0 && len(ev.Message) == 0 && ev.Type == "" && ev.Level == 0 &&
+		ev.Time == 0 && ev.Span == (ID{}) && ev.Parent == (ID{}) && ev.Location == 0 && ev.Elapsed == 0
+}
+
+// Raw returns the whole encoded event.
+func (ev *Event) Raw() []byte { return ev.raw }
+
+// Len returns the number of not well-known key-value pairs.
+func (ev *Event) Len() int { return len(ev.kvs) / 3 }
+
+// Key returns i-th key.
+func (ev *Event) Key(i int) []byte {
+	var d Decoder
+	d.ResetBytes(ev.raw)
+
+	k, _ := d.String(ev.kvs[3*i])
+
+	return k
+}
+
+// RawValue returns i-th encoded value.
+func (ev *Event) RawValue(i int) []byte {
+	return ev.raw[ev.kvs[3*i+1]:ev.kvs[3*i+2]]
+}
+
+// Value decodes i-th value (see Decoder.Value).
+func (ev *Event) Value(i int) interface{} {
+	var d Decoder
+	d.ResetBytes(ev.raw)
+
+	v, _ := d.Value(ev.kvs[3*i+1])
+
+	return v
+}
+
+// ValueString returns i-th value as plain text.
+// IDs are formatted in full, locations as file:line, labels are comma separated
+// and arrays and maps are encoded as json.
+func (ev *Event) ValueString(i int) string {
+	switch v := ev.Value(i).(type) {
+	case nil:
+		return "null"
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case ID:
+		return v.FullString()
+	case loc.PC:
+		_, file, line := v.NameFileLine()
+
+		return fmt.Sprintf("%v:%d", file, line)
+	case Labels:
+		return strings.Join(v, ",")
+	case map[string]interface{}, []interface{}:
+		r, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+
+		return string(r)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// GetRaw finds the first pair with key k and returns encoded value.
+func (ev *Event) GetRaw(k string) ([]byte, bool) {
+	for i := 0; i < ev.Len(); i++ {
+		if string(ev.Key(i)) == k {
+			return ev.RawValue(i), true
+		}
+	}
+
+	return nil, false
+}
+
+// Get finds the first pair with key k and decodes its value.
+func (ev *Event) Get(k string) (interface{}, bool) {
+	for i := 0; i < ev.Len(); i++ {
+		if string(ev.Key(i)) == k {
+			return ev.Value(i), true
+		}
+	}
+
+	return nil, false
+}
+
+// Clone makes a deep copy of the Event which doesn't refer to the original buffer.
+func (ev *Event) Clone() *Event {
+	c := *ev
+
+	c.raw = append([]byte{}, ev.raw...)
+	c.kvs = append([]int{}, ev.kvs...)
+
+	if ev.Message != nil {
+		c.Message = append([]byte{}, ev.Message...)
+	}
+
+	if ev.Labels != nil {
+		c.Labels = ev.Labels.Copy()
+	}
+
+	return &c
+}
+
+func eventType(s []byte) EventType {
+	switch string(s) {
+	case "s":
+		return "s"
+	case "f":
+		return "f"
+	case "v":
+		return "v"
+	case "m":
+		return "m"
+	}
+
+	return EventType(s)
+}
@@ -0,0 +1,809 @@
+package filter
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// Filter is a compiled event filter expression.
+	//
+	// Expression is a list of conditions combined with and (&&, or just a space), or (||), not (!) and parentheses.
+	// Condition is a key alone (key is present) or key, operator and value.
+	// Operators are = != ~ !~ (regexp) < <= > >=.
+	// Values may be quoted as Go strings. Unquoted keys and values end at spaces, parentheses, & and |,
+	// so values containing them must be quoted: m~"refused|timeout".
+	//
+	// Special keys:
+	//	m, msg       message
+	//	i, level     log level (debug, info, warn, error, fatal)
+	//	t, time      event time (RFC3339, 2006-01-02, 2006-01-02T15:04:05, or duration relative to now: -1h)
+	//	s, span      span id (= matches id prefix, like the short ids printed by console)
+	//	p, parent    parent span id
+	//	T, type      event type
+	//	e, elapsed   span duration (Go duration: 1.5s)
+	//	L.<name>     label value, L alone matches any label (L=canary, L~^env=)
+	//	loc          location as file.go:line
+	//	func         function name
+	// Other keys match event key-value pairs.
+	// Numbers, durations and times are compared by value, the rest as strings.
+	//
+	// Example: level>=warn && !(m~"^retry" || L.env=dev) && t>-1h
+	Filter struct {
+		src  string
+		root node
+	}
+
+	node interface {
+		match(ev *tlog.Event) bool
+	}
+
+	and []node
+	or  []node
+
+	not struct {
+		node
+	}
+
+	cond struct {
+		key  string
+		kind int
+		op   string
+		val  string
+
+		re  *regexp.Regexp
+		num float64
+		dur time.Duration
+		ts  tlog.Timestamp
+		rel time.Duration // ts relative to now if isRel
+
+		isNum, isDur, isTime, isRel bool
+	}
+
+	parser struct {
+		s string
+		i int
+	}
+)
+
+const (
+	kindKV = iota
+	kindMessage
+	kindLevel
+	kindTime
+	kindSpan
+	kindParent
+	kindType
+	kindElapsed
+	kindLabel
+	kindLabels
+	kindLoc
+	kindFunc
+)
+
+var now = time.Now
+
+var timeFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// Parse compiles expression. Empty expression matches everything.
+func Parse(s string) (f *Filter, err error) {
+	p := &parser{s: s}
+
+	f = &Filter{src: s}
+
+	p.space()
+
+	if p.i == len(p.s) {
+		return f, nil
+	}
+
+	f.root, err = p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	p.space()
+
+	if p.i != len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.i:])
+	}
+
+	return f, nil
+}
+
+// MustParse is like Parse but panics on error.
+func MustParse(s string) *Filter {
+	f, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+// Match reports whether event matches the filter.
+// nil Filter matches everything.
+func (f *Filter) Match(ev *tlog.Event) bool {
+	if f == nil || f.root == nil {
+		return true
+	}
+
+	return f.root.match(ev)
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.src
+}
+
+func (x and) match(ev *tlog.Event) bool {
+	for _, n := range x {
+		if !n.match(ev) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (x or) match(ev *tlog.Event) bool {
+	for _, n := range x {
+		if n.match(ev) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (x not) match(ev *tlog.Event) bool {
+	return !x.node.match(ev)
+}
+
+func (p *parser) or() (node, error) {
+	var x or
+
+	for {
+		n, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		x = append(x, n)
+
+		p.space()
+
+		if !p.word("||") && !p.word("or") {
+			break
+		}
+	}
+
+	if len(x) == 1 {
+		return x[0], nil
+	}
+
+	return x, nil
+}
+
+func (p *parser) and() (node, error) {
+	var x and
+
+	for {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		x = append(x, n)
+
+		p.space()
+
+		if p.word("&&") || p.word("and") {
+			continue
+		}
+
+		if p.i == len(p.s) || p.s[p.i] == ')' || p.peek("||") || p.peek("or") {
+			break
+		}
+	}
+
+	if len(x) == 1 {
+		return x[0], nil
+	}
+
+	return x, nil
+}
+
+func (p *parser) unary() (node, error) {
+	p.space()
+
+	if p.i == len(p.s) {
+		return nil, p.errorf("expression expected")
+	}
+
+	if p.word("!") || p.word("not") {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		return not{n}, nil
+	}
+
+	if p.s[p.i] == '(' {
+		p.i++
+
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		p.space()
+
+		if p.i == len(p.s) || p.s[p.i] != ')' {
+			return nil, p.errorf("')' expected")
+		}
+
+		p.i++
+
+		return n, nil
+	}
+
+	return p.cond()
+}
+
+func (p *parser) cond() (node, error) {
+	st := p.i
+
+	for p.i < len(p.s) && !isDelim(p.s[p.i]) && !isOp(p.s[p.i]) {
+		p.i++
+	}
+
+	if p.i == st {
+		return nil, p.errorf("key expected")
+	}
+
+	c := &cond{key: p.s[st:p.i]}
+
+	for _, op := range []string{"!=", "!~", "<=", ">=", "=", "~", "<", ">"} {
+		if strings.HasPrefix(p.s[p.i:], op) {
+			c.op = op
+			p.i += len(op)
+
+			break
+		}
+	}
+
+	if c.op != "" {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+
+		c.val = v
+	}
+
+	err := c.compile()
+	if err != nil {
+		return nil, errors.Wrap(err, "%v", p.s[st:p.i])
+	}
+
+	return c, nil
+}
+
+func (p *parser) value() (string, error) {
+	if p.i < len(p.s) && p.s[p.i] == '"' {
+		st := p.i
+		p.i++
+
+		for p.i < len(p.s) && p.s[p.i] != '"' {
+			if p.s[p.i] == '\\' {
+				p.i++
+			}
+
+			p.i++
+		}
+
+		if p.i >= len(p.s) {
+			return "", p.errorf("unterminated string")
+		}
+
+		p.i++
+
+		return strconv.Unquote(p.s[st:p.i])
+	}
+
+	st := p.i
+
+	for p.i < len(p.s) && !isDelim(p.s[p.i]) {
+		p.i++
+	}
+
+	return p.s[st:p.i], nil
+}
+
+func (p *parser) space() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t' || p.s[p.i] == '\n') {
+		p.i++
+	}
+}
+
+func (p *parser) peek(w string) bool {
+	if !strings.HasPrefix(p.s[p.i:], w) {
+		return false
+	}
+
+	if w[0] < 'a' || w[0] > 'z' {
+		return true
+	}
+
+	e := p.i + len(w)
+
+	return e == len(p.s) || isDelim(p.s[e])
+}
+
+func (p *parser) word(w string) bool {
+	if !p.peek(w) {
+		return false
+	}
+
+	p.i += len(w)
+
+	return true
+}
+
+func (p *parser) errorf(f string, args ...interface{}) error {
+	return errors.New("filter: pos %d: %s", p.i, fmt.Sprintf(f, args...))
+}
+
+func isDelim(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '(' || c == ')' || c == '&' || c == '|'
+}
+
+func isOp(c byte) bool {
+	return c == '=' || c == '!' || c == '~' || c == '<' || c == '>' || c == '"'
+}
+
+func (c *cond) compile() (err error) {
+	switch c.key {
+	case tlog.KeyMessage, "msg", "message":
+		c.kind = kindMessage
+	case tlog.KeyLogLevel, "level", "lv":
+		c.kind = kindLevel
+	case tlog.KeyTime, "time":
+		c.kind = kindTime
+	case tlog.KeySpan, "span":
+		c.kind = kindSpan
+	case tlog.KeyParent, "parent":
+		c.kind = kindParent
+	case tlog.KeyEventType, "type":
+		c.kind = kindType
+	case tlog.KeyElapsed, "elapsed":
+		c.kind = kindElapsed
+	case tlog.KeyLabels, "label", "labels":
+		c.kind = kindLabels
+	case "loc":
+		c.kind = kindLoc
+	case "func":
+		c.kind = kindFunc
+	default:
+		if strings.HasPrefix(c.key, "L.") || strings.HasPrefix(c.key, "label.") {
+			c.kind = kindLabel
+			c.key = c.key[strings.IndexByte(c.key, '.')+1:]
+		}
+	}
+
+	if c.op == "" {
+		return nil
+	}
+
+	if c.op == "~" || c.op == "!~" {
+		c.re, err = regexp.Compile(c.val)
+
+		return err
+	}
+
+	switch c.kind {
+	case kindLevel:
+		lv, ok := parseLevel(c.val)
+		if !ok {
+			return errors.New("bad level: %v", c.val)
+		}
+
+		c.num, c.isNum = float64(lv), true
+	case kindTime:
+		if c.rel, c.isRel = parseRelTime(c.val); !c.isRel {
+			c.ts, err = parseTime(c.val)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.isTime = true
+	case kindElapsed:
+		c.dur, err = time.ParseDuration(c.val)
+		if err != nil {
+			return err
+		}
+
+		c.isDur = true
+	case kindSpan, kindParent:
+		c.val = strings.ToLower(c.val)
+
+		if len(c.val) > 2*len(tlog.ID{}) {
+			return errors.New("bad id: too long")
+		}
+
+		if _, err = tlog.IDFromString(c.val); err != nil && !errors.As(err, &tlog.ShortIDError{}) {
+			return errors.Wrap(err, "bad id")
+		}
+
+		if c.op != "=" && c.op != "!=" {
+			return errors.New("ids support only = != ~ !~")
+		}
+	case kindKV:
+		if f, err := strconv.ParseFloat(c.val, 64); err == nil {
+			c.num, c.isNum = f, true
+		}
+
+		if d, err := time.ParseDuration(c.val); err == nil {
+			c.dur, c.isDur = d, true
+		}
+
+		if d, ok := parseRelTime(c.val); ok {
+			c.rel, c.isRel, c.isTime = d, true, true
+		} else if ts, err := parseTime(c.val); err == nil {
+			c.ts, c.isTime = ts, true
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns event value by key. Keys are the same as in Filter expression.
+// Level is returned as its name, location as file.go:line.
+func Lookup(ev *tlog.Event, key string) (v interface{}, ok bool) {
+	c := cond{key: key}
+
+	_ = c.compile()
+
+	switch c.kind {
+	case kindMessage:
+		return string(ev.Message), len(ev.Message) != 0
+	case kindLevel:
+		return levelString(ev.Level), true
+	case kindTime:
+		return ev.Time.Time(), ev.Time != 0
+	case kindSpan:
+		return ev.Span, ev.Span != (tlog.ID{})
+	case kindParent:
+		return ev.Parent, ev.Parent != (tlog.ID{})
+	case kindType:
+		return string(ev.Type), ev.Type != ""
+	case kindElapsed:
+		return ev.Elapsed, ev.Elapsed != 0
+	case kindLabel:
+		return ev.Labels.Lookup(c.key)
+	case kindLabels:
+		return ev.Labels, len(ev.Labels) != 0
+	case kindLoc:
+		if ev.Location == 0 {
+			return nil, false
+		}
+
+		_, file, line := ev.LocationInfo()
+
+		return filepath.Base(file) + ":" + strconv.Itoa(line), true
+	case kindFunc:
+		if ev.Location == 0 {
+			return nil, false
+		}
+
+		name, _, _ := ev.LocationInfo()
+
+		return name, true
+	}
+
+	return ev.Get(key)
+}
+
+// Format formats value the way it's matched by string operators.
+func Format(v interface{}) string {
+	return format(v)
+}
+
+func (c *cond) match(ev *tlog.Event) bool {
+	switch c.kind {
+	case kindMessage:
+		return c.str(string(ev.Message), len(ev.Message) != 0)
+	case kindLevel:
+		if c.op == "" || c.re != nil {
+			return c.str(levelString(ev.Level), ev.Level != tlog.Info)
+		}
+
+		return c.cmp(compareFloat(float64(ev.Level), c.num))
+	case kindTime:
+		if c.op == "" || c.re != nil {
+			return c.str(ev.Time.Time().UTC().Format(time.RFC3339Nano), ev.Time != 0)
+		}
+
+		return ev.Time != 0 && c.cmp(compareInt(int64(ev.Time), c.time()))
+	case kindSpan:
+		return c.id(ev.Span)
+	case kindParent:
+		return c.id(ev.Parent)
+	case kindType:
+		return c.str(string(ev.Type), ev.Type != "")
+	case kindElapsed:
+		if c.op == "" || c.re != nil {
+			return c.str(ev.Elapsed.String(), ev.Elapsed != 0)
+		}
+
+		return c.cmp(compareInt(int64(ev.Elapsed), int64(c.dur)))
+	case kindLabel:
+		v, ok := ev.Labels.Lookup(c.key)
+
+		return c.str(v, ok)
+	case kindLabels:
+		if c.op == "" {
+			return len(ev.Labels) != 0
+		}
+
+		neg := c.op == "!=" || c.op == "!~"
+
+		for _, l := range ev.Labels {
+			if c.str(l, true) != neg {
+				return !neg
+			}
+		}
+
+		return neg
+	case kindLoc:
+		if ev.Location == 0 {
+			return c.str("", false)
+		}
+
+		_, file, line := ev.LocationInfo()
+
+		return c.str(filepath.Base(file)+":"+strconv.Itoa(line), true)
+	case kindFunc:
+		if ev.Location == 0 {
+			return c.str("", false)
+		}
+
+		name, _, _ := ev.LocationInfo()
+
+		return c.str(name, true)
+	}
+
+	v, ok := ev.Get(c.key)
+	if !ok {
+		return c.op == "!=" || c.op == "!~"
+	}
+
+	if c.op == "" {
+		return true
+	}
+
+	if c.re != nil {
+		return c.str(format(v), true)
+	}
+
+	switch x := v.(type) {
+	case int64:
+		if c.isNum {
+			return c.cmp(compareFloat(float64(x), c.num))
+		}
+	case uint64:
+		if c.isNum {
+			return c.cmp(compareFloat(float64(x), c.num))
+		}
+	case tlog.Hex:
+		if c.isNum {
+			return c.cmp(compareFloat(float64(x), c.num))
+		}
+	case float64:
+		if c.isNum {
+			return c.cmp(compareFloat(x, c.num))
+		}
+	case time.Duration:
+		if c.isDur {
+			return c.cmp(compareInt(int64(x), int64(c.dur)))
+		}
+	case time.Time:
+		if c.isTime {
+			return c.cmp(compareInt(x.UnixNano(), c.time()))
+		}
+	case tlog.ID:
+		if c.op == "=" || c.op == "!=" {
+			return c.id(x)
+		}
+	}
+
+	return c.str(format(v), true)
+}
+
+// time returns the time to compare with. Relative time is resolved at match time,
+// so long running filters don't stick to the moment they were parsed.
+func (c *cond) time() int64 {
+	if c.isRel {
+		return now().Add(c.rel).UnixNano()
+	}
+
+	return int64(c.ts)
+}
+
+// str matches string value. ok is false if the value is absent.
+func (c *cond) str(v string, ok bool) bool {
+	switch c.op {
+	case "":
+		return ok
+	case "~":
+		return ok && c.re.MatchString(v)
+	case "!~":
+		return !ok || !c.re.MatchString(v)
+	case "!=":
+		return !ok || v != c.val
+	}
+
+	return ok && c.cmp(strings.Compare(v, c.val))
+}
+
+func (c *cond) id(id tlog.ID) bool {
+	zero := id == (tlog.ID{})
+
+	switch c.op {
+	case "":
+		return !zero
+	case "=":
+		return !zero && strings.HasPrefix(id.FullString(), c.val)
+	case "!=":
+		return zero || !strings.HasPrefix(id.FullString(), c.val)
+	}
+
+	return c.str(id.FullString(), !zero)
+}
+
+func (c *cond) cmp(r int) bool {
+	switch c.op {
+	case "=":
+		return r == 0
+	case "!=":
+		return r != 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	}
+
+	return false
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func format(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case tlog.Message:
+		return string(x)
+	case tlog.ID:
+		return x.FullString()
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+
+	return fmt.Sprint(v)
+}
+
+// parseRelTime parses time relative to now: now, -1h, +10m.
+func parseRelTime(s string) (time.Duration, bool) {
+	if s == "now" {
+		return 0, true
+	}
+
+	if s == "" || s[0] != '-' && s[0] != '+' {
+		return 0, false
+	}
+
+	d, err := time.ParseDuration(s)
+
+	return d, err == nil
+}
+
+func parseTime(s string) (tlog.Timestamp, error) {
+	for _, f := range timeFormats {
+		t, err := time.ParseInLocation(f, s, time.Local)
+		if err == nil {
+			return tlog.Timestamp(t.UnixNano()), nil
+		}
+	}
+
+	return 0, errors.New("bad time: %v", s)
+}
+
+func parseLevel(s string) (tlog.LogLevel, bool) {
+	switch strings.ToLower(s) {
+	case "debug", "dbg", "trace":
+		return tlog.Debug, true
+	case "info", "inf":
+		return tlog.Info, true
+	case "warn", "warning", "wrn":
+		return tlog.Warn, true
+	case "error", "err":
+		return tlog.Error, true
+	case "fatal", "ftl":
+		return tlog.Fatal, true
+	}
+
+	x, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+
+	return tlog.LogLevel(x), true
+}
+
+func levelString(lv tlog.LogLevel) string {
+	switch lv {
+	case tlog.Debug:
+		return "debug"
+	case tlog.Info:
+		return "info"
+	case tlog.Warn:
+		return "warn"
+	case tlog.Error:
+		return "error"
+	case tlog.Fatal:
+		return "fatal"
+	}
+
+	return strconv.Itoa(int(lv))
+}
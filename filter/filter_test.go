@@ -0,0 +1,255 @@
+package filter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/loc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+)
+
+var testTime = time.Date(2020, time.December, 25, 22, 8, 13, 0, time.UTC)
+
+func testEvent(t *testing.T, kvs ...interface{}) *tlog.Event {
+	var b bytes.Buffer
+
+	e := tlog.Encoder{Writer: &b}
+
+	err := e.Encode(nil, kvs)
+	require.NoError(t, err)
+
+	var ev tlog.Event
+
+	_, err = ev.Parse(b.Bytes())
+	require.NoError(t, err)
+
+	ev.Labels = tlog.Labels{"env=prod", "canary"}
+
+	return &ev
+}
+
+func TestMatch(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return testTime.Add(30 * time.Minute) }
+
+	span := tlog.ID{0xaa, 0xbb, 0xcc, 0xdd, 1, 2, 3, 4}
+
+	ev := testEvent(t,
+		tlog.KeyTime, tlog.Timestamp(testTime.UnixNano()),
+		tlog.KeySpan, span,
+		tlog.KeyLogLevel, tlog.Warn,
+		tlog.KeyMessage, tlog.Message("connection refused"),
+		tlog.KeyLocation, loc.Caller(0),
+		"user", "alice",
+		"code", 503,
+		"took", 1500*time.Millisecond,
+	)
+
+	for _, tc := range []struct {
+		q   string
+		exp bool
+	}{
+		{"", true},
+		{"user", true},
+		{"missing", false},
+		{"!missing", true},
+		{"user=alice", true},
+		{"user!=alice", false},
+		{`user="alice"`, true},
+		{"missing!=x", true},
+		{"code=503", true},
+		{"code>=500 code<600", true},
+		{"code>503", false},
+		{"took>1s", true},
+		{"took<1s", false},
+		{"m~refused", true},
+		{`msg~"^conn.*d$"`, true},
+		{"m!~refused", false},
+		{"m=x || m~conn", true},
+		{"m=x or user=bob", false},
+		{"level>=warn", true},
+		{"level>=error", false},
+		{"level=warn && user=alice", true},
+		{"not (level=warn and user=alice)", false},
+		{"i~^w", true},
+		{"t>2020-12-25", true},
+		{"t<2020-12-25T22:00:00Z", false},
+		{"t>-1h", true},
+		{"t>-10m", false},
+		{"span=aabbccdd", true},
+		{"s=AABB", true},
+		{"s=aabbccde", false},
+		{"s!=aabbccde", true},
+		{"parent", false},
+		{"p=aa", false},
+		{"L.env=prod", true},
+		{"label.env!=prod", false},
+		{"L.canary", true},
+		{"L.missing", false},
+		{"L=canary", true},
+		{"L~^env=", true},
+		{"L=dev", false},
+		{"L!=dev", true},
+		{"loc~filter_test.go", true},
+		{"func~TestMatch$", true},
+		{"T", false},
+		{"e", false},
+		{"user=alice&&code=503", true},
+		{"user=bob||code=503", true},
+		{"code>=500&&code<600", true},
+		{"(user=bob||m~refused)&&level>=warn", true},
+		{"!(user=alice)&&code=503", false},
+		{"user=alice&&(code=1||took>1s)", true},
+		{"user&&!missing", true},
+		{`m~"refused|timeout"`, true},
+	} {
+		f, err := Parse(tc.q)
+		if !assert.NoError(t, err, "query: %v", tc.q) {
+			continue
+		}
+
+		assert.Equal(t, tc.exp, f.Match(ev), "query: %v", tc.q)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, q := range []string{
+		"(a=b",
+		"a=b)",
+		"level>=loud",
+		"t>yesterday",
+		"m~(",
+		"s=zz",
+		"s=0102030405060708090a0b0c0d0e0f1011",
+		"p=" + strings.Repeat("a", 100),
+		"s>aa",
+		`a="b`,
+		"a=b ||",
+		"!",
+		"m~refused|timeout",
+		"a=b&c",
+	} {
+		_, err := Parse(q)
+		assert.Error(t, err, "query: %v", q)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+
+	w := NewWriter(&b, MustParse("n>=2"))
+
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"a=b"}}
+	pc := loc.Caller(0)
+
+	for i := 0; i < 4; i++ {
+		err := e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("msg"), "n", i})
+		require.NoError(t, err)
+	}
+
+	r := tlog.NewReader(&b)
+
+	var ns []interface{}
+
+	for r.Next() {
+		ev := r.Event()
+
+		if len(ev.Message) == 0 {
+			continue // labels
+		}
+
+		assert.Equal(t, tlog.Labels{"a=b"}, ev.Labels)
+
+		_, file, _ := ev.Location.NameFileLine()
+		assert.Contains(t, file, "filter_test.go")
+
+		v, _ := ev.Get("n")
+		ns = append(ns, v)
+	}
+
+	require.NoError(t, r.Err())
+
+	assert.Equal(t, []interface{}{int64(2), int64(3)}, ns)
+}
+
+func TestWriterRotated(t *testing.T) {
+	rw := &rotatingWriter{files: []bytes.Buffer{{}}}
+
+	w := NewWriter(rw, MustParse("n>=1"))
+
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"a=b"}}
+
+	for i := 0; i < 4; i++ {
+		err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("msg"), "n", i})
+		require.NoError(t, err)
+	}
+
+	require.Len(t, rw.files, 2)
+
+	var ns []interface{}
+
+	for i := range rw.files {
+		r := tlog.NewReader(&rw.files[i])
+
+		for r.Next() {
+			ev := r.Event()
+
+			if len(ev.Message) == 0 {
+				continue // labels
+			}
+
+			assert.Equal(t, tlog.Labels{"a=b"}, ev.Labels, "file %d", i)
+
+			v, _ := ev.Get("n")
+			ns = append(ns, v)
+		}
+
+		require.NoError(t, r.Err())
+	}
+
+	assert.Equal(t, []interface{}{int64(1), int64(2), int64(3)}, ns)
+}
+
+func TestRelativeTime(t *testing.T) {
+	defer func(old func() time.Time) { now = old }(now)
+	now = func() time.Time { return testTime }
+
+	f := MustParse("t>-1m")
+
+	ev := testEvent(t, tlog.KeyTime, tlog.Timestamp(testTime.Add(-30*time.Second).UnixNano()))
+
+	assert.True(t, f.Match(ev))
+
+	now = func() time.Time { return testTime.Add(time.Minute) }
+
+	assert.False(t, f.Match(ev), "relative time is resolved at match time")
+}
+
+type (
+	rotatingWriter struct {
+		files []bytes.Buffer
+		n     int
+	}
+
+	testRotatedError struct{}
+)
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.n++
+
+	if w.n == 2 {
+		w.files = append(w.files, bytes.Buffer{})
+
+		return 0, testRotatedError{}
+	}
+
+	return w.files[len(w.files)-1].Write(p)
+}
+
+func (testRotatedError) Error() string   { return "rotated" }
+func (testRotatedError) IsRotated() bool { return true }
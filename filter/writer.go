@@ -0,0 +1,112 @@
+package filter
+
+import (
+	"io"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Writer passes through events matching Filter.
+	//
+	// Output is a valid stream by itself: labels are written before the first matching event
+	// after they changed and locations are always written in full,
+	// as the events that defined them may be filtered out.
+	//
+	// tlog.RotatedError from the underlying Writer is returned as is,
+	// labels are written again before the next matching event.
+	Writer struct {
+		io.Writer
+
+		Filter *Filter
+
+		ev   tlog.Event
+		ls   tlog.Labels
+		sent tlog.Labels
+
+		e tlog.Encoder
+		b low.Buf
+	}
+)
+
+// NewWriter creates filtering Writer.
+func NewWriter(w io.Writer, f *Filter) *Writer {
+	return &Writer{
+		Writer: w,
+		Filter: f,
+	}
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	b := w.b[:0]
+
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		if w.ev.Labels != nil {
+			w.ls = w.ev.Labels
+		} else {
+			w.ev.Labels = w.ls
+		}
+
+		if w.ev.IsHeader() {
+			continue // labels header, it's written before the next matching event
+		}
+
+		if !w.Filter.Match(&w.ev) {
+			continue
+		}
+
+		if !equal(w.sent, w.ls) {
+			b = w.e.AppendLabelsHeader(b, w.ls)
+
+			w.sent = w.ls
+		}
+
+		b, err = w.e.AppendEvent(b, &w.ev, nil)
+		if err != nil {
+			return 0, errors.Wrap(err, "encode")
+		}
+	}
+
+	w.b = b[:0]
+
+	if len(b) == 0 {
+		return len(p), nil
+	}
+
+	_, err = w.Writer.Write(b)
+
+	var rot tlog.RotatedError
+	if errors.As(err, &rot) && rot.IsRotated() {
+		w.sent = nil // new file needs labels
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func equal(a, b tlog.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,254 @@
+package tlog
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/tlog/low"
+)
+
+/*
+	Frame layout
+
+	sync     4 bytes  FrameSync marker
+	length   4 bytes  big endian payload length
+	checksum 4 bytes  big endian CRC32C (Castagnoli) of payload
+	payload  length bytes of ordinary events
+*/
+
+type (
+	// DamagedRange is a part of framed stream that was skipped because of corruption.
+	// Offsets are from the beginning of the stream.
+	DamagedRange struct {
+		Start, End int64
+		Err        error
+	}
+
+	// CorruptedError is returned when stream was read to the end but some damaged ranges were skipped.
+	CorruptedError []DamagedRange
+)
+
+const (
+	FrameSync       = "\xcbtlF"
+	FrameHeaderSize = len(FrameSync) + 8
+)
+
+// MaxFrameSize limits frame length accepted by Decoder.
+// Larger length is considered as corruption.
+var MaxFrameSize = 64 << 20
+
+var (
+	ErrFrameChecksum = errors.New("frame checksum mismatch")
+	ErrFrameSize     = errors.New("frame is too big")
+	ErrFrameOverlap  = errors.New("frame overlaps the next frame")
+)
+
+var (
+	crcTable  = crc32.MakeTable(crc32.Castagnoli)
+	frameStub = []byte(FrameSync + "\x00\x00\x00\x00\x00\x00\x00\x00")
+)
+
+// AppendFrame wraps p into a frame and appends it to b.
+func AppendFrame(b, p []byte) []byte {
+	st := len(b)
+
+	b = append(b, frameStub...)
+	b = append(b, p...)
+
+	return finishFrame(b, st)
+}
+
+func finishFrame(b []byte, st int) []byte {
+	p := b[st+FrameHeaderSize:]
+
+	l := len(p)
+	sum := crc32.Checksum(p, crcTable)
+
+	h := b[st+len(FrameSync) : st+FrameHeaderSize]
+
+	h[0], h[1], h[2], h[3] = byte(l>>24), byte(l>>16), byte(l>>8), byte(l)
+	h[4], h[5], h[6], h[7] = byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum)
+
+	return b
+}
+
+// IsFrame checks if frame sync marker is at st.
+func (d *Decoder) IsFrame(st int) bool {
+	if st+len(FrameSync) > len(d.b) && (d.Reader == nil || !d.more(st, st+len(FrameSync))) {
+		return false
+	}
+
+	return string(d.b[st:st+len(FrameSync)]) == FrameSync
+}
+
+// Frame checks frame header and payload checksum and returns the payload.
+// i is the position of the next frame.
+func (d *Decoder) Frame(st int) (p []byte, i int) {
+	if !d.more(st, st+FrameHeaderSize) {
+		return nil, st
+	}
+
+	if string(d.b[st:st+len(FrameSync)]) != FrameSync {
+		d.newErr(st, "expected frame")
+		return nil, st
+	}
+
+	i = st + len(FrameSync)
+
+	l := int(d.b[i])<<24 | int(d.b[i+1])<<16 | int(d.b[i+2])<<8 | int(d.b[i+3])
+	sum := uint32(d.b[i+4])<<24 | uint32(d.b[i+5])<<16 | uint32(d.b[i+6])<<8 | uint32(d.b[i+7])
+	i += 8
+
+	if l > MaxFrameSize {
+		d.wrapErr(st, ErrFrameSize, "frame len %x", l)
+		return nil, st
+	}
+
+	if !d.more(st, i+l) {
+		return nil, st
+	}
+
+	p = d.b[i : i+l]
+
+	if crc32.Checksum(p, crcTable) != sum {
+		d.wrapErr(st, ErrFrameChecksum, "frame")
+		return nil, st
+	}
+
+	return p, i + l
+}
+
+// FrameAfter looks for a complete frame with valid checksum in the buffer starting from st.
+// It doesn't read from Reader.
+// next is the position of the first incomplete frame or the end of buffer
+// where the search can be continued from when more data is read.
+func (d *Decoder) FrameAfter(st int) (ok bool, next int) {
+	next = -1
+
+	for i := st; i < len(d.b); i++ {
+		i = d.Resync(i)
+
+		switch checkFrame(d.b, i) {
+		case frameValid:
+			return true, i
+		case frameIncomplete:
+			if next == -1 {
+				next = i
+			}
+		}
+	}
+
+	if next == -1 {
+		next = len(d.b)
+	}
+
+	return false, next
+}
+
+const (
+	frameInvalid = iota
+	frameIncomplete
+	frameValid
+)
+
+func checkFrame(b []byte, st int) int {
+	if st+FrameHeaderSize > len(b) {
+		return frameIncomplete
+	}
+
+	if string(b[st:st+len(FrameSync)]) != FrameSync {
+		return frameInvalid
+	}
+
+	h := b[st+len(FrameSync):]
+
+	l := int(h[0])<<24 | int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+	sum := uint32(h[4])<<24 | uint32(h[5])<<16 | uint32(h[6])<<8 | uint32(h[7])
+
+	if l > MaxFrameSize {
+		return frameInvalid
+	}
+
+	end := st + FrameHeaderSize + l
+	if end > len(b) {
+		return frameIncomplete
+	}
+
+	if crc32.Checksum(b[st+FrameHeaderSize:end], crcTable) != sum {
+		return frameInvalid
+	}
+
+	return frameValid
+}
+
+// Resync finds the next frame sync marker starting from st.
+// If there is no full marker in the buffer it returns the position of the marker prefix
+// at the end of the buffer or the buffer length.
+// It doesn't read from Reader.
+func (d *Decoder) Resync(st int) (i int) {
+	for i = st; i < len(d.b); i++ {
+		p := bytes.IndexByte(d.b[i:], FrameSync[0])
+		if p == -1 {
+			break
+		}
+
+		i += p
+
+		tail := d.b[i:]
+		if len(tail) > len(FrameSync) {
+			tail = tail[:len(FrameSync)]
+		}
+
+		if string(tail) == FrameSync[:len(tail)] {
+			return i
+		}
+	}
+
+	return len(d.b)
+}
+
+func (w *Dumper) dumpFrame(st int) (i int) {
+	p, end := w.d.Frame(st)
+	if w.d.err != nil {
+		return st
+	}
+
+	i = end - len(p)
+
+	if !w.NoGlobalOffset {
+		w.b = low.AppendPrintf(w.b, "%8x  ", w.ref+st)
+	}
+
+	w.b = low.AppendPrintf(w.b, "%4x  % x  -  frame: len %v\n", st, w.d.b[st:i], len(p))
+
+	for i < end && w.d.err == nil {
+		i = w.dump(i, 1)
+	}
+
+	return i
+}
+
+func (r DamagedRange) String() string {
+	return fmt.Sprintf("[%x-%x): %v", r.Start, r.End, r.Err)
+}
+
+func (e CorruptedError) Error() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "stream corrupted: %d damaged ranges", len(e))
+
+	for i, r := range e {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString(", ")
+		}
+
+		b.WriteString(r.String())
+	}
+
+	return b.String()
+}
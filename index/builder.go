@@ -0,0 +1,287 @@
+package index
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/compress"
+)
+
+type (
+	builder struct {
+		x   *Index
+		cur *Block
+
+		spans map[tlog.ID]struct{}
+		msgs  map[uint32]struct{}
+
+		locs    map[loc.PC]Location // all the locations defined in the stream
+		defined map[loc.PC]struct{} // locations defined in the current block
+		used    map[loc.PC]struct{} // locations defined before the current block
+	}
+
+	resetPoint struct {
+		raw, out int64
+	}
+
+	countingReader struct {
+		io.Reader
+		n int64
+	}
+)
+
+// Build indexes already written data stream r.
+//
+// If x.Compressed is set r is decompressed.
+// Blocks start decompression from the last compressor reset before the block.
+// Files compressed without intermediate resets are decompressed
+// from the beginning of the file up to the block end.
+func (x *Index) Build(r io.Reader) (err error) {
+	if x.Bucket == 0 {
+		x.Bucket = DefaultBucket
+	}
+
+	if x.BlockSize == 0 {
+		x.BlockSize = DefaultBlockSize
+	}
+
+	x.Blocks = x.Blocks[:0]
+
+	raw := &countingReader{Reader: r}
+	str := raw
+
+	var resets []resetPoint
+
+	if x.Compressed {
+		d := compress.NewDecoder(raw)
+		d.OnReset = func(raw, out int64) {
+			resets = append(resets, resetPoint{raw: raw, out: out})
+		}
+
+		str = &countingReader{Reader: d}
+	}
+
+	rd := tlog.NewReader(str)
+	b := newBuilder(x)
+
+	last := int64(-1)
+
+	for rd.Next() {
+		ev := rd.Event()
+		off := rd.Offset()
+
+		if off != last && b.cut(ev.Time, off) {
+			b.finish(off, raw.n)
+		}
+
+		if b.cur == nil {
+			if x.Compressed {
+				p := lastReset(resets, off)
+
+				b.start(off, p.raw, p.out, rd.Labels())
+			} else {
+				b.start(off, off, off, rd.Labels())
+			}
+		}
+
+		b.add(ev)
+
+		last = off
+	}
+
+	if err = rd.Err(); err != nil {
+		return errors.Wrap(err, "read")
+	}
+
+	b.finish(str.n, raw.n)
+
+	return nil
+}
+
+func (x *Index) buildFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return x.Build(f)
+}
+
+func newBuilder(x *Index) *builder {
+	return &builder{
+		x:     x,
+		spans: make(map[tlog.ID]struct{}),
+		msgs:  make(map[uint32]struct{}),
+
+		locs:    make(map[loc.PC]Location),
+		defined: make(map[loc.PC]struct{}),
+		used:    make(map[loc.PC]struct{}),
+	}
+}
+
+// lastReset returns the last reset point before the stream offset off.
+func lastReset(resets []resetPoint, off int64) resetPoint {
+	for i := len(resets) - 1; i >= 0; i-- {
+		if resets[i].out <= off {
+			return resets[i]
+		}
+	}
+
+	return resetPoint{}
+}
+
+// cut reports whether the event at stream offset off should start a new block.
+func (b *builder) cut(ts tlog.Timestamp, off int64) bool {
+	if b.cur == nil || b.cur.Events == 0 {
+		return false
+	}
+
+	if b.x.BlockSize != 0 && off-b.cur.Offset >= b.x.BlockSize {
+		return true
+	}
+
+	if b.x.Bucket == 0 || ts == 0 || b.cur.MinTime == 0 {
+		return false
+	}
+
+	bucket := int64(b.x.Bucket)
+
+	return int64(ts)/bucket != int64(b.cur.MinTime)/bucket
+}
+
+func (b *builder) start(off, raw, base int64, ls tlog.Labels) {
+	b.x.Blocks = append(b.x.Blocks, Block{
+		Offset: off,
+		Raw:    raw,
+		Base:   base,
+		Labels: ls,
+	})
+
+	b.cur = &b.x.Blocks[len(b.x.Blocks)-1]
+}
+
+func (b *builder) add(ev *tlog.Event) {
+	c := b.cur
+
+	c.Events++
+
+	if ev.Time != 0 {
+		if c.MinTime == 0 || ev.Time < c.MinTime {
+			c.MinTime = ev.Time
+		}
+
+		if ev.Time > c.MaxTime {
+			c.MaxTime = ev.Time
+		}
+	}
+
+	if ev.Span != (tlog.ID{}) {
+		b.spans[ev.Span] = struct{}{}
+	}
+
+	if ev.Parent != (tlog.ID{}) {
+		b.spans[ev.Parent] = struct{}{}
+	}
+
+	if len(ev.Message) != 0 {
+		b.msgs[MessageHash(ev.Message)] = struct{}{}
+	}
+
+	b.addLocation(ev)
+}
+
+// addLocation tracks locations so that the block can be read
+// without the part of the stream where they were defined.
+func (b *builder) addLocation(ev *tlog.Event) {
+	pc := ev.Location
+	if pc == 0 {
+		return
+	}
+
+	if ev.LocationDefined() {
+		name, file, line := ev.LocationInfo()
+
+		b.locs[pc] = Location{PC: uint64(pc), Name: name, File: file, Line: line}
+		b.defined[pc] = struct{}{}
+
+		return
+	}
+
+	if _, ok := b.defined[pc]; !ok {
+		b.used[pc] = struct{}{}
+	}
+}
+
+// finish closes the current block at stream offset end and raw offset rawEnd.
+// Empty blocks are dropped.
+func (b *builder) finish(end, rawEnd int64) {
+	c := b.cur
+	if c == nil {
+		return
+	}
+
+	b.cur = nil
+
+	if c.Events == 0 {
+		b.x.Blocks = b.x.Blocks[:len(b.x.Blocks)-1]
+		return
+	}
+
+	c.Size = end - c.Offset
+
+	if b.x.Compressed {
+		c.RawSize = rawEnd - c.Raw
+	} else {
+		c.RawSize = c.Size
+	}
+
+	c.Spans = make([]tlog.ID, 0, len(b.spans))
+	for id := range b.spans {
+		c.Spans = append(c.Spans, id)
+		delete(b.spans, id)
+	}
+
+	sort.Slice(c.Spans, func(i, j int) bool {
+		return bytes.Compare(c.Spans[i][:], c.Spans[j][:]) < 0
+	})
+
+	c.Messages = make([]uint32, 0, len(b.msgs))
+	for h := range b.msgs {
+		c.Messages = append(c.Messages, h)
+		delete(b.msgs, h)
+	}
+
+	sort.Slice(c.Messages, func(i, j int) bool {
+		return c.Messages[i] < c.Messages[j]
+	})
+
+	c.Locations = nil
+	for pc := range b.used {
+		if l, ok := b.locs[pc]; ok {
+			c.Locations = append(c.Locations, l)
+		}
+
+		delete(b.used, pc)
+	}
+
+	for pc := range b.defined {
+		delete(b.defined, pc)
+	}
+
+	sortLocations(c.Locations)
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.n += int64(n)
+
+	return
+}
@@ -0,0 +1,413 @@
+package index
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/compress"
+)
+
+type (
+	// Index is a sidecar index of a tlog file.
+	//
+	// The stream is split into blocks aligned to time buckets and limited by size.
+	// Each block records its offsets, time range, span ids and message hashes it contains.
+	// So the reader can skip the blocks which definitely have no events it's looking for.
+	//
+	// Offsets are in the decompressed stream. For compressed files Raw is the file offset
+	// where decompression can be started from, Base is the stream offset it corresponds to.
+	Index struct {
+		File       string        `tlog:"file"`
+		Compressed bool          `tlog:"compressed,omitempty"`
+		Bucket     time.Duration `tlog:"bucket"`
+		BlockSize  int64         `tlog:"block_size"`
+
+		Blocks []Block `tlog:"-"`
+	}
+
+	Block struct {
+		Offset  int64 `tlog:"off"`
+		Size    int64 `tlog:"size"`
+		Raw     int64 `tlog:"raw"`
+		RawSize int64 `tlog:"raw_size"`
+		Base    int64 `tlog:"base"`
+
+		MinTime tlog.Timestamp `tlog:"min_time"`
+		MaxTime tlog.Timestamp `tlog:"max_time"`
+		Events  int            `tlog:"events"`
+
+		Labels   tlog.Labels `tlog:"labels,omitempty"`
+		Spans    []tlog.ID   `tlog:"spans,omitempty"`
+		Messages []uint32    `tlog:"msgs,omitempty"`
+
+		// Locations used in the block but defined earlier in the stream.
+		Locations []Location `tlog:"locs,omitempty"`
+	}
+
+	Location struct {
+		PC   uint64 `tlog:"pc"`
+		Name string `tlog:"name"`
+		File string `tlog:"file"`
+		Line int    `tlog:"line"`
+	}
+
+	// Reader reads events of the blocks continuing the stream state
+	// (labels and locations) from the index.
+	Reader struct {
+		x  *Index
+		f  io.ReaderAt
+		bs []Block
+
+		r   *tlog.Reader
+		err error
+	}
+
+	// Query selects blocks. Zero fields match everything.
+	Query struct {
+		Since, Until time.Time
+
+		Span    tlog.ID
+		Message string
+	}
+
+	skipReader struct {
+		io.Reader
+		skip int64
+	}
+)
+
+const Ext = ".idx"
+
+var (
+	DefaultBucket    = time.Minute
+	DefaultBlockSize = int64(1 << 20)
+)
+
+// FileName returns sidecar index file name for the data file.
+func FileName(name string) string {
+	return name + Ext
+}
+
+// MessageHash is the hash used to index messages.
+func MessageHash(m []byte) uint32 {
+	h := uint32(2166136261)
+
+	for _, c := range m {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+
+	return h
+}
+
+// Find returns blocks which may contain events matching the query.
+func (x *Index) Find(q Query) (bs []Block) {
+	var h uint32
+	if q.Message != "" {
+		h = MessageHash([]byte(q.Message))
+	}
+
+	for _, b := range x.Blocks {
+		if !q.Since.IsZero() && b.MaxTime != 0 && b.MaxTime.Time().Before(q.Since) {
+			continue
+		}
+
+		if !q.Until.IsZero() && b.MinTime != 0 && !b.MinTime.Time().Before(q.Until) {
+			continue
+		}
+
+		if q.Span != (tlog.ID{}) && !b.hasSpan(q.Span) {
+			continue
+		}
+
+		if q.Message != "" && !b.hasMessage(h) {
+			continue
+		}
+
+		bs = append(bs, b)
+	}
+
+	return bs
+}
+
+// Reader returns stream of the blocks data read from the data file f.
+// Adjacent blocks are read as one region.
+//
+// Blocks are parts of the stream so the data doesn't have stream labels and
+// may refer to the locations defined before. Use NewReader to get events with them.
+func (x *Index) Reader(f io.ReaderAt, bs []Block) io.Reader {
+	var rs []io.Reader
+
+	for _, b := range regions(bs) {
+		rs = append(rs, x.blockReader(f, b))
+	}
+
+	return io.MultiReader(rs...)
+}
+
+// NewReader returns Reader of the blocks events read from the data file f.
+func (x *Index) NewReader(f io.ReaderAt, bs []Block) *Reader {
+	return &Reader{
+		x:  x,
+		f:  f,
+		bs: regions(bs),
+	}
+}
+
+// Next reads the next event.
+func (r *Reader) Next() bool {
+	for {
+		if r.r != nil && r.r.Next() {
+			return true
+		}
+
+		if r.r != nil {
+			if r.err = r.r.Err(); r.err != nil {
+				return false
+			}
+		}
+
+		if len(r.bs) == 0 {
+			return false
+		}
+
+		b := r.bs[0]
+		r.bs = r.bs[1:]
+
+		r.r = tlog.NewReader(r.x.blockReader(r.f, b))
+		r.r.SetLabels(b.Labels)
+
+		for _, l := range b.Locations {
+			r.r.SetLocation(loc.PC(l.PC), l.Name, l.File, l.Line)
+		}
+	}
+}
+
+// Event returns the last read event.
+// It's valid until the next Next call.
+func (r *Reader) Event() *tlog.Event {
+	return r.r.Event()
+}
+
+// Err returns the first error occurred.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// regions merges adjacent blocks.
+// Merged block has the first block labels and all the blocks locations.
+func regions(bs []Block) (rs []Block) {
+	for i := 0; i < len(bs); {
+		b := bs[i]
+
+		for i++; i < len(bs) && bs[i].Offset == b.Offset+b.Size; i++ {
+			b.Size += bs[i].Size
+
+			if end := bs[i].Raw + bs[i].RawSize; end > b.Raw+b.RawSize {
+				b.RawSize = end - b.Raw
+			}
+
+			b.Locations = mergeLocations(b.Locations, bs[i].Locations)
+		}
+
+		rs = append(rs, b)
+	}
+
+	return rs
+}
+
+func mergeLocations(a, b []Location) []Location {
+	if len(b) == 0 {
+		return a
+	}
+
+	r := make([]Location, 0, len(a)+len(b))
+	r = append(r, a...)
+
+outer:
+	for _, l := range b {
+		for _, x := range a {
+			if x.PC == l.PC {
+				continue outer
+			}
+		}
+
+		r = append(r, l)
+	}
+
+	sortLocations(r)
+
+	return r
+}
+
+func sortLocations(ls []Location) {
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].PC < ls[j].PC
+	})
+}
+
+func (x *Index) blockReader(f io.ReaderAt, b Block) io.Reader {
+	var r io.Reader = io.NewSectionReader(f, b.Raw, b.RawSize)
+
+	if !x.Compressed {
+		return r
+	}
+
+	r = compress.NewDecoder(r)
+
+	if b.Offset != b.Base {
+		r = &skipReader{Reader: r, skip: b.Offset - b.Base}
+	}
+
+	return io.LimitReader(r, b.Size)
+}
+
+// Save writes index as a tlog stream.
+func (x *Index) Save(w io.Writer) (err error) {
+	e := tlog.Encoder{Writer: w}
+
+	err = e.Encode(nil, []interface{}{"index", *x})
+	if err != nil {
+		return errors.Wrap(err, "header")
+	}
+
+	for _, b := range x.Blocks {
+		err = e.Encode(nil, []interface{}{"block", b})
+		if err != nil {
+			return errors.Wrap(err, "block")
+		}
+	}
+
+	return nil
+}
+
+// SaveFile writes index to the file atomically.
+func (x *Index) SaveFile(name string) (err error) {
+	var buf bytes.Buffer
+
+	err = x.Save(&buf)
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return errors.Wrap(err, "write")
+	}
+
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return errors.Wrap(err, "rename")
+	}
+
+	return nil
+}
+
+// Load reads index saved by Save.
+func Load(r io.Reader) (x *Index, err error) {
+	rd := tlog.NewReader(r)
+
+	for rd.Next() {
+		ev := rd.Event()
+
+		if raw, ok := ev.GetRaw("index"); ok {
+			x = &Index{}
+
+			err = tlog.Unmarshal(raw, x)
+			if err != nil {
+				return nil, errors.Wrap(err, "header")
+			}
+
+			continue
+		}
+
+		raw, ok := ev.GetRaw("block")
+		if !ok {
+			continue
+		}
+
+		if x == nil {
+			return nil, errors.New("no index header")
+		}
+
+		var b Block
+
+		err = tlog.Unmarshal(raw, &b)
+		if err != nil {
+			return nil, errors.Wrap(err, "block")
+		}
+
+		x.Blocks = append(x.Blocks, b)
+	}
+
+	if err = rd.Err(); err != nil {
+		return nil, err
+	}
+
+	if x == nil {
+		return nil, errors.New("no index header")
+	}
+
+	return x, nil
+}
+
+// LoadFile reads index from the file.
+func LoadFile(name string) (*Index, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return Load(f)
+}
+
+// rawEnd is the data file size covered by the index.
+func (x *Index) rawEnd() (end int64) {
+	for _, b := range x.Blocks {
+		if e := b.Raw + b.RawSize; e > end {
+			end = e
+		}
+	}
+
+	return end
+}
+
+func (b *Block) hasSpan(id tlog.ID) bool {
+	i := sort.Search(len(b.Spans), func(i int) bool {
+		return bytes.Compare(b.Spans[i][:], id[:]) >= 0
+	})
+
+	return i < len(b.Spans) && b.Spans[i] == id
+}
+
+func (b *Block) hasMessage(h uint32) bool {
+	i := sort.Search(len(b.Messages), func(i int) bool {
+		return b.Messages[i] >= h
+	})
+
+	return i < len(b.Messages) && b.Messages[i] == h
+}
+
+func (r *skipReader) Read(p []byte) (n int, err error) {
+	if r.skip != 0 {
+		n, err := io.CopyN(ioutil.Discard, r.Reader, r.skip)
+		r.skip -= n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,387 @@
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/compress"
+	"github.com/nikandfor/tlog/low"
+)
+
+func TestWriter(t *testing.T) {
+	for _, z := range []bool{false, true} {
+		z := z
+
+		t.Run(map[bool]string{false: "plain", true: "compressed"}[z], func(t *testing.T) {
+			var buf low.Buf
+			var x *Index
+
+			w := NewWriter(&buf)
+			if z {
+				w = NewWriter(compress.NewEncoder(&buf, 1<<16))
+			}
+
+			w.BlockSize = 300
+			w.Flush = func(ix *Index) error {
+				c := *ix
+				x = &c
+
+				return nil
+			}
+
+			ids := writeTestLog(t, w)
+
+			err := w.Close()
+			require.NoError(t, err)
+			require.NotNil(t, x)
+
+			assert.Equal(t, z, x.Compressed)
+			assert.True(t, len(x.Blocks) > 3, "blocks: %d", len(x.Blocks))
+
+			checkIndex(t, x, buf, ids)
+
+			var ib bytes.Buffer
+
+			err = x.Save(&ib)
+			require.NoError(t, err)
+
+			y, err := Load(&ib)
+			require.NoError(t, err)
+
+			assert.Equal(t, x, y)
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	for _, z := range []bool{false, true} {
+		z := z
+
+		t.Run(map[bool]string{false: "plain", true: "compressed"}[z], func(t *testing.T) {
+			var buf low.Buf
+
+			var w interface {
+				Write([]byte) (int, error)
+			} = &buf
+
+			if z {
+				w = compress.NewEncoder(&buf, 1<<16)
+			}
+
+			ids := writeTestLog(t, w)
+
+			x := &Index{Compressed: z, BlockSize: 300}
+
+			err := x.Build(bytes.NewReader(buf))
+			require.NoError(t, err)
+
+			assert.True(t, len(x.Blocks) > 3, "blocks: %d", len(x.Blocks))
+
+			checkIndex(t, x, buf, ids)
+		})
+	}
+}
+
+func TestBuildCompressedRawSize(t *testing.T) {
+	var buf low.Buf
+
+	l := tlog.New(compress.NewEncoder(&buf, 1<<16))
+	l.NoTime = true
+
+	for i := 0; i < 10000; i++ {
+		l.Printw("message", "i", i, "id", tlog.ID{byte(i), byte(i >> 8), byte(i * 7)})
+	}
+
+	x := &Index{Compressed: true, BlockSize: 32 << 10}
+
+	err := x.Build(bytes.NewReader(buf))
+	require.NoError(t, err)
+
+	require.True(t, len(x.Blocks) > 3, "blocks: %d", len(x.Blocks))
+
+	first, last := x.Blocks[0], x.Blocks[len(x.Blocks)-1]
+
+	assert.Less(t, first.RawSize, last.RawSize)
+	assert.Equal(t, int64(len(buf)), last.RawSize)
+
+	for _, b := range x.Blocks {
+		r := tlog.NewReader(x.Reader(bytes.NewReader(buf), []Block{b}))
+
+		n := 0
+		for r.Next() {
+			n++
+		}
+
+		assert.NoError(t, r.Err())
+		assert.Equal(t, b.Events, n, "block %+v", b)
+	}
+}
+
+func TestWriterAppend(t *testing.T) {
+	for _, z := range []bool{false, true} {
+		for _, indexed := range []bool{false, true} {
+			z, indexed := z, indexed
+
+			t.Run(fmt.Sprintf("compressed=%v_indexed=%v", z, indexed), func(t *testing.T) {
+				name := filepath.Join(t.TempDir(), "file.tlog")
+
+				write := func(index bool) {
+					f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+					require.NoError(t, err)
+
+					var w io.Writer = f
+
+					if z {
+						w = compress.NewEncoder(f, 1<<16)
+					}
+
+					if index {
+						iw := NewWriter(w)
+						iw.BlockSize = 300
+
+						w = iw
+					}
+
+					writeTestLog(t, w)
+
+					if iw, ok := w.(*Writer); ok {
+						err = iw.Close() // closes f if not compressed
+						require.NoError(t, err)
+					}
+
+					_ = f.Close()
+				}
+
+				write(indexed)
+				write(true)
+
+				data, err := ioutil.ReadFile(name)
+				require.NoError(t, err)
+
+				x, err := LoadFile(FileName(name))
+				require.NoError(t, err)
+
+				assert.Equal(t, int64(len(data)), x.rawEnd())
+
+				var off int64
+
+				for _, b := range x.Blocks {
+					assert.Equal(t, off, b.Offset)
+					off = b.Offset + b.Size
+
+					r := tlog.NewReader(x.Reader(bytes.NewReader(data), []Block{b}))
+
+					n := 0
+					for r.Next() {
+						n++
+					}
+
+					assert.NoError(t, r.Err())
+					assert.Equal(t, b.Events, n, "block %+v", b)
+				}
+
+				assert.Len(t, x.Find(Query{Message: "the last message"}), 2)
+			})
+		}
+	}
+}
+
+func TestReaderState(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		z      bool
+		resets int
+	}{
+		{name: "plain"},
+		{name: "compressed", z: true},
+		{name: "compressed_resets", z: true, resets: 5},
+	} {
+		tc := tc
+
+		t.Run(tc.name, func(t *testing.T) {
+			var buf low.Buf
+
+			var w interface {
+				Write([]byte) (int, error)
+			} = &buf
+
+			if tc.z {
+				w = &resetWriter{Encoder: compress.NewEncoder(&buf, 1<<16), every: tc.resets}
+			}
+
+			ids := writeTestLog(t, w)
+
+			x := &Index{Compressed: tc.z, BlockSize: 300}
+
+			err := x.Build(bytes.NewReader(buf))
+			require.NoError(t, err)
+
+			if tc.resets != 0 {
+				last := x.Blocks[len(x.Blocks)-1]
+
+				assert.NotZero(t, last.Raw)
+				assert.NotZero(t, last.Base)
+				assert.Less(t, last.RawSize, int64(len(buf)))
+			}
+
+			// take the location from the whole stream
+			var rd io.Reader = bytes.NewReader(buf)
+			if tc.z {
+				rd = compress.NewDecoder(rd)
+			}
+
+			r := tlog.NewReader(rd)
+
+			var ev *tlog.Event
+
+			for r.Next() {
+				if ev = r.Event(); string(ev.Message) == "some other message" {
+					break
+				}
+			}
+
+			require.NoError(t, r.Err())
+
+			pc := ev.Location
+			name, file, line := ev.LocationInfo()
+
+			// location is taken from the index, not from the global cache
+			pc.SetCache("other", "other.go", 1)
+			defer pc.SetCache(name, file, line)
+
+			id := ids[len(ids)-1]
+
+			bs := x.Find(Query{Span: id})
+			require.NotEmpty(t, bs)
+			require.NotEmpty(t, bs[0].Locations)
+
+			xr := x.NewReader(bytes.NewReader(buf), bs)
+
+			n := 0
+			for xr.Next() {
+				ev := xr.Event()
+
+				assert.Equal(t, tlog.Labels{"a=b"}, ev.Labels)
+
+				if ev.Span != id || string(ev.Message) != "some other message" {
+					continue
+				}
+
+				n++
+
+				gname, gfile, gline := ev.LocationInfo()
+				assert.Equal(t, name, gname)
+				assert.Equal(t, file, gfile)
+				assert.Equal(t, line, gline)
+			}
+
+			assert.NoError(t, xr.Err())
+			assert.Equal(t, 1, n)
+		})
+	}
+}
+
+func writeTestLog(t *testing.T, w interface {
+	Write([]byte) (int, error)
+}) (ids []tlog.ID) {
+	tm := time.Date(2020, time.December, 25, 22, 8, 13, 0, time.UTC)
+	tlog.TestSetTime(func() time.Time { return tm }, func() int64 {
+		tm = tm.Add(20 * time.Second)
+		return tm.UnixNano()
+	})
+	defer tlog.TestSetTime(time.Now, low.UnixNano)
+
+	var i byte
+
+	l := tlog.New(w)
+	l.NewID = func() tlog.ID {
+		i++
+		return tlog.ID{i}
+	}
+
+	l.SetLabels(tlog.Labels{"a=b"})
+
+	for j := 0; j < 10; j++ {
+		tr := l.Start("span")
+		ids = append(ids, tr.ID)
+
+		tr.Printw("message", "j", j)
+		tr.Printw("some other message")
+
+		tr.Finish()
+	}
+
+	l.Printw("the last message")
+
+	return ids
+}
+
+func checkIndex(t *testing.T, x *Index, data []byte, ids []tlog.ID) {
+	t.Helper()
+
+	for j, id := range ids {
+		bs := x.Find(Query{Span: id})
+		require.NotEmpty(t, bs, "span %v", id)
+		assert.True(t, len(bs) < len(x.Blocks), "span %v", id)
+
+		r := x.NewReader(bytes.NewReader(data), bs)
+
+		var msgs []int64
+		for r.Next() {
+			ev := r.Event()
+
+			if ev.Span != id {
+				continue
+			}
+
+			if v, ok := ev.Get("j"); ok {
+				msgs = append(msgs, v.(int64))
+			}
+
+			assert.Equal(t, tlog.Labels{"a=b"}, ev.Labels)
+		}
+
+		assert.NoError(t, r.Err())
+		assert.Equal(t, []int64{int64(j)}, msgs)
+	}
+
+	bs := x.Find(Query{Message: "the last message"})
+	if assert.Len(t, bs, 1) {
+		assert.Equal(t, x.Blocks[len(x.Blocks)-1], bs[0])
+	}
+
+	last := x.Blocks[len(x.Blocks)-1]
+
+	bs = x.Find(Query{Since: last.MinTime.Time()})
+	assert.Equal(t, []Block{last}, bs)
+
+	bs = x.Find(Query{Until: x.Blocks[1].MinTime.Time()})
+	assert.Equal(t, x.Blocks[:1], bs)
+}
+
+// resetWriter resets compression every n writes.
+type resetWriter struct {
+	*compress.Encoder
+
+	every, n int
+}
+
+func (w *resetWriter) Write(p []byte) (int, error) {
+	if w.every != 0 && w.n != 0 && w.n%w.every == 0 {
+		w.Encoder.Reset(w.Encoder.Writer)
+	}
+
+	w.n++
+
+	return w.Encoder.Write(p)
+}
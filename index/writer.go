@@ -0,0 +1,321 @@
+package index
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/compress"
+)
+
+type (
+	// Writer builds Index while writing the stream.
+	//
+	// It must be placed right under tlog.Encoder so each Write is a whole event.
+	// When a new block is started ErrorOnBlock is returned,
+	// so Encoder writes the labels header and full locations again
+	// and each block can be read independently.
+	// If Z is set it's reset at the block start and the block gets its own compressed offset.
+	//
+	// If the underlying writer returns rotated error (see rotated.File) the index
+	// of the previous file is flushed and a new one is started.
+	//
+	// If the file already has data (opened with O_APPEND) offsets continue from its end
+	// and the existing index is extended. The file is indexed again if the index doesn't cover it.
+	Writer struct {
+		io.Writer
+
+		Z *compress.Encoder
+
+		Bucket    time.Duration
+		BlockSize int64
+
+		ErrorOnBlock error
+
+		// Name returns the name of the file being written.
+		Name func() string
+
+		// Flush is called with the finished index. Default saves it next to the data file.
+		Flush func(x *Index) error
+
+		mu sync.Mutex
+
+		x Index
+		b *builder
+
+		pos    int64
+		raw    int64 // raw file offset the writer started at
+		zbase  int64
+		ls     tlog.Labels
+		resume bool
+
+		d   tlog.Decoder
+		evs []tlog.Event
+	}
+
+	BlockError struct{}
+)
+
+// NewWriter creates index Writer.
+// If w is compress.Encoder it's used as Z.
+// File name is taken from w (or Z.Writer) if it has Name() string method.
+func NewWriter(w io.Writer) *Writer {
+	iw := &Writer{
+		Writer:       w,
+		Bucket:       DefaultBucket,
+		BlockSize:    DefaultBlockSize,
+		ErrorOnBlock: BlockError{},
+	}
+
+	f := w
+
+	if z, ok := w.(*compress.Encoder); ok {
+		iw.Z = z
+		f = z.Writer
+	}
+
+	if n, ok := f.(interface{ Name() string }); ok {
+		iw.Name = n.Name
+	}
+
+	return iw
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	if w.b == nil {
+		w.reset()
+	}
+
+	if w.resume {
+		w.resume = false
+
+		if err = w.resumeFile(); err != nil {
+			return 0, errors.Wrap(err, "index existing data")
+		}
+	}
+
+	w.parse(p)
+
+	if len(w.evs) != 0 && w.b.cut(w.evs[0].Time, w.pos) {
+		w.b.finish(w.pos, w.rawPos())
+
+		if w.Z != nil {
+			w.Z.Reset(w.Z.Writer)
+		}
+
+		if w.ErrorOnBlock != nil {
+			return 0, w.ErrorOnBlock
+		}
+	}
+
+	if w.b.cur == nil {
+		raw := w.rawPos()
+		if w.Z == nil {
+			raw = w.pos
+		}
+
+		w.b.start(w.pos, raw, w.pos, w.ls)
+	}
+
+	n, err = w.Writer.Write(p)
+
+	var rot tlog.RotatedError
+	if errors.As(err, &rot) && rot.IsRotated() {
+		if n != 0 {
+			// the data went to the old file
+			w.add(n)
+		}
+
+		if e := w.flush(); e != nil {
+			return n, e
+		}
+
+		return n, err
+	}
+
+	w.add(n)
+
+	if w.x.File == "" && w.Name != nil {
+		w.x.File = w.Name()
+	}
+
+	return n, err
+}
+
+// Index returns the index of the current file. Last block is not finished.
+func (w *Writer) Index() *Index {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	return &w.x
+}
+
+// Close flushes the index and closes the underlying writer if it's io.Closer.
+func (w *Writer) Close() (err error) {
+	w.mu.Lock()
+	err = w.flush()
+	w.mu.Unlock()
+
+	if c, ok := w.Writer.(io.Closer); ok {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (w *Writer) reset() {
+	w.x = Index{
+		Compressed: w.Z != nil,
+		Bucket:     w.Bucket,
+		BlockSize:  w.BlockSize,
+	}
+
+	w.b = newBuilder(&w.x)
+	w.pos = 0
+	w.raw = 0
+	w.ls = nil
+	w.resume = w.Name != nil
+
+	if w.Z != nil {
+		w.zbase = w.Z.Written()
+	}
+}
+
+// resumeFile continues indexing of the file which already has data.
+func (w *Writer) resumeFile() error {
+	name := w.Name()
+	if name == "" {
+		return nil
+	}
+
+	inf, err := os.Stat(name)
+	if err != nil || inf.Size() == 0 {
+		return nil // nothing to continue
+	}
+
+	x, err := LoadFile(FileName(name))
+	if err != nil || x.Compressed != w.x.Compressed || x.rawEnd() != inf.Size() {
+		x = &Index{
+			Compressed: w.x.Compressed,
+			Bucket:     w.x.Bucket,
+			BlockSize:  w.x.BlockSize,
+		}
+
+		err = x.buildFile(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.x.File = name
+	w.x.Blocks = x.Blocks
+
+	if l := len(x.Blocks); l != 0 {
+		w.pos = x.Blocks[l-1].Offset + x.Blocks[l-1].Size
+	}
+
+	w.raw = inf.Size()
+
+	if w.Z == nil {
+		w.pos = w.raw
+	}
+
+	return nil
+}
+
+func (w *Writer) flush() (err error) {
+	if w.b == nil {
+		return nil
+	}
+
+	w.b.finish(w.pos, w.rawPos())
+
+	defer w.reset()
+
+	if len(w.x.Blocks) == 0 {
+		return nil
+	}
+
+	if w.Flush != nil {
+		return w.Flush(&w.x)
+	}
+
+	if w.x.File == "" {
+		return nil
+	}
+
+	return w.x.SaveFile(FileName(w.x.File))
+}
+
+func (w *Writer) rawPos() int64 {
+	if w.Z == nil {
+		return w.pos
+	}
+
+	return w.raw + w.Z.Written() - w.zbase
+}
+
+func (w *Writer) add(n int) {
+	for i := range w.evs {
+		ev := &w.evs[i]
+
+		if ev.Labels != nil {
+			w.ls = ev.Labels
+
+			if w.b.cur.Events == 0 {
+				w.b.cur.Labels = ev.Labels
+			}
+		}
+
+		w.b.add(ev)
+	}
+
+	w.pos += int64(n)
+}
+
+// parse parses events in p. Parsing errors are ignored, the data is written anyway.
+func (w *Writer) parse(p []byte) {
+	w.evs = w.evs[:0]
+
+	w.d.ResetBytes(p)
+
+	st, end := 0, len(p)
+
+	if w.d.IsFrame(0) {
+		p, _ = w.d.Frame(0)
+		if w.d.Err() != nil {
+			return
+		}
+
+		st, end = 0, len(p)
+	}
+
+	for st < end {
+		if len(w.evs) == cap(w.evs) {
+			w.evs = append(w.evs, tlog.Event{})
+		} else {
+			w.evs = w.evs[:len(w.evs)+1]
+		}
+
+		i, err := w.evs[len(w.evs)-1].Parse(p[st:end])
+		if err != nil {
+			w.evs = w.evs[:len(w.evs)-1]
+			return
+		}
+
+		st += i
+	}
+}
+
+func (BlockError) Error() string { return "index block started" }
+
+func (BlockError) IsRotated() bool { return true }
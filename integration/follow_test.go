@@ -0,0 +1,222 @@
+package integration
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/compress"
+	"github.com/nikandfor/tlog/rotated"
+)
+
+func TestFollowRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlog_follow")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "name@.tlog")
+
+	defer func(old string) {
+		rotated.TimeFormat = old
+	}(rotated.TimeFormat)
+
+	rotated.TimeFormat = "2006-01-02_15-04-05.000000000"
+
+	f := rotated.Create(name)
+	defer f.Close()
+
+	l := tlog.New(f)
+	l.NoCaller = true
+
+	l.SetLabels(tlog.Labels{"a=b"})
+
+	fl := rotated.NewFollower(name)
+	fl.Follow = true
+	fl.Poll = time.Millisecond
+
+	msgs := make(chan int, 10)
+
+	go func() {
+		defer close(msgs)
+
+		r := tlog.NewReader(fl)
+
+		for r.Next() {
+			ev := r.Event()
+
+			if v, ok := ev.Get("i"); ok {
+				msgs <- int(v.(int64))
+			}
+		}
+
+		assert.True(t, errors.Is(r.Err(), rotated.ErrClosed), "%v", r.Err())
+	}()
+
+	for i := 0; i < 6; i++ {
+		l.Printw("message", "i", i)
+
+		assert.Equal(t, i, <-msgs)
+
+		if i%2 == 1 {
+			time.Sleep(time.Millisecond)
+
+			err = f.Rotate()
+			require.NoError(t, err)
+		}
+	}
+
+	files, err := fl.Files()
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+
+	err = fl.Close()
+	assert.NoError(t, err)
+
+	for range msgs {
+		t.Errorf("unexpected message")
+	}
+
+	// read again from checkpoint
+	fl = rotated.NewFollower(name)
+	fl.Resume(rotated.Checkpoint{File: files[1]})
+
+	r := tlog.NewReader(fl)
+
+	var res []int
+	for r.Next() {
+		if v, ok := r.Event().Get("i"); ok {
+			res = append(res, int(v.(int64)))
+		}
+
+		if len(res) == 1 {
+			c := fl.CheckpointAt(r.Offset() + int64(len(r.Event().Raw())))
+			assert.Equal(t, files[1], c.File)
+		}
+	}
+
+	assert.NoError(t, r.Err())
+	assert.Equal(t, []int{2, 3, 4, 5}, res)
+}
+
+func TestFollowCompressedResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlog_follow")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "name@.tlog")
+
+	defer func(old string) {
+		rotated.TimeFormat = old
+	}(rotated.TimeFormat)
+
+	rotated.TimeFormat = "2006-01-02_15-04-05.000000000"
+
+	f := rotated.Create(name)
+
+	l := tlog.New(f)
+	l.NoCaller = true
+
+	l.SetLabels(tlog.Labels{"a=b"})
+
+	for i := 0; i < 6; i++ {
+		l.Printw("message", "i", i)
+
+		if i%2 == 1 && i != 5 {
+			time.Sleep(time.Millisecond)
+
+			err = f.Rotate()
+			require.NoError(t, err)
+		}
+	}
+
+	err = f.Close()
+	require.NoError(t, err)
+
+	read := func(c *rotated.Checkpoint, stopAt int) (res []int, next rotated.Checkpoint) {
+		fl := rotated.NewFollower(name)
+		defer fl.Close()
+
+		if c != nil {
+			fl.Resume(*c)
+		}
+
+		r := tlog.NewReader(fl)
+
+		for r.Next() {
+			v, ok := r.Event().Get("i")
+			if !ok {
+				continue
+			}
+
+			res = append(res, int(v.(int64)))
+
+			if int(v.(int64)) == stopAt {
+				next = fl.CheckpointAt(r.Offset() + int64(len(r.Event().Raw())))
+			}
+		}
+
+		assert.NoError(t, r.Err())
+
+		return
+	}
+
+	files, err := rotated.NewFollower(name).Files()
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	res, c2 := read(nil, 2)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5}, res)
+	assert.Equal(t, files[1], c2.File)
+	assert.NotZero(t, c2.Offset)
+
+	res, c4 := read(&c2, 4)
+	assert.Equal(t, []int{3, 4, 5}, res)
+	assert.Equal(t, files[2], c4.File)
+	assert.NotZero(t, c4.Offset)
+
+	for _, n := range files[:2] {
+		compressFile(t, n)
+	}
+
+	ezfiles, err := rotated.NewFollower(name).Files()
+	require.NoError(t, err)
+	assert.Equal(t, []string{files[0] + ".ez", files[1] + ".ez", files[2]}, ezfiles)
+
+	res, ez2 := read(nil, 2)
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5}, res)
+	assert.Equal(t, rotated.Checkpoint{File: files[1] + ".ez", Offset: c2.Offset}, ez2)
+
+	// checkpoint saved before the file was compressed
+	res, _ = read(&c2, -1)
+	assert.Equal(t, []int{3, 4, 5}, res)
+
+	res, _ = read(&ez2, -1)
+	assert.Equal(t, []int{3, 4, 5}, res)
+
+	res, _ = read(&c4, -1)
+	assert.Equal(t, []int{5}, res)
+}
+
+func compressFile(t *testing.T, name string) {
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+
+	f, err := os.Create(name + ".ez")
+	require.NoError(t, err)
+
+	_, err = compress.NewEncoder(f, 1<<16).Write(data)
+	require.NoError(t, err)
+
+	err = f.Close()
+	require.NoError(t, err)
+
+	err = os.Remove(name)
+	require.NoError(t, err)
+}
@@ -48,6 +48,21 @@ func (w *Buf) NewLine() {
 	}
 }
 
+// AppendSpaces appends n spaces to b. n may be longer than Spaces.
+func AppendSpaces(b []byte, n int) []byte {
+	for n > 0 {
+		c := n
+		if c > len(Spaces) {
+			c = len(Spaces)
+		}
+
+		b = append(b, Spaces[:c]...)
+		n -= c
+	}
+
+	return b
+}
+
 func UnsafeBytesToString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
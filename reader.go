@@ -0,0 +1,391 @@
+package tlog
+
+import (
+	"io"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+)
+
+type (
+	// Reader iterates over events in a stream.
+	//
+	// It handles partial reads, verifies and unwraps framed events
+	// and tracks stream state: current labels and locations.
+	//
+	// Event returned is valid until the next call to Next. Use Event.Clone to keep it.
+	//
+	// Damaged frames are skipped. If any Err returns CorruptedError at the end of the stream.
+	Reader struct {
+		io.Reader
+
+		d, pd Decoder
+		ev    Event
+
+		b      []byte
+		i, n   int
+		ref    int64 // stream offset of b[0]
+		eof    bool
+		framed bool
+
+		p    []byte // current frame payload or plain event
+		pi   int
+		pref int64 // stream offset of p[0]
+
+		raw      []byte // current top-level value
+		tag, sub int
+		evoff    int64
+
+		bad    int64
+		badErr error
+		dmg    CorruptedError
+
+		scanned int64 // stream offset frame sync is searched up to
+		checked int64 // stream offset the next frame is searched from while the current is incomplete
+
+		ls   Labels
+		locs map[loc.PC]locInfo
+
+		err error
+	}
+
+	locInfo struct {
+		name, file string
+		line       int
+	}
+)
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		Reader: r,
+		b:      make([]byte, 16*1024),
+		bad:    -1,
+		locs:   make(map[loc.PC]locInfo),
+	}
+}
+
+// Reset resets Reader to read from the new stream.
+// Labels and locations state is reset as well.
+func (r *Reader) Reset(rd io.Reader) {
+	r.Reader = rd
+	r.i, r.n = 0, 0
+	r.ref = 0
+	r.eof = false
+	r.framed = false
+	r.p, r.pi, r.pref = nil, 0, 0
+	r.bad, r.badErr, r.dmg = -1, nil, nil
+	r.scanned, r.checked = 0, 0
+	r.raw = nil
+	r.ls = nil
+	r.err = nil
+
+	if r.b == nil {
+		r.b = make([]byte, 16*1024)
+	}
+
+	for pc := range r.locs {
+		delete(r.locs, pc)
+	}
+}
+
+// Next reads the next event. It returns false at the end of the stream or on error.
+// Semantic header values are skipped, other non-event values are an error.
+func (r *Reader) Next() bool {
+	for r.NextRaw() {
+		if r.IsEvent() {
+			return true
+		}
+
+		if r.tag == Semantic && r.sub == WireHeader {
+			continue
+		}
+
+		r.err = errors.Wrap(errors.New("expected map, got %x", r.tag), "parse")
+
+		return false
+	}
+
+	return false
+}
+
+// NextRaw reads the next top-level value: an event, a semantic header or any other value.
+// Stream state is tracked the same way as by Next.
+func (r *Reader) NextRaw() bool {
+	if r.err != nil {
+		return false
+	}
+
+	for r.pi >= len(r.p) {
+		if !r.nextItem() {
+			return false
+		}
+	}
+
+	r.pd.ResetBytes(r.p)
+
+	var end int
+	var err error
+
+	r.tag, r.sub, _ = r.pd.Tag(r.pi)
+
+	if r.tag == Map {
+		end, err = r.ev.parse(&r.pd, r.pi)
+	} else {
+		end = r.pd.Skip(r.pi)
+		err = r.pd.Err()
+	}
+
+	if err != nil {
+		r.err = errors.Wrap(err, "parse")
+		return false
+	}
+
+	r.raw = r.p[r.pi:end]
+	r.evoff = r.pref + int64(r.pi)
+	r.pi = end
+
+	if r.tag == Map {
+		r.trackState(&r.ev)
+	}
+
+	return true
+}
+
+// Raw returns the current top-level value as it is in the stream (frame payload part for framed streams).
+// It's valid until the next call to Next or NextRaw.
+func (r *Reader) Raw() []byte { return r.raw }
+
+// IsEvent reports whether the current value is an event.
+// Event is only valid if it is.
+func (r *Reader) IsEvent() bool { return r.tag == Map }
+
+// Event returns the current event.
+func (r *Reader) Event() *Event { return &r.ev }
+
+// Offset returns the current event offset in the stream.
+// For framed streams it's the offset of the frame containing the event.
+func (r *Reader) Offset() int64 { return r.evoff }
+
+// Labels returns the current stream labels.
+func (r *Reader) Labels() Labels { return r.ls }
+
+// SetLabels sets the current stream labels.
+// It's used to continue reading a stream from the middle, as index does.
+func (r *Reader) SetLabels(ls Labels) { r.ls = ls }
+
+// SetLocation defines location pc of the stream as if it was written in full earlier.
+// It's used to continue reading a stream from the middle, as index does.
+func (r *Reader) SetLocation(pc loc.PC, name, file string, line int) {
+	r.locs[pc] = locInfo{name: name, file: file, line: line}
+}
+
+// Err returns the first error occurred. io.EOF is not considered as an error.
+func (r *Reader) Err() error {
+	if r.err == nil && r.eof && len(r.dmg) != 0 {
+		return r.dmg
+	}
+
+	return r.err
+}
+
+func (r *Reader) trackState(ev *Event) {
+	if ev.hasLabels {
+		r.ls = ev.Labels
+	} else {
+		ev.Labels = r.ls
+	}
+
+	if ev.Location == 0 {
+		return
+	}
+
+	if ev.locFull {
+		r.locs[ev.Location] = ev.loc
+
+		return
+	}
+
+	if l, ok := r.locs[ev.Location]; ok {
+		ev.loc, ev.locKnown = l, true
+
+		ev.Location.SetCache(l.name, l.file, l.line)
+	}
+}
+
+// nextItem finds the next frame or plain event in the stream.
+func (r *Reader) nextItem() bool {
+	for {
+		if r.i == r.n || r.framed && !r.eof && r.i+len(FrameSync) > r.n {
+			if r.eof {
+				return false
+			}
+
+			if !r.read() {
+				return false
+			}
+
+			continue
+		}
+
+		d := &r.d
+		d.ResetBytes(r.b[:r.n])
+
+		var p []byte
+		var end int
+
+		i := r.i
+
+		if !r.framed && !isEventStart(r.b[i]) && !d.IsFrame(i) {
+			// framed stream with damaged first sync marker
+			// or garbage in plain stream, which is an error unless frames follow.
+			st := i + 1
+			if s := int(r.scanned - r.ref); s > st {
+				st = s
+			}
+
+			j := d.Resync(st)
+
+			switch {
+			case j+len(FrameSync) <= r.n:
+				r.framed = true
+				r.scanned = 0
+			case !r.eof && r.n-i < MaxFrameSize+FrameHeaderSize:
+				r.scanned = r.ref + int64(j)
+
+				if !r.read() {
+					return false
+				}
+
+				continue
+			}
+		}
+
+		switch {
+		case d.IsFrame(i):
+			r.framed = true
+
+			p, end = d.Frame(i)
+		case r.framed:
+			end = i
+		default:
+			end = d.Skip(i)
+			p = r.b[i:end]
+		}
+
+		err := d.Err()
+
+		if errors.Is(err, io.ErrUnexpectedEOF) && !r.eof {
+			if r.framed && r.frameAfter(i) {
+				r.damaged(i, ErrFrameOverlap)
+				continue
+			}
+
+			if !r.read() {
+				return false
+			}
+
+			continue
+		}
+
+		if err != nil && !r.framed {
+			if r.eof && errors.Is(err, io.ErrUnexpectedEOF) {
+				r.err = io.ErrUnexpectedEOF
+			} else {
+				r.err = errors.Wrap(err, "parse")
+			}
+
+			return false
+		}
+
+		if err != nil || end == i {
+			r.damaged(i, err)
+			continue
+		}
+
+		if r.bad != -1 {
+			r.dmg = append(r.dmg, DamagedRange{Start: r.bad, End: r.ref + int64(i), Err: r.badErr})
+			r.bad = -1
+		}
+
+		r.p = p
+		r.pi = 0
+		r.pref = r.ref + int64(i)
+		r.i = end
+		r.checked = 0
+
+		return true
+	}
+}
+
+// frameAfter reports whether a valid frame is in the buffer after incomplete frame at st.
+// So the st frame length is damaged and there is no reason to wait for the rest of it.
+func (r *Reader) frameAfter(st int) bool {
+	from := st + 1
+	if c := int(r.checked - r.ref); c > from {
+		from = c
+	}
+
+	ok, next := r.d.FrameAfter(from)
+
+	r.checked = r.ref + int64(next)
+
+	return ok
+}
+
+func (r *Reader) damaged(i int, err error) {
+	if r.bad == -1 {
+		r.bad = r.ref + int64(i)
+		r.badErr = err
+
+		if r.badErr == nil {
+			r.badErr = errors.New("no frame sync marker")
+		}
+	}
+
+	r.d.ResetErr()
+	r.checked = 0
+
+	next := r.d.Resync(i + 1)
+
+	if next+len(FrameSync) > r.n && r.eof {
+		next = r.n
+	}
+
+	if next == r.n && r.eof {
+		r.dmg = append(r.dmg, DamagedRange{Start: r.bad, End: r.ref + int64(r.n), Err: r.badErr})
+		r.bad = -1
+	}
+
+	r.i = next
+}
+
+// read shifts unprocessed data to the beginning of the buffer and reads more.
+func (r *Reader) read() bool {
+	r.n = copy(r.b, r.b[r.i:r.n])
+	r.ref += int64(r.i)
+	r.i = 0
+	r.p, r.pi = nil, 0
+
+	if r.n == len(r.b) {
+		q := make([]byte, len(r.b)*2)
+		copy(q, r.b)
+		r.b = q
+	}
+
+	m, err := r.Reader.Read(r.b[r.n:])
+	r.n += m
+
+	if errors.Is(err, io.EOF) {
+		r.eof = true
+	} else if err != nil {
+		r.err = errors.Wrap(err, "read")
+		return false
+	}
+
+	return true
+}
+
+// isEventStart reports whether b can start plain event: map or semantic header.
+func isEventStart(b byte) bool {
+	return b&TypeMask == Map || b == Semantic|WireHeader
+}
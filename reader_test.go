@@ -0,0 +1,309 @@
+package tlog
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog/low"
+)
+
+func TestReader(t *testing.T) {
+	tm := time.Date(2020, time.December, 25, 22, 8, 13, 0, time.Local)
+	TestSetTime(func() time.Time { return tm }, tm.UnixNano)
+	defer TestSetTime(time.Now, low.UnixNano)
+
+	var buf low.Buf
+
+	l := New(&buf)
+	l.NewID = testIDs()
+
+	l.SetLabels(Labels{"a=b", "c"})
+
+	tr := l.Start("span_name")
+	tr.Printw("message", "a", 1, "b", "str", KeyLogLevel, Warn)
+	tr.Spawn("child").Finish()
+	tr.Finish("status", 200)
+
+	r := NewReader(iotest.OneByteReader(bytes.NewReader(buf)))
+
+	var evs []*Event
+	for r.Next() {
+		evs = append(evs, r.Event().Clone())
+	}
+
+	require.NoError(t, r.Err())
+	require.Len(t, evs, 6)
+
+	assert.Equal(t, Labels{"a=b", "c"}, evs[0].Labels)
+
+	ev := evs[1]
+	assert.Equal(t, Labels{"a=b", "c"}, ev.Labels)
+	assert.Equal(t, EventType("s"), ev.Type)
+	assert.Equal(t, ID{1}, ev.Span)
+	assert.Equal(t, []byte("span_name"), ev.Message)
+	assert.Equal(t, Timestamp(tm.UnixNano()), ev.Time)
+	assert.NotZero(t, ev.Location)
+	assert.Equal(t, 0, ev.Len())
+
+	ev = evs[2]
+	assert.Equal(t, ID{1}, ev.Span)
+	assert.Equal(t, []byte("message"), ev.Message)
+	assert.Equal(t, Warn, ev.Level)
+
+	if assert.Equal(t, 2, ev.Len()) {
+		assert.Equal(t, []byte("a"), ev.Key(0))
+		assert.Equal(t, int64(1), ev.Value(0))
+		assert.Equal(t, []byte("b"), ev.Key(1))
+	}
+
+	v, ok := ev.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, "str", v)
+
+	_, ok = ev.GetRaw("none")
+	assert.False(t, ok)
+
+	ev = evs[3]
+	assert.Equal(t, ID{2}, ev.Span)
+	assert.Equal(t, ID{1}, ev.Parent)
+
+	ev = evs[5]
+	assert.Equal(t, EventType("f"), ev.Type)
+	assert.Equal(t, ID{1}, ev.Span)
+
+	v, ok = ev.Get("status")
+	assert.True(t, ok)
+	assert.Equal(t, int64(200), v)
+}
+
+func TestReaderTruncated(t *testing.T) {
+	var buf low.Buf
+
+	l := New(&buf)
+	l.Printw("message")
+
+	r := NewReader(bytes.NewReader(buf[:len(buf)-2]))
+
+	for r.Next() {
+	}
+
+	assert.Equal(t, io.ErrUnexpectedEOF, r.Err())
+}
+
+func TestReaderDamagedFirstFrame(t *testing.T) {
+	var buf low.Buf
+	var offs []int
+
+	l := New(&buf)
+	l.Framed = true
+	l.SetLabels(Labels{"a=b"})
+
+	for i := 0; i < 3; i++ {
+		offs = append(offs, len(buf))
+
+		l.Printw("message", "i", i)
+	}
+
+	for _, pos := range []int{0, 1, 3} {
+		damaged := append([]byte{}, buf...)
+		damaged[pos] ^= 0x01
+
+		for _, rd := range []io.Reader{bytes.NewReader(damaged), iotest.OneByteReader(bytes.NewReader(damaged))} {
+			r := NewReader(rd)
+
+			var got []int64
+
+			for r.Next() {
+				v, ok := r.Event().Get("i")
+				if assert.True(t, ok) {
+					got = append(got, v.(int64))
+				}
+			}
+
+			assert.Equal(t, []int64{0, 1, 2}, got, "pos %d", pos)
+
+			var cerr CorruptedError
+			if assert.True(t, errors.As(r.Err(), &cerr), "pos %d: %v", pos, r.Err()) && assert.Len(t, cerr, 1) {
+				assert.Equal(t, DamagedRange{Start: 0, End: int64(offs[0]), Err: cerr[0].Err}, cerr[0]) // labels frame
+			}
+		}
+	}
+}
+
+func TestReaderFrameOverlap(t *testing.T) {
+	var buf low.Buf
+	var offs []int
+
+	l := New(&buf)
+	l.Framed = true
+
+	for i := 0; i < 3; i++ {
+		offs = append(offs, len(buf))
+
+		l.Printw("message", "i", i)
+	}
+
+	damaged := append([]byte{}, buf...)
+	damaged[offs[0]+len(FrameSync)] = 0x01 // length is about 16MB
+
+	// the stream is not finished, so the Reader can't wait for the rest of the first frame
+	r := NewReader(io.MultiReader(bytes.NewReader(damaged), failingReader{}))
+
+	var got []int64
+
+	for r.Next() {
+		v, ok := r.Event().Get("i")
+		if assert.True(t, ok) {
+			got = append(got, v.(int64))
+		}
+	}
+
+	assert.Equal(t, []int64{1, 2}, got)
+	assert.True(t, errors.Is(r.Err(), errFailingReader), "err: %v", r.Err())
+}
+
+func TestEventAppendEvent(t *testing.T) {
+	var buf low.Buf
+
+	l := New(&buf)
+	l.SetLabels(Labels{"a=b"})
+
+	for i := 0; i < 2; i++ {
+		l.Printw("message", "i", i)
+	}
+
+	r := NewReader(bytes.NewReader(buf))
+
+	var e Encoder
+	var evs []*Event
+
+	for r.Next() {
+		evs = append(evs, r.Event().Clone())
+	}
+
+	require.NoError(t, r.Err())
+	require.Len(t, evs, 3)
+
+	assert.True(t, evs[0].IsHeader())
+	assert.False(t, evs[1].IsHeader())
+	assert.False(t, evs[2].locFull, "the second location is expected to be short")
+	assert.Equal(t, "1", evs[2].ValueString(0))
+
+	name, file, line := evs[1].LocationInfo()
+
+	// location is taken from the stream, not from the global cache
+	evs[1].Location.SetCache("other", "other.go", 1)
+	defer evs[1].Location.SetCache(name, file, line)
+
+	for i, ev := range evs[1:] {
+		b, err := e.AppendEvent(nil, ev, Labels{"c=d"})
+		require.NoError(t, err)
+
+		var x Event
+
+		n, err := x.Parse(b)
+		require.NoError(t, err)
+		assert.Equal(t, len(b), n)
+
+		assert.True(t, x.locFull)
+		assert.Equal(t, ev.Location, x.Location)
+		assert.Equal(t, locInfo{name: name, file: file, line: line}, x.loc)
+		assert.Equal(t, Labels{"c=d"}, x.Labels)
+		assert.Equal(t, "message", string(x.Message))
+		assert.Equal(t, []byte("i"), x.Key(0))
+		assert.Equal(t, int64(i), x.Value(0))
+		assert.False(t, x.IsHeader())
+	}
+
+	// indefinite-length map
+	raw := []byte{Map | LenBreak}
+	raw = e.AppendString(raw, String, KeyMessage)
+	raw = e.AppendString(raw, String, "msg")
+	raw = append(raw, Special|Break)
+
+	var ev Event
+
+	_, err := ev.Parse(raw)
+	require.NoError(t, err)
+
+	b, err := e.AppendEvent(nil, &ev, Labels{"c=d"})
+	require.NoError(t, err)
+
+	_, err = ev.Parse(b)
+	require.NoError(t, err)
+
+	assert.Equal(t, "msg", string(ev.Message))
+	assert.Equal(t, Labels{"c=d"}, ev.Labels)
+}
+
+func TestReaderSetState(t *testing.T) {
+	var buf low.Buf
+
+	l := New(&buf)
+	l.SetLabels(Labels{"a=b"})
+
+	var offs []int
+
+	for i := 0; i < 2; i++ {
+		offs = append(offs, len(buf))
+
+		l.Printw("message", "i", i)
+	}
+
+	r := NewReader(bytes.NewReader(buf))
+
+	var evs []*Event
+
+	for r.Next() {
+		evs = append(evs, r.Event().Clone())
+	}
+
+	require.NoError(t, r.Err())
+	require.Len(t, evs, 3)
+
+	assert.True(t, evs[1].LocationDefined())
+	assert.False(t, evs[2].LocationDefined())
+
+	pc := evs[1].Location
+
+	name, file, line := evs[1].LocationInfo()
+	defer pc.SetCache(name, file, line)
+
+	// continue from the second event as if the beginning was seen before
+	r = NewReader(bytes.NewReader(buf[offs[1]:]))
+	r.SetLabels(Labels{"a=b"})
+	r.SetLocation(pc, "name", "file.go", 10)
+
+	require.True(t, r.Next())
+	require.NoError(t, r.Err())
+
+	ev := r.Event()
+
+	assert.Equal(t, Labels{"a=b"}, ev.Labels)
+	assert.Equal(t, pc, ev.Location)
+	assert.Equal(t, locInfo{name: "name", file: "file.go", line: 10}, ev.loc)
+	assert.Equal(t, "1", ev.ValueString(0))
+}
+
+func testIDs() func() ID {
+	var i byte
+
+	return func() ID {
+		i++
+
+		return ID{i}
+	}
+}
+
+type failingReader struct{}
+
+var errFailingReader = errors.New("read past the data")
+
+func (failingReader) Read(p []byte) (int, error) { return 0, errFailingReader }
@@ -15,6 +15,7 @@ type (
 		w  io.Writer
 
 		name string
+		cur  string
 
 		size    int64
 		rotated bool
@@ -101,9 +102,22 @@ func (f *File) rotate() (err error) {
 	f.size = 0
 	f.rotated = true
 
+	f.cur = ""
+	if n, ok := f.w.(interface{ Name() string }); ok {
+		f.cur = n.Name()
+	}
+
 	return
 }
 
+// Name returns the current file name if known.
+func (f *File) Name() string {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	return f.cur
+}
+
 func (f *File) Close() (err error) {
 	defer f.mu.Unlock()
 	f.mu.Lock()
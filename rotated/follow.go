@@ -0,0 +1,388 @@
+package rotated
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog/compress"
+)
+
+type (
+	// Follower reads rotated files set as one continuous stream.
+	//
+	// Files are found by name pattern the same way File creates them (name@.tlog)
+	// and are read in the name (time) order.
+	// Files with .ez extension are decompressed. Compressed segments (name_time.tlog.ez)
+	// match the pattern without .ez as well.
+	//
+	// If Follow is set Follower waits for new data at the end of the last file
+	// and switches to the next file once it appears. Close interrupts waiting.
+	Follower struct {
+		Follow bool
+		Poll   time.Duration
+
+		OpenFile func(name string) (io.ReadCloser, error)
+
+		pattern string
+
+		name string
+		f    io.ReadCloser
+		r    io.Reader
+
+		resume bool
+		skip   int64
+
+		off   int64 // current file offset (decompressed)
+		pos   int64 // stream offset
+		marks []fileMark
+
+		mu       sync.Mutex
+		stopOnce sync.Once
+		stop     chan struct{}
+	}
+
+	// Checkpoint is a position in the rotated files set.
+	// Offset is in decompressed data for compressed files.
+	Checkpoint struct {
+		File   string `json:"file"`
+		Offset int64  `json:"offset"`
+	}
+
+	fileMark struct {
+		name  string
+		start int64
+	}
+
+	tailReader struct {
+		f *Follower
+	}
+)
+
+var ErrClosed = errors.New("follower closed")
+
+// maxMarks limits the number of recent files CheckpointAt can refer to.
+const maxMarks = 64
+
+// NewFollower creates Follower of files set created by File with the same name.
+// Name without SubstChar refers to the single file.
+func NewFollower(name string) *Follower {
+	return &Follower{
+		Poll:     500 * time.Millisecond,
+		OpenFile: func(n string) (io.ReadCloser, error) { return os.Open(n) },
+		pattern:  name,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Resume sets the position to start reading from.
+// It must be called before the first Read.
+func (f *Follower) Resume(c Checkpoint) {
+	f.name = c.File
+	f.skip = c.Offset
+	f.resume = true
+}
+
+// Checkpoint returns the position of the data already returned by Read.
+func (f *Follower) Checkpoint() Checkpoint {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	return Checkpoint{File: f.name, Offset: f.off}
+}
+
+// CheckpointAt converts stream offset (counted from the first Read) into Checkpoint.
+// It's useful to save position of the event end returned by Reader built on top of Follower.
+//
+// Offsets are expected to grow with each call, files before the one off points to are forgotten.
+func (f *Follower) CheckpointAt(off int64) (c Checkpoint) {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	j := 0
+
+	for i, m := range f.marks {
+		if m.start > off {
+			break
+		}
+
+		c = Checkpoint{File: m.name, Offset: off - m.start}
+		j = i
+	}
+
+	f.marks = append(f.marks[:0], f.marks[j:]...)
+
+	return
+}
+
+// Files returns the files set sorted in rotation order.
+func (f *Follower) Files() ([]string, error) {
+	if !strings.ContainsRune(f.pattern, SubstChar) {
+		return []string{f.pattern}, nil
+	}
+
+	p := strings.LastIndexByte(f.pattern, byte(SubstChar))
+	pref, suff := globEscape(f.pattern[:p])+"*", globEscape(f.pattern[p+1:])
+
+	files, err := filepath.Glob(pref + suff)
+	if err != nil {
+		return nil, err
+	}
+
+	if filepath.Ext(f.pattern) != ".ez" {
+		ez, err := filepath.Glob(pref + suff + ".ez")
+		if err != nil {
+			return nil, err
+		}
+
+		plain := make(map[string]struct{}, len(files))
+		for _, n := range files {
+			plain[n] = struct{}{}
+		}
+
+		for _, n := range ez {
+			if _, ok := plain[strings.TrimSuffix(n, ".ez")]; ok {
+				continue // being compressed
+			}
+
+			files = append(files, n)
+		}
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func (f *Follower) Read(p []byte) (n int, err error) {
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	for {
+		if f.r == nil {
+			err = f.openNext()
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		n, err = f.r.Read(p)
+
+		if f.skip != 0 {
+			m := int64(n)
+			if m > f.skip {
+				m = f.skip
+			}
+
+			copy(p, p[m:n])
+			n -= int(m)
+			f.skip -= m
+			f.off += m
+		}
+
+		f.off += int64(n)
+		f.pos += int64(n)
+
+		if errors.Is(err, io.EOF) {
+			err = f.closeCurrent()
+			if err != nil {
+				return n, err
+			}
+
+			if n != 0 {
+				return n, nil
+			}
+
+			continue
+		}
+
+		if n == 0 && err == nil {
+			continue
+		}
+
+		return n, err
+	}
+}
+
+// Close stops following and closes the current file.
+// It's safe to call Close concurrently with Read.
+func (f *Follower) Close() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+
+	defer f.mu.Unlock()
+	f.mu.Lock()
+
+	return f.closeCurrent()
+}
+
+func (f *Follower) openNext() (err error) {
+	for {
+		name, err := f.nextName()
+		if err != nil {
+			return errors.Wrap(err, "list files")
+		}
+
+		if name != "" {
+			return f.open(name)
+		}
+
+		if !f.Follow {
+			return io.EOF
+		}
+
+		if !f.wait() {
+			return ErrClosed
+		}
+	}
+}
+
+func (f *Follower) nextName() (string, error) {
+	files, err := f.Files()
+	if err != nil {
+		return "", err
+	}
+
+	if f.resume {
+		if _, err = os.Stat(f.name); os.IsNotExist(err) && filepath.Ext(f.name) != ".ez" {
+			if _, err = os.Stat(f.name + ".ez"); err == nil {
+				return f.name + ".ez", nil // compressed since then, offset is in decompressed data
+			}
+		}
+
+		return f.name, nil
+	}
+
+	if !strings.ContainsRune(f.pattern, SubstChar) {
+		if f.name != "" {
+			return "", nil
+		}
+
+		if _, err = os.Stat(f.pattern); os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return f.pattern, nil
+	}
+
+	last := strings.TrimSuffix(f.name, ".ez")
+
+	for _, n := range files {
+		if strings.TrimSuffix(n, ".ez") > last {
+			return n, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (f *Follower) open(name string) (err error) {
+	f.f, err = f.OpenFile(name)
+	if err != nil {
+		return errors.Wrap(err, "open %v", name)
+	}
+
+	f.name = name
+	f.off = 0
+
+	f.r = tailReader{f: f}
+
+	if filepath.Ext(name) == ".ez" {
+		f.r = compress.NewDecoder(f.r)
+	} else if s, ok := f.f.(io.Seeker); ok && f.skip != 0 {
+		f.off, err = s.Seek(f.skip, io.SeekStart)
+		if err != nil {
+			return errors.Wrap(err, "seek")
+		}
+
+		f.skip = 0
+	}
+
+	if len(f.marks) >= maxMarks {
+		f.marks = append(f.marks[:0], f.marks[1:]...)
+	}
+
+	f.marks = append(f.marks, fileMark{name: name, start: f.pos - f.off - f.skip})
+	f.resume = false
+
+	return nil
+}
+
+func (f *Follower) closeCurrent() (err error) {
+	if f.f != nil {
+		err = f.f.Close()
+	}
+
+	f.f = nil
+	f.r = nil
+
+	return err
+}
+
+// wait waits for Poll interval with f.mu unlocked.
+func (f *Follower) wait() bool {
+	t := time.NewTimer(f.Poll)
+	defer t.Stop()
+
+	f.mu.Unlock()
+	defer f.mu.Lock()
+
+	select {
+	case <-t.C:
+		return true
+	case <-f.stop:
+		return false
+	}
+}
+
+// Read reads the current file and waits for more data at the end
+// until the newer file appears.
+func (t tailReader) Read(p []byte) (n int, err error) {
+	f := t.f
+
+	for {
+		n, err = f.f.Read(p)
+		if n != 0 || !errors.Is(err, io.EOF) || !f.Follow {
+			return
+		}
+
+		next, err := f.nextName()
+		if err != nil {
+			return 0, errors.Wrap(err, "list files")
+		}
+
+		if next != "" && next != f.name {
+			// the last data could be written right before rotation
+			n, err = f.f.Read(p)
+			if n != 0 {
+				return n, nil
+			}
+
+			return 0, io.EOF
+		}
+
+		if !f.wait() || f.f == nil {
+			return 0, ErrClosed
+		}
+	}
+}
+
+func globEscape(s string) string {
+	var b strings.Builder
+
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', '\\':
+			b.WriteByte('\\')
+		}
+
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
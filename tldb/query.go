@@ -0,0 +1,207 @@
+package tldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// Query selects events. Zero fields match everything.
+	//
+	// The most selective index is used to iterate: span, parent, message, label,
+	// and events by time if none is set. The rest of conditions are checked on events.
+	Query struct {
+		Since, Until time.Time
+
+		Span    tlog.ID
+		Parent  tlog.ID
+		Message string
+
+		// Labels must all be present in event labels.
+		Labels tlog.Labels
+
+		// Limit is the max number of events returned.
+		Limit int
+	}
+
+	// Iter iterates over query results in time order.
+	//
+	// It holds read transaction open until Close.
+	// Event returned is valid until the next call to Next or Close. Use Event.Clone to keep it.
+	Iter struct {
+		q Query
+
+		tx  *bbolt.Tx
+		evs *bbolt.Bucket
+		c   *bbolt.Cursor
+
+		prefix []byte
+		since  []byte
+		until  uint64
+
+		started bool
+		n       int
+
+		ev tlog.Event
+
+		err error
+	}
+)
+
+// Query starts iteration over events matching q.
+// Buffered events are committed first.
+// Iter must be closed.
+func (w *DB) Query(q Query) *Iter {
+	it := &Iter{q: q}
+
+	it.err = w.Flush()
+	if it.err != nil {
+		return it
+	}
+
+	it.tx, it.err = w.db.Begin(false)
+	if it.err != nil {
+		return it
+	}
+
+	it.evs = it.tx.Bucket(BucketEvents)
+
+	var idx []byte
+
+	switch {
+	case q.Span != (tlog.ID{}):
+		idx, it.prefix = BucketSpan, q.Span[:]
+	case q.Parent != (tlog.ID{}):
+		idx, it.prefix = BucketParent, q.Parent[:]
+	case q.Message != "":
+		idx, it.prefix = BucketMessage, strPrefix([]byte(q.Message))
+	case len(q.Labels) != 0:
+		idx, it.prefix = BucketLabel, strPrefix([]byte(q.Labels[0]))
+	default:
+		idx = BucketEvents
+	}
+
+	it.c = it.tx.Bucket(idx).Cursor()
+
+	it.since = append([]byte{}, it.prefix...)
+
+	if !q.Since.IsZero() {
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], uint64(q.Since.UnixNano()))
+
+		it.since = append(it.since, ts[:]...)
+	}
+
+	if !q.Until.IsZero() {
+		it.until = uint64(q.Until.UnixNano())
+	}
+
+	return it
+}
+
+// Next advances to the next matching event.
+func (it *Iter) Next() bool {
+	if it.err != nil || it.tx == nil {
+		return false
+	}
+
+	if it.q.Limit != 0 && it.n >= it.q.Limit {
+		return false
+	}
+
+	for {
+		var k, v []byte
+
+		if it.started {
+			k, v = it.c.Next()
+		} else {
+			k, v = it.c.Seek(it.since)
+			it.started = true
+		}
+
+		if k == nil || !bytes.HasPrefix(k, it.prefix) || len(k) != len(it.prefix)+KeySize {
+			return false
+		}
+
+		key := k[len(it.prefix):]
+
+		if it.until != 0 && binary.BigEndian.Uint64(key) >= it.until {
+			return false
+		}
+
+		if it.prefix != nil {
+			v = it.evs.Get(key)
+			if v == nil {
+				continue // index is ahead of data, shouldn't happen
+			}
+		}
+
+		_, it.err = it.ev.Parse(v)
+		if it.err != nil {
+			return false
+		}
+
+		if !it.match(&it.ev) {
+			continue
+		}
+
+		it.n++
+
+		return true
+	}
+}
+
+func (it *Iter) match(ev *tlog.Event) bool {
+	q := &it.q
+
+	if q.Span != (tlog.ID{}) && ev.Span != q.Span {
+		return false
+	}
+
+	if q.Parent != (tlog.ID{}) && ev.Parent != q.Parent {
+		return false
+	}
+
+	if q.Message != "" && string(ev.Message) != q.Message {
+		return false
+	}
+
+outer:
+	for _, l := range q.Labels {
+		for _, el := range ev.Labels {
+			if el == l {
+				continue outer
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// Event returns the current event.
+func (it *Iter) Event() *tlog.Event { return &it.ev }
+
+func (it *Iter) Err() error { return it.err }
+
+// Close ends read transaction.
+func (it *Iter) Close() error {
+	if it.tx == nil {
+		return it.err
+	}
+
+	err := it.tx.Rollback()
+	it.tx = nil
+
+	if it.err != nil {
+		return it.err
+	}
+
+	return err
+}
@@ -0,0 +1,354 @@
+package tldb
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"go.etcd.io/bbolt"
+
+	"github.com/nikandfor/tlog"
+)
+
+type (
+	// DB is an event store on top of bbolt.
+	//
+	// It's an io.Writer accepting tlog stream. Events are stored by time
+	// with secondary indexes on span id, parent id, message and labels.
+	//
+	// Events are stored self-contained: locations are written in full
+	// and stream labels are added as KeyLabels pair.
+	// Events without time (span finish for example) take the last seen time in the stream.
+	//
+	// Writes are batched: events are committed in one transaction when MaxBatch bytes
+	// are buffered, Interval after the first buffered Write, or on Flush, Query and Close.
+	// Zero MaxBatch commits each Write in its own transaction.
+	// Commit error of a background flush is returned from the next Write or Flush.
+	//
+	// Events are parsed in Write, so a malformed event is rejected by the Write
+	// it came in and doesn't fail the batch of already accepted events.
+	DB struct {
+		MaxBatch int
+		Interval time.Duration
+
+		db *bbolt.DB
+
+		mu sync.Mutex
+
+		buf   []byte
+		timer *time.Timer
+		err   error
+
+		ev tlog.Event
+		e  tlog.Encoder
+
+		st stream
+	}
+
+	// stream is the state of the written stream.
+	// It's updated when the events are committed.
+	stream struct {
+		ls   tlog.Labels
+		last tlog.Timestamp
+	}
+)
+
+// Bucket names.
+var (
+	BucketEvents  = []byte("events")
+	BucketSpan    = []byte("span")
+	BucketParent  = []byte("parent")
+	BucketMessage = []byte("message")
+	BucketLabel   = []byte("label")
+)
+
+var buckets = [][]byte{BucketEvents, BucketSpan, BucketParent, BucketMessage, BucketLabel}
+
+// KeySize is event key size: big endian timestamp and sequence number.
+const KeySize = 16
+
+// Batching defaults.
+const DefaultMaxBatch = 1 << 20
+
+var DefaultBatchInterval = 100 * time.Millisecond
+
+// Open opens or creates the database file.
+//
+// Each commit is synced to disk. Set opts.NoSync to skip it,
+// that is much faster but the last events may be lost on system crash.
+func Open(name string, opts *bbolt.Options) (*DB, error) {
+	db, err := bbolt.Open(name, 0644, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := New(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// New creates DB on top of opened bbolt database.
+func New(db *bbolt.DB) (*DB, error) {
+	if !db.IsReadOnly() {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			for _, b := range buckets {
+				_, err := tx.CreateBucketIfNotExists(b)
+				if err != nil {
+					return errors.Wrap(err, "create bucket %s", b)
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &DB{
+		MaxBatch: DefaultMaxBatch,
+		Interval: DefaultBatchInterval,
+		db:       db,
+	}, nil
+}
+
+// Bolt returns the underlying database.
+func (w *DB) Bolt() *bbolt.DB { return w.db }
+
+// Close commits buffered events and closes the database.
+func (w *DB) Close() (err error) {
+	err = w.Flush()
+
+	if e := w.db.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// Write buffers events from p or stores them if MaxBatch is zero.
+// p must consist of whole events.
+// Events preceding the malformed one are accepted and their length is returned
+// along with the parsing error.
+func (w *DB) Write(p []byte) (n int, err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	if err = w.err; err != nil {
+		w.err = nil
+		return 0, err
+	}
+
+	var perr error
+
+	for n < len(p) {
+		m, err := w.ev.Parse(p[n:])
+		if err != nil {
+			perr = errors.Wrap(err, "parse event")
+			break
+		}
+
+		n += m
+	}
+
+	if n == 0 {
+		return 0, perr
+	}
+
+	p = p[:n]
+
+	if w.MaxBatch == 0 {
+		err = w.commit(p)
+		if err != nil {
+			return 0, err
+		}
+
+		return n, perr
+	}
+
+	w.buf = append(w.buf, p...)
+
+	if len(w.buf) >= w.MaxBatch {
+		err = w.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(w.buf) != 0 && w.timer == nil {
+		iv := w.Interval
+		if iv <= 0 {
+			iv = DefaultBatchInterval
+		}
+
+		w.timer = time.AfterFunc(iv, w.flushAsync)
+	}
+
+	return n, perr
+}
+
+// Flush commits buffered events.
+func (w *DB) Flush() (err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	err = w.flush()
+
+	if err == nil {
+		err = w.err
+	}
+
+	w.err = nil
+
+	return err
+}
+
+func (w *DB) flushAsync() {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	err := w.flush()
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *DB) flush() (err error) {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err = w.commit(w.buf)
+
+	w.buf = w.buf[:0]
+
+	return err
+}
+
+// commit stores events from p in one transaction.
+// p is already validated by Write.
+func (w *DB) commit(p []byte) error {
+	st := w.st
+
+	err := w.db.Update(func(tx *bbolt.Tx) error {
+		for i := 0; i < len(p); {
+			n, err := w.ev.Parse(p[i:])
+			if err != nil {
+				return errors.Wrap(err, "parse event")
+			}
+
+			i += n
+
+			err = w.put(tx, &w.ev, &st)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.st = st
+
+	return nil
+}
+
+func (w *DB) put(tx *bbolt.Tx, ev *tlog.Event, st *stream) (err error) {
+	if ev.Labels != nil {
+		st.ls = ev.Labels
+	}
+
+	if ev.IsHeader() {
+		return nil // labels header
+	}
+
+	ts := ev.Time
+	switch {
+	case ts != 0:
+		st.last = ts
+	case st.last != 0:
+		ts = st.last
+	default:
+		ts = tlog.Timestamp(time.Now().UnixNano())
+	}
+
+	evs := tx.Bucket(BucketEvents)
+
+	seq, err := evs.NextSequence()
+	if err != nil {
+		return errors.Wrap(err, "sequence")
+	}
+
+	var key [KeySize]byte
+	binary.BigEndian.PutUint64(key[:], uint64(ts))
+	binary.BigEndian.PutUint64(key[8:], seq)
+
+	// value must stay valid until the transaction is committed
+	val, err := w.e.AppendEvent(nil, ev, st.ls)
+	if err != nil {
+		return errors.Wrap(err, "encode")
+	}
+
+	err = evs.Put(key[:], val)
+	if err != nil {
+		return errors.Wrap(err, "put event")
+	}
+
+	if ev.Span != (tlog.ID{}) {
+		err = putIndex(tx, BucketSpan, ev.Span[:], key[:])
+	}
+
+	if err == nil && ev.Parent != (tlog.ID{}) {
+		err = putIndex(tx, BucketParent, ev.Parent[:], key[:])
+	}
+
+	if err == nil && len(ev.Message) != 0 {
+		err = putIndex(tx, BucketMessage, strPrefix(ev.Message), key[:])
+	}
+
+	for _, l := range st.ls {
+		if err != nil {
+			break
+		}
+
+		err = putIndex(tx, BucketLabel, strPrefix([]byte(l)), key[:])
+	}
+
+	return err
+}
+
+func putIndex(tx *bbolt.Tx, bucket, prefix, key []byte) error {
+	k := make([]byte, len(prefix)+len(key))
+	copy(k, prefix)
+	copy(k[len(prefix):], key)
+
+	err := tx.Bucket(bucket).Put(k, []byte{})
+	if err != nil {
+		return errors.Wrap(err, "put %s index", bucket)
+	}
+
+	return nil
+}
+
+// strPrefix is the length prefixed string so one value is not a prefix of another.
+func strPrefix(s []byte) []byte {
+	b := make([]byte, binary.MaxVarintLen64+len(s))
+
+	n := binary.PutUvarint(b, uint64(len(s)))
+	n += copy(b[n:], s)
+
+	return b[:n]
+}
@@ -0,0 +1,225 @@
+package tldb
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/loc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+
+	"github.com/nikandfor/tlog"
+)
+
+func TestDB(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "events.db")
+
+	db, err := Open(name, nil)
+	require.NoError(t, err)
+
+	base := time.Date(2020, time.December, 25, 22, 8, 13, 0, time.UTC)
+	ts := func(s int) tlog.Timestamp { return tlog.Timestamp(base.Add(time.Duration(s) * time.Second).UnixNano()) }
+
+	root := tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	child := tlog.ID{2, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	pc := loc.Caller(0)
+
+	e := tlog.Encoder{Writer: db, Labels: tlog.Labels{"a=b"}}
+
+	for _, kvs := range [][]interface{}{
+		{tlog.KeyTime, ts(0), tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("first")},
+		{tlog.KeyTime, ts(1), tlog.KeySpan, root, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("request")},
+		{tlog.KeyTime, ts(2), tlog.KeySpan, child, tlog.KeyParent, root, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("db")},
+		{tlog.KeyTime, ts(3), tlog.KeySpan, child, tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("query"), "rows", 3},
+		{tlog.KeySpan, child, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 2 * time.Second},
+		{tlog.KeySpan, root, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 3 * time.Second},
+	} {
+		err = e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+
+	e = tlog.Encoder{Writer: db, Labels: tlog.Labels{"c=d"}}
+
+	err = e.Encode(nil, []interface{}{tlog.KeyTime, ts(4), tlog.KeyMessage, tlog.Message("first")})
+	require.NoError(t, err)
+
+	err = db.Close()
+	require.NoError(t, err)
+
+	db, err = Open(name, nil)
+	require.NoError(t, err)
+
+	defer func() {
+		err := db.Close()
+		assert.NoError(t, err)
+	}()
+
+	type res struct {
+		Time    tlog.Timestamp
+		Type    tlog.EventType
+		Message string
+		Labels  tlog.Labels
+	}
+
+	query := func(q Query) (rs []res) {
+		it := db.Query(q)
+
+		for it.Next() {
+			ev := it.Event()
+			rs = append(rs, res{Time: ev.Time, Type: ev.Type, Message: string(ev.Message), Labels: ev.Labels})
+		}
+
+		err := it.Close()
+		assert.NoError(t, err)
+
+		return rs
+	}
+
+	assert.Equal(t, []res{
+		{Time: ts(1), Type: "s", Message: "request", Labels: tlog.Labels{"a=b"}},
+		{Type: "f", Labels: tlog.Labels{"a=b"}},
+	}, query(Query{Span: root}))
+
+	assert.Equal(t, []res{
+		{Time: ts(2), Type: "s", Message: "db", Labels: tlog.Labels{"a=b"}},
+	}, query(Query{Parent: root}))
+
+	assert.Equal(t, []res{
+		{Time: ts(0), Message: "first", Labels: tlog.Labels{"a=b"}},
+		{Time: ts(4), Message: "first", Labels: tlog.Labels{"c=d"}},
+	}, query(Query{Message: "first"}))
+
+	assert.Equal(t, []res{
+		{Time: ts(4), Message: "first", Labels: tlog.Labels{"c=d"}},
+	}, query(Query{Message: "first", Labels: tlog.Labels{"c=d"}}))
+
+	assert.Equal(t, []res{
+		{Time: ts(1), Type: "s", Message: "request", Labels: tlog.Labels{"a=b"}},
+		{Time: ts(2), Type: "s", Message: "db", Labels: tlog.Labels{"a=b"}},
+	}, query(Query{Since: base.Add(time.Second), Until: base.Add(3 * time.Second)}))
+
+	assert.Len(t, query(Query{Labels: tlog.Labels{"a=b"}}), 6)
+	assert.Len(t, query(Query{Limit: 2}), 2)
+	assert.Len(t, query(Query{Span: child, Since: base.Add(3 * time.Second)}), 2)
+
+	// locations are stored in full
+	it := db.Query(Query{Span: child, Message: "query"})
+
+	if assert.True(t, it.Next()) {
+		ev := it.Event()
+
+		assert.True(t, bytes.Contains(ev.Raw(), []byte("tldb_test.go")))
+		assert.Equal(t, int64(3), ev.Value(0))
+	}
+
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Close())
+}
+
+func TestDBBatch(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "events.db"), nil)
+	require.NoError(t, err)
+
+	defer func() {
+		err := db.Close()
+		assert.NoError(t, err)
+	}()
+
+	db.Interval = time.Hour
+
+	count := func() (n int) {
+		err := db.Bolt().View(func(tx *bbolt.Tx) error {
+			n = tx.Bucket(BucketEvents).Stats().KeyN
+
+			return nil
+		})
+		require.NoError(t, err)
+
+		return n
+	}
+
+	e := tlog.Encoder{Writer: db}
+
+	for i := 0; i < 3; i++ {
+		err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("message")})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 0, count())
+
+	err = db.Flush()
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, count())
+
+	db.Interval = 10 * time.Millisecond
+
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("message")})
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return count() == 4 }, time.Second, 10*time.Millisecond)
+
+	db.MaxBatch = 0
+
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("message")})
+	require.NoError(t, err)
+
+	assert.Equal(t, 5, count())
+}
+
+func TestDBMalformed(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "events.db"), nil)
+	require.NoError(t, err)
+
+	defer func() {
+		err := db.Close()
+		assert.NoError(t, err)
+	}()
+
+	db.Interval = time.Hour
+
+	var buf bytes.Buffer
+
+	e := tlog.Encoder{Writer: &buf, Labels: tlog.Labels{"a=b"}}
+
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("first")})
+	require.NoError(t, err)
+
+	good := buf.Len()
+
+	buf.Write([]byte{tlog.Map | 2, tlog.String | 1, 'm'}) // truncated event
+
+	n, err := db.Write(buf.Bytes())
+	assert.Error(t, err)
+	assert.Equal(t, good, n)
+
+	buf.Reset()
+
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("second")})
+	require.NoError(t, err)
+
+	n, err = db.Write(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, buf.Len(), n)
+
+	n, err = db.Write([]byte{0xff})
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	err = db.Flush()
+	require.NoError(t, err)
+
+	var msgs []string
+
+	it := db.Query(Query{Labels: tlog.Labels{"a=b"}})
+
+	for it.Next() {
+		msgs = append(msgs, string(it.Event().Message))
+	}
+
+	assert.NoError(t, it.Close())
+	assert.Equal(t, []string{"first", "second"}, msgs)
+}
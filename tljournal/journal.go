@@ -0,0 +1,262 @@
+package tljournal
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Writer sends events to systemd-journald using its native protocol.
+	//
+	// Message goes to MESSAGE, LogLevel to PRIORITY, location to CODE_FILE, CODE_LINE and CODE_FUNC,
+	// span ids to TLOG_SPAN and TLOG_PARENT, _execname label to SYSLOG_IDENTIFIER.
+	// The rest of kvs are written with upper-cased keys (see AppendFieldName).
+	//
+	// Entries too big for a datagram are passed in a sealed memfd.
+	Writer struct {
+		Addr string
+
+		// Prefix is prepended to kvs field names.
+		Prefix string
+
+		mu sync.Mutex
+
+		conn *net.UnixConn
+
+		ev tlog.Event
+		ls tlog.Labels
+		b  low.Buf
+		k  []byte
+	}
+)
+
+// DefaultSocket is the journald native protocol socket.
+var DefaultSocket = "/run/systemd/journal/socket"
+
+// NewWriter creates journald Writer. addr is DefaultSocket if empty.
+func NewWriter(addr string) *Writer {
+	if addr == "" {
+		addr = DefaultSocket
+	}
+
+	return &Writer{
+		Addr: addr,
+	}
+}
+
+// Priority maps tlog level to syslog priority.
+func Priority(lv tlog.LogLevel) int {
+	switch {
+	case lv >= tlog.Fatal:
+		return 2 // crit
+	case lv == tlog.Error:
+		return 3 // err
+	case lv == tlog.Warn:
+		return 4 // warning
+	case lv == tlog.Info:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		if w.ev.Labels != nil {
+			w.ls = w.ev.Labels
+		}
+
+		if w.ev.IsHeader() {
+			continue // labels header
+		}
+
+		w.b = w.AppendEntry(w.b[:0], &w.ev, w.ls)
+
+		err = w.send(w.b)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (w *Writer) Close() (err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	if w.conn == nil {
+		return nil
+	}
+
+	err = w.conn.Close()
+	w.conn = nil
+
+	return err
+}
+
+func (w *Writer) send(b []byte) (err error) {
+	if w.conn == nil {
+		// not connected socket so we can pass descriptors with WriteMsgUnix
+		w.conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+		if err != nil {
+			return errors.Wrap(err, "socket")
+		}
+	}
+
+	addr := &net.UnixAddr{Name: w.Addr, Net: "unixgram"}
+
+	_, err = w.conn.WriteToUnix(b, addr)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+		return errors.Wrap(err, "write")
+	}
+
+	err = sendMemfd(w.conn, addr, b)
+	if err != nil {
+		return errors.Wrap(err, "memfd")
+	}
+
+	return nil
+}
+
+// AppendEntry encodes event as journal entry.
+func (w *Writer) AppendEntry(b []byte, ev *tlog.Event, ls tlog.Labels) []byte {
+	b = appendField(b, "PRIORITY", strconv.Itoa(Priority(ev.Level)))
+
+	if len(ev.Message) != 0 {
+		b = appendField(b, "MESSAGE", string(ev.Message))
+	}
+
+	if v, ok := ls.Lookup("_execname"); ok && v != "" {
+		b = appendField(b, "SYSLOG_IDENTIFIER", v)
+	}
+
+	if ev.Location != 0 {
+		name, file, line := ev.LocationInfo()
+
+		b = appendField(b, "CODE_FILE", file)
+		b = appendField(b, "CODE_LINE", strconv.Itoa(line))
+		b = appendField(b, "CODE_FUNC", name)
+	}
+
+	if ev.Span != (tlog.ID{}) {
+		b = appendField(b, "TLOG_SPAN", ev.Span.FullString())
+	}
+
+	if ev.Parent != (tlog.ID{}) {
+		b = appendField(b, "TLOG_PARENT", ev.Parent.FullString())
+	}
+
+	if ev.Type != "" {
+		b = appendField(b, "TLOG_TYPE", string(ev.Type))
+	}
+
+	if ev.Time != 0 {
+		b = appendField(b, "TLOG_TIME", ev.Time.Time().UTC().Format(time.RFC3339Nano))
+	}
+
+	if ev.Elapsed != 0 {
+		b = appendField(b, "TLOG_ELAPSED", ev.Elapsed.String())
+	}
+
+	if len(ls) != 0 {
+		b = appendField(b, "TLOG_LABELS", strings.Join(ls, ","))
+	}
+
+	for i := 0; i < ev.Len(); i++ {
+		w.k = append(w.k[:0], w.Prefix...)
+		w.k = AppendFieldName(w.k, ev.Key(i))
+
+		b = appendField(b, string(w.k), ev.ValueString(i))
+	}
+
+	return b
+}
+
+// AppendFieldName converts key to journal field name:
+// upper case letters, digits and underscores not starting with underscore or digit.
+func AppendFieldName(b, k []byte) []byte {
+	st := len(b)
+
+	for _, c := range k {
+		switch {
+		case c >= 'a' && c <= 'z':
+			c -= 'a' - 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			c = '_'
+		}
+
+		if len(b) == st && (c == '_' || c >= '0' && c <= '9') {
+			b = append(b, 'X')
+		}
+
+		b = append(b, c)
+	}
+
+	if len(b) == st {
+		b = append(b, 'X')
+	}
+
+	if len(b)-st > 64 {
+		b = b[:st+64]
+	}
+
+	return b
+}
+
+// appendField appends KEY=value line or binary safe form if value has newlines.
+func appendField(b []byte, k, v string) []byte {
+	b = append(b, k...)
+
+	if !hasNewline(v) {
+		b = append(b, '=')
+		b = append(b, v...)
+
+		return append(b, '\n')
+	}
+
+	b = append(b, '\n')
+
+	var l [8]byte
+	binary.LittleEndian.PutUint64(l[:], uint64(len(v)))
+
+	b = append(b, l[:]...)
+	b = append(b, v...)
+
+	return append(b, '\n')
+}
+
+func hasNewline(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			return true
+		}
+	}
+
+	return false
+}
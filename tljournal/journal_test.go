@@ -0,0 +1,133 @@
+// +build linux
+
+package tljournal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/loc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+)
+
+func listen(t *testing.T) (*net.UnixConn, string) {
+	name := filepath.Join(t.TempDir(), "journal.sock")
+
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err)
+
+	return l, name
+}
+
+func TestWriter(t *testing.T) {
+	l, name := listen(t)
+	defer l.Close()
+
+	w := NewWriter(name)
+	defer w.Close()
+
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"_execname=app", "a=b"}}
+
+	pc := loc.Caller(0)
+	ts := tlog.Timestamp(time.Date(2020, time.December, 25, 22, 8, 13, 0, time.UTC).UnixNano())
+
+	err := e.Encode(nil, []interface{}{
+		tlog.KeyTime, ts,
+		tlog.KeySpan, tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		tlog.KeyLocation, pc,
+		tlog.KeyLogLevel, tlog.Warn,
+		tlog.KeyMessage, tlog.Message("some message"),
+		"user_id", 5,
+		"multi-line", "a\nb",
+	})
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+
+	_ = l.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, err := l.Read(buf)
+	require.NoError(t, err)
+
+	name, file, line := pc.NameFileLine()
+
+	exp := "PRIORITY=4\n" +
+		"MESSAGE=some message\n" +
+		"SYSLOG_IDENTIFIER=app\n" +
+		"CODE_FILE=" + file + "\n" +
+		"CODE_LINE=" + strconv.Itoa(line) + "\n" +
+		"CODE_FUNC=" + name + "\n" +
+		"TLOG_SPAN=0102030405060708090a0b0c0d0e0f10\n" +
+		"TLOG_TIME=2020-12-25T22:08:13Z\n" +
+		"TLOG_LABELS=_execname=app,a=b\n" +
+		"USER_ID=5\n" +
+		"MULTI_LINE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n"
+
+	assert.Equal(t, exp, string(buf[:n]))
+}
+
+func TestMemfd(t *testing.T) {
+	l, name := listen(t)
+	defer l.Close()
+
+	w := NewWriter(name)
+	defer w.Close()
+
+	e := tlog.Encoder{Writer: w}
+
+	big := string(bytes.Repeat([]byte("a"), 1<<20))
+
+	err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message(big)})
+	require.NoError(t, err)
+
+	oob := make([]byte, 128)
+
+	_ = l.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, oobn, _, _, err := l.ReadMsgUnix(nil, oob)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	require.NoError(t, err)
+	require.Len(t, fds, 1)
+
+	f := os.NewFile(uintptr(fds[0]), "memfd")
+	defer f.Close()
+
+	_, err = f.Seek(0, io.SeekStart) // offset is shared with the sender
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+
+	assert.True(t, bytes.HasPrefix(data, []byte("PRIORITY=6\nMESSAGE=aaa")))
+	assert.Len(t, data, len("PRIORITY=6\nMESSAGE=\n")+len(big))
+}
+
+func TestFieldName(t *testing.T) {
+	for k, exp := range map[string]string{
+		"user_id":  "USER_ID",
+		"Req.Path": "REQ_PATH",
+		"_secret":  "X_SECRET",
+		"1st":      "X1ST",
+		"":         "X",
+	} {
+		assert.Equal(t, exp, string(AppendFieldName(nil, []byte(k))), "%q", k)
+	}
+}
@@ -0,0 +1,40 @@
+// +build linux
+
+package tljournal
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/nikandfor/errors"
+	"golang.org/x/sys/unix"
+)
+
+// sendMemfd writes entry to sealed memfd and passes its descriptor to journald.
+func sendMemfd(c *net.UnixConn, addr *net.UnixAddr, b []byte) (err error) {
+	fd, err := unix.MemfdCreate("tlog-journal", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return errors.Wrap(err, "create")
+	}
+
+	f := os.NewFile(uintptr(fd), "tlog-journal")
+	defer f.Close()
+
+	_, err = f.Write(b)
+	if err != nil {
+		return errors.Wrap(err, "write")
+	}
+
+	_, err = unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL)
+	if err != nil {
+		return errors.Wrap(err, "seal")
+	}
+
+	_, _, err = c.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), addr)
+	if err != nil {
+		return errors.Wrap(err, "send")
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package tljournal
+
+import (
+	"net"
+
+	"github.com/nikandfor/errors"
+)
+
+func sendMemfd(c *net.UnixConn, addr *net.UnixAddr, b []byte) error {
+	return errors.New("entry is too big")
+}
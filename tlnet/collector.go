@@ -0,0 +1,301 @@
+package tlnet
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Collector accepts Writer connections and writes events to sinks opened by Open.
+	//
+	// Sink name is given by Name for each client after its first event.
+	// Sinks are shared: several clients with the same name (or all of them if Name returns constant)
+	// are merged into one stream. Client labels are written before its events each time the sink
+	// switches to another client and locations are always written in full,
+	// so the merged stream keeps each event attributed correctly.
+	Collector struct {
+		Open func(name string) (io.Writer, error)
+		Name func(ls tlog.Labels, addr net.Addr) string
+
+		mu    sync.Mutex
+		sinks map[string]*sink
+		conns map[net.Conn]struct{}
+
+		wg sync.WaitGroup
+	}
+
+	sink struct {
+		mu   sync.Mutex
+		w    io.Writer
+		last *client
+		refs int
+
+		e tlog.Encoder
+		b low.Buf
+	}
+
+	client struct {
+		addr net.Addr
+		r    *tlog.Reader
+	}
+)
+
+// Serve accepts connections until l is closed and returns Accept error.
+// It waits for client handlers to finish before return.
+func (c *Collector) Serve(l net.Listener) (err error) {
+	defer c.wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() { //nolint:staticcheck
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+
+		if c.conns == nil {
+			c.conns = make(map[net.Conn]struct{})
+		}
+
+		c.conns[conn] = struct{}{}
+		c.wg.Add(1)
+
+		c.mu.Unlock()
+
+		go func() {
+			defer c.wg.Done()
+
+			err := c.Handle(conn, conn.RemoteAddr())
+			tlog.V("conn").Printw("client disconnected", "addr", conn.RemoteAddr(), "err", err)
+
+			c.mu.Lock()
+			delete(c.conns, conn)
+			c.mu.Unlock()
+		}()
+	}
+}
+
+// Handle reads client stream r until EOF.
+func (c *Collector) Handle(r io.ReadCloser, addr net.Addr) (err error) {
+	_, err = c.handle(r, addr, 0)
+
+	return err
+}
+
+// handle skips the first skip events and returns the number of events processed including skipped.
+func (c *Collector) handle(r io.ReadCloser, addr net.Addr, skip int) (n int, err error) {
+	defer func() {
+		e := r.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	cl := &client{
+		addr: addr,
+		r:    tlog.NewReader(r),
+	}
+
+	var s *sink
+
+	defer func() {
+		if s == nil {
+			return
+		}
+
+		e := c.release(s)
+		if err == nil {
+			err = e
+		}
+	}()
+
+	for cl.r.Next() {
+		ev := cl.r.Event()
+
+		if n < skip {
+			n++
+			continue
+		}
+
+		if s == nil {
+			name := c.name(cl.r.Labels(), addr)
+
+			s, err = c.acquire(name)
+			if err != nil {
+				return n, errors.Wrap(err, "open %v", name)
+			}
+		}
+
+		err = s.write(cl, ev)
+		if err != nil {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, cl.r.Err()
+}
+
+// Close closes client connections accepted by Serve, waits for them to finish and closes sinks.
+func (c *Collector) Close() (err error) {
+	c.mu.Lock()
+
+	for conn := range c.conns {
+		_ = conn.Close()
+	}
+
+	c.mu.Unlock()
+
+	c.wg.Wait()
+
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	for name, s := range c.sinks {
+		if cl, ok := s.w.(io.Closer); ok {
+			if e := cl.Close(); err == nil {
+				err = e
+			}
+		}
+
+		delete(c.sinks, name)
+	}
+
+	return err
+}
+
+func (c *Collector) name(ls tlog.Labels, addr net.Addr) string {
+	if c.Name != nil {
+		return c.Name(ls, addr)
+	}
+
+	return ClientName(ls, addr)
+}
+
+func (c *Collector) acquire(name string) (s *sink, err error) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	if c.sinks == nil {
+		c.sinks = make(map[string]*sink)
+	}
+
+	s = c.sinks[name]
+	if s == nil {
+		w, err := c.Open(name)
+		if err != nil {
+			return nil, err
+		}
+
+		s = &sink{w: w}
+		c.sinks[name] = s
+	}
+
+	s.refs++
+
+	return s, nil
+}
+
+func (c *Collector) release(s *sink) (err error) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+
+	s.refs--
+	if s.refs != 0 {
+		return nil
+	}
+
+	for name, x := range c.sinks {
+		if x == s {
+			delete(c.sinks, name)
+		}
+	}
+
+	if cl, ok := s.w.(io.Closer); ok {
+		return cl.Close()
+	}
+
+	return nil
+}
+
+// ClientName is the default sink name: _hostname, _execname and _pid labels joined by '_'
+// or remote address host if there are no such labels, or "unknown".
+func ClientName(ls tlog.Labels, addr net.Addr) string {
+	var parts []string
+
+	for _, k := range []string{"_hostname", "_execname", "_pid"} {
+		if v, ok := ls.Lookup(k); ok && v != "" {
+			parts = append(parts, v)
+		}
+	}
+
+	if len(parts) == 0 && addr != nil {
+		a := addr.String()
+
+		if h, _, err := net.SplitHostPort(a); err == nil {
+			a = h
+		}
+
+		if a != "" && a != "@" {
+			parts = append(parts, a)
+		}
+	}
+
+	if len(parts) == 0 {
+		return "unknown"
+	}
+
+	name := strings.Join(parts, "_")
+
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', ' ', '@':
+			return '_'
+		}
+
+		return r
+	}, name)
+}
+
+func (s *sink) write(cl *client, ev *tlog.Event) (err error) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+again:
+	b := s.b[:0]
+
+	if s.last != cl && !ev.IsHeader() && (s.last != nil || len(cl.r.Labels()) != 0) {
+		b = s.e.AppendLabelsHeader(b, cl.r.Labels())
+	}
+
+	s.last = cl
+
+	b, err = s.e.AppendEvent(b, ev, nil)
+	if err != nil {
+		return errors.Wrap(err, "encode")
+	}
+
+	s.b = b[:0]
+
+	_, err = s.w.Write(b)
+
+	var rot tlog.RotatedError
+	if errors.As(err, &rot) && rot.IsRotated() {
+		s.last = nil
+
+		goto again
+	}
+
+	return err
+}
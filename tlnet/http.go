@@ -0,0 +1,483 @@
+package tlnet
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/compress"
+)
+
+type (
+	// HTTPHandler accepts POSTed batches of events and writes them through Collector.
+	//
+	// Body may be compressed by compress package (Content-Encoding: ez).
+	// Batches with Idempotency-Key header already seen are acknowledged without writing,
+	// Conflict is returned while the batch with the same key is in progress.
+	// If a batch failed partway, its retry skips events already written.
+	// Bodies larger than MaxBody bytes (before decompression) are cut off and rejected.
+	HTTPHandler struct {
+		Collector *Collector
+
+		// MaxKeys is the number of recent idempotency keys remembered.
+		MaxKeys int
+
+		// MaxBody is the request body size limit.
+		MaxBody int64
+
+		mu    sync.Mutex
+		keys  map[string]*httpBatch
+		order []string
+	}
+
+	httpBatch struct {
+		busy   bool
+		done   bool
+		listed bool // in order
+		n      int  // events written
+	}
+
+	// HTTPPusher batches events and POSTs them to HTTPHandler at URL.
+	//
+	// Batch is sent by background goroutine each Interval or when it grows over MaxBatch bytes,
+	// Write doesn't wait for the network.
+	// Failed requests are retried up to Retries times with doubling Backoff
+	// using the same Idempotency-Key. Batch is dropped if all attempts fail
+	// and the error is returned from the next Write, Flush or Close.
+	//
+	// Up to MaxBuffer bytes are buffered while the batch is being sent,
+	// newer data is dropped after that. See Dropped.
+	//
+	// Each batch is a self-contained stream: the first Write after a batch is taken
+	// returns ReconnectedError so tlog.Encoder (or convert.Copy) writes labels and locations again.
+	HTTPPusher struct {
+		URL string
+
+		Client *http.Client
+		Header http.Header
+
+		Interval  time.Duration
+		MaxBatch  int
+		MaxBuffer int
+
+		Compress bool
+
+		Retries int
+		Backoff time.Duration
+
+		mu sync.Mutex
+
+		buf     bytes.Buffer
+		fresh   bool
+		err     error
+		dropped int64
+
+		kick  chan struct{}
+		stopc chan struct{}
+		done  chan struct{}
+
+		smu sync.Mutex // sending
+
+		batch []byte
+		body  bytes.Buffer
+		z     *compress.Encoder
+	}
+
+	readCloser struct {
+		io.Reader
+		io.Closer
+	}
+
+	httpAddr string
+
+	permanentError struct {
+		error
+	}
+)
+
+// HTTP headers and values.
+const (
+	ContentType      = "application/x-tlog"
+	EncodingEz       = "ez"
+	IdempotencyKey   = "Idempotency-Key"
+	DefaultMaxKeys   = 4096
+	DefaultMaxBatch  = 1 << 20
+	DefaultMaxBuffer = 16 << 20
+	DefaultMaxBody   = int64(64 << 20)
+)
+
+var (
+	DefaultPushInterval = time.Second
+	DefaultPushBackoff  = 100 * time.Millisecond
+	DefaultPushTimeout  = 10 * time.Second
+)
+
+// NewHTTPHandler creates handler writing all the batches merged into w.
+func NewHTTPHandler(w io.Writer) *HTTPHandler {
+	return &HTTPHandler{
+		Collector: &Collector{
+			Open: func(string) (io.Writer, error) { return struct{ io.Writer }{w}, nil },
+			Name: func(tlog.Labels, net.Addr) string { return "" },
+		},
+	}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	max := h.MaxBody
+	if max == 0 {
+		max = DefaultMaxBody
+	}
+
+	body := http.MaxBytesReader(w, req.Body, max)
+
+	var r io.Reader = body
+
+	switch enc := req.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case EncodingEz:
+		r = compress.NewDecoder(r)
+	default:
+		http.Error(w, "unsupported encoding: "+enc, http.StatusUnsupportedMediaType)
+
+		return
+	}
+
+	key := req.Header.Get(IdempotencyKey)
+
+	var skip int
+
+	if key != "" {
+		var done, busy bool
+
+		skip, done, busy = h.start(key)
+
+		switch {
+		case done:
+			w.WriteHeader(http.StatusOK)
+
+			return
+		case busy:
+			http.Error(w, "batch is in progress", http.StatusConflict)
+
+			return
+		}
+	}
+
+	n, err := h.Collector.handle(readCloser{Reader: r, Closer: body}, httpAddr(req.RemoteAddr), skip)
+
+	if key != "" {
+		h.finish(key, n, err == nil)
+	}
+
+	if err != nil {
+		tlog.V("http").Printw("ingest", "remote_addr", req.RemoteAddr, "err", err)
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *HTTPHandler) start(key string) (skip int, done, busy bool) {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	if b, ok := h.keys[key]; ok {
+		if b.done || b.busy {
+			return 0, b.done, b.busy
+		}
+
+		b.busy = true
+
+		return b.n, false, false
+	}
+
+	if h.keys == nil {
+		h.keys = make(map[string]*httpBatch)
+	}
+
+	h.keys[key] = &httpBatch{busy: true}
+
+	return 0, false, false
+}
+
+func (h *HTTPHandler) finish(key string, n int, ok bool) {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	b := h.keys[key]
+	if b == nil {
+		return // evicted
+	}
+
+	b.busy = false
+	b.done = ok
+
+	if n > b.n {
+		b.n = n
+	}
+
+	if !ok && b.n == 0 {
+		delete(h.keys, key) // nothing is written, retry from scratch
+
+		return
+	}
+
+	if b.listed {
+		return
+	}
+
+	b.listed = true
+	h.order = append(h.order, key)
+
+	max := h.MaxKeys
+	if max == 0 {
+		max = DefaultMaxKeys
+	}
+
+	for len(h.order) > max {
+		delete(h.keys, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+// NewHTTPPusher creates pusher. Flushing goroutine is started on the first Write.
+func NewHTTPPusher(url string) *HTTPPusher {
+	return &HTTPPusher{
+		URL:       url,
+		Client:    &http.Client{Timeout: DefaultPushTimeout},
+		Interval:  DefaultPushInterval,
+		MaxBatch:  DefaultMaxBatch,
+		MaxBuffer: DefaultMaxBuffer,
+		Retries:   3,
+		Backoff:   DefaultPushBackoff,
+	}
+}
+
+func (w *HTTPPusher) Write(p []byte) (n int, err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	if w.fresh {
+		w.fresh = false
+
+		return 0, ReconnectedError{}
+	}
+
+	if w.stopc == nil {
+		w.kick = make(chan struct{}, 1)
+		w.stopc = make(chan struct{})
+		w.done = make(chan struct{})
+
+		go w.run(w.Interval, w.kick, w.stopc, w.done)
+	}
+
+	if w.MaxBuffer != 0 && w.buf.Len()+len(p) > w.MaxBuffer {
+		w.dropped += int64(len(p))
+		w.fresh = true // labels or locations may be lost with the dropped data
+
+		return len(p), w.takeErr()
+	}
+
+	n, _ = w.buf.Write(p)
+
+	if w.MaxBatch != 0 && w.buf.Len() >= w.MaxBatch {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	return n, w.takeErr()
+}
+
+// Dropped returns bytes dropped because the buffer was full.
+func (w *HTTPPusher) Dropped() int64 {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	return w.dropped
+}
+
+func (w *HTTPPusher) takeErr() (err error) {
+	err = w.err
+	w.err = nil
+
+	return err
+}
+
+// Flush sends the current batch and waits for it to be sent.
+func (w *HTTPPusher) Flush() error {
+	err := w.flush()
+
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	if err == nil {
+		err = w.err
+	}
+
+	w.err = nil
+
+	return err
+}
+
+// Close stops the flushing goroutine and sends the rest.
+func (w *HTTPPusher) Close() error {
+	w.mu.Lock()
+	stopc, done := w.stopc, w.done
+	w.stopc = nil
+	w.mu.Unlock()
+
+	if stopc != nil {
+		close(stopc)
+		<-done
+	}
+
+	return w.Flush()
+}
+
+func (w *HTTPPusher) run(iv time.Duration, kick, stopc, done chan struct{}) {
+	defer close(done)
+
+	if iv == 0 {
+		iv = DefaultPushInterval
+	}
+
+	t := time.NewTicker(iv)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-kick:
+		case <-stopc:
+			return
+		}
+
+		if err := w.flush(); err != nil {
+			w.mu.Lock()
+			w.err = err
+			w.mu.Unlock()
+		}
+	}
+}
+
+// flush takes the current batch and sends it.
+// Sending is serialized by smu, w.mu is not held meanwhile so Write is not blocked.
+func (w *HTTPPusher) flush() (err error) {
+	defer w.smu.Unlock()
+	w.smu.Lock()
+
+	w.mu.Lock()
+
+	w.batch = append(w.batch[:0], w.buf.Bytes()...)
+
+	if len(w.batch) != 0 {
+		w.buf.Reset()
+		w.fresh = true
+	}
+
+	w.mu.Unlock()
+
+	if len(w.batch) == 0 {
+		return nil
+	}
+
+	data := w.batch
+
+	if w.Compress {
+		w.body.Reset()
+
+		if w.z == nil {
+			w.z = compress.NewEncoder(&w.body, 1<<20)
+		} else {
+			w.z.Reset(&w.body)
+		}
+
+		_, err = w.z.Write(data)
+		if err != nil {
+			return errors.Wrap(err, "compress")
+		}
+
+		data = w.body.Bytes()
+	}
+
+	key := tlog.MathRandID().FullString()
+	backoff := w.Backoff
+
+	for try := 0; ; try++ {
+		err = w.post(data, key)
+		if err == nil || try >= w.Retries {
+			return err
+		}
+
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *HTTPPusher) post(data []byte, key string) (err error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(data))
+	if err != nil {
+		return permanentError{err}
+	}
+
+	for k, v := range w.Header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set(IdempotencyKey, key)
+
+	if w.Compress {
+		req.Header.Set("Content-Encoding", EncodingEz)
+	}
+
+	cl := w.Client
+	if cl == nil {
+		cl = &http.Client{Timeout: DefaultPushTimeout}
+	}
+
+	resp, err := cl.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "post")
+	}
+
+	defer resp.Body.Close()
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusConflict, resp.StatusCode/100 == 5:
+		return errors.New("post: %v: %s", resp.Status, bytes.TrimSpace(msg))
+	default:
+		return permanentError{errors.New("post: %v: %s", resp.Status, bytes.TrimSpace(msg))}
+	}
+}
+
+func (a httpAddr) Network() string { return "tcp" }
+
+func (a httpAddr) String() string { return string(a) }
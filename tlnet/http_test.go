@@ -0,0 +1,252 @@
+package tlnet
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/loc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/convert"
+)
+
+type flushingWriter struct {
+	*HTTPPusher
+}
+
+func TestHTTPPush(t *testing.T) {
+	for _, z := range []bool{false, true} {
+		var out lockedBuf
+		var reqs int32
+
+		h := NewHTTPHandler(&out)
+
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&reqs, 1) == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+
+			h.ServeHTTP(w, req)
+		}))
+
+		p := NewHTTPPusher(srv.URL)
+		p.Interval = time.Hour
+		p.Backoff = time.Millisecond
+		p.Compress = z
+
+		e := tlog.Encoder{Writer: p, Labels: tlog.Labels{"job=a"}}
+		pc := loc.Caller(0)
+
+		err := e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("first")})
+		require.NoError(t, err)
+
+		err = p.Flush()
+		require.NoError(t, err)
+
+		// the next batch starts with labels and full locations again
+		err = e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("second")})
+		require.NoError(t, err)
+
+		err = p.Close()
+		require.NoError(t, err)
+
+		srv.Close()
+
+		assert.Equal(t, int32(3), atomic.LoadInt32(&reqs), "compress: %v", z)
+
+		assert.Equal(t, []evInfo{
+			{Message: "first", Labels: tlog.Labels{"job=a"}, File: "http_test.go"},
+			{Message: "second", Labels: tlog.Labels{"job=a"}, File: "http_test.go"},
+		}, readEvents(t, out.Bytes()), "compress: %v", z)
+	}
+}
+
+func TestHTTPPushCopy(t *testing.T) {
+	var out lockedBuf
+
+	srv := httptest.NewServer(NewHTTPHandler(&out))
+	defer srv.Close()
+
+	var src bytes.Buffer
+
+	e := tlog.Encoder{Writer: &src, Labels: tlog.Labels{"job=a"}}
+	pc := loc.Caller(0)
+
+	for _, m := range []string{"first", "second", "third"} {
+		err := e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message(m)})
+		require.NoError(t, err)
+	}
+
+	p := NewHTTPPusher(srv.URL)
+	p.Interval = time.Hour
+
+	// each event is sent in its own batch
+	err := convert.Copy(flushingWriter{p}, &src)
+	require.NoError(t, err)
+
+	err = p.Close()
+	require.NoError(t, err)
+
+	assert.Equal(t, []evInfo{
+		{Message: "first", Labels: tlog.Labels{"job=a"}, File: "http_test.go"},
+		{Message: "second", Labels: tlog.Labels{"job=a"}, File: "http_test.go"},
+		{Message: "third", Labels: tlog.Labels{"job=a"}, File: "http_test.go"},
+	}, readEvents(t, out.Bytes()))
+}
+
+func TestHTTPPartialRetry(t *testing.T) {
+	var out lockedBuf
+
+	h := NewHTTPHandler(&out)
+
+	var b bytes.Buffer
+
+	e := tlog.Encoder{Writer: &b}
+
+	for _, m := range []string{"first", "second"} {
+		err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message(m)})
+		require.NoError(t, err)
+	}
+
+	full := append([]byte{}, b.Bytes()...)
+
+	err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("third")})
+	require.NoError(t, err)
+
+	for i, body := range [][]byte{
+		append(full, 0xff, 0xff), // damaged after two events
+		b.Bytes(),
+		b.Bytes(),
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set(IdempotencyKey, "key")
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		if i == 0 {
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		} else {
+			assert.Equal(t, http.StatusOK, w.Code)
+		}
+	}
+
+	assert.Equal(t, []evInfo{
+		{Message: "first", File: "."},
+		{Message: "second", File: "."},
+		{Message: "third", File: "."},
+	}, readEvents(t, out.Bytes()))
+}
+
+func TestHTTPIdempotency(t *testing.T) {
+	var out lockedBuf
+
+	h := NewHTTPHandler(&out)
+
+	var b bytes.Buffer
+
+	e := tlog.Encoder{Writer: &b}
+
+	err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("once")})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b.Bytes()))
+		req.Header.Set(IdempotencyKey, "key")
+
+		w := httptest.NewRecorder()
+
+		h.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	assert.Equal(t, []evInfo{{Message: "once", File: "."}}, readEvents(t, out.Bytes()))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHTTPPushMaxBuffer(t *testing.T) {
+	var out lockedBuf
+
+	srv := httptest.NewServer(NewHTTPHandler(&out))
+	defer srv.Close()
+
+	p := NewHTTPPusher(srv.URL)
+	p.Interval = time.Hour
+	p.MaxBatch = 0
+	p.MaxBuffer = 50
+
+	e := tlog.Encoder{Writer: p, Labels: tlog.Labels{"job=a"}}
+
+	for _, m := range []string{"first", "second", "third", "fourth", "fifth", "sixth"} {
+		err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message(m)})
+		require.NoError(t, err)
+	}
+
+	assert.NotZero(t, p.Dropped())
+
+	err := p.Flush()
+	require.NoError(t, err)
+
+	// labels are written again after the dropped data
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("after")})
+	require.NoError(t, err)
+
+	err = p.Close()
+	require.NoError(t, err)
+
+	evs := readEvents(t, out.Bytes())
+
+	require.True(t, len(evs) > 1 && len(evs) < 7, "events: %v", evs)
+	assert.Equal(t, evInfo{Message: "first", Labels: tlog.Labels{"job=a"}, File: "."}, evs[0])
+	assert.Equal(t, evInfo{Message: "after", Labels: tlog.Labels{"job=a"}, File: "."}, evs[len(evs)-1])
+}
+
+func TestHTTPMaxBody(t *testing.T) {
+	var out lockedBuf
+
+	h := NewHTTPHandler(&out)
+	h.MaxBody = 50
+
+	var b bytes.Buffer
+
+	e := tlog.Encoder{Writer: &b}
+
+	for i := 0; i < 10; i++ {
+		err := e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("message"), "i", i})
+		require.NoError(t, err)
+	}
+
+	require.True(t, b.Len() > 50)
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b.Bytes()))
+	w := httptest.NewRecorder()
+
+	h.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.True(t, len(readEvents(t, out.Bytes())) < 10)
+}
+
+func (w flushingWriter) Write(p []byte) (int, error) {
+	err := w.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	return w.HTTPPusher.Write(p)
+}
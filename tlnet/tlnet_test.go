@@ -0,0 +1,336 @@
+package tlnet
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/nikandfor/loc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/convert"
+)
+
+type (
+	lockedBuf struct {
+		mu sync.Mutex
+		bytes.Buffer
+	}
+
+	evInfo struct {
+		Message string
+		Labels  tlog.Labels
+		File    string
+	}
+
+	readerFunc func(p []byte) (int, error)
+)
+
+func TestWriterSpoolReconnect(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "collector.sock")
+
+	w := NewWriter("unix", sock)
+	w.Spool = filepath.Join(dir, "spool")
+	w.MinBackoff = 0
+
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"a=b"}}
+	pc := loc.Caller(0)
+
+	err := e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("spooled")})
+	require.NoError(t, err)
+
+	assert.NotZero(t, w.spoolSize)
+
+	l, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+
+	var out lockedBuf
+
+	c := &Collector{
+		Open: func(name string) (io.Writer, error) { return &out, nil },
+	}
+
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+
+		done <- c.Handle(conn, conn.RemoteAddr())
+	}()
+
+	err = e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("sent")})
+	require.NoError(t, err)
+
+	assert.Zero(t, w.spoolSize)
+
+	err = w.Close()
+	require.NoError(t, err)
+
+	err = <-done
+	require.NoError(t, err)
+
+	assert.Equal(t, []evInfo{
+		{Message: "spooled", Labels: tlog.Labels{"a=b"}, File: "tlnet_test.go"},
+		{Message: "sent", Labels: tlog.Labels{"a=b"}, File: "tlnet_test.go"},
+	}, readEvents(t, out.Bytes()))
+}
+
+func TestWriterCopyReconnect(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "collector.sock")
+
+	w := NewWriter("unix", sock)
+	w.Spool = filepath.Join(dir, "spool")
+	w.MinBackoff = 0
+
+	var src bytes.Buffer
+
+	e := tlog.Encoder{Writer: &src, Labels: tlog.Labels{"a=b"}}
+	pc := loc.Caller(0)
+
+	for _, m := range []string{"spooled1", "spooled2"} {
+		err := e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message(m)})
+		require.NoError(t, err)
+	}
+
+	part1 := append([]byte{}, src.Bytes()...)
+	src.Reset()
+
+	err := e.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("sent")})
+	require.NoError(t, err)
+
+	var out lockedBuf
+
+	c := &Collector{
+		Open: func(name string) (io.Writer, error) { return &out, nil },
+	}
+
+	done := make(chan error, 1)
+
+	// collector is started when the first part is spooled
+	r := io.MultiReader(bytes.NewReader(part1), readerFunc(func(p []byte) (int, error) {
+		l, err := net.Listen("unix", sock)
+		if err != nil {
+			return 0, err
+		}
+
+		go func() {
+			defer l.Close()
+
+			conn, err := l.Accept()
+			if err != nil {
+				done <- err
+				return
+			}
+
+			done <- c.Handle(conn, conn.RemoteAddr())
+		}()
+
+		return 0, io.EOF
+	}), &src)
+
+	err = convert.Copy(w, r)
+	require.NoError(t, err)
+
+	err = w.Close()
+	require.NoError(t, err)
+
+	err = <-done
+	require.NoError(t, err)
+
+	assert.Equal(t, []evInfo{
+		{Message: "spooled1", Labels: tlog.Labels{"a=b"}, File: "tlnet_test.go"},
+		{Message: "spooled2", Labels: tlog.Labels{"a=b"}, File: "tlnet_test.go"},
+		{Message: "sent", Labels: tlog.Labels{"a=b"}, File: "tlnet_test.go"},
+	}, readEvents(t, out.Bytes()))
+}
+
+func TestWriterNoSpool(t *testing.T) {
+	w := NewWriter("tcp", "nowhere")
+	w.Dial = func(network, addr string) (net.Conn, error) {
+		return nil, io.ErrClosedPipe
+	}
+
+	_, err := w.Write([]byte("data"))
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(4), w.Dropped())
+	assert.Equal(t, DefaultMinBackoff, w.backoff)
+
+	w.nextDial = now()
+
+	_, _ = w.Write([]byte("data"))
+	assert.Equal(t, 2*DefaultMinBackoff, w.backoff)
+}
+
+func TestCollectorMerge(t *testing.T) {
+	var out lockedBuf
+
+	c := &Collector{
+		Open: func(name string) (io.Writer, error) { return &out, nil },
+		Name: func(tlog.Labels, net.Addr) string { return "merged" },
+	}
+
+	pr, pw := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Handle(pr, nil)
+	}()
+
+	ea := tlog.Encoder{Writer: pw, Labels: tlog.Labels{"client=a"}}
+	pc := loc.Caller(0)
+
+	for _, m := range []string{"a1", "a2"} {
+		err := ea.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message(m)})
+		require.NoError(t, err)
+	}
+
+	var b bytes.Buffer
+	eb := tlog.Encoder{Writer: &b, Labels: tlog.Labels{"client=b"}}
+
+	err := eb.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("b1")})
+	require.NoError(t, err)
+
+	err = c.Handle(ioutil.NopCloser(&b), nil)
+	require.NoError(t, err)
+
+	err = ea.Encode(nil, []interface{}{tlog.KeyLocation, pc, tlog.KeyMessage, tlog.Message("a3")})
+	require.NoError(t, err)
+
+	_ = pw.Close()
+
+	err = <-done
+	require.NoError(t, err)
+
+	evs := readEvents(t, out.Bytes())
+	assert.Len(t, evs, 4)
+
+	for _, ev := range evs {
+		assert.Equal(t, tlog.Labels{"client=" + ev.Message[:1]}, ev.Labels, "%v", ev.Message)
+		assert.Equal(t, "tlnet_test.go", ev.File, "%v", ev.Message)
+	}
+}
+
+func TestCollectorClientLocations(t *testing.T) {
+	var out lockedBuf
+
+	c := &Collector{
+		Open: func(name string) (io.Writer, error) { return &out, nil },
+		Name: func(tlog.Labels, net.Addr) string { return "merged" },
+	}
+
+	pr, pw := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Handle(pr, nil)
+	}()
+
+	// both clients use the same pc for different locations
+	pc := loc.PC(0x123456)
+
+	_, err := pw.Write(locEvent(nil, "a1", pc, "a.go"))
+	require.NoError(t, err)
+
+	b := locEvent(nil, "b1", pc, "b.go")
+	b = locEvent(b, "b2", pc, "")
+
+	err = c.Handle(ioutil.NopCloser(bytes.NewReader(b)), nil)
+	require.NoError(t, err)
+
+	_, err = pw.Write(locEvent(nil, "a2", pc, ""))
+	require.NoError(t, err)
+
+	_ = pw.Close()
+
+	err = <-done
+	require.NoError(t, err)
+
+	evs := readEvents(t, out.Bytes())
+	assert.Len(t, evs, 4)
+
+	for _, ev := range evs {
+		assert.Equal(t, ev.Message[:1]+".go", ev.File, "%v", ev.Message)
+	}
+}
+
+func TestClientName(t *testing.T) {
+	assert.Equal(t, "host_app_123", ClientName(tlog.Labels{"_hostname=host", "_execname=app", "_pid=123", "a=b"}, nil))
+	assert.Equal(t, "127.0.0.1", ClientName(nil, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}))
+}
+
+func readEvents(t *testing.T, data []byte) (evs []evInfo) {
+	r := tlog.NewReader(bytes.NewReader(data))
+
+	for r.Next() {
+		ev := r.Event()
+
+		if len(ev.Message) == 0 {
+			continue
+		}
+
+		_, file, _ := ev.LocationInfo()
+
+		evs = append(evs, evInfo{Message: string(ev.Message), Labels: ev.Labels, File: filepath.Base(file)})
+	}
+
+	require.NoError(t, r.Err())
+
+	return evs
+}
+
+func (b *lockedBuf) Write(p []byte) (int, error) {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+
+	return b.Buffer.Write(p)
+}
+
+// locEvent appends message event with full location if file is set or short one otherwise.
+func locEvent(b []byte, msg string, pc loc.PC, file string) []byte {
+	var e tlog.Encoder
+
+	b = e.AppendTag(b, tlog.Map, 2)
+
+	b = e.AppendString(b, tlog.String, tlog.KeyMessage)
+	b = append(b, tlog.Semantic|tlog.WireMessage)
+	b = e.AppendString(b, tlog.String, msg)
+
+	b = e.AppendString(b, tlog.String, tlog.KeyLocation)
+	b = append(b, tlog.Semantic|tlog.WireLocation)
+
+	if file == "" {
+		return e.AppendUint(b, tlog.Int, uint64(pc))
+	}
+
+	b = e.AppendTag(b, tlog.Map, 4)
+
+	b = e.AppendString(b, tlog.String, "p")
+	b = e.AppendUint(b, tlog.Int, uint64(pc))
+
+	b = e.AppendString(b, tlog.String, "n")
+	b = e.AppendString(b, tlog.String, "main."+msg)
+
+	b = e.AppendString(b, tlog.String, "f")
+	b = e.AppendString(b, tlog.String, file)
+
+	b = e.AppendString(b, tlog.String, "l")
+	b = e.AppendInt(b, 10)
+
+	return b
+}
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,276 @@
+package tlnet
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nikandfor/errors"
+)
+
+type (
+	// Writer streams raw tlog events to a collector over tcp or unix socket.
+	//
+	// It reconnects with exponential backoff from MinBackoff to MaxBackoff.
+	// While disconnected data goes to Spool file if set (up to MaxSpool bytes, newer data is dropped after that)
+	// and is sent first after reconnect.
+	//
+	// Each time destination changes (new connection or spool) Write returns ReconnectedError
+	// without writing anything. It makes tlog.Encoder to reset its state and to write
+	// labels and locations again, as it does for rotated files. convert.Copy handles it the same way.
+	Writer struct {
+		Network, Addr string
+
+		Dial func(network, addr string) (net.Conn, error)
+
+		MinBackoff, MaxBackoff time.Duration
+
+		Spool    string
+		MaxSpool int64
+
+		mu sync.Mutex
+
+		conn net.Conn
+
+		backoff  time.Duration
+		nextDial time.Time
+
+		spool     *os.File
+		spoolSize int64
+
+		started bool // something is written
+		fresh   bool // destination changed
+
+		dropped int64
+	}
+
+	// ReconnectedError is returned when the destination is changed.
+	// It implements tlog.RotatedError.
+	ReconnectedError struct{}
+)
+
+var (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+	DefaultMaxSpool   = int64(64 << 20)
+)
+
+var now = time.Now
+
+// NewWriter creates Writer. Connection is established on the first write.
+func NewWriter(network, addr string) *Writer {
+	return &Writer{
+		Network:    network,
+		Addr:       addr,
+		Dial:       net.Dial,
+		MinBackoff: DefaultMinBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+		MaxSpool:   DefaultMaxSpool,
+	}
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	if w.conn == nil && !now().Before(w.nextDial) {
+		w.connect()
+	}
+
+	if w.fresh {
+		w.fresh = false
+
+		if w.started {
+			return 0, ReconnectedError{}
+		}
+	}
+
+	if w.conn != nil {
+		n, err = w.conn.Write(p)
+		if err == nil {
+			w.started = true
+
+			return n, nil
+		}
+
+		w.disconnect()
+		w.fresh = false // the same write is retried to spool
+
+		if w.started {
+			return 0, ReconnectedError{}
+		}
+	}
+
+	return w.writeSpool(p)
+}
+
+// Dropped returns bytes dropped because spool was full or not set.
+func (w *Writer) Dropped() int64 {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	return w.dropped
+}
+
+// Close closes connection and spool. Spooled data is kept for the next run.
+func (w *Writer) Close() (err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	if w.conn != nil {
+		err = w.conn.Close()
+		w.conn = nil
+	}
+
+	if w.spool != nil {
+		if e := w.spool.Close(); err == nil {
+			err = e
+		}
+
+		w.spool = nil
+	}
+
+	return err
+}
+
+func (w *Writer) connect() {
+	dial := w.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	conn, err := dial(w.Network, w.Addr)
+	if err != nil {
+		w.fail()
+		return
+	}
+
+	err = w.sendSpool(conn)
+	if err != nil {
+		_ = conn.Close()
+		w.fail()
+
+		return
+	}
+
+	w.conn = conn
+	w.backoff = 0
+	w.fresh = true
+}
+
+func (w *Writer) disconnect() {
+	_ = w.conn.Close()
+	w.conn = nil
+
+	w.fail()
+}
+
+func (w *Writer) fail() {
+	switch {
+	case w.backoff == 0:
+		w.backoff = w.MinBackoff
+	case w.backoff < w.MaxBackoff:
+		w.backoff *= 2
+	}
+
+	if w.MaxBackoff != 0 && w.backoff > w.MaxBackoff {
+		w.backoff = w.MaxBackoff
+	}
+
+	w.nextDial = now().Add(w.backoff)
+}
+
+func (w *Writer) openSpool() (err error) {
+	if w.spool != nil {
+		return nil
+	}
+
+	w.spool, err = os.OpenFile(w.Spool, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open spool")
+	}
+
+	w.spoolSize, err = w.spool.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrap(err, "seek spool")
+	}
+
+	return nil
+}
+
+func (w *Writer) writeSpool(p []byte) (n int, err error) {
+	if w.Spool == "" {
+		w.dropped += int64(len(p))
+
+		return len(p), nil
+	}
+
+	err = w.openSpool()
+	if err != nil {
+		return 0, err
+	}
+
+	if w.MaxSpool != 0 && w.spoolSize+int64(len(p)) > w.MaxSpool {
+		w.dropped += int64(len(p))
+
+		return len(p), nil
+	}
+
+	n, err = w.spool.Write(p)
+	w.spoolSize += int64(n)
+
+	if err != nil {
+		return n, errors.Wrap(err, "write spool")
+	}
+
+	w.started = true
+
+	return n, nil
+}
+
+// sendSpool sends spooled data and truncates spool.
+func (w *Writer) sendSpool(conn net.Conn) (err error) {
+	if w.Spool == "" {
+		return nil
+	}
+
+	if w.spool == nil {
+		if _, err = os.Stat(w.Spool); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	err = w.openSpool()
+	if err != nil {
+		return err
+	}
+
+	if w.spoolSize == 0 {
+		return nil
+	}
+
+	_, err = io.Copy(conn, io.NewSectionReader(w.spool, 0, w.spoolSize))
+	if err != nil {
+		return errors.Wrap(err, "send spool")
+	}
+
+	err = w.spool.Truncate(0)
+	if err != nil {
+		return errors.Wrap(err, "truncate spool")
+	}
+
+	_, err = w.spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "seek spool")
+	}
+
+	w.spoolSize = 0
+
+	return nil
+}
+
+func (ReconnectedError) Error() string { return "reconnected" }
+
+func (ReconnectedError) IsRotated() bool { return true }
@@ -0,0 +1,440 @@
+package tlstatsd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Writer sends Observe values as StatsD metrics over udp.
+	//
+	// Metric type is learned from RegisterMetric events:
+	// counters are sent as |c, summaries as |ms for durations (in milliseconds) and |h for the rest,
+	// gauges and unregistered metrics as |g.
+	// Counter values are increments.
+	//
+	// Labels and Observe kvs become DogStatsD tags unless NoTags is set.
+	//
+	// Values are aggregated client side during Interval: counters are summed,
+	// the last gauge value is sent, summary values are all sent.
+	// If Interval is zero metrics are sent at the end of each Write.
+	// Lines are packed into packets up to MaxPacket bytes.
+	//
+	// Send errors are not returned from Write, metrics are dropped instead.
+	Writer struct {
+		Network, Addr string
+
+		// Prefix is prepended to metric names.
+		Prefix string
+
+		Interval  time.Duration
+		MaxPacket int
+
+		NoTags bool
+
+		Dial func(network, addr string) (net.Conn, error)
+
+		mu sync.Mutex
+
+		conn net.Conn
+
+		types  map[string]string
+		series map[string]*series
+
+		dropped int64
+
+		stopc chan struct{}
+		done  chan struct{}
+
+		ev   tlog.Event
+		ls   tlog.Labels
+		b    low.Buf
+		tags []string
+	}
+
+	series struct {
+		name string
+		kind string
+		tags string
+
+		val  float64
+		vals []float64
+	}
+)
+
+// StatsD metric types.
+const (
+	Counter   = "c"
+	Gauge     = "g"
+	Timing    = "ms"
+	Histogram = "h"
+)
+
+var (
+	DefaultMaxPacket = 1432
+	DefaultInterval  = 10 * time.Second
+)
+
+// NewWriter creates Writer sending to udp addr.
+func NewWriter(addr string) *Writer {
+	return &Writer{
+		Network:   "udp",
+		Addr:      addr,
+		Interval:  DefaultInterval,
+		MaxPacket: DefaultMaxPacket,
+		Dial:      net.Dial,
+	}
+}
+
+func (w *Writer) Write(p []byte) (n int, err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		if w.ev.Labels != nil {
+			w.ls = w.ev.Labels
+		}
+
+		switch w.ev.Type {
+		case "m":
+			w.register(&w.ev)
+		case "v":
+			w.add(&w.ev)
+		}
+	}
+
+	if w.Interval == 0 {
+		_ = w.flush()
+	} else if w.stopc == nil {
+		w.stopc = make(chan struct{})
+		w.done = make(chan struct{})
+
+		go w.run(w.Interval, w.stopc, w.done)
+	}
+
+	return len(p), nil
+}
+
+// Dropped returns the number of lines dropped because of send errors.
+func (w *Writer) Dropped() int64 {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	return w.dropped
+}
+
+// Flush sends aggregated metrics.
+func (w *Writer) Flush() error {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	return w.flush()
+}
+
+// Close stops the flushing goroutine, sends the rest and closes the connection.
+func (w *Writer) Close() (err error) {
+	w.mu.Lock()
+	stopc, done := w.stopc, w.done
+	w.stopc = nil
+	w.mu.Unlock()
+
+	if stopc != nil {
+		close(stopc)
+		<-done
+	}
+
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	err = w.flush()
+
+	if w.conn != nil {
+		if e := w.conn.Close(); err == nil {
+			err = e
+		}
+
+		w.conn = nil
+	}
+
+	return err
+}
+
+func (w *Writer) run(iv time.Duration, stopc, done chan struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(iv)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-stopc:
+			return
+		}
+
+		w.mu.Lock()
+		_ = w.flush()
+		w.mu.Unlock()
+	}
+}
+
+func (w *Writer) register(ev *tlog.Event) {
+	for i := 0; i < ev.Len(); i++ {
+		if string(ev.Key(i)) != "type" {
+			continue
+		}
+
+		typ, _ := ev.Value(i).(string)
+
+		if w.types == nil {
+			w.types = make(map[string]string)
+		}
+
+		w.types[string(ev.Message)] = typ
+	}
+}
+
+func (w *Writer) add(ev *tlog.Event) {
+	if ev.Len() == 0 {
+		return
+	}
+
+	name := string(ev.Key(0))
+
+	var v float64
+	dur := false
+
+	switch x := ev.Value(0).(type) {
+	case int64:
+		v = float64(x)
+	case uint64:
+		v = float64(x)
+	case float64:
+		v = x
+	case time.Duration:
+		v = float64(x) / float64(time.Millisecond)
+		dur = true
+	default:
+		return
+	}
+
+	kind := Gauge
+
+	switch w.types[name] {
+	case tlog.MetricCounter:
+		kind = Counter
+	case tlog.MetricSummary:
+		kind = Histogram
+
+		if dur {
+			kind = Timing
+		}
+	}
+
+	var tags string
+	if !w.NoTags {
+		tags = w.appendTags(ev)
+	}
+
+	key := name + "|" + kind + "|" + tags
+
+	s := w.series[key]
+	if s == nil {
+		if w.series == nil {
+			w.series = make(map[string]*series)
+		}
+
+		s = &series{name: name, kind: kind, tags: tags}
+		w.series[key] = s
+	}
+
+	switch kind {
+	case Counter:
+		s.val += v
+	case Gauge:
+		s.val = v
+	default:
+		s.vals = append(s.vals, v)
+	}
+}
+
+func (w *Writer) appendTags(ev *tlog.Event) string {
+	w.tags = w.tags[:0]
+
+	for _, l := range w.ls {
+		k, v := l, ""
+
+		if p := strings.IndexByte(l, '='); p != -1 {
+			k, v = l[:p], l[p+1:]
+		}
+
+		w.tags = append(w.tags, tag(k, v))
+	}
+
+	for i := 1; i < ev.Len(); i++ {
+		w.tags = append(w.tags, tag(string(ev.Key(i)), fmt.Sprint(ev.Value(i))))
+	}
+
+	return strings.Join(w.tags, ",")
+}
+
+func (w *Writer) flush() (err error) {
+	if len(w.series) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(w.series))
+	for k := range w.series {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	max := w.MaxPacket
+	if max == 0 {
+		max = DefaultMaxPacket
+	}
+
+	b := w.b[:0]
+	lines := 0
+
+	for _, k := range keys {
+		s := w.series[k]
+
+		vals := s.vals
+		if s.kind == Counter || s.kind == Gauge {
+			vals = []float64{s.val}
+		}
+
+		for _, v := range vals {
+			st := len(b)
+
+			if st != 0 {
+				b = append(b, '\n')
+			}
+
+			b = w.AppendLine(b, s.name, v, s.kind, s.tags)
+
+			if len(b) <= max || st == 0 {
+				lines++
+				continue
+			}
+
+			if e := w.send(b[:st], lines); err == nil {
+				err = e
+			}
+
+			b = append(b[:0], b[st+1:]...)
+			lines = 1
+		}
+	}
+
+	if len(b) != 0 {
+		if e := w.send(b, lines); err == nil {
+			err = e
+		}
+	}
+
+	w.b = b[:0]
+
+	for k := range w.series {
+		delete(w.series, k)
+	}
+
+	return err
+}
+
+func (w *Writer) send(b []byte, lines int) (err error) {
+	if w.conn == nil {
+		dial := w.Dial
+		if dial == nil {
+			dial = net.Dial
+		}
+
+		w.conn, err = dial(w.Network, w.Addr)
+		if err != nil {
+			w.dropped += int64(lines)
+
+			return errors.Wrap(err, "dial")
+		}
+	}
+
+	_, err = w.conn.Write(b)
+	if err != nil {
+		_ = w.conn.Close()
+		w.conn = nil
+
+		w.dropped += int64(lines)
+
+		return errors.Wrap(err, "write")
+	}
+
+	return nil
+}
+
+// AppendLine formats StatsD line: <prefix><name>:<value>|<kind>[|#<tags>].
+func (w *Writer) AppendLine(b []byte, name string, v float64, kind, tags string) []byte {
+	b = appendName(b, w.Prefix)
+	b = appendName(b, name)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, v, 'f', -1, 64)
+	b = append(b, '|')
+	b = append(b, kind...)
+
+	if tags != "" {
+		b = append(b, "|#"...)
+		b = append(b, tags...)
+	}
+
+	return b
+}
+
+func appendName(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch c {
+		case ':', '|', '@', '#', ',', ' ', '\n':
+			c = '_'
+		}
+
+		b = append(b, c)
+	}
+
+	return b
+}
+
+func tag(k, v string) string {
+	b := appendName(nil, k)
+
+	if v != "" {
+		b = append(b, ':')
+		b = append(b, strings.Map(func(r rune) rune {
+			switch r {
+			case '|', ',', '#', '\n':
+				return '_'
+			}
+
+			return r
+		}, v)...)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,102 @@
+package tlstatsd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+)
+
+func TestWriter(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	w := NewWriter(l.LocalAddr().String())
+	w.Prefix = "app."
+	w.Interval = time.Hour
+
+	tl := tlog.New(w)
+	tl.NoTime = true
+	tl.NoCaller = true
+	tl.SetLabels(tlog.Labels{"env=prod", "canary"})
+
+	tl.RegisterMetric("requests", tlog.MetricCounter, "number of requests")
+	tl.RegisterMetric("latency", tlog.MetricSummary, "request latency")
+	tl.RegisterMetric("size", tlog.MetricSummary, "response size")
+
+	tl.Observe("requests", 1, "path", "/a")
+	tl.Observe("requests", 2, "path", "/a")
+	tl.Observe("requests", 1, "path", "/b")
+	tl.Observe("latency", 1500*time.Microsecond)
+	tl.Observe("latency", 2*time.Millisecond)
+	tl.Observe("size", 100)
+	tl.Observe("temp", 36.6)
+	tl.Observe("temp", 36.7)
+
+	err = w.Flush()
+	require.NoError(t, err)
+
+	buf := make([]byte, 2048)
+
+	_ = l.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := l.ReadFrom(buf)
+	require.NoError(t, err)
+
+	lines := strings.Split(string(buf[:n]), "\n")
+	sort.Strings(lines)
+
+	assert.Equal(t, []string{
+		"app.latency:1.5|ms|#env:prod,canary",
+		"app.latency:2|ms|#env:prod,canary",
+		"app.requests:1|c|#env:prod,canary,path:/b",
+		"app.requests:3|c|#env:prod,canary,path:/a",
+		"app.size:100|h|#env:prod,canary",
+		"app.temp:36.7|g|#env:prod,canary",
+	}, lines)
+
+	err = w.Close()
+	assert.NoError(t, err)
+}
+
+func TestWriterPackets(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	w := NewWriter(l.LocalAddr().String())
+	w.Interval = 0
+	w.MaxPacket = 20
+	w.NoTags = true
+
+	e := tlog.Encoder{Writer: w, Labels: tlog.Labels{"a=b"}}
+
+	err = e.Encode(nil, []interface{}{tlog.KeyEventType, tlog.EventType("v"), "first_metric", 1})
+	require.NoError(t, err)
+
+	err = e.Encode(nil, []interface{}{tlog.KeyEventType, tlog.EventType("v"), "second_metric", 2, "k", "v"})
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+
+	for _, exp := range []string{"first_metric:1|g", "second_metric:2|g"} {
+		_ = l.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, _, err := l.ReadFrom(buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, exp, string(buf[:n]))
+	}
+
+	err = w.Close()
+	assert.NoError(t, err)
+}
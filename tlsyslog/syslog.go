@@ -0,0 +1,521 @@
+package tlsyslog
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	// Writer sends events to syslog in RFC 5424 format.
+	//
+	// LogLevel is mapped to severity, _hostname, _execname and _pid labels
+	// to HOSTNAME, APP-NAME and PROCID header fields, the message goes to MSG
+	// and the rest of kvs and labels go to structured data element SDID.
+	// RFC 5424 requires private SD-IDs to be name@<private enterprise number>,
+	// so there is no default one: if SDID is empty kvs are appended to MSG as key=value pairs.
+	//
+	// Stream connections (tcp, unix) use octet-counting framing,
+	// datagram ones (udp, unixgram) send one message per packet.
+	// unix falls back to unixgram if the socket is not a stream one, as /dev/log usually is.
+	// Datagram messages are truncated to MaxMessage bytes, and messages rejected
+	// by the transport as too long are dropped, so they don't block the queue.
+	//
+	// Connection is established on the first write and reestablished after errors
+	// not often than ReconnectInterval. Messages are buffered while disconnected
+	// up to MaxBuffer bytes, the oldest are dropped after that.
+	Writer struct {
+		Network, Addr string
+
+		Facility int
+		SDID     string
+
+		// Hostname, AppName and ProcID are used if event labels have no such values.
+		Hostname string
+		AppName  string
+		ProcID   string
+
+		MaxBuffer         int
+		MaxMessage        int
+		ReconnectInterval time.Duration
+
+		Dial func(network, addr string) (net.Conn, error)
+
+		mu sync.Mutex
+
+		conn     net.Conn
+		stream   bool
+		lastDial time.Time
+
+		pend    [][]byte
+		pendLen int
+		dropped int64
+
+		ev tlog.Event
+		ls tlog.Labels
+		b  low.Buf
+	}
+)
+
+// Facilities.
+const (
+	Kern = iota
+	User
+	Mail
+	Daemon
+	Auth
+	Syslog
+	Lpr
+	News
+	Uucp
+	Cron
+	AuthPriv
+	Ftp
+)
+
+// Local use facilities.
+const (
+	Local0 = 16 + iota
+	Local1
+	Local2
+	Local3
+	Local4
+	Local5
+	Local6
+	Local7
+)
+
+// Severities.
+const (
+	Emergency = iota
+	Alert
+	Critical
+	Error
+	Warning
+	Notice
+	Informational
+	Debug
+)
+
+var (
+	DefaultMaxBuffer         = 1 << 20
+	DefaultMaxMessage        = 8 << 10
+	DefaultReconnectInterval = time.Second
+)
+
+// Nil is RFC 5424 NILVALUE.
+const Nil = "-"
+
+// NewWriter creates syslog Writer.
+// network is one of udp, tcp, unix or unixgram.
+func NewWriter(network, addr string) *Writer {
+	w := &Writer{
+		Network:           network,
+		Addr:              addr,
+		Facility:          User,
+		MaxBuffer:         DefaultMaxBuffer,
+		MaxMessage:        DefaultMaxMessage,
+		ReconnectInterval: DefaultReconnectInterval,
+		Dial:              net.Dial,
+	}
+
+	w.Hostname, _ = os.Hostname()
+
+	return w
+}
+
+// Severity maps tlog level to syslog severity.
+func Severity(lv tlog.LogLevel) int {
+	switch {
+	case lv >= tlog.Fatal:
+		return Critical
+	case lv == tlog.Error:
+		return Error
+	case lv == tlog.Warn:
+		return Warning
+	case lv == tlog.Info:
+		return Informational
+	default:
+		return Debug
+	}
+}
+
+// Write formats events and sends them.
+// Connection errors are not returned, messages are buffered instead.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	for i := 0; i < len(p); {
+		n, err = w.ev.Parse(p[i:])
+		if err != nil {
+			return 0, err
+		}
+
+		i += n
+
+		if w.ev.Labels != nil {
+			w.ls = w.ev.Labels
+		}
+
+		if w.ev.IsHeader() {
+			continue // labels header
+		}
+
+		w.b = w.AppendMessage(w.b[:0], &w.ev, w.ls)
+
+		w.enqueue(w.b)
+	}
+
+	_ = w.flush()
+
+	return len(p), nil
+}
+
+// Dropped returns the number of messages dropped because of buffer overflow
+// or rejected by the transport as too long.
+func (w *Writer) Dropped() int64 {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	return w.dropped
+}
+
+// Flush tries to send buffered messages.
+func (w *Writer) Flush() error {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	return w.flush()
+}
+
+// Close sends what it can and closes the connection.
+func (w *Writer) Close() (err error) {
+	defer w.mu.Unlock()
+	w.mu.Lock()
+
+	err = w.flush()
+
+	if w.conn != nil {
+		if e := w.conn.Close(); err == nil {
+			err = e
+		}
+
+		w.conn = nil
+	}
+
+	return err
+}
+
+func (w *Writer) enqueue(msg []byte) {
+	w.pend = append(w.pend, append([]byte{}, msg...))
+	w.pendLen += len(msg)
+
+	for w.MaxBuffer != 0 && w.pendLen > w.MaxBuffer && len(w.pend) > 1 {
+		w.pendLen -= len(w.pend[0])
+		w.pend[0] = nil
+		w.pend = w.pend[1:]
+		w.dropped++
+	}
+}
+
+func (w *Writer) flush() (err error) {
+	if len(w.pend) == 0 {
+		return nil
+	}
+
+	if w.conn == nil {
+		err = w.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	var b []byte
+
+	for len(w.pend) != 0 {
+		msg := w.pend[0]
+
+		switch {
+		case w.stream:
+			b = strconv.AppendInt(b[:0], int64(len(msg)), 10)
+			b = append(b, ' ')
+			b = append(b, msg...)
+		case w.MaxMessage != 0 && len(msg) > w.MaxMessage:
+			b = msg[:w.MaxMessage]
+		default:
+			b = msg
+		}
+
+		_, err = w.conn.Write(b)
+		if !w.stream && errors.Is(err, syscall.EMSGSIZE) {
+			// it would never fit, don't retry it forever
+			w.dropped++
+			err = nil
+		}
+		if err != nil {
+			_ = w.conn.Close()
+			w.conn = nil
+
+			return errors.Wrap(err, "write")
+		}
+
+		w.pendLen -= len(msg)
+		w.pend[0] = nil
+		w.pend = w.pend[1:]
+	}
+
+	w.pend = w.pend[:0]
+
+	return nil
+}
+
+func (w *Writer) connect() (err error) {
+	now := time.Now()
+
+	if !w.lastDial.IsZero() && now.Sub(w.lastDial) < w.ReconnectInterval {
+		return errors.New("reconnect backoff")
+	}
+
+	w.lastDial = now
+
+	dial := w.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+
+	network := w.Network
+
+	w.conn, err = dial(network, w.Addr)
+	if err != nil && network == "unix" {
+		// local syslog sockets (/dev/log) are usually datagram ones
+		network = "unixgram"
+
+		w.conn, err = dial(network, w.Addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "dial")
+	}
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		w.stream = true
+	default:
+		w.stream = false
+	}
+
+	return nil
+}
+
+// AppendMessage formats event as RFC 5424 message without framing.
+func (w *Writer) AppendMessage(b []byte, ev *tlog.Event, ls tlog.Labels) []byte {
+	pri := w.Facility*8 + Severity(ev.Level)
+
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(pri), 10)
+	b = append(b, ">1 "...)
+
+	ts := ev.Time.Time()
+	if ev.Time == 0 {
+		ts = time.Now()
+	}
+
+	b = ts.UTC().AppendFormat(b, "2006-01-02T15:04:05.000000Z07:00")
+
+	b = append(b, ' ')
+	b = appendHeader(b, label(ls, "_hostname", w.Hostname), 255)
+	b = append(b, ' ')
+	b = appendHeader(b, label(ls, "_execname", w.AppName), 48)
+	b = append(b, ' ')
+	b = appendHeader(b, label(ls, "_pid", w.ProcID), 128)
+	b = append(b, ' ')
+	b = appendHeader(b, string(ev.Type), 32)
+	b = append(b, ' ')
+
+	if w.SDID == "" {
+		return w.appendMsgParams(b, ev, ls)
+	}
+
+	b = w.appendSD(b, ev, ls)
+
+	if len(ev.Message) != 0 {
+		b = append(b, ' ')
+		b = append(b, ev.Message...)
+	}
+
+	return b
+}
+
+func (w *Writer) appendSD(b []byte, ev *tlog.Event, ls tlog.Labels) []byte {
+	st := len(b)
+
+	b = append(b, '[')
+	b = appendName(b, w.SDID)
+
+	n := 0
+
+	params(ev, ls, func(k, v string) {
+		b = append(b, ' ')
+		b = appendName(b, k)
+		b = append(b, '=', '"')
+		b = appendParam(b, v)
+		b = append(b, '"')
+		n++
+	})
+
+	if n == 0 {
+		return append(b[:st], Nil...)
+	}
+
+	return append(b, ']')
+}
+
+// appendMsgParams appends NILVALUE structured data and the message followed by key=value pairs.
+func (w *Writer) appendMsgParams(b []byte, ev *tlog.Event, ls tlog.Labels) []byte {
+	b = append(b, Nil...)
+
+	if len(ev.Message) != 0 {
+		b = append(b, ' ')
+		b = append(b, ev.Message...)
+	}
+
+	params(ev, ls, func(k, v string) {
+		b = append(b, ' ')
+		b = append(b, k...)
+		b = append(b, '=')
+
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			b = strconv.AppendQuote(b, v)
+		} else {
+			b = append(b, v...)
+		}
+	})
+
+	return b
+}
+
+// params calls param for each structured data parameter of the event.
+func params(ev *tlog.Event, ls tlog.Labels, param func(k, v string)) {
+
+	if ev.Span != (tlog.ID{}) {
+		param(tlog.KeySpan, ev.Span.FullString())
+	}
+
+	if ev.Parent != (tlog.ID{}) {
+		param(tlog.KeyParent, ev.Parent.FullString())
+	}
+
+	if ev.Location != 0 {
+		_, file, line := ev.LocationInfo()
+
+		param(tlog.KeyLocation, fmt.Sprintf("%v:%d", file, line))
+	}
+
+	if ev.Elapsed != 0 {
+		param(tlog.KeyElapsed, ev.Elapsed.String())
+	}
+
+	var rest tlog.Labels
+
+	for _, l := range ls {
+		switch k := labelKey(l); k {
+		case "_hostname", "_execname", "_pid":
+		default:
+			rest = append(rest, l)
+		}
+	}
+
+	if len(rest) != 0 {
+		param(tlog.KeyLabels, strings.Join(rest, ","))
+	}
+
+	for i := 0; i < ev.Len(); i++ {
+		param(string(ev.Key(i)), ev.ValueString(i))
+	}
+}
+
+func label(ls tlog.Labels, k, def string) string {
+	if v, ok := ls.Lookup(k); ok && v != "" {
+		return v
+	}
+
+	return def
+}
+
+func labelKey(l string) string {
+	for i := 0; i < len(l); i++ {
+		if l[i] == '=' {
+			return l[:i]
+		}
+	}
+
+	return l
+}
+
+// appendHeader appends header field: printable US-ASCII limited by n chars.
+func appendHeader(b []byte, s string, n int) []byte {
+	if s == "" {
+		return append(b, Nil...)
+	}
+
+	if len(s) > n {
+		s = s[:n]
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f {
+			c = '_'
+		}
+
+		b = append(b, c)
+	}
+
+	return b
+}
+
+// appendName appends SD-NAME: printable US-ASCII except '=', ' ', ']', '"', up to 32 chars.
+func appendName(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '_')
+	}
+
+	if len(s) > 32 {
+		s = s[:32]
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+
+		b = append(b, c)
+	}
+
+	return b
+}
+
+// appendParam appends PARAM-VALUE escaping '"', '\' and ']'.
+func appendParam(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', ']':
+			b = append(b, '\\', c)
+		default:
+			b = append(b, c)
+		}
+	}
+
+	return b
+}
@@ -0,0 +1,228 @@
+package tlsyslog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+)
+
+// testSDID uses RFC 5612 documentation enterprise number.
+const testSDID = "tlog@32473"
+
+var testLabels = tlog.Labels{"_hostname=host", "_execname=app", "_pid=123", "a=b"}
+
+func writeEvents(t *testing.T, w *Writer) {
+	e := tlog.Encoder{Writer: w, Labels: testLabels}
+
+	ts := tlog.Timestamp(time.Date(2020, time.December, 25, 22, 8, 13, 123456789, time.UTC).UnixNano())
+
+	err := e.Encode(nil, []interface{}{tlog.KeyTime, ts, tlog.KeyLogLevel, tlog.Error, tlog.KeyMessage, tlog.Message("some message"), "str", `q"]\`, "int", 5})
+	require.NoError(t, err)
+
+	err = e.Encode(nil, []interface{}{tlog.KeyTime, ts, tlog.KeySpan, tlog.ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, tlog.KeyEventType, tlog.EventType("s")})
+	require.NoError(t, err)
+}
+
+var expected = []string{
+	`<11>1 2020-12-25T22:08:13.123456Z host app 123 - [tlog@32473 L="a=b" str="q\"\]\\" int="5"] some message`,
+	`<14>1 2020-12-25T22:08:13.123456Z host app 123 s [tlog@32473 s="0102030405060708090a0b0c0d0e0f10" L="a=b"]`,
+}
+
+func TestUDP(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	w := NewWriter("udp", l.LocalAddr().String())
+	w.SDID = testSDID
+
+	writeEvents(t, w)
+
+	buf := make([]byte, 1024)
+
+	for _, exp := range expected {
+		_ = l.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, _, err := l.ReadFrom(buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, exp, string(buf[:n]))
+	}
+
+	err = w.Close()
+	assert.NoError(t, err)
+}
+
+func TestUnixReconnect(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "syslog.sock")
+
+	w := NewWriter("unix", name)
+	w.SDID = testSDID
+	w.ReconnectInterval = 0
+
+	writeEvents(t, w) // no server yet, buffered
+
+	assert.Len(t, w.pend, 2)
+
+	l, err := net.Listen("unix", name)
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	err = w.Flush()
+	require.NoError(t, err)
+
+	c, err := l.Accept()
+	require.NoError(t, err)
+
+	defer c.Close()
+
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+
+	r := bufio.NewReader(c)
+
+	for _, exp := range expected {
+		assert.Equal(t, exp, readFrame(t, r))
+	}
+
+	err = w.Close()
+	assert.NoError(t, err)
+}
+
+func TestUnixgramFallback(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log.sock")
+
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	w := NewWriter("unix", name)
+	w.SDID = testSDID
+
+	writeEvents(t, w)
+
+	buf := make([]byte, 1024)
+
+	for _, exp := range expected {
+		_ = l.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, _, err := l.ReadFrom(buf)
+		require.NoError(t, err)
+
+		assert.Equal(t, exp, string(buf[:n]))
+	}
+
+	err = w.Close()
+	assert.NoError(t, err)
+}
+
+func TestBufferOverflow(t *testing.T) {
+	w := NewWriter("tcp", "nowhere")
+	w.MaxBuffer = 150
+	w.Dial = func(network, addr string) (net.Conn, error) {
+		return nil, io.ErrClosedPipe
+	}
+
+	writeEvents(t, w)
+	writeEvents(t, w)
+
+	assert.Equal(t, int64(3), w.Dropped())
+	assert.Len(t, w.pend, 1)
+}
+
+func TestNoSDID(t *testing.T) {
+	var msgs []string
+
+	w := NewWriter("udp", "nowhere")
+	w.Dial = func(network, addr string) (net.Conn, error) {
+		return nil, io.ErrClosedPipe
+	}
+
+	writeEvents(t, w)
+
+	for _, m := range w.pend {
+		msgs = append(msgs, string(m))
+	}
+
+	assert.Equal(t, []string{
+		`<11>1 2020-12-25T22:08:13.123456Z host app 123 - - some message L="a=b" str="q\"]\\" int=5`,
+		`<14>1 2020-12-25T22:08:13.123456Z host app 123 s - s=0102030405060708090a0b0c0d0e0f10 L="a=b"`,
+	}, msgs)
+}
+
+func TestDatagramTooLong(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "log.sock")
+
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err)
+
+	defer l.Close()
+
+	w := NewWriter("unixgram", name)
+	w.SDID = testSDID
+
+	e := tlog.Encoder{Writer: w}
+
+	long := make([]byte, 1<<20)
+	for i := range long {
+		long[i] = 'a'
+	}
+
+	w.MaxMessage = 0 // too long for the socket
+
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message(long)})
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(1), w.Dropped())
+
+	w.MaxMessage = 100 // truncated
+
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message(long)})
+	require.NoError(t, err)
+
+	err = e.Encode(nil, []interface{}{tlog.KeyMessage, tlog.Message("after")})
+	require.NoError(t, err)
+
+	assert.Len(t, w.pend, 0)
+
+	buf := make([]byte, 1024)
+
+	_ = l.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := l.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, 100, n)
+
+	n, _, err = l.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Contains(t, string(buf[:n]), " after")
+
+	err = w.Close()
+	assert.NoError(t, err)
+}
+
+func readFrame(t *testing.T, r *bufio.Reader) string {
+	l, err := r.ReadString(' ')
+	require.NoError(t, err)
+
+	n, err := strconv.Atoi(l[:len(l)-1])
+	require.NoError(t, err)
+
+	msg := make([]byte, n)
+
+	_, err = io.ReadFull(r, msg)
+	require.NoError(t, err)
+
+	return string(msg)
+}
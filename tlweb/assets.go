@@ -0,0 +1,273 @@
+package tlweb
+
+// indexHTML is the whole UI: events, traces, metrics, labels and tail views over the JSON API.
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tlog</title>
+<style>
+body { margin: 0; font: 13px monospace; color: #222; background: #fafafa; }
+header { display: flex; gap: 4px; padding: 6px; background: #333; }
+header button { background: #555; color: #eee; border: 0; padding: 4px 10px; cursor: pointer; }
+header button.on { background: #eee; color: #222; }
+main { padding: 6px; }
+section { display: none; }
+section.on { display: block; }
+form { display: flex; gap: 4px; margin-bottom: 6px; }
+input[type=text] { flex: 1; font: inherit; padding: 3px; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 1px 6px; text-align: left; vertical-align: top; white-space: nowrap; }
+tr:nth-child(even) { background: #f0f0f0; }
+td.msg { white-space: normal; }
+.kv { color: #666; }
+.kv b { color: #236; font-weight: normal; }
+.error, .fatal { color: #c00; }
+.warn { color: #b60; }
+.debug { color: #888; }
+a { color: #236; cursor: pointer; }
+.err { color: #c00; }
+.bar { position: relative; height: 14px; background: #eee; min-width: 300px; }
+.bar div { position: absolute; height: 14px; background: #79b; }
+.bar div.crit { background: #c55; }
+.bar span { position: absolute; width: 2px; height: 14px; background: #333; }
+.sel td { font-weight: bold; }
+.facet { display: inline-block; vertical-align: top; margin: 0 16px 12px 0; }
+.facet h4 { margin: 4px 0; }
+svg { background: #fff; border: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<header>
+<button data-tab="events" class="on">events</button>
+<button data-tab="trace">trace</button>
+<button data-tab="metrics">metrics</button>
+<button data-tab="labels">labels</button>
+<button data-tab="tail">tail</button>
+</header>
+<main>
+<section id="events" class="on">
+<form id="events-form"><input type="text" id="events-q" placeholder="filter, e.g. level>=warn and L.service=api and t>-1h"><input type="text" id="events-limit" size="5" value="200" style="flex: 0"><button>search</button></form>
+<div id="events-info"></div>
+<table id="events-table"></table>
+</section>
+<section id="trace">
+<form id="trace-form"><input type="text" id="trace-span" placeholder="span id or its prefix"><button>show</button><button type="button" id="trace-roots">root spans</button></form>
+<div id="trace-out"></div>
+</section>
+<section id="metrics">
+<form id="metrics-form"><input type="text" id="metrics-q" placeholder="filter for observed values"><button>load</button></form>
+<div id="metrics-out"></div>
+</section>
+<section id="labels">
+<div id="labels-out"></div>
+</section>
+<section id="tail">
+<form id="tail-form"><input type="text" id="tail-q" placeholder="filter"><button id="tail-btn">start</button></form>
+<table id="tail-table"></table>
+</section>
+</main>
+<script>
+"use strict";
+
+var $ = function(id) { return document.getElementById(id); };
+
+function esc(s) {
+	return String(s).replace(/[&<>"]/g, function(c) { return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c]; });
+}
+
+function get(url, f) {
+	fetch(url).then(function(r) {
+		if (!r.ok) return r.text().then(function(t) { throw new Error(t); });
+		return r.json();
+	}).then(f).catch(function(e) { f(null, e); });
+}
+
+function tab(name) {
+	document.querySelectorAll("header button").forEach(function(b) { b.classList.toggle("on", b.dataset.tab === name); });
+	document.querySelectorAll("section").forEach(function(s) { s.classList.toggle("on", s.id === name); });
+	if (name === "labels") loadLabels();
+	if (name === "metrics" && !$("metrics-out").innerHTML) loadMetrics();
+}
+
+document.querySelectorAll("header button").forEach(function(b) { b.onclick = function() { tab(b.dataset.tab); }; });
+
+function quote(v) {
+	return /^[\w.:\/-]+$/.test(v) ? v : JSON.stringify(v);
+}
+
+function dur(ns) {
+	if (ns >= 1e9) return (ns / 1e9).toFixed(3) + "s";
+	if (ns >= 1e6) return (ns / 1e6).toFixed(3) + "ms";
+	if (ns >= 1e3) return (ns / 1e3).toFixed(1) + "µs";
+	return ns + "ns";
+}
+
+function kvs(list) {
+	return (list || []).map(function(kv) {
+		var v = typeof kv.v === "string" ? kv.v : JSON.stringify(kv.v);
+		return '<span class="kv"><b>' + esc(kv.k) + "</b>=" + esc(v) + "</span>";
+	}).join(" ");
+}
+
+function spanLink(id) {
+	return id ? '<a data-span="' + id + '">' + id.slice(0, 8) + "</a>" : "";
+}
+
+function eventRow(e) {
+	var msg = esc(e.msg || "");
+	if (e.type === "s") msg = "span start: " + msg;
+	if (e.type === "f") msg = "span finish" + (e.elapsed_ns ? " " + dur(e.elapsed_ns) : "");
+	if (e.type === "v" || e.type === "m") msg = (e.type === "v" ? "value " : "metric ") + msg;
+	return "<tr><td>" + esc((e.time || "").replace("T", " ").replace("Z", "")) + "</td>" +
+		'<td class="' + esc(e.level || "") + '">' + esc(e.level || "") + "</td>" +
+		"<td>" + esc(e.loc || "") + "</td>" +
+		"<td>" + spanLink(e.span) + "</td>" +
+		'<td class="msg">' + msg + " " + kvs(e.kvs) + "</td>" +
+		'<td class="kv">' + esc((e.labels || []).join(" ")) + "</td></tr>";
+}
+
+document.addEventListener("click", function(ev) {
+	var s = ev.target.dataset && ev.target.dataset.span;
+	if (s) {
+		$("trace-span").value = s;
+		tab("trace");
+		loadTrace();
+	}
+	var q = ev.target.dataset && ev.target.dataset.q;
+	if (q) {
+		var cur = $("events-q").value.trim();
+		$("events-q").value = cur ? cur + " and " + q : q;
+		tab("events");
+		loadEvents();
+	}
+});
+
+function loadEvents() {
+	var url = "/api/events?q=" + encodeURIComponent($("events-q").value) + "&limit=" + encodeURIComponent($("events-limit").value);
+	location.hash = "q=" + encodeURIComponent($("events-q").value);
+	get(url, function(r, err) {
+		if (err) { $("events-info").innerHTML = '<span class="err">' + esc(err.message) + "</span>"; return; }
+		$("events-info").textContent = "matched " + r.matched + " of " + r.total + ", showing last " + r.events.length;
+		$("events-table").innerHTML = r.events.map(eventRow).join("");
+	});
+}
+
+$("events-form").onsubmit = function(e) { e.preventDefault(); loadEvents(); };
+
+function spanRows(s, total, depth, out) {
+	var w = function(d) { return total > 0 ? (100 * d / total) : 0; };
+	var bar = '<div class="bar"><div class="' + (s.critical ? "crit" : "") + '" style="left: ' + w(s.offset_ns) + "%; width: " + Math.max(w(s.duration_ns), 0.3) + '%"></div>';
+	(s.logs || []).forEach(function(l) { bar += '<span style="left: ' + w(l.offset_ns) + '%" title="' + esc(l.message) + '"></span>'; });
+	bar += "</div>";
+	var tags = Object.keys(s.tags || {}).map(function(k) { return {k: k, v: s.tags[k]}; });
+	out.push("<tr" + (s.selected ? ' class="sel"' : "") + "><td>" + dur(s.offset_ns) + "</td><td>" + dur(s.duration_ns) + (s.finished ? "" : " …") + "</td><td>" + bar + "</td>" +
+		'<td style="padding-left: ' + (depth * 16 + 6) + 'px">' + esc(s.name) + " " + spanLink(s.span_id) + (s.service ? " [" + esc(s.service) + "]" : "") + " " + kvs(tags) + "</td></tr>");
+	(s.logs || []).forEach(function(l) {
+		out.push('<tr><td>' + dur(l.offset_ns) + '</td><td></td><td></td><td style="padding-left: ' + (depth * 16 + 22) + 'px" class="' + esc(l.level || "") + '">- ' + esc(l.message) + " " +
+			kvs(Object.keys(l.kvs || {}).map(function(k) { return {k: k, v: l.kvs[k]}; })) + "</td></tr>");
+	});
+	(s.children || []).forEach(function(c) { spanRows(c, total, depth + 1, out); });
+}
+
+function loadTrace() {
+	var span = $("trace-span").value.trim();
+	if (!span) return;
+	get("/api/trace?span=" + encodeURIComponent(span), function(trs, err) {
+		if (err) { $("trace-out").innerHTML = '<span class="err">' + esc(err.message) + "</span>"; return; }
+		$("trace-out").innerHTML = trs.map(function(tr) {
+			var out = [];
+			spanRows(tr.root, tr.duration_ns, 0, out);
+			return "<h3>trace " + esc(tr.trace_id) + "</h3><p>start " + esc(tr.start) + ", duration " + dur(tr.duration_ns) + ", spans " + tr.spans + "</p><table>" + out.join("") + "</table>";
+		}).join("");
+	});
+}
+
+$("trace-form").onsubmit = function(e) { e.preventDefault(); loadTrace(); };
+
+$("trace-roots").onclick = function() {
+	get("/api/events?q=" + encodeURIComponent("T=s !p") + "&limit=200", function(r, err) {
+		if (err) { $("trace-out").innerHTML = '<span class="err">' + esc(err.message) + "</span>"; return; }
+		$("trace-out").innerHTML = "<table>" + r.events.reverse().map(eventRow).join("") + "</table>";
+	});
+};
+
+function chart(m) {
+	var W = 600, H = 160, P = 30;
+	var ps = m.points;
+	if (!ps.length) return "<p>no values</p>";
+	var x0 = ps[0][0], x1 = ps[ps.length - 1][0], y0 = Infinity, y1 = -Infinity;
+	ps.forEach(function(p) { y0 = Math.min(y0, p[1]); y1 = Math.max(y1, p[1]); });
+	if (x1 === x0) x1 = x0 + 1;
+	if (y1 === y0) { y0 -= 1; y1 += 1; }
+	var x = function(v) { return P + (W - 2 * P) * (v - x0) / (x1 - x0); };
+	var y = function(v) { return H - P + (2 * P - H) * (v - y0) / (y1 - y0); };
+	var d = ps.map(function(p, i) { return (i ? "L" : "M") + x(p[0]).toFixed(1) + " " + y(p[1]).toFixed(1); }).join(" ");
+	var t = function(ms) { return new Date(ms).toISOString().slice(11, 19); };
+	return '<svg width="' + W + '" height="' + H + '">' +
+		'<path d="' + d + '" fill="none" stroke="#369" stroke-width="1.5"/>' +
+		'<text x="2" y="' + (P - 8) + '">' + esc(+y1.toPrecision(4)) + "</text>" +
+		'<text x="2" y="' + (H - P + 12) + '">' + esc(+y0.toPrecision(4)) + "</text>" +
+		'<text x="' + P + '" y="' + (H - 4) + '">' + t(x0) + "</text>" +
+		'<text x="' + (W - P - 56) + '" y="' + (H - 4) + '">' + t(x1) + "</text></svg>";
+}
+
+function loadMetrics() {
+	get("/api/metrics?q=" + encodeURIComponent($("metrics-q").value), function(ms, err) {
+		if (err) { $("metrics-out").innerHTML = '<span class="err">' + esc(err.message) + "</span>"; return; }
+		if (!ms.length) { $("metrics-out").textContent = "no metrics"; return; }
+		$("metrics-out").innerHTML = ms.map(function(m) {
+			return "<h4>" + esc(m.name) + (m.type ? " (" + esc(m.type) + ")" : "") + (m.unit ? " [" + esc(m.unit) + "]" : "") +
+				" " + m.points.length + " values</h4>" + (m.help ? "<p>" + esc(m.help) + "</p>" : "") + chart(m);
+		}).join("");
+	});
+}
+
+$("metrics-form").onsubmit = function(e) { e.preventDefault(); loadMetrics(); };
+
+function loadLabels() {
+	get("/api/labels", function(fs, err) {
+		if (err) { $("labels-out").innerHTML = '<span class="err">' + esc(err.message) + "</span>"; return; }
+		if (!fs.length) { $("labels-out").textContent = "no labels"; return; }
+		$("labels-out").innerHTML = fs.map(function(f) {
+			return '<div class="facet"><h4>' + esc(f.key) + "</h4>" + f.values.map(function(v) {
+				var q = v.value === "" ? "L." + f.key : "L." + f.key + "=" + quote(v.value);
+				return '<div><a data-q="' + esc(q) + '">' + esc(v.value || "(set)") + "</a> " + v.count + "</div>";
+			}).join("") + "</div>";
+		}).join("");
+	});
+}
+
+var tail = null;
+
+$("tail-form").onsubmit = function(e) {
+	e.preventDefault();
+	if (tail) {
+		tail.close();
+		tail = null;
+		$("tail-btn").textContent = "start";
+		return;
+	}
+	$("tail-table").innerHTML = "";
+	tail = new EventSource("/api/tail?q=" + encodeURIComponent($("tail-q").value));
+	tail.onmessage = function(m) {
+		var t = $("tail-table");
+		t.insertAdjacentHTML("afterbegin", eventRow(JSON.parse(m.data)));
+		while (t.rows.length > 1000) t.deleteRow(-1);
+	};
+	tail.addEventListener("error", function(m) {
+		if (!m.data) return;
+		$("tail-table").insertAdjacentHTML("afterbegin", '<tr><td class="err" colspan="6">' + esc(JSON.parse(m.data)) + "</td></tr>");
+		tail.close();
+		tail = null;
+		$("tail-btn").textContent = "start";
+	});
+	$("tail-btn").textContent = "stop";
+};
+
+if (location.hash.indexOf("#q=") === 0) $("events-q").value = decodeURIComponent(location.hash.slice(3));
+loadEvents();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,759 @@
+package tlweb
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikandfor/errors"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/convert"
+	"github.com/nikandfor/tlog/ext/tlflag"
+	"github.com/nikandfor/tlog/filter"
+	"github.com/nikandfor/tlog/rotated"
+	"github.com/nikandfor/tlog/tldb"
+)
+
+type (
+	// Server is a local web UI over tlog files or tldb database.
+	//
+	// Files are read on each request so the view is always up to date.
+	// Names with rotated.SubstChar are read as rotated files sets.
+	// If DB is set it's used instead of Files.
+	//
+	// Requests are served only if Host is localhost, 127.0.0.1, ::1, the Addr host or one of Hosts.
+	// That protects the local UI from DNS rebinding: a foreign page can't read the logs
+	// through a domain name pointed to the loopback address.
+	//
+	// API:
+	//	/api/events?q=<filter>&limit=N  last N events matching filter expression
+	//	/api/trace?span=<id prefix>     span tree (convert.WaterfallTrace)
+	//	/api/metrics?q=<filter>         metrics registered and observed values
+	//	/api/labels?q=<filter>          label facets
+	//	/api/tail?q=<filter>            new events as server-sent events
+	Server struct {
+		Files []string
+		DB    *tldb.DB
+
+		// Addr is the server listen address.
+		Addr string
+
+		// Hosts are additional allowed Host header values, with or without port.
+		Hosts []string
+
+		// Limit is the default and max number of events and metric points returned.
+		Limit int
+
+		// Poll is the tail polling interval.
+		Poll time.Duration
+	}
+
+	Event struct {
+		Time     string        `json:"time,omitempty"`
+		Level    string        `json:"level,omitempty"`
+		Type     string        `json:"type,omitempty"`
+		Message  string        `json:"msg,omitempty"`
+		Span     string        `json:"span,omitempty"`
+		Parent   string        `json:"parent,omitempty"`
+		Elapsed  time.Duration `json:"elapsed_ns,omitempty"`
+		Location string        `json:"loc,omitempty"`
+		Labels   tlog.Labels   `json:"labels,omitempty"`
+		KVs      []KV          `json:"kvs,omitempty"`
+	}
+
+	KV struct {
+		Key   string      `json:"k"`
+		Value interface{} `json:"v"`
+	}
+
+	Events struct {
+		Events  []*Event `json:"events"`
+		Matched int      `json:"matched"`
+		Total   int      `json:"total"`
+	}
+
+	Metric struct {
+		Name string `json:"name"`
+		Type string `json:"type,omitempty"`
+		Help string `json:"help,omitempty"`
+		Unit string `json:"unit,omitempty"`
+
+		// Points are [unix ms, value] pairs.
+		Points [][2]float64 `json:"points"`
+	}
+
+	Facet struct {
+		Key    string       `json:"key"`
+		Values []FacetValue `json:"values"`
+	}
+
+	FacetValue struct {
+		Value string `json:"value"`
+		Count int    `json:"count"`
+	}
+
+	httpError struct {
+		code int
+		error
+	}
+)
+
+var DefaultLimit = 1000
+
+var now = time.Now
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.hostAllowed(req.Host) {
+		http.Error(w, "host not allowed", http.StatusForbidden)
+		return
+	}
+
+	var err error
+
+	switch req.URL.Path {
+	case "/", "/index.html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, indexHTML)
+
+		return
+	case "/api/events":
+		err = s.events(w, req)
+	case "/api/trace":
+		err = s.trace(w, req)
+	case "/api/metrics":
+		err = s.metrics(w, req)
+	case "/api/labels":
+		err = s.labels(w, req)
+	case "/api/tail":
+		err = s.tail(w, req)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	if err == nil {
+		return
+	}
+
+	code := http.StatusInternalServerError
+
+	if herr, ok := err.(httpError); ok {
+		code = herr.code
+	}
+
+	http.Error(w, err.Error(), code)
+}
+
+func (s *Server) hostAllowed(h string) bool {
+	host := hostOnly(h)
+
+	switch host {
+	case "localhost", "127.0.0.1", "::1":
+		return true
+	}
+
+	if host != "" && host == hostOnly(s.Addr) {
+		return true
+	}
+
+	for _, a := range s.Hosts {
+		if h == a || host != "" && host == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hostOnly(h string) string {
+	if host, _, err := net.SplitHostPort(h); err == nil {
+		return host
+	}
+
+	return strings.Trim(h, "[]")
+}
+
+func (s *Server) events(w http.ResponseWriter, req *http.Request) error {
+	f, err := parseFilter(req)
+	if err != nil {
+		return err
+	}
+
+	limit := s.limit(req)
+
+	var res Events
+
+	err = s.each(req.Context(), func(ev *tlog.Event) error {
+		res.Total++
+
+		if !f.Match(ev) {
+			return nil
+		}
+
+		res.Matched++
+
+		res.Events = append(res.Events, newEvent(ev))
+
+		if len(res.Events) >= 2*limit {
+			res.Events = append(res.Events[:0], res.Events[len(res.Events)-limit:]...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(res.Events) > limit {
+		res.Events = res.Events[len(res.Events)-limit:]
+	}
+
+	if res.Events == nil {
+		res.Events = []*Event{}
+	}
+
+	return writeJSON(w, res)
+}
+
+func (s *Server) trace(w http.ResponseWriter, req *http.Request) error {
+	span := req.FormValue("span")
+	if span == "" {
+		return httpError{code: http.StatusBadRequest, error: errors.New("span expected")}
+	}
+
+	wf := convert.NewWaterfallWriter(nil, span)
+
+	err := s.each(req.Context(), func(ev *tlog.Event) error {
+		_, err := wf.Write(ev.Raw())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	trs, err := wf.Traces()
+	if err != nil {
+		return httpError{code: http.StatusNotFound, error: err}
+	}
+
+	return writeJSON(w, trs)
+}
+
+func (s *Server) metrics(w http.ResponseWriter, req *http.Request) error {
+	f, err := parseFilter(req)
+	if err != nil {
+		return err
+	}
+
+	limit := s.limit(req)
+
+	ms := map[string]*Metric{}
+
+	get := func(name string) *Metric {
+		m := ms[name]
+		if m == nil {
+			m = &Metric{Name: name, Points: [][2]float64{}}
+			ms[name] = m
+		}
+
+		return m
+	}
+
+	var last tlog.Timestamp
+
+	err = s.each(req.Context(), func(ev *tlog.Event) error {
+		if ev.Time != 0 {
+			last = ev.Time
+		}
+
+		switch ev.Type {
+		case "m":
+			m := get(string(ev.Message))
+
+			if v, ok := ev.Get("type"); ok {
+				m.Type, _ = v.(string)
+			}
+
+			if v, ok := ev.Get("help"); ok {
+				m.Help, _ = v.(string)
+			}
+		case "v":
+			if ev.Len() == 0 || !f.Match(ev) {
+				return nil
+			}
+
+			v, unit, ok := number(ev.Value(0))
+			if !ok {
+				return nil
+			}
+
+			m := get(string(ev.Key(0)))
+
+			if unit != "" {
+				m.Unit = unit
+			}
+
+			m.Points = append(m.Points, [2]float64{float64(last / 1e6), v})
+
+			if len(m.Points) >= 2*limit {
+				m.Points = append(m.Points[:0], m.Points[len(m.Points)-limit:]...)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	res := make([]*Metric, 0, len(ms))
+
+	for _, m := range ms {
+		if len(m.Points) > limit {
+			m.Points = m.Points[len(m.Points)-limit:]
+		}
+
+		res = append(res, m)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return writeJSON(w, res)
+}
+
+func (s *Server) labels(w http.ResponseWriter, req *http.Request) error {
+	f, err := parseFilter(req)
+	if err != nil {
+		return err
+	}
+
+	cnt := map[string]map[string]int{}
+
+	err = s.each(req.Context(), func(ev *tlog.Event) error {
+		if !f.Match(ev) {
+			return nil
+		}
+
+		for _, l := range ev.Labels {
+			k, v := l, ""
+			if p := strings.IndexByte(l, '='); p != -1 {
+				k, v = l[:p], l[p+1:]
+			}
+
+			vs := cnt[k]
+			if vs == nil {
+				vs = map[string]int{}
+				cnt[k] = vs
+			}
+
+			vs[v]++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	res := make([]Facet, 0, len(cnt))
+
+	for k, vs := range cnt {
+		fc := Facet{Key: k}
+
+		for v, n := range vs {
+			fc.Values = append(fc.Values, FacetValue{Value: v, Count: n})
+		}
+
+		sort.Slice(fc.Values, func(i, j int) bool {
+			a, b := fc.Values[i], fc.Values[j]
+
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+
+			return a.Value < b.Value
+		})
+
+		res = append(res, fc)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+
+	return writeJSON(w, res)
+}
+
+// tail streams events appeared after the request as server-sent events.
+func (s *Server) tail(w http.ResponseWriter, req *http.Request) (err error) {
+	f, err := parseFilter(req)
+	if err != nil {
+		return err
+	}
+
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming is not supported")
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+
+	var wg sync.WaitGroup
+
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	since := tlog.Timestamp(now().UnixNano())
+
+	evc := make(chan *Event, 128)
+	errc := make(chan error, len(s.Files)+1)
+
+	send := func(ev *tlog.Event) error {
+		if ev.IsHeader() || !f.Match(ev) {
+			return nil
+		}
+
+		select {
+		case evc <- newEvent(ev):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if s.DB != nil {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			errc <- s.pollDB(ctx, since, send)
+		}()
+	} else {
+		for _, name := range s.Files {
+			fol := rotated.NewFollower(name)
+			fol.Follow = true
+
+			if s.Poll != 0 {
+				fol.Poll = s.Poll
+			}
+
+			wg.Add(2)
+
+			go func() {
+				defer wg.Done()
+
+				<-ctx.Done()
+				_ = fol.Close()
+			}()
+
+			go func(name string) {
+				defer wg.Done()
+
+				errc <- errors.Wrap(readSince(fol, since, send), "%v", name)
+			}(name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	var b []byte
+
+	for {
+		select {
+		case ev := <-evc:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+
+			b = append(b[:0], "data: "...)
+			b = append(b, data...)
+			b = append(b, "\n\n"...)
+
+			_, err = w.Write(b)
+			if err != nil {
+				return nil
+			}
+
+			fl.Flush()
+		case err = <-errc:
+			if err != nil && ctx.Err() == nil {
+				_, _ = io.WriteString(w, "event: error\ndata: "+strconv.Quote(err.Error())+"\n\n")
+				fl.Flush()
+
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// readSince reads the whole stream to track labels and locations
+// and sends events from since. Events without time take the last seen one.
+func readSince(r io.Reader, since tlog.Timestamp, send func(*tlog.Event) error) error {
+	rd := tlog.NewReader(r)
+
+	var last tlog.Timestamp
+
+	for rd.Next() {
+		ev := rd.Event()
+
+		if ev.Time != 0 {
+			last = ev.Time
+		}
+
+		if last < since {
+			continue
+		}
+
+		if err := send(ev); err != nil {
+			return err
+		}
+	}
+
+	err := rd.Err()
+	if errors.Is(err, rotated.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *Server) pollDB(ctx context.Context, since tlog.Timestamp, send func(*tlog.Event) error) error {
+	poll := s.Poll
+	if poll == 0 {
+		poll = 500 * time.Millisecond
+	}
+
+	t := time.NewTicker(poll)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		it := s.DB.Query(tldb.Query{Since: since.Time()})
+
+		for it.Next() {
+			ev := it.Event()
+
+			if ev.Time >= since {
+				since = ev.Time + 1
+			}
+
+			if err := send(ev); err != nil {
+				_ = it.Close()
+				return nil
+			}
+		}
+
+		if err := it.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+// each calls f for each event in the source. Labels headers are skipped.
+func (s *Server) each(ctx context.Context, f func(ev *tlog.Event) error) (err error) {
+	if s.DB != nil {
+		it := s.DB.Query(tldb.Query{})
+
+		defer func() {
+			e := it.Close()
+			if err == nil {
+				err = e
+			}
+		}()
+
+		for it.Next() {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+
+			if it.Event().IsHeader() {
+				continue
+			}
+
+			if err = f(it.Event()); err != nil {
+				return err
+			}
+		}
+
+		return it.Err()
+	}
+
+	for _, name := range s.Files {
+		err = eachFile(ctx, name, f)
+		if err != nil {
+			return errors.Wrap(err, "%v", name)
+		}
+	}
+
+	return nil
+}
+
+func eachFile(ctx context.Context, name string, f func(ev *tlog.Event) error) (err error) {
+	var r io.ReadCloser
+	if strings.ContainsRune(name, rotated.SubstChar) {
+		r = rotated.NewFollower(name)
+	} else {
+		r, err = tlflag.OpenReader(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		e := r.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+
+	rd := tlog.NewReader(r)
+
+	for rd.Next() {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		ev := rd.Event()
+
+		if ev.IsHeader() {
+			continue
+		}
+
+		if err = f(ev); err != nil {
+			return err
+		}
+	}
+
+	return rd.Err()
+}
+
+func (s *Server) limit(req *http.Request) int {
+	max := s.Limit
+	if max <= 0 {
+		max = DefaultLimit
+	}
+
+	n, err := strconv.Atoi(req.FormValue("limit"))
+	if err != nil || n <= 0 || n > max {
+		return max
+	}
+
+	return n
+}
+
+func newEvent(ev *tlog.Event) *Event {
+	e := &Event{
+		Type:    string(ev.Type),
+		Message: string(ev.Message),
+		Elapsed: ev.Elapsed,
+		Labels:  ev.Labels,
+	}
+
+	if ev.Time != 0 {
+		e.Time = ev.Time.Time().UTC().Format(time.RFC3339Nano)
+	}
+
+	if ev.Level != tlog.Info {
+		v, _ := filter.Lookup(ev, "level")
+		e.Level, _ = v.(string)
+	}
+
+	if ev.Span != (tlog.ID{}) {
+		e.Span = ev.Span.FullString()
+	}
+
+	if ev.Parent != (tlog.ID{}) {
+		e.Parent = ev.Parent.FullString()
+	}
+
+	if v, ok := filter.Lookup(ev, "loc"); ok {
+		e.Location, _ = v.(string)
+	}
+
+	for i := 0; i < ev.Len(); i++ {
+		e.KVs = append(e.KVs, KV{Key: string(ev.Key(i)), Value: jsonValue(ev.Value(i))})
+	}
+
+	return e
+}
+
+// jsonValue leaves values json can represent as is and formats the rest.
+func jsonValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case nil, bool, string, int64, uint64:
+		return v
+	case float64:
+		if !math.IsNaN(x) && !math.IsInf(x, 0) {
+			return v
+		}
+	}
+
+	return filter.Format(v)
+}
+
+func number(v interface{}) (f float64, unit string, ok bool) {
+	switch x := v.(type) {
+	case int64:
+		return float64(x), "", true
+	case uint64:
+		return float64(x), "", true
+	case float64:
+		return x, "", !math.IsNaN(x) && !math.IsInf(x, 0)
+	case time.Duration:
+		return x.Seconds(), "s", true
+	}
+
+	return 0, "", false
+}
+
+func parseFilter(req *http.Request) (*filter.Filter, error) {
+	f, err := filter.Parse(req.FormValue("q"))
+	if err != nil {
+		return nil, httpError{code: http.StatusBadRequest, error: err}
+	}
+
+	return f, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, _ = w.Write(data)
+
+	return nil
+}
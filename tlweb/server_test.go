@@ -0,0 +1,241 @@
+package tlweb
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nikandfor/loc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog"
+	"github.com/nikandfor/tlog/convert"
+	"github.com/nikandfor/tlog/tldb"
+)
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "events.tlog")
+
+	f, err := os.Create(name)
+	require.NoError(t, err)
+
+	db, err := tldb.Open(filepath.Join(dir, "events.db"), nil)
+	require.NoError(t, err)
+
+	defer func() {
+		err := db.Close()
+		assert.NoError(t, err)
+	}()
+
+	ts := func(s int) tlog.Timestamp {
+		return tlog.Timestamp(time.Date(2020, 12, 25, 10, 0, s, 0, time.UTC).UnixNano())
+	}
+
+	root := tlog.ID{1, 2, 3, 4}
+	child := tlog.ID{5, 6, 7, 8}
+	pc := loc.Caller(0)
+
+	e := tlog.Encoder{Writer: io.MultiWriter(f, db), Labels: tlog.Labels{"service=api", "canary"}}
+
+	for _, kvs := range [][]interface{}{
+		{tlog.KeyTime, ts(0), tlog.KeyEventType, tlog.EventType("m"), tlog.KeyMessage, "latency", "type", "summary", "help", "request latency"},
+		{tlog.KeyTime, ts(0), tlog.KeySpan, root, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("request")},
+		{tlog.KeyTime, ts(1), tlog.KeySpan, child, tlog.KeyParent, root, tlog.KeyEventType, tlog.EventType("s"), tlog.KeyMessage, tlog.Message("db")},
+		{tlog.KeyTime, ts(2), tlog.KeySpan, child, tlog.KeyLocation, pc, tlog.KeyLogLevel, tlog.Warn, tlog.KeyMessage, tlog.Message("query"), "rows", 3, "took", time.Second},
+		{tlog.KeySpan, child, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 2 * time.Second},
+		{tlog.KeyTime, ts(3), tlog.KeyEventType, tlog.EventType("v"), "latency", 3 * time.Second},
+		{tlog.KeyTime, ts(4), tlog.KeyEventType, tlog.EventType("v"), "latency", 500 * time.Millisecond},
+		{tlog.KeySpan, root, tlog.KeyEventType, tlog.EventType("f"), tlog.KeyElapsed, 5 * time.Second},
+	} {
+		err = e.Encode(nil, kvs)
+		require.NoError(t, err)
+	}
+
+	err = f.Close()
+	require.NoError(t, err)
+
+	for _, s := range []*Server{{Files: []string{name}}, {DB: db}} {
+		srv := httptest.NewServer(s)
+
+		get := func(path string, res interface{}) int {
+			resp, err := http.Get(srv.URL + path)
+			require.NoError(t, err)
+
+			defer resp.Body.Close()
+
+			data, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			if resp.StatusCode == http.StatusOK && res != nil {
+				err = json.Unmarshal(data, res)
+				require.NoError(t, err, "%s", data)
+			}
+
+			return resp.StatusCode
+		}
+
+		var evs Events
+
+		code := get("/api/events?q="+url.QueryEscape("level>=warn and L.service=api"), &evs)
+		if assert.Equal(t, http.StatusOK, code) && assert.Len(t, evs.Events, 1) {
+			assert.Equal(t, &Event{
+				Time:     "2020-12-25T10:00:02Z",
+				Level:    "warn",
+				Message:  "query",
+				Span:     child.FullString(),
+				Location: "server_test.go:" + lineOf(pc),
+				Labels:   tlog.Labels{"service=api", "canary"},
+				KVs:      []KV{{Key: "rows", Value: 3.0}, {Key: "took", Value: "1s"}},
+			}, evs.Events[0])
+
+			assert.Equal(t, 8, evs.Total)
+			assert.Equal(t, 1, evs.Matched)
+		}
+
+		code = get("/api/events?limit=2", &evs)
+		if assert.Equal(t, http.StatusOK, code) && assert.Len(t, evs.Events, 2) {
+			assert.Equal(t, 8, evs.Matched)
+			assert.Equal(t, "f", evs.Events[1].Type)
+			assert.Equal(t, 5*time.Second, evs.Events[1].Elapsed)
+		}
+
+		var trs []*convert.WaterfallTrace
+
+		code = get("/api/trace?span=0506", &trs)
+		if assert.Equal(t, http.StatusOK, code) && assert.Len(t, trs, 1) {
+			r := trs[0].Root
+			assert.Equal(t, "request", r.Name)
+
+			if assert.Len(t, r.Children, 1) {
+				assert.Equal(t, "db", r.Children[0].Name)
+				assert.True(t, r.Children[0].Selected)
+				assert.Equal(t, 2*time.Second, r.Children[0].Duration)
+			}
+		}
+
+		assert.Equal(t, http.StatusNotFound, get("/api/trace?span=ff", nil))
+
+		var ms []*Metric
+
+		code = get("/api/metrics", &ms)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []*Metric{{
+			Name:   "latency",
+			Type:   "summary",
+			Help:   "request latency",
+			Unit:   "s",
+			Points: [][2]float64{{float64(ts(3) / 1e6), 3}, {float64(ts(4) / 1e6), 0.5}},
+		}}, ms)
+
+		var fs []Facet
+
+		code = get("/api/labels?q=T=s", &fs)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, []Facet{
+			{Key: "canary", Values: []FacetValue{{Value: "", Count: 2}}},
+			{Key: "service", Values: []FacetValue{{Value: "api", Count: 2}}},
+		}, fs)
+
+		assert.Equal(t, http.StatusBadRequest, get("/api/events?q=(", nil))
+		assert.Equal(t, http.StatusOK, get("/", nil))
+		assert.Equal(t, http.StatusNotFound, get("/nothing", nil))
+
+		srv.Close()
+	}
+}
+
+func TestTail(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "events.tlog")
+
+	f, err := os.Create(name)
+	require.NoError(t, err)
+
+	defer f.Close()
+
+	e := tlog.Encoder{Writer: f, Labels: tlog.Labels{"a=b"}}
+
+	err = e.Encode(nil, []interface{}{tlog.KeyTime, tlog.Timestamp(time.Now().Add(-time.Hour).UnixNano()), tlog.KeyMessage, tlog.Message("old")})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(&Server{Files: []string{name}, Poll: 10 * time.Millisecond})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/tail?q=" + url.QueryEscape("m!=skip"))
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	for _, m := range []string{"skip", "new"} {
+		err = e.Encode(nil, []interface{}{tlog.KeyTime, tlog.Timestamp(time.Now().UnixNano()), tlog.KeyMessage, tlog.Message(m)})
+		require.NoError(t, err)
+	}
+
+	r := bufio.NewReader(resp.Body)
+
+	for {
+		l, err := r.ReadString('\n')
+		require.NoError(t, err)
+
+		if !strings.HasPrefix(l, "data: ") {
+			continue
+		}
+
+		var ev Event
+
+		err = json.Unmarshal([]byte(l[len("data: "):]), &ev)
+		require.NoError(t, err)
+
+		assert.Equal(t, "new", ev.Message)
+		assert.Equal(t, tlog.Labels{"a=b"}, ev.Labels)
+
+		break
+	}
+}
+
+func lineOf(pc loc.PC) string {
+	_, _, line := pc.NameFileLine()
+
+	return strconv.Itoa(line)
+}
+
+func TestHostCheck(t *testing.T) {
+	s := &Server{Addr: "10.0.0.1:8000", Hosts: []string{"logs.internal"}}
+
+	for _, tc := range []struct {
+		host string
+		code int
+	}{
+		{"localhost:8000", http.StatusOK},
+		{"127.0.0.1:8000", http.StatusOK},
+		{"[::1]:8000", http.StatusOK},
+		{"localhost", http.StatusOK},
+		{"10.0.0.1:8000", http.StatusOK},
+		{"logs.internal:8000", http.StatusOK},
+		{"evil.example:8000", http.StatusForbidden},
+		{"evil.example", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tc.host
+
+		rec := httptest.NewRecorder()
+
+		s.ServeHTTP(rec, req)
+
+		assert.Equal(t, tc.code, rec.Code, "host %q", tc.host)
+	}
+}
@@ -0,0 +1,325 @@
+package tlog
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/nikandfor/errors"
+	"github.com/nikandfor/loc"
+)
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Unmarshal decodes event (or any other encoded value) into v.
+//
+// v must be a non-nil pointer.
+// Struct fields are matched by the same tags Encoder uses: tlog, yaml and json.
+// Fields with embed option are filled from the same map as the outer struct.
+func Unmarshal(event []byte, v interface{}) error {
+	r := reflect.ValueOf(v)
+	if r.Kind() != reflect.Ptr || r.IsNil() {
+		return errors.New("non-nil pointer expected, got %T", v)
+	}
+
+	d := NewDecoderBytes(event)
+
+	val, _ := d.Value(0)
+	if err := d.Err(); err != nil {
+		return errors.Wrap(err, "decode")
+	}
+
+	return assignValue(r.Elem(), val)
+}
+
+func assignValue(r reflect.Value, v interface{}) (err error) {
+	if v == nil {
+		r.Set(reflect.Zero(r.Type()))
+		return nil
+	}
+
+	t := r.Type()
+	vr := reflect.ValueOf(v)
+
+	if vr.Type().AssignableTo(t) {
+		r.Set(vr)
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if r.IsNil() {
+			r.Set(reflect.New(t.Elem()))
+		}
+
+		return assignValue(r.Elem(), v)
+	case reflect.Struct:
+		if t == timeType {
+			return assignTime(r, v)
+		}
+
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		return assignStruct(r, m)
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok || t.Key().Kind() != reflect.String {
+			break
+		}
+
+		if r.IsNil() {
+			r.Set(reflect.MakeMapWithSize(t, len(m)))
+		}
+
+		for k, v := range m {
+			ev := reflect.New(t.Elem()).Elem()
+
+			err = assignValue(ev, v)
+			if err != nil {
+				return errors.Wrap(err, "key %q", k)
+			}
+
+			r.SetMapIndex(reflect.ValueOf(k).Convert(t.Key()), ev)
+		}
+
+		return nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			switch v := v.(type) {
+			case []byte:
+				r.SetBytes(append([]byte{}, v...))
+				return nil
+			case string:
+				r.SetBytes([]byte(v))
+				return nil
+			}
+		}
+
+		arr, ok := v.([]interface{})
+		if !ok {
+			if vr.Kind() == reflect.Slice && vr.Type().ConvertibleTo(t) {
+				r.Set(vr.Convert(t))
+				return nil
+			}
+
+			break
+		}
+
+		s := reflect.MakeSlice(t, len(arr), len(arr))
+
+		for i, v := range arr {
+			err = assignValue(s.Index(i), v)
+			if err != nil {
+				return errors.Wrap(err, "index %d", i)
+			}
+		}
+
+		r.Set(s)
+
+		return nil
+	case reflect.Array:
+		if vr.Kind() == reflect.Array && vr.Type().ConvertibleTo(t) {
+			r.Set(vr.Convert(t))
+			return nil
+		}
+
+		if b, ok := v.([]byte); ok && t.Elem().Kind() == reflect.Uint8 {
+			if len(b) != t.Len() {
+				return errors.New("can't unmarshal %d bytes into %v", len(b), t)
+			}
+
+			for i, c := range b {
+				r.Index(i).SetUint(uint64(c))
+			}
+
+			return nil
+		}
+
+		arr, ok := v.([]interface{})
+		if !ok || len(arr) > t.Len() {
+			break
+		}
+
+		for i, v := range arr {
+			err = assignValue(r.Index(i), v)
+			if err != nil {
+				return errors.Wrap(err, "index %d", i)
+			}
+		}
+
+		return nil
+	case reflect.String:
+		switch v := v.(type) {
+		case []byte:
+			r.SetString(string(v))
+			return nil
+		case ID:
+			r.SetString(v.FullString())
+			return nil
+		case error:
+			r.SetString(v.Error())
+			return nil
+		case loc.PC:
+			r.SetString(fmt.Sprintf("%v", v))
+			return nil
+		}
+
+		if vr.Kind() == reflect.String {
+			r.SetString(vr.String())
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		if tm, ok := v.(time.Time); ok && t.Kind() == reflect.Int64 {
+			r.SetInt(tm.UnixNano())
+			return nil
+		}
+
+		switch vr.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+			return assignNumber(r, vr)
+		}
+	case reflect.Bool:
+		if b, ok := v.(bool); ok {
+			r.SetBool(b)
+			return nil
+		}
+	case reflect.Interface:
+		if t == errorType {
+			if s, ok := v.(string); ok {
+				r.Set(reflect.ValueOf(errors.NewNoLoc("%s", s)))
+				return nil
+			}
+		}
+	}
+
+	return errors.New("can't unmarshal %T into %v", v, t)
+}
+
+// assignNumber converts number to r type.
+// Values which don't fit into r (overflow, fraction into integer) are errors.
+func assignNumber(r, vr reflect.Value) error {
+	t := r.Type()
+
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, ok := numberInt(vr)
+		if ok && !r.OverflowInt(x) {
+			r.SetInt(x)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, ok := numberUint(vr)
+		if ok && !r.OverflowUint(x) {
+			r.SetUint(x)
+			return nil
+		}
+	default:
+		x := numberFloat(vr)
+		if !r.OverflowFloat(x) {
+			r.SetFloat(x)
+			return nil
+		}
+	}
+
+	return errors.New("%v doesn't fit into %v", vr.Interface(), t)
+}
+
+func numberInt(vr reflect.Value) (int64, bool) {
+	switch vr.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return vr.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x := vr.Uint()
+		return int64(x), x <= math.MaxInt64
+	default:
+		x := vr.Float()
+		return int64(x), x == math.Trunc(x) && x >= -(1<<63) && x < 1<<63
+	}
+}
+
+func numberUint(vr reflect.Value) (uint64, bool) {
+	switch vr.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x := vr.Int()
+		return uint64(x), x >= 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return vr.Uint(), true
+	default:
+		x := vr.Float()
+		return uint64(x), x == math.Trunc(x) && x >= 0 && x < 1<<64
+	}
+}
+
+func numberFloat(vr reflect.Value) float64 {
+	switch vr.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(vr.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(vr.Uint())
+	default:
+		return vr.Float()
+	}
+}
+
+func assignTime(r reflect.Value, v interface{}) error {
+	var t time.Time
+
+	switch v := v.(type) {
+	case Timestamp:
+		t = v.Time()
+	case int64:
+		t = Timestamp(v).Time()
+	case string:
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return errors.Wrap(err, "parse time")
+		}
+	default:
+		return errors.New("can't unmarshal %T into time", v)
+	}
+
+	r.Set(reflect.ValueOf(t))
+
+	return nil
+}
+
+func assignStruct(r reflect.Value, m map[string]interface{}) (err error) {
+	s := parseStruct(r.Type())
+
+	for _, fc := range s.fs {
+		fv := r.Field(fc.I)
+
+		if fc.Embed && fv.Kind() == reflect.Struct {
+			err = assignStruct(fv, m)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		v, ok := m[fc.Name]
+		if !ok || fc.Unexported {
+			continue
+		}
+
+		err = assignValue(fv, v)
+		if err != nil {
+			return errors.Wrap(err, "field %v", fc.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package tlog
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nikandfor/tlog/low"
+)
+
+type (
+	testInner struct {
+		A int    `json:"a"`
+		B string `tlog:"b"`
+	}
+
+	testEmbed struct {
+		E string `json:"e"`
+	}
+
+	testStruct struct {
+		Str   string            `json:"str"`
+		Int   int               `yaml:"int"`
+		Neg   int64             `tlog:"neg"`
+		Uint  uint16            `json:"uint"`
+		Float float64           `json:"float"`
+		Bool  bool              `json:"bool"`
+		Bytes []byte            `json:"bytes"`
+		Arr   []int             `json:"arr"`
+		Map   map[string]string `json:"map"`
+		Ptr   *testInner        `json:"ptr"`
+		Inner testInner         `json:"inner"`
+		Empty *int              `json:"empty,omitempty"`
+		Skip  int               `json:"-"`
+
+		Time time.Time     `json:"time"`
+		Dur  time.Duration `json:"dur"`
+		ID   ID            `json:"id"`
+		Lv   LogLevel      `json:"lv"`
+
+		testEmbed `tlog:",embed"`
+	}
+)
+
+func TestDecoderValue(t *testing.T) {
+	var e Encoder
+
+	tm := time.Unix(100, 200)
+
+	for _, v := range []interface{}{
+		int64(10), int64(-1000), "str", []byte("bytes"), 1.5, true, false, nil,
+		[]interface{}{int64(1), "two"},
+		map[string]interface{}{"a": int64(1), "b": "c"},
+		tm, 3 * time.Second, Message("msg"), ID{1, 2, 3}, Labels{"a=b", "c"},
+		EventType("s"), LogLevel(Warn), LogLevel(Debug), Hex(0x100),
+	} {
+		b := e.AppendValue(nil, v)
+
+		d := NewDecoderBytes(b)
+
+		res, i := d.Value(0)
+		if !assert.NoError(t, d.Err(), "%T %[1]v", v) {
+			continue
+		}
+
+		assert.Equal(t, len(b), i, "%T %[1]v", v)
+
+		switch v := v.(type) {
+		case time.Time:
+			assert.True(t, v.Equal(res.(time.Time)), "%v != %v", v, res)
+		case LogLevel:
+			assert.Equal(t, v, res)
+		default:
+			assert.Equal(t, v, res, "%T %[1]v", v)
+		}
+	}
+}
+
+func TestDecoderValueLenBreak(t *testing.T) {
+	var e Encoder
+
+	b := []byte{Array | LenBreak}
+	b = e.AppendInt(b, 1)
+	b = e.AppendString(b, String, "two")
+	b = append(b, Map|LenBreak)
+	b = e.AppendString(b, String, "k")
+	b = e.AppendUint(b, Int, 1<<64-1)
+	b = append(b, Special|Break)
+	b = append(b, Array|LenBreak, Special|Break)
+	b = append(b, Special|Break)
+
+	d := NewDecoderBytes(b)
+
+	v, i := d.Value(0)
+	require.NoError(t, d.Err())
+	assert.Equal(t, len(b), i)
+	assert.Equal(t, []interface{}{int64(1), "two", map[string]interface{}{"k": uint64(1<<64 - 1)}, []interface{}{}}, v)
+
+	for _, b := range [][]byte{
+		{Array | LenBreak, Int | 1},
+		{Map | LenBreak, String | 1, 'k'},
+		{Map | 2, String | 1, 'k'},
+		{Array | Len4, 0x7f, 0xff, 0xff, 0xff},
+	} {
+		d := NewDecoderBytes(b)
+
+		v, _ := d.Value(0)
+		assert.Error(t, d.Err(), "%x", b)
+		assert.Nil(t, v, "%x", b)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	exp := testStruct{
+		Str:   "string",
+		Int:   4,
+		Neg:   -5,
+		Uint:  1000,
+		Float: 3.25,
+		Bool:  true,
+		Bytes: []byte("bytes"),
+		Arr:   []int{1, 2, 3},
+		Map:   map[string]string{"a": "b"},
+		Ptr:   &testInner{A: 1, B: "ptr"},
+		Inner: testInner{A: 2, B: "inner"},
+		Skip:  7,
+
+		Time: time.Unix(1000, 2000),
+		Dur:  time.Minute,
+		ID:   ID{5, 6, 7},
+		Lv:   Error,
+
+		testEmbed: testEmbed{E: "embedded"},
+	}
+
+	var e Encoder
+	b := e.AppendValue(nil, exp)
+
+	var res testStruct
+
+	err := Unmarshal(b, &res)
+	require.NoError(t, err, "dump\n%s", Dump(b))
+
+	assert.Nil(t, res.Empty)
+	assert.True(t, exp.Time.Equal(res.Time))
+
+	exp.Skip = 0
+	res.Time = exp.Time
+
+	assert.Equal(t, exp, res)
+}
+
+func TestUnmarshalNumbers(t *testing.T) {
+	var e Encoder
+
+	for _, tc := range []struct {
+		v   interface{}
+		to  interface{}
+		exp interface{}
+	}{
+		{3.0, new(int), 3},
+		{200, new(uint8), uint8(200)},
+		{-5, new(int8), int8(-5)},
+		{7, new(float32), float32(7)},
+		{300, new(uint8), nil},
+		{-1, new(uint), nil},
+		{1.5, new(int), nil},
+		{1e20, new(int64), nil},
+		{uint64(math.MaxUint64), new(int64), nil},
+		{1e40, new(float32), nil},
+		{make([]byte, 15), new(ID), nil},
+		{make([]byte, 17), new([16]byte), nil},
+		{[]byte{1, 2}, new([2]byte), [2]byte{1, 2}},
+	} {
+		b := e.AppendValue(nil, tc.v)
+
+		err := Unmarshal(b, tc.to)
+
+		if tc.exp == nil {
+			assert.Error(t, err, "%v into %T", tc.v, tc.to)
+			continue
+		}
+
+		if assert.NoError(t, err, "%v into %T", tc.v, tc.to) {
+			assert.Equal(t, tc.exp, reflect.ValueOf(tc.to).Elem().Interface())
+		}
+	}
+}
+
+func TestUnmarshalEvent(t *testing.T) {
+	var buf low.Buf
+
+	l := New(&buf)
+	l.NoCaller = true
+
+	l.Printw("message", "status_code", 200, "path", "/index", "elapsed", time.Second)
+
+	var ev struct {
+		Time    time.Time     `tlog:"t"`
+		Message string        `tlog:"m"`
+		Status  int           `json:"status_code"`
+		Path    string        `json:"path"`
+		Elapsed time.Duration `json:"elapsed"`
+	}
+
+	err := Unmarshal(buf, &ev)
+	require.NoError(t, err)
+
+	assert.False(t, ev.Time.IsZero())
+	assert.Equal(t, "message", ev.Message)
+	assert.Equal(t, 200, ev.Status)
+	assert.Equal(t, "/index", ev.Path)
+	assert.Equal(t, time.Second, ev.Elapsed)
+
+	err = Unmarshal(buf, ev)
+	assert.Error(t, err)
+}